@@ -1,11 +1,22 @@
 #!/bin/bash
+#pin the checksums of setting repository if it publishes them, lpmx then refuses setting files not listed inside them
+SETTING_URL=$(sed -n 's/^\s*SETTING_URL = "\(.*\)"$/\1/p' docker/docker.go)
+SETTING_INDEX=$(mktemp)
+LDFLAGS=""
+if curl -fsSL -o $SETTING_INDEX "$SETTING_URL/SHA256SUMS"; then
+    LDFLAGS="-X github.com/JasonYangShadow/lpmx/docker.SETTING_INDEX_SHA256=$(sha256sum $SETTING_INDEX | cut -d ' ' -f 1)"
+else
+    echo "$SETTING_URL/SHA256SUMS is not published, setting files of this build are not pinned"
+fi
+rm -f $SETTING_INDEX
+
 for GOOS in linux; do
     mkdir -p build/$GOOS
 #    for GOARCH in i686 x86_64; do
      for GOARCH in x86_64; do
         mkdir -p build/$GOOS/$GOARCH
         if [ $GOARCH = "x86_64" ];then
-          env GOOS=$GOOS GOARCH="amd64" GO111MODULE=off go build -v -o build/$GOOS/$GOARCH/Linux-x86_64-lpmx
+          env GOOS=$GOOS GOARCH="amd64" GO111MODULE=off go build -v -ldflags "$LDFLAGS" -o build/$GOOS/$GOARCH/Linux-x86_64-lpmx
         #generate log first
           if [ -x "$(command -v chglog)" ];then
               chglog init
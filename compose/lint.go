@@ -0,0 +1,156 @@
+package compose
+
+import (
+	"fmt"
+	"strings"
+
+	. "github.com/JasonYangShadow/lpmx/error"
+	"github.com/goccy/go-yaml"
+	"github.com/goccy/go-yaml/ast"
+	"github.com/goccy/go-yaml/parser"
+)
+
+//Problem is a single issue found in compose yaml file
+type Problem struct {
+	Path   string //yaml path of the offending node, e.g, $.apps[0].share[1]
+	Line   int
+	Column int
+	Msg    string
+}
+
+func (p Problem) String() string {
+	if p.Line > 0 {
+		return fmt.Sprintf("line %d, column %d: %s (%s)", p.Line, p.Column, p.Msg, p.Path)
+	}
+	return fmt.Sprintf("%s (%s)", p.Msg, p.Path)
+}
+
+//Document is the compose yaml file together with its syntax tree, used for locating problems
+type Document struct {
+	TopLevel TopLevel
+	file     *ast.File
+}
+
+func LoadDocument(data []byte) (*Document, *Error) {
+	doc := new(Document)
+	file, err := parser.ParseBytes(data, 0)
+	if err != nil {
+		cerr := ErrNew(err, "could not parse compose yaml file")
+		return nil, cerr
+	}
+	doc.file = file
+
+	err = yaml.Unmarshal(data, &doc.TopLevel)
+	if err != nil {
+		cerr := ErrNew(err, "could not unmarshal compose yaml file")
+		return nil, cerr
+	}
+	return doc, nil
+}
+
+//Position returns line and column of the yaml path, the closest existing parent is used if the path does not exist
+func (doc *Document) Position(path string) (int, int) {
+	for {
+		if p, err := yaml.PathString(path); err == nil {
+			if node, nerr := p.FilterFile(doc.file); nerr == nil && node != nil && node.GetToken() != nil {
+				pos := node.GetToken().Position
+				return pos.Line, pos.Column
+			}
+		}
+
+		idx := strings.LastIndexAny(path, ".[")
+		if idx <= 0 {
+			return 0, 0
+		}
+		path = path[:idx]
+	}
+}
+
+//Problem creates a problem located at path
+func (doc *Document) Problem(path string, msg string) Problem {
+	line, column := doc.Position(path)
+	return Problem{Path: path, Line: line, Column: column, Msg: msg}
+}
+
+//AppPath returns the yaml path of the idx-th app, optionally followed by the field
+func AppPath(idx int, field string) string {
+	if field == "" {
+		return fmt.Sprintf("$.apps[%d]", idx)
+	}
+	return fmt.Sprintf("$.apps[%d].%s", idx, field)
+}
+
+//Lint checks the whole file and collects all problems rather than stopping at the first one. Besides the checks of Validate,
+//it warns about exposed names used more than once and circular dependencies, which Validate leaves to the scheduler
+func (doc *Document) Lint() []Problem {
+	var problems []Problem
+	add := func(path, msg string) {
+		problems = append(problems, doc.Problem(path, msg))
+	}
+
+	topLevel := doc.TopLevel
+	v := validator{report: func(path string, err *Error) bool {
+		add(path, err.Msg.Front().Value.(string))
+		return true
+	}}
+	v.validate(&topLevel)
+
+	names := make(map[string]int)
+	exposes := make(map[string]string)
+	for idx, app := range topLevel.Apps {
+		if _, ok := names[app.Name]; !ok {
+			names[app.Name] = idx
+		}
+		for i, expose := range app.Expose {
+			values := strings.Split(expose, ":")
+			if len(values) != 2 || values[1] == "" {
+				continue
+			}
+			if owner, ok := exposes[values[1]]; ok {
+				add(AppPath(idx, fmt.Sprintf("expose[%d]", i)), fmt.Sprintf("expose name %s is already used by %s", values[1], owner))
+			} else {
+				exposes[values[1]] = app.Name
+			}
+		}
+	}
+
+	for _, name := range findCycle(topLevel.Apps) {
+		add(AppPath(names[name], "depends"), fmt.Sprintf("%s is part of a circular dependency", name))
+	}
+	return problems
+}
+
+//findCycle returns the names of apps which could never start because of circular dependencies
+func findCycle(apps []AppLevel) []string {
+	defined := make(map[string]bool)
+	for _, app := range apps {
+		defined[app.Name] = true
+	}
+	resolved := make(map[string]bool)
+	for progress := true; progress; {
+		progress = false
+		for _, app := range apps {
+			if resolved[app.Name] {
+				continue
+			}
+			ok := true
+			for _, dep := range app.DependsOn {
+				if defined[dep.Name] && !resolved[dep.Name] {
+					ok = false
+				}
+			}
+			if ok {
+				resolved[app.Name] = true
+				progress = true
+			}
+		}
+	}
+
+	var names []string
+	for _, app := range apps {
+		if !resolved[app.Name] && app.Name != "" {
+			names = append(names, app.Name)
+		}
+	}
+	return names
+}
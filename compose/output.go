@@ -0,0 +1,58 @@
+package compose
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+//PrefixWriter prepends a prefix to each line written to the underlying writer.
+//Writers sharing the same lock never interleave their lines
+type PrefixWriter struct {
+	prefix []byte
+	out    io.Writer
+	lock   *sync.Mutex
+	buf    bytes.Buffer
+}
+
+func NewPrefixWriter(prefix string, out io.Writer, lock *sync.Mutex) *PrefixWriter {
+	pw := new(PrefixWriter)
+	pw.prefix = []byte(prefix)
+	pw.out = out
+	pw.lock = lock
+	return pw
+}
+
+func (pw *PrefixWriter) Write(p []byte) (int, error) {
+	pw.buf.Write(p)
+	for {
+		idx := bytes.IndexByte(pw.buf.Bytes(), '\n')
+		if idx < 0 {
+			break
+		}
+		line := pw.buf.Next(idx + 1)
+		if err := pw.writeLine(line); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+//Flush writes out the remaining partial line, if any
+func (pw *PrefixWriter) Flush() error {
+	if pw.buf.Len() == 0 {
+		return nil
+	}
+	line := append(pw.buf.Next(pw.buf.Len()), '\n')
+	return pw.writeLine(line)
+}
+
+func (pw *PrefixWriter) writeLine(line []byte) error {
+	pw.lock.Lock()
+	defer pw.lock.Unlock()
+	if _, err := pw.out.Write(pw.prefix); err != nil {
+		return err
+	}
+	_, err := pw.out.Write(line)
+	return err
+}
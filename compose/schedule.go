@@ -0,0 +1,199 @@
+package compose
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	. "github.com/JasonYangShadow/lpmx/error"
+)
+
+const (
+	statusPending = iota
+	statusRunning
+	statusHealthy
+	statusCompleted
+	statusFailed
+	statusSkipped
+)
+
+//AppRunner runs a single app, ctx is cancelled once the remaining work should be abandoned.
+//Apps having healthcheck call healthy once they pass the check, so that apps waiting for them could start
+type AppRunner func(ctx context.Context, app AppLevel, healthy func()) *Error
+
+type appEvent struct {
+	name    string
+	healthy bool
+	err     *Error
+}
+
+//Schedule runs all apps defined in topLevel, an app is started only after all its dependencies satisfy their conditions.
+//At most parallel apps run at the same time, apps that became healthy do not count as they are regarded as services.
+//On the first failure the remaining apps are cancelled unless keepGoing is set, in which case only the apps depending on the failed one are skipped
+func (topLevel *TopLevel) Schedule(parallel int, keepGoing bool, runner AppRunner) *Error {
+	_, _, appMap, verr := topLevel.Validate()
+	if verr != nil {
+		return verr
+	}
+
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	//keep the order of definition so that scheduling is deterministic
+	var order []string
+	status := make(map[string]int)
+	for _, app := range topLevel.Apps {
+		order = append(order, app.Name)
+		status[app.Name] = statusPending
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events := make(chan appEvent)
+	var wg sync.WaitGroup
+	//alive counts running processes, busy counts the ones occupying a slot
+	alive, busy := 0, 0
+	var firstErr *Error
+
+	start := func(app AppLevel) {
+		status[app.Name] = statusRunning
+		alive++
+		busy++
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			//healthy never blocks the health check even if it is called late or many times, only the first call counts
+			healthyCh := make(chan struct{}, 1)
+			healthy := func() {
+				select {
+				case healthyCh <- struct{}{}:
+				default:
+				}
+			}
+			result := make(chan *Error, 1)
+			go func() {
+				result <- runner(ctx, app, healthy)
+			}()
+			var err *Error
+			select {
+			case <-healthyCh:
+				events <- appEvent{name: app.Name, healthy: true}
+				err = <-result
+			case err = <-result:
+				//keep the healthy event reported right before the runner returns
+				select {
+				case <-healthyCh:
+					events <- appEvent{name: app.Name, healthy: true}
+				default:
+				}
+			}
+			events <- appEvent{name: app.Name, err: err}
+		}()
+	}
+
+	for {
+		if firstErr == nil || keepGoing {
+			for progress := true; progress; {
+				progress = false
+				for _, name := range order {
+					if status[name] != statusPending {
+						continue
+					}
+					ready, blocked := dependsSatisfied((*appMap)[name], status)
+					if blocked {
+						status[name] = statusSkipped
+						progress = true
+						continue
+					}
+					if ready && busy < parallel {
+						start((*appMap)[name])
+						progress = true
+					}
+				}
+			}
+		}
+
+		if alive == 0 {
+			break
+		}
+
+		event := <-events
+		if event.healthy {
+			if status[event.name] == statusRunning {
+				status[event.name] = statusHealthy
+				busy--
+			}
+			continue
+		}
+
+		alive--
+		if status[event.name] == statusRunning {
+			busy--
+		}
+		if event.err != nil {
+			status[event.name] = statusFailed
+			if firstErr == nil {
+				firstErr = event.err
+				if !keepGoing {
+					cancel()
+				}
+			}
+		} else {
+			status[event.name] = statusCompleted
+		}
+	}
+	wg.Wait()
+
+	var pending, failed, skipped []string
+	for _, name := range order {
+		switch status[name] {
+		case statusPending:
+			pending = append(pending, name)
+		case statusFailed:
+			failed = append(failed, name)
+		case statusSkipped:
+			skipped = append(skipped, name)
+		}
+	}
+
+	if firstErr != nil {
+		firstErr.AddMsg(fmt.Sprintf("failed apps: %s", strings.Join(failed, ",")))
+		skipped = append(skipped, pending...)
+		if len(skipped) > 0 {
+			firstErr.AddMsg(fmt.Sprintf("skipped apps: %s", strings.Join(skipped, ",")))
+		}
+		return firstErr
+	}
+
+	if len(pending) > 0 {
+		cerr := ErrNew(ErrMismatch, fmt.Sprintf("circular dependency detected among apps: %s", strings.Join(pending, ",")))
+		return cerr
+	}
+	return nil
+}
+
+//dependsSatisfied checks whether all dependencies of app meet their conditions, blocked is true if some dependency failed or was skipped
+func dependsSatisfied(app AppLevel, status map[string]int) (bool, bool) {
+	ready := true
+	for _, dep := range app.DependsOn {
+		switch status[dep.Name] {
+		case statusFailed, statusSkipped:
+			return false, true
+		case statusCompleted:
+		case statusHealthy:
+			if dep.Condition == ConditionCompleted {
+				ready = false
+			}
+		case statusRunning:
+			if dep.Condition != ConditionStarted {
+				ready = false
+			}
+		default:
+			ready = false
+		}
+	}
+	return ready, false
+}
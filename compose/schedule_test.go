@@ -0,0 +1,181 @@
+package compose
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	error2 "github.com/JasonYangShadow/lpmx/error"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestTopLevel(apps ...AppLevel) *TopLevel {
+	topLevel := new(TopLevel)
+	topLevel.Version = Version
+	for _, app := range apps {
+		app.Image = "image"
+		app.ImageType = TypeDocker
+		topLevel.Apps = append(topLevel.Apps, app)
+	}
+	return topLevel
+}
+
+func TestScheduleDependencyOrder(t *testing.T) {
+	topLevel := newTestTopLevel(AppLevel{Name: "a", DependsOn: deps("b")}, AppLevel{Name: "b"}, AppLevel{Name: "c", DependsOn: deps("a")})
+
+	var lock sync.Mutex
+	var order []string
+	err := topLevel.Schedule(4, false, func(ctx context.Context, app AppLevel, healthy func()) *error2.Error {
+		lock.Lock()
+		order = append(order, app.Name)
+		lock.Unlock()
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"b", "a", "c"}, order)
+}
+
+func TestScheduleParallelLimit(t *testing.T) {
+	topLevel := newTestTopLevel(AppLevel{Name: "a"}, AppLevel{Name: "b"}, AppLevel{Name: "c"}, AppLevel{Name: "d"})
+
+	var lock sync.Mutex
+	current, max := 0, 0
+	err := topLevel.Schedule(2, false, func(ctx context.Context, app AppLevel, healthy func()) *error2.Error {
+		lock.Lock()
+		current++
+		if current > max {
+			max = current
+		}
+		lock.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		lock.Lock()
+		current--
+		lock.Unlock()
+		return nil
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, 2, max, "should run 2 apps concurrently")
+}
+
+func TestScheduleFailureCancels(t *testing.T) {
+	topLevel := newTestTopLevel(AppLevel{Name: "a"}, AppLevel{Name: "b", DependsOn: deps("a")}, AppLevel{Name: "c"})
+
+	var lock sync.Mutex
+	var started []string
+	err := topLevel.Schedule(1, false, func(ctx context.Context, app AppLevel, healthy func()) *error2.Error {
+		lock.Lock()
+		started = append(started, app.Name)
+		lock.Unlock()
+		if app.Name == "a" {
+			return error2.ErrNew(error2.ErrCmd, "a fails")
+		}
+		return nil
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, error2.ErrCmd, err.Err)
+	assert.Equal(t, []string{"a"}, started, "remaining apps should not start")
+}
+
+func TestScheduleKeepGoing(t *testing.T) {
+	topLevel := newTestTopLevel(AppLevel{Name: "a"}, AppLevel{Name: "b", DependsOn: deps("a")}, AppLevel{Name: "c", DependsOn: deps("b")}, AppLevel{Name: "d"})
+
+	var lock sync.Mutex
+	var started []string
+	err := topLevel.Schedule(1, true, func(ctx context.Context, app AppLevel, healthy func()) *error2.Error {
+		lock.Lock()
+		started = append(started, app.Name)
+		lock.Unlock()
+		if app.Name == "a" {
+			return error2.ErrNew(error2.ErrCmd, "a fails")
+		}
+		return nil
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, []string{"a", "d"}, started, "dependents of failed app should be skipped")
+}
+
+func TestScheduleCircularDependency(t *testing.T) {
+	topLevel := newTestTopLevel(AppLevel{Name: "a", DependsOn: deps("b")}, AppLevel{Name: "b", DependsOn: deps("a")})
+
+	err := topLevel.Schedule(2, false, func(ctx context.Context, app AppLevel, healthy func()) *error2.Error {
+		return nil
+	})
+	assert.NotNil(t, err)
+	assert.Equal(t, error2.ErrMismatch, err.Err)
+}
+
+func TestPrefixWriter(t *testing.T) {
+	var out bytes.Buffer
+	var lock sync.Mutex
+	pw := NewPrefixWriter("[a] ", &out, &lock)
+	pw.Write([]byte("line1\nli"))
+	pw.Write([]byte("ne2\nline3"))
+	pw.Flush()
+	assert.Equal(t, "[a] line1\n[a] line2\n[a] line3\n", out.String())
+}
+
+func deps(names ...string) Depends {
+	var depends Depends
+	for _, name := range names {
+		depends = append(depends, Dependency{Name: name, Condition: ConditionCompleted})
+	}
+	return depends
+}
+
+func TestScheduleWaitHealthy(t *testing.T) {
+	topLevel := newTestTopLevel(AppLevel{Name: "db", HealthCheck: &HealthCheck{Command: "true"}}, AppLevel{Name: "web", DependsOn: Depends{{Name: "db", Condition: ConditionHealthy}}})
+
+	webDone := make(chan struct{})
+	err := topLevel.Schedule(1, false, func(ctx context.Context, app AppLevel, healthy func()) *error2.Error {
+		if app.Name == "db" {
+			healthy()
+			//service keeps running until its dependent finishes
+			<-webDone
+			return nil
+		}
+		close(webDone)
+		return nil
+	})
+	assert.Nil(t, err)
+}
+
+func TestScheduleHealthyNeverBlocks(t *testing.T) {
+	topLevel := newTestTopLevel(AppLevel{Name: "db", HealthCheck: &HealthCheck{Command: "true"}}, AppLevel{Name: "web", DependsOn: Depends{{Name: "db", Condition: ConditionHealthy}}})
+	err := topLevel.Schedule(1, false, func(ctx context.Context, app AppLevel, healthy func()) *error2.Error {
+		if app.Name == "db" {
+			//repeated calls return at once, the one right before returning still counts
+			healthy()
+			healthy()
+		}
+		return nil
+	})
+	assert.Nil(t, err)
+
+	//health check could report after the app exits and the schedule ends
+	late := make(chan func(), 1)
+	topLevel = newTestTopLevel(AppLevel{Name: "db", HealthCheck: &HealthCheck{Command: "true"}})
+	err = topLevel.Schedule(1, false, func(ctx context.Context, app AppLevel, healthy func()) *error2.Error {
+		late <- healthy
+		return nil
+	})
+	assert.Nil(t, err)
+	done := make(chan struct{})
+	go func() {
+		(<-late)()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("healthy blocks after schedule ends")
+	}
+}
+
+func TestValidateHealthyWithoutHealthCheck(t *testing.T) {
+	topLevel := newTestTopLevel(AppLevel{Name: "db"}, AppLevel{Name: "web", DependsOn: Depends{{Name: "db", Condition: ConditionHealthy}}})
+	_, _, _, verr := topLevel.Validate()
+	assert.NotNil(t, verr)
+	assert.Equal(t, error2.ErrMismatch, verr.Err)
+}
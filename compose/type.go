@@ -1,18 +1,30 @@
 package compose
 
 import (
+	"crypto/sha256"
 	"fmt"
 	. "github.com/JasonYangShadow/lpmx/error"
 	"github.com/agrison/go-commons-lang/stringUtils"
-	"github.com/deckarep/golang-set"
+	"github.com/deckarep/golang-set/v2"
+	"github.com/goccy/go-yaml"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 )
 
 const (
 	Version         = "1"
 	TypeDocker      = "docker"
 	TypeSingularity = "singularity"
+
+	ConditionCompleted = "completed"
+	ConditionStarted   = "started"
+	ConditionHealthy   = "healthy"
+
+	DefaultHealthInterval = "10s"
+	DefaultHealthTimeout  = "30s"
+	DefaultHealthRetries  = 3
 )
 
 type TopLevel struct {
@@ -28,110 +40,272 @@ type AppLevel struct {
 	Port      []string `yaml:"port"`
 	Share     []string `yaml:"share"`
 	Inject    []string `yaml:"inject"`
-	DependsOn []string `yaml:"depends"`
+	DependsOn Depends  `yaml:"depends"`
 	Env 	  []string `yaml:"envs"`
 	Command   string `yaml:"command"`
+	HealthCheck *HealthCheck `yaml:"healthcheck"`
 }
 
-func (topLevel *TopLevel) Validate() ([]string, []string, *map[string]AppLevel, *Error) {
+//Dependency is a single item of depends field, condition defines when the dependency is regarded as satisfied
+type Dependency struct {
+	Name      string `yaml:"name"`
+	Condition string `yaml:"condition"`
+}
+
+//Depends accepts either a list of app names, which wait for the completion of apps,
+//or a map from app name to its condition, e.g, 'db: {condition: healthy}'
+type Depends []Dependency
+
+func (depends *Depends) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var names []string
+	if err := unmarshal(&names); err == nil {
+		for _, name := range names {
+			*depends = append(*depends, Dependency{Name: name, Condition: ConditionCompleted})
+		}
+		return nil
+	}
+
+	var conds map[string]Dependency
+	if err := unmarshal(&conds); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(conds))
+	for key := range conds {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		dep := conds[key]
+		dep.Name = key
+		if stringUtils.IsEmpty(dep.Condition) {
+			dep.Condition = ConditionCompleted
+		}
+		*depends = append(*depends, dep)
+	}
+	return nil
+}
+
+//HealthCheck is executed inside the container periodically until the app becomes healthy
+type HealthCheck struct {
+	Command     string `yaml:"command"`
+	Interval    string `yaml:"interval"`
+	Retries     int    `yaml:"retries"`
+	Timeout     string `yaml:"timeout"`
+	StartPeriod string `yaml:"start_period"`
+}
+
+//Durations returns interval, timeout and start period of the health check, default values are used for empty fields
+func (hc *HealthCheck) Durations() (time.Duration, time.Duration, time.Duration, *Error) {
+	values := []string{hc.Interval, hc.Timeout, hc.StartPeriod}
+	defaults := []string{DefaultHealthInterval, DefaultHealthTimeout, "0s"}
+	var durations []time.Duration
+	for idx, value := range values {
+		if stringUtils.IsEmpty(value) {
+			value = defaults[idx]
+		}
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			cerr := ErrNew(err, fmt.Sprintf("could not parse duration %s of healthcheck", value))
+			return 0, 0, 0, cerr
+		}
+		durations = append(durations, d)
+	}
+	return durations[0], durations[1], durations[2], nil
+}
+
+func (hc *HealthCheck) GetRetries() int {
+	if hc.Retries <= 0 {
+		return DefaultHealthRetries
+	}
+	return hc.Retries
+}
+
+//Hash returns the digest of app definition, used for detecting changes between compose runs
+func (app AppLevel) Hash() (string, *Error) {
+	data, err := yaml.Marshal(app)
+	if err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("could not marshal app %s", app.Name))
+		return "", cerr
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(data)), nil
+}
+
+//PortMapping is the parsed form of 'host:container' port field, host port 0 means it will be allocated automatically
+type PortMapping struct {
+	Host      int
+	Container int
+}
+
+func ParsePort(port string) (*PortMapping, *Error) {
+	values := strings.Split(strings.TrimSpace(port), ":")
+	if len(values) != 2 {
+		err := ErrNew(ErrNExist, fmt.Sprintf("port %s should be in the format of 'host:container'", port))
+		return nil, err
+	}
+
+	var mapping PortMapping
+	if strings.TrimSpace(values[0]) != "" {
+		host, err := strconv.Atoi(strings.TrimSpace(values[0]))
+		if err != nil || host < 0 || host > 65535 {
+			cerr := ErrNew(ErrType, fmt.Sprintf("host port of %s is not a valid port number", port))
+			return nil, cerr
+		}
+		mapping.Host = host
+	}
+
+	con, err := strconv.Atoi(strings.TrimSpace(values[1]))
+	if err != nil || con <= 0 || con > 65535 {
+		cerr := ErrNew(ErrType, fmt.Sprintf("container port of %s is not a valid port number", port))
+		return nil, cerr
+	}
+	mapping.Container = con
+	return &mapping, nil
+}
+
+//BoundPorts returns the ports of mapping occupied on the host when the app runs. Apps share the network of the host and
+//fakechroot could not redirect bind calls, so the container port is always bound on the host besides the host port
+func (mapping *PortMapping) BoundPorts() []int {
+	ports := []int{mapping.Container}
+	if mapping.Host != 0 && mapping.Host != mapping.Container {
+		ports = append(ports, mapping.Host)
+	}
+	return ports
+}
+
+//validator runs the checks shared by Validate and Lint, every problem is reported with the yaml path of the offending node.
+//Checking stops once report returns false, so that Validate stops at the first problem while Lint collects all of them
+type validator struct {
+	report  func(path string, err *Error) bool
+	stopped bool
+}
+
+func (v *validator) fail(path string, code error, msg string) {
+	if !v.stopped && !v.report(path, ErrNew(code, msg)) {
+		v.stopped = true
+	}
+}
+
+func (v *validator) validate(topLevel *TopLevel) {
 	if stringUtils.IsEmpty(topLevel.Version) || strings.TrimSpace(topLevel.Version) != Version {
-		err := ErrNew(ErrNExist, "version in yaml file does not exist or is not correct")
-		return nil, nil, nil, err
+		v.fail("$.version", ErrNExist, fmt.Sprintf("version should be %s", Version))
 	}
 
-	nameSet := mapset.NewSet[string]()
-	dependMap := make(map[string]int8)
-	appsMap := make(map[string]AppLevel)
-	for idx, element := range topLevel.Apps {
-		if stringUtils.IsEmpty(element.Name) {
-			err := ErrNew(ErrNExist, "name is a mandatory field")
-			return nil, nil, nil, err
+	names := make(map[string]int)
+	boundPorts := make(map[int]string)
+	for idx, app := range topLevel.Apps {
+		if v.stopped {
+			return
+		}
+		if stringUtils.IsEmpty(app.Name) {
+			v.fail(AppPath(idx, "name"), ErrNExist, "name is a mandatory field")
+		} else if first, ok := names[app.Name]; ok {
+			v.fail(AppPath(idx, "name"), ErrExist, fmt.Sprintf("%s is already defined by apps[%d], should not have duplicated name", app.Name, first))
+		} else {
+			names[app.Name] = idx
 		}
 
-		if stringUtils.IsEmpty(element.Image) {
-			err := ErrNew(ErrNExist, "image is a mandatory field")
-			return nil, nil, nil, err
+		if stringUtils.IsEmpty(app.Image) {
+			v.fail(AppPath(idx, "image"), ErrNExist, "image is a mandatory field")
 		}
 
-		if stringUtils.IsEmpty(element.ImageType) {
-			err := ErrNew(ErrNExist, "image type is a mandatory field")
-			return nil, nil, nil, err
+		if stringUtils.IsEmpty(app.ImageType) {
+			v.fail(AppPath(idx, "type"), ErrNExist, "image type is a mandatory field")
+		} else if app.ImageType != TypeDocker && app.ImageType != TypeSingularity {
+			v.fail(AppPath(idx, "type"), ErrMismatch, "image type should be 'docker' or 'singularity'")
 		}
 
-		if element.ImageType != TypeDocker && element.ImageType != TypeSingularity{
-			err := ErrNew(ErrMismatch, "image type should be 'docker' or 'singularity'")
-			return nil, nil, nil, err
+		for i, expose := range app.Expose {
+			if values := strings.Split(expose, ":"); len(values) != 2 || values[0] == "" || values[1] == "" {
+				v.fail(AppPath(idx, fmt.Sprintf("expose[%d]", i)), ErrNExist, "expose should be in the format of 'path:name'")
+			}
 		}
 
-		if len(element.Expose) > 0 {
-			for _, expose := range element.Expose {
-				if !stringUtils.Contains(expose, ":") {
-					err := ErrNew(ErrNExist, "expose should contain ':'")
-					return nil, nil, nil,err
+		for i, port := range app.Port {
+			path := AppPath(idx, fmt.Sprintf("port[%d]", i))
+			mapping, err := ParsePort(port)
+			if err != nil {
+				v.fail(path, err.Err, err.Msg.Front().Value.(string))
+				continue
+			}
+			for _, p := range mapping.BoundPorts() {
+				if owner, ok := boundPorts[p]; ok {
+					v.fail(path, ErrExist, fmt.Sprintf("port %d of %s is already used by %s, see the port limitation in README", p, app.Name, owner))
+				} else {
+					boundPorts[p] = app.Name
 				}
 			}
 		}
 
-		if len(element.Port) > 0 {
-			for _, port := range element.Port {
-				if !stringUtils.Contains(port, ":") {
-					err := ErrNew(ErrNExist, "port should contain ':'")
-					return nil, nil, nil, err
-				}
+		for i, share := range app.Share {
+			if !stringUtils.Contains(share, ":") {
+				v.fail(AppPath(idx, fmt.Sprintf("share[%d]", i)), ErrNExist, "share should be in the format of 'host:container'")
 			}
 		}
 
-		if len(element.Share) > 0 {
-			for _, share := range element.Share {
-				if !stringUtils.Contains(share, ":") {
-					err := ErrNew(ErrNExist, "share should contain ':'")
-					return nil, nil, nil, err
-				}
+		for i, inject := range app.Inject {
+			if !stringUtils.Contains(inject, ":") {
+				v.fail(AppPath(idx, fmt.Sprintf("inject[%d]", i)), ErrNExist, "inject should be in the format of 'host:container'")
 			}
 		}
 
-		if len(element.Inject) > 0 {
-			for _, inject := range element.Inject {
-				if !stringUtils.Contains(inject, ":") {
-					err := ErrNew(ErrNExist, "inject should contain ':'")
-					return nil, nil, nil, err
-				}
+		for i, env := range app.Env {
+			if !stringUtils.Contains(env, "=") {
+				v.fail(AppPath(idx, fmt.Sprintf("envs[%d]", i)), ErrNExist, "env should be in the format of 'key=value'")
 			}
 		}
 
-		if len(element.Env) > 0 {
-			for _, env := range element.Env {
-				if !stringUtils.Contains(env, "=") {
-					err := ErrNew(ErrNExist, "env should contain '=")
-					return nil, nil, nil, err
-				}
+		if app.HealthCheck != nil {
+			if stringUtils.IsEmpty(app.HealthCheck.Command) {
+				v.fail(AppPath(idx, "healthcheck.command"), ErrNExist, fmt.Sprintf("healthcheck of %s should contain command", app.Name))
+			}
+			if _, _, _, err := app.HealthCheck.Durations(); err != nil {
+				v.fail(AppPath(idx, "healthcheck"), err.Err, err.Msg.Front().Value.(string))
 			}
 		}
+	}
 
-		if nameSet.Contains(element.Name) {
-			err := ErrNew(ErrExist, fmt.Sprintf("%s is already defined in yaml, should not have duplicated name", element.Name))
-			return nil, nil, nil, err
+	for idx, app := range topLevel.Apps {
+		for _, dep := range app.DependsOn {
+			path := AppPath(idx, "depends")
+			if _, ok := names[dep.Name]; !ok {
+				v.fail(path, ErrMismatch, fmt.Sprintf("%s is not defined in yaml file", dep.Name))
+				continue
+			}
+			switch dep.Condition {
+			case ConditionCompleted, ConditionStarted:
+			case ConditionHealthy:
+				if topLevel.Apps[names[dep.Name]].HealthCheck == nil {
+					v.fail(path, ErrMismatch, fmt.Sprintf("%s waits for %s to be healthy, but %s has no healthcheck", app.Name, dep.Name, dep.Name))
+				}
+			default:
+				v.fail(path, ErrType, fmt.Sprintf("condition of %s should be one of 'completed', 'started' or 'healthy'", dep.Name))
+			}
 		}
+	}
+}
 
-		nameSet.Add(element.Name)
+func (topLevel *TopLevel) Validate() ([]string, []string, *map[string]AppLevel, *Error) {
+	var verr *Error
+	v := validator{report: func(path string, err *Error) bool {
+		verr = err
+		return false
+	}}
+	v.validate(topLevel)
+	if verr != nil {
+		return nil, nil, nil, verr
+	}
 
+	nameSet := mapset.NewSet[string]()
+	dependMap := make(map[string]int8)
+	appsMap := make(map[string]AppLevel)
+	for idx, element := range topLevel.Apps {
+		nameSet.Add(element.Name)
 		appsMap[element.Name] = topLevel.Apps[idx]
 	}
 
 	for _, element := range topLevel.Apps {
-		if len(element.DependsOn) > 0 {
-			for _, dependItem := range element.DependsOn {
-				if !nameSet.Contains(dependItem) {
-					err := ErrNew(ErrMismatch, fmt.Sprintf("%s is not defined in yaml file", dependItem))
-					return nil, nil, nil, err
-				}
-
-				if v, ok := dependMap[dependItem]; ok {
-					dependMap[dependItem] = v + 1
-				} else {
-					dependMap[dependItem] = 1
-				}
-			}
+		for _, depend := range element.DependsOn {
+			dependMap[depend.Name]++
 		}
 	}
 
@@ -40,7 +40,7 @@ func TestLoadSimpleYamlFailure(t *testing.T) {
 		return
 	}
 
-	_, _, verr := topLevel.Validate()
+	_, _, _, verr := topLevel.Validate()
 	assert.NotNil(t, verr, "expected error occurs")
 	assert.Equal(t, verr.Err, error2.ErrMismatch, "should be mismatch error")
 }
@@ -59,8 +59,130 @@ func TestLoadDependYamlSuccess(t *testing.T) {
 		return
 	}
 
-	keys, appMap, verr := topLevel.Validate()
+	keys, _, appMap, verr := topLevel.Validate()
 	assert.Equal(t, len(keys), 2, "should have 2 apps")
 	assert.Nil(t, verr)
 	t.Log(appMap)
 }
+
+func TestParsePort(t *testing.T) {
+	mapping, err := ParsePort("18888:8888")
+	assert.Nil(t, err)
+	assert.Equal(t, 18888, mapping.Host)
+	assert.Equal(t, 8888, mapping.Container)
+
+	mapping, err = ParsePort(":8787")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, mapping.Host, "empty host port should be allocated automatically")
+
+	_, err = ParsePort("8888")
+	assert.NotNil(t, err)
+	_, err = ParsePort("a:8888")
+	assert.NotNil(t, err)
+}
+
+func TestValidatePortCollision(t *testing.T) {
+	topLevel := newTestTopLevel(AppLevel{Name: "a", Port: []string{"8080:80"}}, AppLevel{Name: "b", Port: []string{"8080:81"}})
+	_, _, _, verr := topLevel.Validate()
+	assert.NotNil(t, verr)
+	assert.Equal(t, error2.ErrExist, verr.Err)
+
+	//container ports are bound on the host directly, so they could not be shared even if host ports differ
+	topLevel = newTestTopLevel(AppLevel{Name: "a", Port: []string{"8080:80"}}, AppLevel{Name: "b", Port: []string{"8081:80"}})
+	_, _, _, verr = topLevel.Validate()
+	assert.NotNil(t, verr)
+	assert.Equal(t, error2.ErrExist, verr.Err)
+	topLevel = newTestTopLevel(AppLevel{Name: "a", Port: []string{"8080:80"}}, AppLevel{Name: "b", Port: []string{":8080"}})
+	_, _, _, verr = topLevel.Validate()
+	assert.NotNil(t, verr)
+	topLevel = newTestTopLevel(AppLevel{Name: "a", Port: []string{"8080:80"}}, AppLevel{Name: "b", Port: []string{":81"}})
+	_, _, _, verr = topLevel.Validate()
+	assert.Nil(t, verr)
+}
+
+func TestLoadHealthCheckYamlSuccess(t *testing.T) {
+	yamlFile, err := ioutil.ReadFile("test_data/healthcheck_success.yaml")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	var topLevel TopLevel
+	err = yaml.Unmarshal(yamlFile, &topLevel)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, _, _, verr := topLevel.Validate()
+	assert.Nil(t, verr)
+	assert.Equal(t, Depends{{Name: "db", Condition: ConditionHealthy}}, topLevel.Apps[1].DependsOn)
+	interval, timeout, start, verr := topLevel.Apps[0].HealthCheck.Durations()
+	assert.Nil(t, verr)
+	assert.Equal(t, "5s", interval.String())
+	assert.Equal(t, "3s", timeout.String())
+	assert.Equal(t, "10s", start.String())
+	assert.Equal(t, 5, topLevel.Apps[0].HealthCheck.GetRetries())
+}
+
+func TestLintCollectsAllProblems(t *testing.T) {
+	yamlFile, err := ioutil.ReadFile("test_data/lint_failure.yaml")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	doc, verr := LoadDocument(yamlFile)
+	if verr != nil {
+		t.Error(verr)
+		return
+	}
+
+	problems := doc.Lint()
+	for _, problem := range problems {
+		t.Log(problem)
+	}
+	assert.Equal(t, 6, len(problems), "type, share, duplicated name, image, port and depends should be reported")
+	assert.Equal(t, "$.apps[0].type", problems[0].Path)
+	assert.Equal(t, 5, problems[0].Line)
+	assert.Equal(t, "$.apps[0].share[0]", problems[1].Path)
+	assert.Equal(t, 7, problems[1].Line)
+	assert.Equal(t, "$.apps[1].image", problems[3].Path)
+	assert.Equal(t, 10, problems[3].Line, "missing field should be located at its app")
+}
+
+func TestLintSharesValidate(t *testing.T) {
+	yamlFile, err := ioutil.ReadFile("test_data/lint_failure.yaml")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	doc, verr := LoadDocument(yamlFile)
+	assert.Nil(t, verr)
+
+	//Validate stops at the first problem reported by Lint
+	_, _, _, verr = doc.TopLevel.Validate()
+	assert.NotNil(t, verr)
+	assert.Equal(t, error2.ErrMismatch, verr.Err)
+	assert.Equal(t, doc.Lint()[0].Msg, verr.Msg.Front().Value.(string))
+
+	//exposed names used twice are only warned by Lint
+	doc.TopLevel = *newTestTopLevel(AppLevel{Name: "a", Image: "a", ImageType: TypeDocker, Expose: []string{"/bin/a:tool"}}, AppLevel{Name: "b", Image: "b", ImageType: TypeDocker, Expose: []string{"/bin/b:tool"}})
+	_, _, _, verr = doc.TopLevel.Validate()
+	assert.Nil(t, verr)
+	problems := doc.Lint()
+	assert.Equal(t, 1, len(problems))
+	assert.Equal(t, "$.apps[1].expose[0]", problems[0].Path)
+}
+
+func TestAppHash(t *testing.T) {
+	app := AppLevel{Name: "a", Image: "ubuntu:18.04", ImageType: TypeDocker, Command: "ls"}
+	h1, err := app.Hash()
+	assert.Nil(t, err)
+	h2, _ := app.Hash()
+	assert.Equal(t, h1, h2, "hash should be stable")
+
+	app.Command = "ls -l"
+	h3, _ := app.Hash()
+	assert.NotEqual(t, h1, h3, "hash should change with definition")
+}
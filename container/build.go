@@ -0,0 +1,282 @@
+package container
+
+import (
+	"archive/tar"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+
+	. "github.com/JasonYangShadow/lpmx/docker"
+	. "github.com/JasonYangShadow/lpmx/error"
+	. "github.com/JasonYangShadow/lpmx/pid"
+	. "github.com/JasonYangShadow/lpmx/singularity"
+	. "github.com/JasonYangShadow/lpmx/utils"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sys/unix"
+)
+
+//flatLayer is one extracted layer folder merged by flattenLayers
+type flatLayer struct {
+	folder   string
+	excludes []string //paths relative to the layer root which are skipped, e.g, the runtime files of rw layer
+}
+
+//layerFlattener merges extracted layers into one file tree following the whiteouts of OCI layers
+type layerFlattener struct {
+	root     bool //ownership is only kept for root, otherwise entries are owned by root inside image
+	metas    map[string]LayerEntryMeta
+	excludes map[string]bool
+}
+
+//flattenLayers merges layers(from lower to higher) into one file tree. Attributes recorded inside the meta files of layers
+//(see UntarLayer) replace the ones on disk
+func flattenLayers(layers []flatLayer) (*FsEntry, *Error) {
+	f := &layerFlattener{root: os.Geteuid() == 0}
+	tree := NewFsDir(0755)
+	for _, layer := range layers {
+		metas, err := ReadLayerMeta(filepath.Clean(layer.folder) + LAYER_META)
+		if err != nil && err.Err != ErrNExist {
+			return nil, err
+		}
+		f.metas = make(map[string]LayerEntryMeta)
+		for _, meta := range metas {
+			f.metas[meta.Path] = meta
+		}
+		f.excludes = make(map[string]bool)
+		for _, exclude := range layer.excludes {
+			f.excludes["/"+strings.Trim(exclude, "/")] = true
+		}
+		if ferr := f.apply(tree, layer.folder, "/"); ferr != nil {
+			cerr := ErrNew(ferr, fmt.Sprintf("could not flatten layer %s", layer.folder))
+			return nil, cerr
+		}
+	}
+	return tree, nil
+}
+
+//apply merges folder dir of layer into node, rel is the path of dir relative to the layer root
+func (f *layerFlattener) apply(node *FsEntry, dir, rel string) error {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	//whiteouts only hide the entries of lower layers, so they are applied before the entries of this layer
+	for _, fi := range infos {
+		if name := fi.Name(); name == WHITEOUT_OPAQUE {
+			node.Children = make(map[string]*FsEntry)
+		} else if strings.HasPrefix(name, WHITEOUT_PREFIX) {
+			delete(node.Children, strings.TrimPrefix(name, WHITEOUT_PREFIX))
+		}
+	}
+	for _, fi := range infos {
+		name := fi.Name()
+		crel := path.Join(rel, name)
+		if strings.HasPrefix(name, WHITEOUT_PREFIX) || f.excludes[crel] {
+			continue
+		}
+		p := filepath.Join(dir, name)
+		entry, err := f.entry(p, crel, fi)
+		if err != nil {
+			return err
+		}
+		//folders existing in lower layers are merged, other entries are replaced
+		if old, ok := node.Children[name]; ok && old.Mode.IsDir() && entry.Mode.IsDir() {
+			entry.Children = old.Children
+		}
+		node.Children[name] = entry
+		if entry.Mode.IsDir() {
+			if err := f.apply(entry, p, crel); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+//entry converts file p of layer into tree entry
+func (f *layerFlattener) entry(p, rel string, fi os.FileInfo) (*FsEntry, error) {
+	e := &FsEntry{Mode: fi.Mode() & (os.ModeType | os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky), Mtime: fi.ModTime().Unix()}
+	st, _ := fi.Sys().(*syscall.Stat_t)
+	if f.root && st != nil {
+		e.Uid, e.Gid = st.Uid, st.Gid
+	}
+	switch {
+	case fi.IsDir():
+		e.Children = make(map[string]*FsEntry)
+	case fi.Mode()&os.ModeSymlink != 0:
+		link, err := os.Readlink(p)
+		if err != nil {
+			return nil, err
+		}
+		e.Link = link
+	case fi.Mode()&os.ModeDevice != 0 && st != nil:
+		e.Rdev = uint64(st.Rdev)
+	case fi.Mode().IsRegular():
+		e.Source = p
+	}
+
+	if meta, ok := f.metas[rel]; ok {
+		//the mode recorded inside layer is parsed in the way tar does
+		mode := (&tar.Header{Mode: meta.Mode}).FileInfo().Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)
+		e.Mode = e.Mode&os.ModeType | mode
+		e.Uid, e.Gid = uint32(meta.Uid), uint32(meta.Gid)
+		//device nodes are placeholders of regular files inside layers
+		switch meta.Device {
+		case "char":
+			e.Mode = os.ModeDevice | os.ModeCharDevice | mode
+		case "block":
+			e.Mode = os.ModeDevice | mode
+		case "fifo":
+			e.Mode = os.ModeNamedPipe | mode
+		}
+		if meta.Device != "" {
+			e.Source = ""
+			e.Rdev = unix.Mkdev(uint32(meta.Devmajor), uint32(meta.Devminor))
+		}
+		for k, v := range meta.Xattrs {
+			if e.Xattrs == nil {
+				e.Xattrs = make(map[string][]byte)
+			}
+			e.Xattrs[k] = []byte(v)
+		}
+	}
+
+	//files sharing inode(hardlinks inside layers or deduplicated files) stay hardlinks if their attributes are the same
+	if e.Source != "" && st != nil && st.Nlink > 1 && len(e.Xattrs) == 0 {
+		e.LinkKey = fmt.Sprintf("%d:%d:%v:%d:%d", st.Dev, st.Ino, e.Mode, e.Uid, e.Gid)
+	}
+	return e, nil
+}
+
+//buildSource returns the layers(from lower to higher) and the image of target, which is either a container id or an image name
+func buildSource(currdir, target string) ([]flatLayer, map[string]interface{}, *Error) {
+	var sys Sys
+	if err := unmarshalObj(fmt.Sprintf("%s/.lpmxsys", currdir), &sys); err != nil && err.Err != ErrNExist {
+		return nil, nil, err
+	}
+	var doc Image
+	if err := unmarshalObj(fmt.Sprintf("%s/.lpmxdata", currdir), &doc); err != nil {
+		return nil, nil, err
+	}
+
+	if v, ok := sys.Containers[target].(map[string]interface{}); ok {
+		var con Container
+		if err := unmarshalObj(v["ConfigPath"].(string), &con); err != nil {
+			return nil, nil, err
+		}
+		pidfile := fmt.Sprintf("%s/container.pid", path.Dir(con.RootPath))
+		if pok, _ := PidIsActive(pidfile); pok {
+			pid, _ := PidValue(pidfile)
+			cerr := ErrNew(ErrExist, fmt.Sprintf("conatiner with id: %s is running with pid: %d, please stop it firstly", target, pid))
+			return nil, nil, cerr
+		}
+		image_map, map_ok := doc.Images[con.ImageBase].(map[string]interface{})
+		if !map_ok {
+			cerr := ErrNew(ErrNExist, fmt.Sprintf("image %s of container %s does not exist", con.ImageBase, target))
+			return nil, nil, cerr
+		}
+		//layers of container are recorded from higher to lower, the first one is the rw layer
+		var layers []flatLayer
+		for _, layer := range ReverseStrArray(strings.Split(con.Layers, ":")) {
+			if layer != "" && layer != "rw" {
+				layers = append(layers, flatLayer{folder: fmt.Sprintf("%s/%s", con.BaseLayerPath, layer)})
+			}
+		}
+		layers = append(layers, flatLayer{folder: con.RootPath, excludes: rwExcludes(&con)})
+		return layers, image_map, nil
+	}
+
+	name := target
+	if !strings.Contains(name, ":") {
+		name = name + ":latest"
+	}
+	image_map, map_ok := doc.Images[name].(map[string]interface{})
+	if !map_ok {
+		cerr := ErrNew(ErrNExist, fmt.Sprintf("%s is neither a container id nor an image", target))
+		return nil, nil, cerr
+	}
+	base, _ := image_map["base"].(string)
+	layer_order, _ := image_map["layer_order"].(string)
+	if base == "" || layer_order == "" {
+		cerr := ErrNew(ErrNil, fmt.Sprintf("image %s does not record its extracted layers", name))
+		return nil, nil, cerr
+	}
+	var layers []flatLayer
+	for _, layer := range strings.Split(layer_order, ":") {
+		if layer != "" {
+			layers = append(layers, flatLayer{folder: fmt.Sprintf("%s/%s", base, path.Base(layer))})
+		}
+	}
+	return layers, image_map, nil
+}
+
+//SingularityBuild exports image or container target as sif image output. Layers are flattened into the primary squashfs partition,
+//the run configuration of image becomes the runscript, environment and labels used by singularity
+func SingularityBuild(target, output string) *Error {
+	currdir, err := GetConfigDir()
+	if err != nil {
+		return err
+	}
+	tempdir := fmt.Sprintf("%s/.temp", currdir)
+	defer func() {
+		if FolderExist(tempdir) {
+			os.RemoveAll(tempdir)
+		}
+	}()
+
+	aoutput, aerr := filepath.Abs(output)
+	if aerr != nil {
+		cerr := ErrNew(aerr, fmt.Sprintf("could not parse to the absolute path: %s", output))
+		return cerr
+	}
+	if _, serr := os.Lstat(aoutput); serr == nil {
+		cerr := ErrNew(ErrExist, fmt.Sprintf("%s already exists, please remove it firstly", aoutput))
+		return cerr
+	}
+
+	layers, image_map, err := buildSource(currdir, target)
+	if err != nil {
+		return err
+	}
+	//image config is recorded by lpmx, older images do not have it
+	var config *ocispec.Image
+	if rdir, ok := image_map["rootdir"].(string); ok {
+		config, err = LoadImageConfig(fmt.Sprintf("%s/%s", rdir, IMAGE_CONFIG))
+		if err != nil && err.Err != ErrNExist {
+			return err
+		}
+	}
+	if config == nil {
+		config = new(ocispec.Image)
+	}
+
+	fmt.Println("flattening layers...")
+	root, err := flattenLayers(layers)
+	if err != nil {
+		return err
+	}
+	build := &SifBuild{
+		Root:        root,
+		Environment: config.Config.Env,
+		Entrypoint:  config.Config.Entrypoint,
+		Cmd:         config.Config.Cmd,
+		Labels:      config.Config.Labels,
+		Arch:        config.Architecture,
+		From:        target,
+	}
+	if build.Arch == "" {
+		build.Arch = runtime.GOARCH
+	}
+
+	temp_dir, terr := CreateTempDir(tempdir)
+	if terr != nil {
+		return terr
+	}
+	fmt.Printf("building %s...\n", aoutput)
+	return BuildSif(build, aoutput, temp_dir)
+}
@@ -0,0 +1,133 @@
+package container
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/JasonYangShadow/lpmx/docker"
+	. "github.com/JasonYangShadow/lpmx/msgpack"
+	. "github.com/JasonYangShadow/lpmx/singularity"
+	. "github.com/JasonYangShadow/lpmx/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		file := filepath.Join(dir, name)
+		assert.Nil(t, os.MkdirAll(filepath.Dir(file), 0755))
+		assert.Nil(t, ioutil.WriteFile(file, []byte(content), 0755))
+	}
+}
+
+func TestSingularityBuild(t *testing.T) {
+	datadir := newTestImageStore(t)
+	base := datadir + "/.base"
+	writeTestFiles(t, base+"/a.tar.gz", map[string]string{
+		"bin/sh":        "sh",
+		"etc/motd":      "lower",
+		"opt/old":       "old",
+		"dev/null":      "",
+		"usr/bin/sudo":  "sudo",
+		"home/.profile": "profile",
+	})
+	//device node and setuid bit could not be reproduced while extracting the layer
+	metas, _ := json.Marshal([]LayerEntryMeta{
+		{Path: "/dev/null", Mode: 0666, Device: "char", Devmajor: 1, Devminor: 3},
+		{Path: "/usr/bin/sudo", Mode: 04755},
+	})
+	assert.Nil(t, ioutil.WriteFile(base+"/a.tar.gz"+LAYER_META, metas, 0644))
+	writeTestFiles(t, base+"/b.tar.gz", map[string]string{
+		"etc/.wh.motd":         "",
+		"opt/.wh..wh..opq":     "",
+		"opt/new":              "new",
+		"etc/hostname":         "test",
+		".singularity.d/stale": "stale",
+	})
+
+	config := NewImageConfig()
+	config.Architecture = "arm64"
+	config.Config.Env = []string{"PATH=/opt/bin:/usr/bin:/bin", "GREETING=it's $HOME"}
+	config.Config.Cmd = []string{"echo", "hi"}
+	config.Config.Labels = map[string]string{"maintainer": "lpmx"}
+	assert.Nil(t, SaveImageConfig(config, fmt.Sprintf("%s/test/v1/%s", datadir, IMAGE_CONFIG)))
+
+	dir, _ := ioutil.TempDir("", "lpmx-build")
+	defer os.RemoveAll(dir)
+	output := filepath.Join(dir, "test.sif")
+	assert.Nil(t, SingularityBuild("test:v1", output))
+	assert.NotNil(t, SingularityBuild("test:v1", output), "existing file should not be overwritten")
+	assert.NotNil(t, SingularityBuild("missing:v1", filepath.Join(dir, "missing.sif")))
+
+	//run configuration survives the round trip through sif
+	meta, err := ReadSifMetadata(output)
+	assert.Nil(t, err)
+	assert.Equal(t, "arm64", meta.Arch)
+	assert.Equal(t, config.Config.Env, meta.Environment)
+	assert.Equal(t, "lpmx", meta.Labels["maintainer"])
+	assert.Contains(t, meta.Runscript, "OCI_CMD=\"echo hi\"")
+	assert.Contains(t, meta.Deffile, "Bootstrap: scratch")
+
+	squashfs := filepath.Join(dir, "test.squashfs")
+	assert.Nil(t, ExtractSquashfs(output, squashfs))
+	f, oerr := os.Open(squashfs)
+	assert.Nil(t, oerr)
+	defer f.Close()
+	fs, err := OpenSquashfs(f)
+	assert.Nil(t, err)
+	names, rerr := fs.ReadDir("/.singularity.d")
+	assert.Nil(t, rerr)
+	assert.NotContains(t, names, "stale")
+	data, rerr := fs.ReadFile("/singularity")
+	assert.Nil(t, rerr)
+	assert.Equal(t, meta.Runscript, string(data))
+
+	rootfs := filepath.Join(dir, "rootfs")
+	assert.Nil(t, fs.Extract(rootfs))
+	for _, name := range []string{"bin/sh", "opt/new", "etc/hostname", "home/.profile", "etc/resolv.conf"} {
+		assert.True(t, FileExist(filepath.Join(rootfs, name)), name)
+	}
+	//mount points of singularity are created
+	assert.True(t, FolderExist(filepath.Join(rootfs, "proc")))
+	assert.True(t, FolderExist(filepath.Join(rootfs, "sys")))
+	for _, name := range []string{"etc/motd", "opt/old"} {
+		assert.False(t, FileExist(filepath.Join(rootfs, name)), name)
+	}
+	fi, serr := os.Stat(filepath.Join(rootfs, "usr/bin/sudo"))
+	assert.Nil(t, serr)
+	assert.NotZero(t, fi.Mode()&os.ModeSetuid)
+	if os.Geteuid() == 0 {
+		fi, serr = os.Stat(filepath.Join(rootfs, "dev/null"))
+		assert.Nil(t, serr)
+		assert.NotZero(t, fi.Mode()&os.ModeCharDevice)
+	}
+
+	//rw layer of container is the top layer, the files generated at runtime are skipped
+	condir := fmt.Sprintf("%s/test/v1/workspace/c1/.lpmx", datadir)
+	rw := fmt.Sprintf("%s/test/v1/workspace/c1/rw", datadir)
+	writeTestFiles(t, rw, map[string]string{
+		"bin/.wh.sh":   "",
+		"root/file":    "rw",
+		"tmp/junk":     "junk",
+		"etc/passwd":   "root:x:0:0::/root:/bin/sh",
+		"data/mounted": "host",
+	})
+	con := Container{Id: "c1", ImageBase: "test:v1", RootPath: rw, BaseLayerPath: base, Layers: "rw:b.tar.gz:a.tar.gz", DataSyncMap: "/host/data=/data"}
+	cdata, _ := StructMarshal(con)
+	WriteToFile(cdata, condir+"/.info")
+
+	output = filepath.Join(dir, "c1.sif")
+	assert.Nil(t, SingularityBuild("c1", output))
+	squashfs = filepath.Join(dir, "c1.squashfs")
+	assert.Nil(t, ExtractSquashfs(output, squashfs))
+	rootfs = filepath.Join(dir, "c1")
+	assert.Nil(t, Unsquashfs(squashfs, rootfs))
+	assert.True(t, FileExist(filepath.Join(rootfs, "root/file")))
+	assert.True(t, FileExist(filepath.Join(rootfs, "opt/new")))
+	for _, name := range []string{"bin/sh", "tmp/junk", "etc/passwd", "data/mounted"} {
+		assert.False(t, FileExist(filepath.Join(rootfs, name)), name)
+	}
+}
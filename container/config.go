@@ -0,0 +1,261 @@
+package container
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/JasonYangShadow/lpmx/docker"
+	. "github.com/JasonYangShadow/lpmx/error"
+	. "github.com/JasonYangShadow/lpmx/forward"
+	. "github.com/JasonYangShadow/lpmx/log"
+	. "github.com/JasonYangShadow/lpmx/utils"
+	. "github.com/JasonYangShadow/lpmx/yaml"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	//GLOBAL_CONFIG is the name of global config file, it is searched inside lpmx root and then $HOME/.config/lpmx
+	GLOBAL_CONFIG = "config"
+	//ENV_LPMX_CONFIG points to the global config file explicitly
+	ENV_LPMX_CONFIG = "LPMX_CONFIG"
+	//ENV_LOG_LEVEL is preferred over log_level of global config
+	ENV_LOG_LEVEL = "LPMX_LOG_LEVEL"
+)
+
+var (
+	//DEFAULT_VOLUMES are mounted into every new container unless the container path is already mapped, the format is the same as -v
+	DEFAULT_VOLUMES []string
+	//DEFAULT_ENGINE is used when the engine of new container is not given
+	DEFAULT_ENGINE = ""
+)
+
+//globalConfigFile returns the global config file in use, it is empty if there is none
+func globalConfigFile() (string, *Error) {
+	if file := os.Getenv(ENV_LPMX_CONFIG); file != "" {
+		if !FileExist(file) {
+			cerr := ErrNew(ErrNExist, fmt.Sprintf("%s: %s does not exist", ENV_LPMX_CONFIG, file))
+			return "", cerr
+		}
+		return file, nil
+	}
+	currdir, err := GetConfigDir()
+	if err != nil {
+		return "", err
+	}
+	dirs := []string{currdir}
+	if home, herr := os.UserHomeDir(); herr == nil {
+		dirs = append(dirs, filepath.Join(home, ".config", "lpmx"))
+	}
+	for _, dir := range dirs {
+		for _, ext := range []string{"yaml", "yml"} {
+			if file := fmt.Sprintf("%s/%s.%s", dir, GLOBAL_CONFIG, ext); FileExist(file) {
+				return file, nil
+			}
+		}
+	}
+	return "", nil
+}
+
+//splitVolumes converts volumes of global config(either one string in -v format or a list of host=container items) to items
+func splitVolumes(value interface{}) []string {
+	var items []string
+	switch v := value.(type) {
+	case string:
+		items = strings.Split(v, ":")
+	case []interface{}:
+		for _, item := range v {
+			items = append(items, strings.Split(fmt.Sprint(item), ":")...)
+		}
+	}
+	var volumes []string
+	for _, item := range items {
+		if strings.Contains(item, "=") {
+			volumes = append(volumes, item)
+		}
+	}
+	return volumes
+}
+
+//mergeVolumes appends the default volumes to volume_map, volumes whose container paths are already mapped are skipped
+func mergeVolumes(volume_map string, defaults []string) string {
+	mapped := make(map[string]bool)
+	for _, item := range strings.Split(volume_map, ":") {
+		if kv := strings.SplitN(item, "=", 2); len(kv) == 2 {
+			mapped[filepath.Clean(kv[1])] = true
+		}
+	}
+	items := []string{}
+	if volume_map != "" {
+		items = append(items, strings.TrimSuffix(volume_map, ":"))
+	}
+	for _, volume := range defaults {
+		kv := strings.SplitN(volume, "=", 2)
+		if len(kv) != 2 || mapped[filepath.Clean(kv[1])] {
+			continue
+		}
+		mapped[filepath.Clean(kv[1])] = true
+		items = append(items, volume)
+	}
+	return strings.Join(items, ":")
+}
+
+//globalConfig holds the values of config.yaml, empty strings and nil pointers are not set by the file
+type globalConfig struct {
+	file    string
+	level   *logrus.Level
+	url     string
+	user    *string
+	pass    *string
+	workers *int
+	volumes []string
+	engine  string
+	address string
+	repo    string
+	pinned  string
+	verify  string
+}
+
+//readGlobalConfig reads and validates config.yaml without applying it, nil is returned if there is no config file
+func readGlobalConfig() (*globalConfig, *Error) {
+	file, err := globalConfigFile()
+	if err != nil || file == "" {
+		return nil, err
+	}
+	dir, name := filepath.Split(file)
+	v, _, err := MultiGetMap(strings.TrimSuffix(name, filepath.Ext(name)), []string{dir})
+	if err != nil {
+		cerr := ErrNew(ErrFileIO, fmt.Sprintf("could not load global config %s", file))
+		return nil, cerr
+	}
+
+	config := &globalConfig{file: file}
+	if level := v.GetString("log_level"); level != "" {
+		lvl, lerr := logrus.ParseLevel(strings.ToLower(level))
+		if lerr != nil {
+			cerr := ErrNew(lerr, fmt.Sprintf("log_level of %s is invalid", file))
+			return nil, cerr
+		}
+		config.level = &lvl
+	}
+
+	if url := v.GetString("registry.url"); url != "" {
+		if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+			url = "https://" + url
+		}
+		config.url = strings.TrimSuffix(url, "/")
+	}
+	if v.IsSet("registry.username") {
+		user := v.GetString("registry.username")
+		config.user = &user
+	}
+	if v.IsSet("registry.password") {
+		pass := v.GetString("registry.password")
+		config.pass = &pass
+	}
+
+	if v.IsSet("download_workers") {
+		workers := v.GetInt("download_workers")
+		if workers < 1 {
+			cerr := ErrNew(ErrType, fmt.Sprintf("download_workers of %s should be positive", file))
+			return nil, cerr
+		}
+		config.workers = &workers
+	}
+
+	if v.IsSet("volumes") {
+		config.volumes = splitVolumes(v.Get("volumes"))
+	}
+
+	if engine := v.GetString("engine"); engine != "" {
+		if _, ok := FindStringArray(strings.ToUpper(engine), ENGINE_TYPE); !ok {
+			cerr := ErrNew(ErrType, fmt.Sprintf("engine %s of %s is not supported, supported ones are %s", engine, file, strings.Join(ENGINE_TYPE, ", ")))
+			return nil, cerr
+		}
+		config.engine = strings.ToUpper(engine)
+	}
+
+	if address := v.GetString("bind_address"); address != "" {
+		if net.ParseIP(address) == nil {
+			cerr := ErrNew(ErrType, fmt.Sprintf("bind_address %s of %s is not an ip address", address, file))
+			return nil, cerr
+		}
+		config.address = address
+	}
+
+	config.repo = strings.TrimSuffix(v.GetString("setting.repo"), "/")
+	if pinned := v.GetString("setting.index_sha256"); pinned != "" {
+		if err := digest.NewDigestFromHex(string(digest.SHA256), strings.TrimPrefix(pinned, "sha256:")).Validate(); err != nil {
+			cerr := ErrNew(err, fmt.Sprintf("setting.index_sha256 %s of %s is not a sha256 digest", pinned, file))
+			return nil, cerr
+		}
+		config.pinned = pinned
+	}
+	if verify := v.GetString("setting.verify"); verify != "" {
+		if verify != SETTING_VERIFY_STRICT && verify != SETTING_VERIFY_AUTO {
+			cerr := ErrNew(ErrType, fmt.Sprintf("setting.verify of %s should be either %s or %s", file, SETTING_VERIFY_STRICT, SETTING_VERIFY_AUTO))
+			return nil, cerr
+		}
+		config.verify = verify
+	}
+	return config, nil
+}
+
+//LoadGlobalConfig reads config.yaml and applies registry defaults, download workers, default volumes, engine type, log level,
+//the address of port forwarders and the verification of setting repository. Nothing is changed if there is no config file
+//or it is invalid, so that defaults are kept
+func LoadGlobalConfig() *Error {
+	config, err := readGlobalConfig()
+	if err != nil || config == nil {
+		return err
+	}
+
+	if config.level != nil && os.Getenv(ENV_LOG_LEVEL) == "" {
+		LOGGER.SetLevel(*config.level)
+	}
+	if config.url != "" {
+		DOCKER_URL = config.url
+	}
+	if config.user != nil {
+		REGISTRY_USER = *config.user
+	}
+	if config.pass != nil {
+		REGISTRY_PASS = *config.pass
+	}
+	if config.workers != nil {
+		DOWNLOAD_WORKERS = *config.workers
+	}
+	if config.volumes != nil {
+		DEFAULT_VOLUMES = config.volumes
+	}
+	if config.engine != "" {
+		DEFAULT_ENGINE = config.engine
+	}
+	if config.address != "" {
+		BIND_ADDRESS = config.address
+	}
+	if config.repo != "" {
+		SETTING_REPO = config.repo
+	}
+	if config.pinned != "" {
+		SETTING_INDEX_SHA256 = config.pinned
+	}
+	if config.verify != "" {
+		SETTING_VERIFY = config.verify
+	}
+
+	LOGGER.WithFields(logrus.Fields{
+		"file":     config.file,
+		"registry": DOCKER_URL,
+		"workers":  DOWNLOAD_WORKERS,
+		"volumes":  DEFAULT_VOLUMES,
+		"engine":   DEFAULT_ENGINE,
+		"address":  BIND_ADDRESS,
+		"setting":  SettingURL(),
+		"verify":   SETTING_VERIFY,
+	}).Debug("global config is loaded")
+	return nil
+}
@@ -0,0 +1,83 @@
+package container
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/JasonYangShadow/lpmx/docker"
+	. "github.com/JasonYangShadow/lpmx/forward"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadGlobalConfig(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "lpmx-config")
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "config.yaml")
+	ioutil.WriteFile(file, []byte(`registry:
+  url: registry.example.com/
+  username: user
+  password: pass
+download_workers: 4
+volumes:
+  - /data=/data
+  - /scratch=/tmp/scratch
+engine: sge
+bind_address: 0.0.0.0
+setting:
+  repo: https://mirror.example.com/setting/
+  index_sha256: sha256:0000000000000000000000000000000000000000000000000000000000000000
+  verify: strict
+`), 0644)
+	os.Setenv(ENV_LPMX_CONFIG, file)
+	defer os.Unsetenv(ENV_LPMX_CONFIG)
+	url, workers := DOCKER_URL, DOWNLOAD_WORKERS
+	defer func() {
+		DOCKER_URL, REGISTRY_USER, REGISTRY_PASS, DOWNLOAD_WORKERS = url, "", "", workers
+		DEFAULT_VOLUMES, DEFAULT_ENGINE, BIND_ADDRESS = nil, "", "127.0.0.1"
+		SETTING_REPO, SETTING_INDEX_SHA256, SETTING_VERIFY = "", "", SETTING_VERIFY_AUTO
+	}()
+
+	assert.Nil(t, LoadGlobalConfig())
+	assert.Equal(t, "https://registry.example.com", DOCKER_URL)
+	assert.Equal(t, "user", REGISTRY_USER)
+	assert.Equal(t, "pass", REGISTRY_PASS)
+	assert.Equal(t, 4, DOWNLOAD_WORKERS)
+	assert.Equal(t, []string{"/data=/data", "/scratch=/tmp/scratch"}, DEFAULT_VOLUMES)
+	assert.Equal(t, "SGE", DEFAULT_ENGINE)
+	assert.Equal(t, "0.0.0.0", BIND_ADDRESS)
+	assert.Equal(t, "https://mirror.example.com/setting", SettingURL())
+	assert.Equal(t, "sha256:0000000000000000000000000000000000000000000000000000000000000000", SETTING_INDEX_SHA256)
+	assert.Equal(t, SETTING_VERIFY_STRICT, SETTING_VERIFY)
+
+	ioutil.WriteFile(file, []byte("engine: slurm\n"), 0644)
+	assert.NotNil(t, LoadGlobalConfig())
+	ioutil.WriteFile(file, []byte("setting:\n  verify: none\n"), 0644)
+	assert.NotNil(t, LoadGlobalConfig())
+	ioutil.WriteFile(file, []byte("setting:\n  index_sha256: abc\n"), 0644)
+	assert.NotNil(t, LoadGlobalConfig())
+	//invalid config changes nothing, defaults are kept
+	DOCKER_URL = url
+	ioutil.WriteFile(file, []byte("registry:\n  url: https://other.example.com\nengine: slurm\n"), 0644)
+	assert.NotNil(t, LoadGlobalConfig())
+	assert.Equal(t, url, DOCKER_URL)
+
+	//doctor reports invalid config
+	d := new(diagnostics)
+	d.checkConfig()
+	if assert.Len(t, *d, 1) {
+		assert.Equal(t, DOCTOR_FAIL, (*d)[0].Status)
+		assert.Contains(t, (*d)[0].Detail, "engine slurm")
+	}
+	os.Setenv(ENV_LPMX_CONFIG, filepath.Join(dir, "missing.yaml"))
+	assert.NotNil(t, LoadGlobalConfig())
+}
+
+func TestMergeVolumes(t *testing.T) {
+	defaults := []string{"/data=/data", "/scratch=/tmp/"}
+	assert.Equal(t, "/sync=/lpmx:/data=/data:/scratch=/tmp/", mergeVolumes("/sync=/lpmx:", defaults))
+	//container paths already mapped by user are kept
+	assert.Equal(t, "/mine=/tmp:/data=/data", mergeVolumes("/mine=/tmp", defaults))
+	assert.Equal(t, "/data=/data:/scratch=/tmp/", mergeVolumes("", defaults))
+}
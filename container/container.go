@@ -2,8 +2,10 @@ package container
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"github.com/goccy/go-yaml"
+	"io"
 	"io/ioutil"
 	"net"
 	"net/rpc"
@@ -11,14 +13,17 @@ import (
 	"os/user"
 	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	. "github.com/JasonYangShadow/lpmx/docker"
 	. "github.com/JasonYangShadow/lpmx/elf"
 	. "github.com/JasonYangShadow/lpmx/error"
 	. "github.com/JasonYangShadow/lpmx/filecache"
+	. "github.com/JasonYangShadow/lpmx/forward"
 	. "github.com/JasonYangShadow/lpmx/log"
 	. "github.com/JasonYangShadow/lpmx/msgpack"
 	. "github.com/JasonYangShadow/lpmx/paeudo"
@@ -28,11 +33,17 @@ import (
 	. "github.com/JasonYangShadow/lpmx/utils"
 	. "github.com/JasonYangShadow/lpmx/yaml"
 	. "github.com/JasonYangShadow/lpmx/compose"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/sirupsen/logrus"
 )
 
 const (
 	IDLENGTH = 10
+
+	//recreate policies of compose
+	RecreateChanged = "changed" //recreate containers whose app definition or image changed
+	RecreateForce   = "force"   //always recreate containers
+	RecreateNever   = "never"   //always reuse existing containers
 )
 
 var (
@@ -42,6 +53,15 @@ var (
 	CACHE_FOLDER            = []string{"/var/cache/apt/archives"}
 	UNSTALL_FOLDER          = []string{".lpmxsys", "sync", "bin", ".lpmxdata", "package"}
 	ENGINE_TYPE             = []string{"SGE"}
+
+	//sysLock serializes the updates of $/.lpmxsys/.info when containers run concurrently, e.g, parallel compose
+	sysLock sync.Mutex
+	//composeLock serializes image downloading and container generation of parallel compose apps
+	composeLock sync.Mutex
+	//composeOutputLock makes sure lines of parallel compose apps do not interleave
+	composeOutputLock sync.Mutex
+	//composePorts records the host ports occupied by running compose apps, guarded by composeLock
+	composePorts = make(map[int]string)
 )
 
 //located inside $/.lpmxsys/.info
@@ -81,6 +101,14 @@ type Container struct {
 	Engine           string //engine type used on the host
 	Execmaps         string //executables mapping info
 	FileSyncMap      string //mount separated files from host to container (host1=container1:host2=container2)
+	ComposeHash      string //hash of compose app definition which created this container
+
+	//runtime only fields, used by compose for running apps concurrently
+	ctx     context.Context
+	stdout  io.Writer
+	stderr  io.Writer
+	health  *HealthCheck
+	healthy func()
 }
 
 type RPC struct {
@@ -169,8 +197,7 @@ func Init(reset bool, deppath string, useNewGlibc bool) *Error {
 	sys.LogPath = fmt.Sprintf("%s/log", sys.RootDir)
 
 	defer func() {
-		data, _ := StructMarshal(&sys)
-		WriteToFile(data, fmt.Sprintf("%s/.info", sys.RootDir))
+		marshalObj(sys.RootDir, &sys)
 	}()
 
 	configfile := fmt.Sprintf("%s/.info", sys.RootDir)
@@ -213,7 +240,7 @@ func Init(reset bool, deppath string, useNewGlibc bool) *Error {
 		}
 		if !FileExist(deppath) {
 			if !useNewGlibc {
-				gen_url := fmt.Sprintf("%s/default.dependency.tar.gz", SETTING_URL)
+				gen_url := fmt.Sprintf("%s/default.dependency.tar.gz", SettingURL())
 				fmt.Printf("Downloading default.dependency.tar.gz from %s\n", gen_url)
 				err = DirectDownloadFilefromGithub("dependency.tar.gz", gen_url, sys.RootDir)
 				if err != nil {
@@ -221,7 +248,7 @@ func Init(reset bool, deppath string, useNewGlibc bool) *Error {
 				}
 			} else {
 				yaml := fmt.Sprintf("%s/distro.management.yml", sys.RootDir)
-				err = DownloadFilefromGithubPlus(dist, release, "dependency.tar.gz", SETTING_URL, sys.RootDir, yaml)
+				err = DownloadFilefromGithubPlus(dist, release, "dependency.tar.gz", SettingURL(), sys.RootDir, yaml)
 				if err != nil {
 					return err
 				}
@@ -308,7 +335,7 @@ func Reset(useNewGlibc bool) *Error {
 	}
 
 	if !useNewGlibc {
-		gen_url := fmt.Sprintf("%s/default.dependency.tar.gz", SETTING_URL)
+		gen_url := fmt.Sprintf("%s/default.dependency.tar.gz", SettingURL())
 		fmt.Printf("Downloading default.dependency.tar.gz from %s\n", gen_url)
 		err = DirectDownloadFilefromGithub("dependency.tar.gz", gen_url, sys.RootDir)
 		if err != nil {
@@ -316,7 +343,7 @@ func Reset(useNewGlibc bool) *Error {
 		}
 	} else {
 		yaml := fmt.Sprintf("%s/distro.management.yml", sys.RootDir)
-		err = DownloadFilefromGithubPlus(dist, release, "dependency.tar.gz", SETTING_URL, sys.RootDir, yaml)
+		err = DownloadFilefromGithubPlus(dist, release, "dependency.tar.gz", SettingURL(), sys.RootDir, yaml)
 		if err != nil {
 			return err
 		}
@@ -411,7 +438,7 @@ func Update() *Error {
 	}
 	if !FileExist(deppath) {
 		yaml := fmt.Sprintf("%s/distro.management.yml", sys.RootDir)
-		err = DownloadFilefromGithubPlus(dist, release, "dependency.tar.gz", SETTING_URL, config, yaml)
+		err = DownloadFilefromGithubPlus(dist, release, "dependency.tar.gz", SettingURL(), config, yaml)
 		if err != nil {
 			return err
 		}
@@ -580,22 +607,7 @@ func Resume(id string, engine bool, args ...string) *Error {
 				pidfile := fmt.Sprintf("%s/container.pid", path.Dir(con.RootPath))
 
 				if pok, _ := PidIsActive(pidfile); !pok {
-					configmap := make(map[string]interface{})
-					configmap["dir"] = con.RootPath
-					configmap["config"] = con.SettingPath
-					configmap["passive"] = false
-					configmap["docker"] = true
-					configmap["layers"] = con.Layers
-					configmap["id"] = con.Id
-					configmap["image"] = con.ImageBase
-					configmap["baselayerpath"] = con.BaseLayerPath
-					configmap["elf_loader"] = con.PatchedELFLoader
-					configmap["parent_dir"] = filepath.Dir(con.RootPath)
-					configmap["sync_folder"] = con.DataSyncFolder
-					configmap["sync_ori_folder"] = con.DataSyncMap
-					configmap["imagetype"] = con.BaseType
-					configmap["engine"] = con.Engine
-					configmap["mountfile"] = con.FileSyncMap
+					configmap := con.resumeConfig()
 
 					//only if the user explicitly set enable_engine, then we skip enabling it
 					if engine {
@@ -626,6 +638,9 @@ func Resume(id string, engine bool, args ...string) *Error {
 }
 
 func Destroy(id string) *Error {
+	sysLock.Lock()
+	defer sysLock.Unlock()
+
 	currdir, err := GetConfigDir()
 	if err != nil {
 		return err
@@ -635,8 +650,7 @@ func Destroy(id string) *Error {
 	err = unmarshalObj(rootdir, &sys)
 
 	defer func() {
-		data, _ := StructMarshal(&sys)
-		WriteToFile(data, fmt.Sprintf("%s/.info", sys.RootDir))
+		marshalObj(sys.RootDir, &sys)
 	}()
 
 	if err == nil {
@@ -678,7 +692,7 @@ func Destroy(id string) *Error {
 
 }
 
-func Compose(file string) *Error {
+func Compose(file string, parallel int, keepGoing bool, recreate string) *Error {
 	yamlFile, err := ioutil.ReadFile(file)
 	if err != nil {
 		cerr := ErrNew(err, fmt.Sprintf("could not read %s", file))
@@ -692,34 +706,112 @@ func Compose(file string) *Error {
 		return cerr
 	}
 
-	depends, remains, appMap, validateErr := topLevel.Validate()
-	if validateErr != nil {
-		return validateErr
+	return topLevel.Schedule(parallel, keepGoing, func(ctx context.Context, app AppLevel, healthy func()) *Error {
+		return runComposeApp(ctx, app, healthy, recreate)
+	})
+}
+
+//ComposeValidate checks the compose file and reports all problems found, including the ones depending on the host, e.g,
+//missing images, host paths and collisions of exposed names with existing wrappers. Registry is not queried if offline is set
+func ComposeValidate(file string, offline bool) ([]Problem, *Error) {
+	yamlFile, err := ioutil.ReadFile(file)
+	if err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("could not read %s", file))
+		return nil, cerr
+	}
+
+	doc, cerr := LoadDocument(yamlFile)
+	if cerr != nil {
+		return nil, cerr
 	}
+	problems := doc.Lint()
 
-	if len(depends) > 0 {
-		for _, depend := range depends {
-			if targetApp, tok := (*appMap)[depend]; tok {
-				terr := runComposeApp(targetApp)
-				if terr != nil {
-					return terr
-				}
+	currdir, cerr := GetConfigDir()
+	if cerr != nil {
+		return nil, cerr
+	}
+	var images Image
+	ierr := unmarshalObj(fmt.Sprintf("%s/.lpmxdata", currdir), &images)
+	if ierr != nil && ierr.Err != ErrNExist {
+		return nil, ierr
+	}
+	//containers created by previous runs of apps, which are reused together with their wrappers
+	var sys Sys
+	serr := unmarshalObj(fmt.Sprintf("%s/.lpmxsys", currdir), &sys)
+	if serr != nil && serr.Err != ErrNExist {
+		return nil, serr
+	}
+	owners := make(map[string]string)
+	for id, v := range sys.Containers {
+		if val, vok := v.(map[string]interface{}); vok {
+			if name, nok := val["ContainerName"].(string); nok {
+				owners[id] = name
 			}
 		}
 	}
 
-	if len(remains) > 0 {
-		for _, remain := range remains {
-			if targetApp, tok := (*appMap)[remain]; tok {
-				terr := runComposeApp(targetApp)
-				if terr != nil {
-					return terr
+	for idx, app := range doc.TopLevel.Apps {
+		if app.Image != "" {
+			if _, ok := images.Images[app.Image]; !ok {
+				switch app.ImageType {
+				case TypeDocker:
+					name := app.Image
+					if !strings.Contains(name, ":") {
+						name = name + ":latest"
+					}
+					if _, ok := images.Images[name]; !ok && !offline {
+						tdata := strings.Split(name, ":")
+						if _, derr := GetDigest("", "", tdata[0], tdata[1]); derr != nil {
+							problems = append(problems, doc.Problem(AppPath(idx, "image"), fmt.Sprintf("image %s is neither loaded nor pullable from registry", app.Image)))
+						}
+					}
+				case TypeSingularity:
+					if !FileExist(app.Image) {
+						problems = append(problems, doc.Problem(AppPath(idx, "image"), fmt.Sprintf("SIF file %s does not exist", app.Image)))
+					}
+				}
+			}
+		}
+
+		fields := map[string][]string{"share": app.Share, "inject": app.Inject}
+		for _, field := range []string{"share", "inject"} {
+			for i, value := range fields[field] {
+				host := strings.Split(value, ":")[0]
+				if host != "" && !FileExist(host) && !FolderExist(host) {
+					problems = append(problems, doc.Problem(AppPath(idx, fmt.Sprintf("%s[%d]", field, i)), fmt.Sprintf("host path %s does not exist", host)))
 				}
 			}
 		}
+
+		for i, expose := range app.Expose {
+			values := strings.Split(expose, ":")
+			if len(values) != 2 || values[1] == "" {
+				continue
+			}
+			//wrappers of the container reused by app are replaced when it runs again
+			wrapper := fmt.Sprintf("%s/bin/%s", currdir, values[1])
+			if FileExist(wrapper) && owners[exposedContainer(wrapper)] != app.Name {
+				problems = append(problems, doc.Problem(AppPath(idx, fmt.Sprintf("expose[%d]", i)), fmt.Sprintf("expose name %s collides with existing wrapper %s/bin/%s", values[1], currdir, values[1])))
+			}
+		}
 	}
 
-	return nil
+	return problems, nil
+}
+
+//exposedContainer returns the id of container resumed by wrapper file created by Expose, it is empty if file is not such a wrapper
+func exposedContainer(file string) string {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return ""
+	}
+	fields := strings.Fields(string(data))
+	for i := 0; i+2 < len(fields); i++ {
+		if fields[i] == "resume" && fields[i+2] == "--" {
+			return fields[i+1]
+		}
+	}
+	return ""
 }
 
 func Run(configmap *map[string]interface{}, env *map[string]string, args ...string) *Error {
@@ -771,6 +863,11 @@ func Run(configmap *map[string]interface{}, env *map[string]string, args ...stri
 		envmap["execmaps"] = (*configmap)["execmaps"].(string)
 	}
 
+	//save compose hash
+	if hash, hok := (*configmap)["compose_hash"].(string); hok {
+		con.ComposeHash = hash
+	}
+
 	//save mountfile maps
 	if _, fok := (*configmap)["mountfile"]; fok {
 		con.FileSyncMap = (*configmap)["mountfile"].(string)
@@ -782,24 +879,34 @@ func Run(configmap *map[string]interface{}, env *map[string]string, args ...stri
 		envmap["engine"] = "TRUE"
 	}
 
+	//redirect output if needed, used by compose
+	if ctx, cok := (*configmap)["context"].(context.Context); cok {
+		con.ctx = ctx
+	}
+	if stdout, sok := (*configmap)["stdout"].(io.Writer); sok {
+		con.stdout = stdout
+	}
+	if stderr, sok := (*configmap)["stderr"].(io.Writer); sok {
+		con.stderr = stderr
+	}
+	if health, hok := (*configmap)["healthcheck"].(*HealthCheck); hok {
+		con.health = health
+	}
+	if healthy, hok := (*configmap)["healthy"].(func()); hok {
+		con.healthy = healthy
+	}
+
 	defer func() {
 		con.Pid = -1
-		data, _ := StructMarshal(&con)
-		WriteToFile(data, fmt.Sprintf("%s/.info", con.ConfigPath))
+		marshalObj(con.ConfigPath, &con)
 		con.appendToSys()
 	}()
 
 	if FolderExist(con.ConfigPath) {
 		info := fmt.Sprintf("%s/.info", con.ConfigPath)
 		if FileExist(info) {
-			data, err := ReadFromFile(info)
-			if err == nil {
-				err := StructUnmarshal(data, &con)
-				if err != nil {
-					err.AddMsg("struct unmarshal error")
-					return err
-				}
-			} else {
+			err := unmarshalObj(con.ConfigPath, &con)
+			if err != nil {
 				err.AddMsg(fmt.Sprintf("can't read configuration file from %s", info))
 				return err
 			}
@@ -1087,6 +1194,7 @@ func DockerAdd(file string) *Error {
 		mdata["config"] = fmt.Sprintf("%s/setting.yml", mdata["rootdir"])
 		mdata["image"] = fmt.Sprintf("%s/.image", rootdir)
 		mdata["imagetype"] = "Docker"
+		recordImageSource(mdata, fmt.Sprintf("package:%s", file))
 		image_dir, _ := mdata["image"].(string)
 
 		if !FolderExist(mdata["rootdir"].(string)) {
@@ -1154,7 +1262,7 @@ func DockerAdd(file string) *Error {
 			layerfolder := fmt.Sprintf("%s/%s", mdata["base"], k)
 			if !FolderExist(layerfolder) {
 				MakeDir(layerfolder)
-				err := Untar(tar_path, layerfolder)
+				err := extractLayer(tar_path, layerfolder)
 				if err != nil {
 					return err
 				}
@@ -1175,8 +1283,7 @@ func DockerAdd(file string) *Error {
 		LOGGER.WithFields(logrus.Fields{
 			"doc": doc,
 		}).Debug("DockerAdd update image info")
-		ddata, _ := StructMarshal(doc)
-		cerr := WriteToFile(ddata, fmt.Sprintf("%s/.info", doc.RootDir))
+		cerr := marshalObj(doc.RootDir, &doc)
 		if cerr != nil {
 			return cerr
 		}
@@ -1184,7 +1291,8 @@ func DockerAdd(file string) *Error {
 	}
 }
 
-func DockerCommit(id, newname, newtag string) *Error {
+//DockerCommit creates image newname:newtag from container id, rw layer is compressed with compression(gzip, zstd or none)
+func DockerCommit(id, newname, newtag, author, message, compression string, changes []string) *Error {
 	currdir, err := GetConfigDir()
 	if err != nil {
 		return err
@@ -1201,380 +1309,294 @@ func DockerCommit(id, newname, newtag string) *Error {
 			os.RemoveAll(tempdir)
 		}
 	}()
-	if err == nil {
-		if v, ok := sys.Containers[id]; ok {
-			if val, vok := v.(map[string]interface{}); vok {
-				config_path := val["ConfigPath"].(string)
-
-				var con Container
-				err = unmarshalObj(config_path, &con)
-				if err != nil {
-					return err
-				}
-				pidfile := fmt.Sprintf("%s/container.pid", path.Dir(con.RootPath))
-
-				if pok, _ := PidIsActive(pidfile); !pok {
-					//parameters are src/target folder, target file name, and layer paths
-					//check new image already exists?
-					rootdir := fmt.Sprintf("%s/.lpmxdata", currdir)
-					var doc Image
-					err := unmarshalObj(rootdir, &doc)
-					if err != nil {
-						return err
-					}
-					if _, ok := doc.Images[fmt.Sprintf("%s:%s", newname, newtag)]; ok {
-						cerr := ErrNew(ErrExist, fmt.Sprintf("%s:%s already exists, please choose another name and tag", newname, newtag))
-						return cerr
-					}
-
-					//step0: before taring rw layer, remove unecessary folders
-					for _, cache := range CACHE_FOLDER {
-						cache = fmt.Sprintf("%s%s", con.RootPath, cache)
-						if FolderExist(cache) {
-							RemoveAll(cache)
-						}
-					}
-					//moving /etc/group /etc/passwd /tmp folder to temp folder
-					cache_temp_dir, cache_err := CreateTempDir(tempdir)
-					if cache_err != nil {
-						return cache_err
-					}
-
-					if FileExist(fmt.Sprintf("%s/etc/group", con.RootPath)) {
-						cerr := Rename(fmt.Sprintf("%s/etc/group", con.RootPath), fmt.Sprintf("%s/etc/group", cache_temp_dir))
-						if cerr != nil {
-							return cerr
-						}
-					}
-					if FileExist(fmt.Sprintf("%s/etc/passwd", con.RootPath)) {
-						cerr := Rename(fmt.Sprintf("%s/etc/passwd", con.RootPath), fmt.Sprintf("%s/etc/passwd", cache_temp_dir))
-						if cerr != nil {
-							return cerr
-						}
-					}
-					if FolderExist(fmt.Sprintf("%s/tmp", con.RootPath)) {
-						RemoveAll(fmt.Sprintf("%s/tmp", con.RootPath))
-					}
-					if FileExist(fmt.Sprintf("%s/.wh.tmp", con.RootPath)) {
-						RemoveFile(fmt.Sprintf("%s/.wh.tmp", con.RootPath))
-					}
-					//remove data symlink
-					if len(con.DataSyncMap) > 0 {
-						for _, kv := range strings.Split(con.DataSyncMap, ":") {
-							if len(kv) > 0 {
-								v := strings.Split(kv, "=")
-								if len(v) == 2 && len(v[1]) > 0 {
-									s_link := fmt.Sprintf("%s%s", con.RootPath, v[1])
-									os.RemoveAll(s_link)
-								}
-							}
-						}
-					}
-
-					//remove apt cache
-					if FolderExist(fmt.Sprintf("%s/var/lib/apt/lists", con.RootPath)) {
-						RemoveAll(fmt.Sprintf("%s/var/lib/apt/lists", con.RootPath))
-					}
-
-					if FolderExist(fmt.Sprintf("%s/var/lib/dpkg", con.RootPath)) {
-						RemoveAll(fmt.Sprintf("%s/var/lib/dpkg", con.RootPath))
-					}
-
-					//step 1: tar rw layer
-					layers := strings.Split(con.Layers, ":")
-					layers = layers[1:]
-					layers_full_path := []string{con.RootPath}
-					for _, layer := range layers {
-						layers_full_path = append(layers_full_path, fmt.Sprintf("%s/%s", con.BaseLayerPath, layer))
-					}
-					fmt.Println("taring rw layers...")
-					//get temp dir
-					temp_dir, temp_err := CreateTempDir(tempdir)
-					if temp_err != nil {
-						return temp_err
-					}
-					//tar rw layer
-					cerr := TarLayer(con.RootPath, temp_dir, con.Id, layers_full_path)
-					if cerr != nil {
-						return cerr
-					}
-					//step 2: calculate shasum value and move it to image folder
-					rw_tar_path := fmt.Sprintf("%s/%s.tar.gz", temp_dir, con.Id)
-					shasum, serr := Sha256file(rw_tar_path)
-					if serr != nil {
-						return serr
-					}
-					//image dir is LPMX/.lpmxdata/.image
-					//moving layer tarball to image folder
-					fmt.Println("renaming rw layer...")
-					image_dir := fmt.Sprintf("%s/.image", filepath.Dir(con.BaseLayerPath))
-					src_tar_path := rw_tar_path
-					target_tar_path := fmt.Sprintf("%s/%s.tar.gz", image_dir, shasum)
-					rerr := os.Rename(src_tar_path, target_tar_path)
-					if rerr != nil {
-						cerr := ErrNew(rerr, fmt.Sprintf("could not rename(move): %s to %s", src_tar_path, target_tar_path))
-						return cerr
-					}
-
-					//moving rw layer to base folder
-					//here, target place has suffix of .tar.gz
-					rerr = os.Rename(con.RootPath, fmt.Sprintf("%s/%s.tar.gz", con.BaseLayerPath, shasum))
-					if rerr != nil {
-						cerr := ErrNew(rerr, fmt.Sprintf("could not rename(move): %s to %s", con.RootPath, fmt.Sprintf("%s/%s", con.BaseLayerPath, shasum)))
-						return cerr
-					}
-
-					//create new symlink
-					new_symlink_path := fmt.Sprintf("%s/%s.tar.gz", filepath.Dir(con.RootPath), shasum)
-					old_symlink_path := fmt.Sprintf("%s/%s.tar.gz", con.BaseLayerPath, shasum)
-					rerr = os.Symlink(old_symlink_path, new_symlink_path)
-					if rerr != nil {
-						cerr := ErrNew(rerr, fmt.Sprintf("could not symlink: %s to %s", old_symlink_path, new_symlink_path))
-						return cerr
-					}
-
-					//moving workspace and copying setting.yml to new place
-					docker_path := filepath.Dir(con.BaseLayerPath)
-					new_workspace_path := fmt.Sprintf("%s/%s/%s/workspace", docker_path, newname, newtag)
-					if !FolderExist(new_workspace_path) {
-						derr := os.MkdirAll(new_workspace_path, os.FileMode(FOLDER_MODE))
-						if derr != nil {
-							cerr := ErrNew(derr, fmt.Sprintf("could not make dir %s", new_workspace_path))
-							return cerr
-						}
-					}
-
-					old_workspace_path := filepath.Dir(con.ConfigPath)
-					rerr = os.Rename(old_workspace_path, fmt.Sprintf("%s/%s", new_workspace_path, id))
-					if rerr != nil {
-						cerr := ErrNew(rerr, fmt.Sprintf("could not rename(move): %s to %s", old_workspace_path, fmt.Sprintf("%s/%s", new_workspace_path, id)))
-						return cerr
-					}
-					//copy setting.yml rather than rename
-					new_setting_path := fmt.Sprintf("%s/setting.yml", filepath.Dir(new_workspace_path))
-					_, cerr = CopyFile(con.SettingPath, new_setting_path)
-					if cerr != nil {
-						return cerr
-					}
-					con.RootPath = fmt.Sprintf("%s/%s/rw", new_workspace_path, id)
-					con.SettingPath = new_setting_path
-					con.ConfigPath = fmt.Sprintf("%s/%s/.lpmx", new_workspace_path, id)
-					con.LogPath = fmt.Sprintf("%s/log", con.ConfigPath)
-					con.PatchedELFLoader = fmt.Sprintf("%s/%s/ld.so.patch", new_workspace_path, id)
-
-					//step 3: froze rw layer and create new rw layer
-					fmt.Println("cleaning up...")
-					derr := os.Mkdir(con.RootPath, os.FileMode(FOLDER_MODE))
-					if derr != nil {
-						cerr := ErrNew(derr, fmt.Sprintf("could not make new folder: %s", con.RootPath))
-						return cerr
-					}
-					//create new data sync folder
-					for _, kv := range strings.Split(con.DataSyncMap, ":") {
-						if len(kv) > 0 {
-							v := strings.Split(kv, "=")
-							derr := os.Symlink(v[0], fmt.Sprintf("%s%s", con.RootPath, v[1]))
-							if derr != nil {
-								cerr := ErrNew(derr, fmt.Sprintf("could not symlink, oldpath: %s, newpath: %s", v[0], v[1]))
-								return cerr
-							}
-						}
-					}
-					//moving folders back to new rw folder
-					if FileExist(fmt.Sprintf("%s/etc/group", cache_temp_dir)) {
-						cerr := Rename(fmt.Sprintf("%s/etc/group", cache_temp_dir), fmt.Sprintf("%s/etc/group", con.RootPath))
-						if cerr != nil {
-							return cerr
-						}
-					}
-					if FileExist(fmt.Sprintf("%s/etc/passwd", cache_temp_dir)) {
-						cerr := Rename(fmt.Sprintf("%s/etc/passwd", cache_temp_dir), fmt.Sprintf("%s/etc/passwd", con.RootPath))
-						if cerr != nil {
-							return cerr
-						}
-					}
-					//create new tmp
-					os.MkdirAll(fmt.Sprintf("%s/tmp", con.RootPath), os.FileMode(FOLDER_MODE))
-					f, _ := os.Create(fmt.Sprintf("%s/.wh.tmp", con.RootPath))
-					f.Close()
-
-					//step 4: modify container info
-					new_layers := []string{"rw", fmt.Sprintf("%s.tar.gz", shasum)}
-					new_layers = append(new_layers, strings.Split(con.Layers, ":")[1:]...)
-					con.Layers = strings.Join(new_layers, ":")
-
-					data, _ := StructMarshal(&con)
-					LOGGER.WithFields(logrus.Fields{
-						"con": con,
-					}).Debug("DockerCommit update container info")
-					cerr = WriteToFile(data, fmt.Sprintf("%s/.info", con.ConfigPath))
-					if cerr != nil {
-						return cerr
-					}
-					old_imagebase := con.ImageBase
-					con.ImageBase = fmt.Sprintf("%s:%s", newname, newtag)
-					//update $/.lpmxsys/.info
-					con.appendToSys()
-					//end of updating container info
-
-					//located inside $/.lpmxdata
-					//start updating image info
-					fmt.Println("updating image info...")
-					mdata := make(map[string]interface{})
-					mdata["rootdir"] = fmt.Sprintf("%s/%s/%s", docker_path, newname, newtag)
-					mdata["config"] = con.SettingPath
-					mdata["image"] = fmt.Sprintf("%s/.image", docker_path)
-					//get old layer map to update new image info
-					image_map := doc.Images[old_imagebase]
-					if image_map != nil {
-						if map_interface, map_ok := image_map.(map[string]interface{}); map_ok {
-							if old_map, old_ok := (map_interface["layer"]).(map[string]interface{}); old_ok {
-								size, serr := GetFileSize(target_tar_path)
-								if serr != nil {
-									return serr
-								}
-								//here we clone the original map
-								clone_map := CopyMap(old_map)
-								clone_map[fmt.Sprintf("%s/%s.tar.gz", mdata["image"].(string), shasum)] = size
-								mdata["layer"] = clone_map
-								mdata["layer_order"] = fmt.Sprintf("%s:%s", map_interface["layer_order"].(string), fmt.Sprintf("%s/%s.tar.gz", mdata["image"].(string), shasum))
-
-								//check if orig_layer_order exists
-								if val, ok := map_interface["orig_layer_order"]; ok {
-									mdata["orig_layer_order"] = fmt.Sprintf("%s:%s", val.(string), fmt.Sprintf("%s/%s.tar.gz", mdata["image"].(string), shasum))
-								}
-							} else {
-								cerr := ErrNew(ErrType, fmt.Sprintf("doc.Image.Layer type is not right, actual: %T, want: map[string]interface{}", map_interface))
-								return cerr
-							}
-						} else {
-							cerr := ErrNew(ErrType, fmt.Sprintf("doc.Image type is not right, actual: %T, want: map[string]interface{}", image_map))
-							return cerr
-						}
-					}
-					mdata["workspace"] = fmt.Sprintf("%s/workspace", mdata["rootdir"])
-					mdata["base"] = fmt.Sprintf("%s/.base", docker_path)
-					mdata["imagetype"] = "Docker"
-
-					doc.Images[fmt.Sprintf("%s:%s", newname, newtag)] = mdata
-					mddata, _ := StructMarshal(doc)
-					LOGGER.WithFields(logrus.Fields{
-						"doc":        doc,
-						"write_path": fmt.Sprintf("%s/.info", doc.RootDir),
-					}).Debug("DockerCommit, update image info")
-					cerr = WriteToFile(mddata, fmt.Sprintf("%s/.info", doc.RootDir))
-					if cerr != nil {
-						return cerr
-					}
-
-					//start adding docinfo
-					var docinfo ImageInfo
-					docinfo.Name = fmt.Sprintf("%s:%s", newname, newtag)
-					docinfo.ImageType = "Docker"
-					// layer_order is absolute path
-					docinfo.LayersMap = make(map[string]int64)
-					if mdata["layer"] != nil {
-						layerinfo := mdata["layer"].(map[string]interface{})
-						for key, value := range layerinfo {
-							docinfo.LayersMap[path.Base(key)] = value.(int64)
-						}
-					}
-					//here we remove the absolute path, only keep shasum value
-					layersorder := strings.Split(mdata["layer_order"].(string), ":")
-					for idx, l := range layersorder {
-						layersorder[idx] = path.Base(l)
-					}
-					docinfo.Layers = strings.Join(layersorder, ":")
-
-					LOGGER.WithFields(logrus.Fields{
-						"docinfo":    docinfo,
-						"write_path": fmt.Sprintf("%s/.info", mdata["rootdir"].(string)),
-					}).Debug("DockerCommit, update docinfo info")
-					dinfodata, _ := StructMarshal(docinfo)
-					err = WriteToFile(dinfodata, fmt.Sprintf("%s/.info", mdata["rootdir"].(string)))
-					if err != nil {
-						return err
-					}
-					//end
-
-					return nil
-					//done
-				} else {
-					pid, _ := PidValue(pidfile)
-					cerr := ErrNew(ErrExist, fmt.Sprintf("conatiner with id: %s is running with pid: %d, can't package layer, please stop it firstly", id, pid))
-					return cerr
-				}
-			}
-		} else {
-			cerr := ErrNew(ErrNExist, fmt.Sprintf("conatiner with id: %s doesn't exist", id))
-			return cerr
+	if err != nil {
+		if err == ErrNExist {
+			err.AddMsg(fmt.Sprintf("%s does not exist", rootdir))
 		}
-		return nil
+		return err
 	}
-	if err == ErrNExist {
-		err.AddMsg(fmt.Sprintf("%s does not exist", rootdir))
+
+	v, ok := sys.Containers[id]
+	if !ok {
+		cerr := ErrNew(ErrNExist, fmt.Sprintf("conatiner with id: %s doesn't exist", id))
+		return cerr
+	}
+	val, vok := v.(map[string]interface{})
+	if !vok {
+		cerr := ErrNew(ErrType, fmt.Sprintf("sys.Containers[%s] type is not right, actual: %T, want: map[string]interface{}", id, v))
+		return cerr
 	}
-	return err
-}
 
-func DockerMerge(name, user, pass string) *Error {
-	currdir, err := GetConfigDir()
+	var con Container
+	err = unmarshalObj(val["ConfigPath"].(string), &con)
 	if err != nil {
 		return err
 	}
-	rootdir := fmt.Sprintf("%s/.lpmxdata", currdir)
-	sysdir := fmt.Sprintf("%s/.lpmxsys", currdir)
+	pidfile := fmt.Sprintf("%s/container.pid", path.Dir(con.RootPath))
+	if pok, _ := PidIsActive(pidfile); pok {
+		pid, _ := PidValue(pidfile)
+		cerr := ErrNew(ErrExist, fmt.Sprintf("conatiner with id: %s is running with pid: %d, can't package layer, please stop it firstly", id, pid))
+		return cerr
+	}
+
+	//check new image already exists?
+	datadir := fmt.Sprintf("%s/.lpmxdata", currdir)
 	var doc Image
-	err = unmarshalObj(rootdir, &doc)
-	if err != nil && err.Err != ErrNExist {
+	err = unmarshalObj(datadir, &doc)
+	if err != nil {
 		return err
 	}
-	if err != nil && err.Err == ErrNExist {
-		ret, err := MakeDir(rootdir)
-		doc.RootDir = rootdir
-		doc.Images = make(map[string]interface{})
-		if !ret {
-			return err
-		}
+	newimage := fmt.Sprintf("%s:%s", newname, newtag)
+	if _, ok := doc.Images[newimage]; ok {
+		cerr := ErrNew(ErrExist, fmt.Sprintf("%s already exists, please choose another name and tag", newimage))
+		return cerr
 	}
-	if !strings.Contains(name, ":") {
-		name = name + ":latest"
+	image_map, map_ok := doc.Images[con.ImageBase].(map[string]interface{})
+	if !map_ok {
+		cerr := ErrNew(ErrNExist, fmt.Sprintf("image %s of container %s does not exist", con.ImageBase, id))
+		return cerr
+	}
+	old_map, old_ok := image_map["layer"].(map[string]interface{})
+	if !old_ok {
+		cerr := ErrNew(ErrType, fmt.Sprintf("doc.Image.Layer type is not right, actual: %T, want: map[string]interface{}", image_map["layer"]))
+		return cerr
 	}
 
-	mdata := make(map[string]interface{})
-	tdata := strings.Split(name, ":")
-	tname := tdata[0]
-	ttag := tdata[1]
-	mdata["rootdir"] = fmt.Sprintf("%s/%s/%s-merge", doc.RootDir, tname, ttag)
-	mdata["config"] = fmt.Sprintf("%s/setting.yml", mdata["rootdir"].(string))
-	mdata["image"] = fmt.Sprintf("%s/.image", rootdir)
-	image_dir, _ := mdata["image"].(string)
-	//name is something like "ubuntu:16.04"
-	var layer_order []string
-	if mdata_orig, ok := doc.Images[name]; ok {
-		if mdata_map, m_ok := mdata_orig.(map[string]interface{}); m_ok {
-			layer_order = strings.Split(mdata_map["layer_order"].(string), ":")
-		}
-	} else {
-		_, layer_order, err = DownloadLayers(user, pass, tname, ttag, image_dir)
+	//step 1: prepare image configuration, changes are applied before doing anything heavy so that mistakes are reported early
+	config, err := commitImageConfig(image_map)
+	if err != nil {
+		return err
+	}
+	for _, change := range changes {
+		err = ApplyChange(config, change)
 		if err != nil {
 			return err
 		}
 	}
 
-	//base folder
-	base := fmt.Sprintf("%s/.base", rootdir)
-	if !FolderExist(base) {
-		MakeDir(base)
+	//step 2: tar rw layer, the container itself is never touched, files generated by lpmx or only useful at runtime are excluded
+	excludes := rwExcludes(&con)
+	temp_dir, temp_err := CreateTempDir(tempdir)
+	if temp_err != nil {
+		return temp_err
 	}
-	mdata["base"] = base
+	fmt.Println("taring rw layer...")
+	rw_tar_path := fmt.Sprintf("%s/%s", temp_dir, con.Id)
+	err = TarLayerCompress(con.RootPath, rw_tar_path, excludes, compression)
+	if err != nil {
+		return err
+	}
+	layer, err := DescribeLayer(rw_tar_path)
+	if err != nil {
+		return err
+	}
+	shasum := layer.Digest.Hex()
 
-	//workspace folder
-	workspace := fmt.Sprintf("%s/workspace", mdata["rootdir"])
-	if !FolderExist(workspace) {
-		MakeDir(workspace)
+	//step 3: store layer tarball inside image folder(LPMX/.lpmxdata/.image) and extract it into base folder
+	docker_path := filepath.Dir(con.BaseLayerPath)
+	image_dir := fmt.Sprintf("%s/.image", docker_path)
+	target_tar_path := fmt.Sprintf("%s/%s", image_dir, shasum)
+	if !FileExist(target_tar_path) {
+		rerr := os.Rename(rw_tar_path, target_tar_path)
+		if rerr != nil {
+			cerr := ErrNew(rerr, fmt.Sprintf("could not rename(move): %s to %s", rw_tar_path, target_tar_path))
+			return cerr
+		}
 	}
-	mdata["workspace"] = workspace
+	layer.File = target_tar_path
+
+	//base folder has the same name as the layer tarball
+	base_layer_path := fmt.Sprintf("%s/%s", con.BaseLayerPath, shasum)
+	if !FolderExist(base_layer_path) {
+		fmt.Println("extracting new layer...")
+		derr := os.MkdirAll(base_layer_path, os.FileMode(FOLDER_MODE))
+		if derr != nil {
+			cerr := ErrNew(derr, fmt.Sprintf("could not make dir %s", base_layer_path))
+			return cerr
+		}
+		//whiteout files are kept as they hide the deleted files of lower layers
+		err = extractLayer(target_tar_path, base_layer_path)
+		if err != nil {
+			os.RemoveAll(base_layer_path)
+			return err
+		}
+	}
+
+	//step 4: create new image
+	fmt.Println("updating image info...")
+	mdata := make(map[string]interface{})
+	mdata["rootdir"] = fmt.Sprintf("%s/%s/%s", docker_path, newname, newtag)
+	mdata["workspace"] = fmt.Sprintf("%s/workspace", mdata["rootdir"])
+	mdata["config"] = fmt.Sprintf("%s/setting.yml", mdata["rootdir"])
+	mdata["image"] = image_dir
+	mdata["base"] = fmt.Sprintf("%s/.base", docker_path)
+	mdata["imagetype"] = "Docker"
+	recordImageSource(mdata, fmt.Sprintf("commit:%s", id))
+	if !FolderExist(mdata["workspace"].(string)) {
+		derr := os.MkdirAll(mdata["workspace"].(string), os.FileMode(FOLDER_MODE))
+		if derr != nil {
+			cerr := ErrNew(derr, fmt.Sprintf("could not make dir %s", mdata["workspace"]))
+			return cerr
+		}
+	}
+	_, err = CopyFile(con.SettingPath, mdata["config"].(string))
+	if err != nil {
+		return err
+	}
+
+	AppendLayer(config, layer, fmt.Sprintf("lpmx commit %s", id), author, message)
+	if author != "" {
+		config.Author = author
+	}
+	err = SaveImageConfig(config, fmt.Sprintf("%s/%s", mdata["rootdir"], IMAGE_CONFIG))
+	if err != nil {
+		return err
+	}
+
+	//here we clone the original map
+	clone_map := CopyMap(old_map)
+	clone_map[target_tar_path] = layer.Size
+	mdata["layer"] = clone_map
+	mdata["layer_order"] = fmt.Sprintf("%s:%s", image_map["layer_order"].(string), target_tar_path)
+	//check if orig_layer_order exists
+	if val, ok := image_map["orig_layer_order"]; ok {
+		mdata["orig_layer_order"] = fmt.Sprintf("%s:%s", val.(string), target_tar_path)
+	}
+
+	doc.Images[newimage] = mdata
+	LOGGER.WithFields(logrus.Fields{
+		"doc":        doc,
+		"write_path": fmt.Sprintf("%s/.info", doc.RootDir),
+	}).Debug("DockerCommit, update image info")
+	err = marshalObj(doc.RootDir, &doc)
+	if err != nil {
+		return err
+	}
+
+	//start adding docinfo
+	var docinfo ImageInfo
+	docinfo.Name = newimage
+	docinfo.ImageType = "Docker"
+	docinfo.LayersMap = make(map[string]int64)
+	for key, value := range clone_map {
+		docinfo.LayersMap[path.Base(key)] = value.(int64)
+	}
+	//here we remove the absolute path, only keep shasum value
+	layersorder := strings.Split(mdata["layer_order"].(string), ":")
+	for idx, l := range layersorder {
+		layersorder[idx] = path.Base(l)
+	}
+	docinfo.Layers = strings.Join(layersorder, ":")
+
+	LOGGER.WithFields(logrus.Fields{
+		"docinfo":    docinfo,
+		"write_path": fmt.Sprintf("%s/.info", mdata["rootdir"].(string)),
+	}).Debug("DockerCommit, update docinfo info")
+	dinfodata, _ := StructMarshal(docinfo)
+	return WriteToFile(dinfodata, fmt.Sprintf("%s/.info", mdata["rootdir"].(string)))
+}
+
+//rwExcludes returns the paths inside the rw layer of container which are generated by lpmx or only useful at runtime, they are not exported
+func rwExcludes(con *Container) []string {
+	excludes := append([]string{"/tmp", "/.wh.tmp", "/etc/group", "/etc/passwd", "/var/lib/apt/lists", "/var/lib/dpkg"}, CACHE_FOLDER...)
+	for _, kv := range strings.Split(con.DataSyncMap, ":") {
+		if v := strings.Split(kv, "="); len(v) == 2 && len(v[1]) > 0 {
+			excludes = append(excludes, v[1])
+		}
+	}
+	return excludes
+}
+
+//commitImageConfig returns the image configuration of the committed image, it is loaded from image rootdir if it exists,
+//otherwise it is generated from the layers of image
+func commitImageConfig(image_map map[string]interface{}) (*ocispec.Image, *Error) {
+	if rootdir, ok := image_map["rootdir"].(string); ok {
+		config, err := LoadImageConfig(fmt.Sprintf("%s/%s", rootdir, IMAGE_CONFIG))
+		if err == nil {
+			return config, nil
+		}
+		if err.Err != ErrNExist {
+			return nil, err
+		}
+	}
+
+	layer_order, ok := image_map["layer_order"].(string)
+	if !ok {
+		cerr := ErrNew(ErrType, fmt.Sprintf("layer_order type is not right, actual: %T, want: string", image_map["layer_order"]))
+		return nil, cerr
+	}
+	var layers []*LayerDescriptor
+	for _, file := range strings.Split(layer_order, ":") {
+		if file == "" {
+			continue
+		}
+		layer, err := DescribeLayer(file)
+		if err != nil {
+			return nil, err
+		}
+		layers = append(layers, layer)
+	}
+	return RebaseImageConfig(nil, layers), nil
+}
+
+func DockerMerge(name, user, pass string) *Error {
+	currdir, err := GetConfigDir()
+	if err != nil {
+		return err
+	}
+	rootdir := fmt.Sprintf("%s/.lpmxdata", currdir)
+	sysdir := fmt.Sprintf("%s/.lpmxsys", currdir)
+	var doc Image
+	err = unmarshalObj(rootdir, &doc)
+	if err != nil && err.Err != ErrNExist {
+		return err
+	}
+	if err != nil && err.Err == ErrNExist {
+		ret, err := MakeDir(rootdir)
+		doc.RootDir = rootdir
+		doc.Images = make(map[string]interface{})
+		if !ret {
+			return err
+		}
+	}
+	if !strings.Contains(name, ":") {
+		name = name + ":latest"
+	}
+
+	mdata := make(map[string]interface{})
+	tdata := strings.Split(name, ":")
+	tname := tdata[0]
+	ttag := tdata[1]
+	mdata["rootdir"] = fmt.Sprintf("%s/%s/%s-merge", doc.RootDir, tname, ttag)
+	mdata["config"] = fmt.Sprintf("%s/setting.yml", mdata["rootdir"].(string))
+	mdata["image"] = fmt.Sprintf("%s/.image", rootdir)
+	image_dir, _ := mdata["image"].(string)
+	//name is something like "ubuntu:16.04"
+	var layer_order []string
+	if mdata_orig, ok := doc.Images[name]; ok {
+		if mdata_map, m_ok := mdata_orig.(map[string]interface{}); m_ok {
+			layer_order = strings.Split(mdata_map["layer_order"].(string), ":")
+		}
+	} else {
+		_, layer_order, err = DownloadLayers(user, pass, tname, ttag, image_dir)
+		if err != nil {
+			return err
+		}
+	}
+
+	//base folder
+	base := fmt.Sprintf("%s/.base", rootdir)
+	if !FolderExist(base) {
+		MakeDir(base)
+	}
+	mdata["base"] = base
+
+	//workspace folder
+	workspace := fmt.Sprintf("%s/workspace", mdata["rootdir"])
+	if !FolderExist(workspace) {
+		MakeDir(workspace)
+	}
+	mdata["workspace"] = workspace
 
 	//create temp folder
 	tmpdir, terr := CreateTempDir(mdata["base"].(string))
@@ -1592,7 +1614,7 @@ func DockerMerge(name, user, pass string) *Error {
 	rdir, _ := mdata["rootdir"].(string)
 
 	yaml := fmt.Sprintf("%s/distro.management.yml", sysdir)
-	err = DownloadFilefromGithubPlus(tname, ttag, "setting.yml", SETTING_URL, rdir, yaml)
+	err = DownloadFilefromGithubPlus(tname, ttag, "setting.yml", SettingURL(), rdir, yaml)
 	if err != nil {
 		LOGGER.WithFields(logrus.Fields{
 			"err":    err,
@@ -1603,25 +1625,29 @@ func DockerMerge(name, user, pass string) *Error {
 
 	//tar folder to tarball
 	LOGGER.Info("Start merging layers...please wait")
-	target_name := RandomString(10)
-	terr = TarLayer(tmpdir, image_dir, target_name, nil)
+	compression := COMPRESSION_GZIP
+	tar_image_path := fmt.Sprintf("%s/%s%s", image_dir, RandomString(10), CompressionExtension(compression))
+	terr = TarLayerCompress(tmpdir, tar_image_path, nil, compression)
 	if terr != nil {
 		return terr
 	}
 
-	tar_image_path := fmt.Sprintf("%s/%s.tar.gz", image_dir, target_name)
 	sha256, serr := Sha256file(tar_image_path)
 	if serr != nil {
 		return serr
 	}
 
-	//rename folder and file
-	new_folder_name := fmt.Sprintf("%s/%s.tar.gz", mdata["base"].(string), sha256)
-	new_image_name := fmt.Sprintf("%s/%s.tar.gz", mdata["image"].(string), sha256)
+	//rename folder and file, both are named by the digest of layer tarball
+	new_folder_name := fmt.Sprintf("%s/%s", mdata["base"].(string), sha256)
+	new_image_name := fmt.Sprintf("%s/%s", mdata["image"].(string), sha256)
 	rerr := Rename(tmpdir, new_folder_name)
 	if rerr != nil {
 		return rerr
 	}
+	rerr = dedupLayer(new_folder_name)
+	if rerr != nil {
+		return rerr
+	}
 	rerr = Rename(tar_image_path, new_image_name)
 	if rerr != nil {
 		return rerr
@@ -1645,6 +1671,7 @@ func DockerMerge(name, user, pass string) *Error {
 
 	//add image type
 	mdata["imagetype"] = "Docker"
+	recordImageSource(mdata, fmt.Sprintf("merge:%s", name))
 
 	//add docker info file(.info)
 	if !FolderExist(mdata["rootdir"].(string)) {
@@ -1682,8 +1709,7 @@ func DockerMerge(name, user, pass string) *Error {
 	LOGGER.WithFields(logrus.Fields{
 		"docinfo": doc,
 	}).Debug("DockerMerge, update docinfo info")
-	ddata, _ := StructMarshal(doc)
-	err = WriteToFile(ddata, fmt.Sprintf("%s/.info", doc.RootDir))
+	err = marshalObj(doc.RootDir, &doc)
 	if err != nil {
 		return err
 	}
@@ -1691,7 +1717,10 @@ func DockerMerge(name, user, pass string) *Error {
 	return nil
 }
 
-func SingularityLoad(file string, name string, tag string) *Error {
+//SingularityLoad loads sif file as image name:tag, the overlay partitions are applied as upper layers if overlay is true.
+//Environment, runscript and labels of sif are imported into image config. Signatures of sif are checked against keyrings
+//according to verify(VERIFY_AUTO, VERIFY_REQUIRE or VERIFY_SKIP), the default keyrings of singularity are used if keyrings is empty
+func SingularityLoad(file string, name string, tag string, overlay bool, verify int, keyrings []string) *Error {
 	currdir, err := GetConfigDir()
 	if err != nil {
 		return err
@@ -1712,6 +1741,12 @@ func SingularityLoad(file string, name string, tag string) *Error {
 		return cerr
 	}
 
+	//tampered images are refused before anything is extracted
+	err = CheckSifSignatures(file, verify, keyrings)
+	if err != nil {
+		return err
+	}
+
 	//configure Singularity related info locally
 	var sig Image
 	err = unmarshalObj(rootdir, &sig)
@@ -1746,6 +1781,38 @@ func SingularityLoad(file string, name string, tag string) *Error {
 		return lerr
 	}
 
+	//overlay partitions become the layers on top of system partition, in the order they are stored
+	overlays, err := ExtractOverlays(file, tmpdir)
+	if err != nil {
+		return err
+	}
+	overlay_layers := make(map[string]bool)
+	if len(overlays) > 0 && !overlay {
+		LOGGER.WithFields(logrus.Fields{
+			"file":     file,
+			"overlays": len(overlays),
+		}).Warn("overlay partitions of sif are skipped, use --overlay to apply them")
+		overlays = nil
+	}
+	for _, ov := range overlays {
+		ov_data, ov_order, oerr := LoadSquashfs(ov, image_dir)
+		if oerr != nil {
+			return oerr
+		}
+		for k, v := range ov_data {
+			ret[k] = v
+		}
+		for _, layer := range ov_order {
+			overlay_layers[path.Base(layer)] = true
+		}
+		layer_order = append(layer_order, ov_order...)
+	}
+
+	meta, err := ReadSifMetadata(file)
+	if err != nil {
+		return err
+	}
+
 	//step 3: generate necessary info
 	if _, ok := sig.Images[full_name]; ok {
 		cerr := ErrNew(ErrExist, fmt.Sprintf("%s already exists", full_name))
@@ -1760,6 +1827,7 @@ func SingularityLoad(file string, name string, tag string) *Error {
 		mdata["layer"] = ret
 		mdata["layer_order"] = strings.Join(layer_order, ":")
 		mdata["imagetype"] = "Singularity"
+		recordImageSource(mdata, fmt.Sprintf("sif:%s", file))
 
 		//add image info file(.info)
 		if !FolderExist(mdata["rootdir"].(string)) {
@@ -1818,17 +1886,40 @@ func SingularityLoad(file string, name string, tag string) *Error {
 				MakeDir(layerfolder)
 			}
 
-			err := Unsquashfs(tar_path, layerfolder)
+			var err *Error
+			if overlay_layers[k] {
+				err = ExtractFilesystem(tar_path, layerfolder, true)
+			} else {
+				err = Unsquashfs(tar_path, layerfolder)
+			}
+			if err != nil {
+				return err
+			}
+			err = dedupLayer(layerfolder)
 			if err != nil {
 				return err
 			}
 		}
 
-		//download setting from github
+		//run configuration of sif
 		rdir, _ := mdata["rootdir"].(string)
+		config := NewImageConfig()
+		config.Config.Env = meta.Environment
+		config.Config.Cmd = meta.RunCmd()
+		if len(meta.Labels) > 0 {
+			config.Config.Labels = meta.Labels
+		}
+		if meta.Arch != "" {
+			config.Architecture = meta.Arch
+		}
+		err = SaveImageConfig(config, fmt.Sprintf("%s/%s", rdir, IMAGE_CONFIG))
+		if err != nil {
+			return err
+		}
 
+		//download setting from github
 		yaml := fmt.Sprintf("%s/distro.management.yml", sysdir)
-		err = DownloadFilefromGithubPlus(tname, ttag, "setting.yml", SETTING_URL, rdir, yaml)
+		err = downloadSetting(tname, ttag, yaml, mdata)
 		if err != nil {
 			LOGGER.WithFields(logrus.Fields{
 				"err":    err,
@@ -1840,8 +1931,7 @@ func SingularityLoad(file string, name string, tag string) *Error {
 		//add map to this image
 		sig.Images[full_name] = mdata
 
-		ddata, _ := StructMarshal(sig)
-		err = WriteToFile(ddata, fmt.Sprintf("%s/.info", sig.RootDir))
+		err = marshalObj(sig.RootDir, &sig)
 		if err != nil {
 			return err
 		}
@@ -1856,7 +1946,6 @@ func SkopeoLoad(name, dir string) *Error {
 		return err
 	}
 	rootdir := fmt.Sprintf("%s/.lpmxdata", currdir)
-	sysdir := fmt.Sprintf("%s/.lpmxsys", currdir)
 	tempdir := fmt.Sprintf("%s/.temp", currdir)
 	//we delete temp dir if it exists at the end of the function
 	defer func() {
@@ -1897,107 +1986,7 @@ func SkopeoLoad(name, dir string) *Error {
 	if lerr != nil {
 		return lerr
 	}
-	if _, ok := doc.Images[name]; ok {
-		cerr := ErrNew(ErrExist, fmt.Sprintf("%s already exists", name))
-		return cerr
-	} else {
-		tdata := strings.Split(name, ":")
-		tname := tdata[0]
-		ttag := tdata[1]
-		mdata := make(map[string]interface{})
-		mdata["rootdir"] = fmt.Sprintf("%s/%s/%s", doc.RootDir, tname, ttag)
-		mdata["config"] = fmt.Sprintf("%s/setting.yml", mdata["rootdir"].(string))
-		mdata["image"] = fmt.Sprintf("%s/.image", rootdir)
-		mdata["layer"] = ret
-		mdata["layer_order"] = strings.Join(layer_order, ":")
-		mdata["imagetype"] = "Docker"
-
-		//add docker info file(.info)
-		if !FolderExist(mdata["rootdir"].(string)) {
-			merr := os.MkdirAll(mdata["rootdir"].(string), os.FileMode(FOLDER_MODE))
-			if merr != nil {
-				cerr := ErrNew(merr, fmt.Sprintf("could not mkdir %s", mdata["rootdir"].(string)))
-				return cerr
-			}
-		}
-		var docinfo ImageInfo
-		docinfo.Name = name
-		docinfo.ImageType = "Docker"
-		// layer_order is absolute path
-		//docinfo layers map should remove absolute path of host
-		layersmap := make(map[string]int64)
-		for k, v := range ret {
-			layersmap[path.Base(k)] = v
-		}
-		docinfo.LayersMap = layersmap
-
-		var layer_sha []string
-		for _, layer := range layer_order {
-			layer_sha = append(layer_sha, path.Base(layer))
-		}
-		docinfo.Layers = strings.Join(layer_sha, ":")
-
-		LOGGER.WithFields(logrus.Fields{
-			"docinfo": docinfo,
-		}).Debug("Skopeo debug, docinfo debug")
-
-		dinfodata, _ := StructMarshal(docinfo)
-		err = WriteToFile(dinfodata, fmt.Sprintf("%s/.info", mdata["rootdir"].(string)))
-		if err != nil {
-			return err
-		}
-		//end
-
-		workspace := fmt.Sprintf("%s/workspace", mdata["rootdir"])
-		if !FolderExist(workspace) {
-			MakeDir(workspace)
-		}
-		mdata["workspace"] = workspace
-
-		//extract layers
-		base := fmt.Sprintf("%s/.base", rootdir)
-		if !FolderExist(base) {
-			MakeDir(base)
-		}
-		mdata["base"] = base
-
-		for _, k := range layer_order {
-			k = path.Base(k)
-			tar_path := fmt.Sprintf("%s/%s", image_dir, k)
-			layerfolder := fmt.Sprintf("%s/%s", mdata["base"], k)
-			if !FolderExist(layerfolder) {
-				MakeDir(layerfolder)
-			}
-
-			err := Untar(tar_path, layerfolder)
-			if err != nil {
-				return err
-			}
-		}
-
-		//download setting from github
-		rdir, _ := mdata["rootdir"].(string)
-
-		yaml := fmt.Sprintf("%s/distro.management.yml", sysdir)
-		err = DownloadFilefromGithubPlus(tname, ttag, "setting.yml", SETTING_URL, rdir, yaml)
-		if err != nil {
-			LOGGER.WithFields(logrus.Fields{
-				"err":    err,
-				"toPath": rdir,
-			}).Error("Download setting from github failure and could not rollback to default one")
-			return err
-		}
-
-		//add map to this image
-		doc.Images[name] = mdata
-
-		ddata, _ := StructMarshal(doc)
-		err = WriteToFile(ddata, fmt.Sprintf("%s/.info", doc.RootDir))
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+	return registerDockerImage(&doc, name, fmt.Sprintf("skopeo:%s", adir), ret, layer_order, nil)
 }
 
 func DockerLoad(file string) *Error {
@@ -2006,7 +1995,6 @@ func DockerLoad(file string) *Error {
 		return err
 	}
 	rootdir := fmt.Sprintf("%s/.lpmxdata", currdir)
-	sysdir := fmt.Sprintf("%s/.lpmxsys", currdir)
 	tempdir := fmt.Sprintf("%s/.temp", currdir)
 	//we delete temp dir if it exists at the end of the function
 	defer func() {
@@ -2059,134 +2047,189 @@ func DockerLoad(file string) *Error {
 	if lerr != nil {
 		return lerr
 	}
-	if _, ok := doc.Images[name]; ok {
-		cerr := ErrNew(ErrExist, fmt.Sprintf("%s already exists", name))
-		return cerr
-	} else {
-		tdata := strings.Split(name, ":")
-		tname := tdata[0]
-		ttag := tdata[1]
-		mdata := make(map[string]interface{})
-		mdata["rootdir"] = fmt.Sprintf("%s/%s/%s", doc.RootDir, tname, ttag)
-		mdata["config"] = fmt.Sprintf("%s/setting.yml", mdata["rootdir"].(string))
-		mdata["image"] = fmt.Sprintf("%s/.image", rootdir)
-		mdata["layer"] = ret
-		mdata["layer_order"] = strings.Join(layer_order, ":")
-		mdata["imagetype"] = "Docker"
+	return registerDockerImage(&doc, name, fmt.Sprintf("docker-archive:%s", afile), ret, layer_order, nil)
+}
 
-		//add docker info file(.info)
-		if !FolderExist(mdata["rootdir"].(string)) {
-			merr := os.MkdirAll(mdata["rootdir"].(string), os.FileMode(FOLDER_MODE))
-			if merr != nil {
-				cerr := ErrNew(merr, fmt.Sprintf("could not mkdir %s", mdata["rootdir"].(string)))
-				return cerr
-			}
-		}
-		var docinfo ImageInfo
-		docinfo.Name = name
-		docinfo.ImageType = "Docker"
-		// layer_order is absolute path
-		//docinfo layers map should remove absolute path of host
-		layersmap := make(map[string]int64)
-		for k, v := range ret {
-			layersmap[path.Base(k)] = v
+//OCILoad imports oci image layout directory or oci-archive tarball, name selects the image if it contains several ones,
+//it could be empty if the image name is recorded inside the layout
+func OCILoad(file, name string) *Error {
+	currdir, err := GetConfigDir()
+	if err != nil {
+		return err
+	}
+	rootdir := fmt.Sprintf("%s/.lpmxdata", currdir)
+	tempdir := fmt.Sprintf("%s/.temp", currdir)
+	//we delete temp dir if it exists at the end of the function
+	defer func() {
+		if FolderExist(tempdir) {
+			os.RemoveAll(tempdir)
 		}
-		docinfo.LayersMap = layersmap
+	}()
 
-		var layer_sha []string
-		for _, layer := range layer_order {
-			layer_sha = append(layer_sha, path.Base(layer))
-		}
-		docinfo.Layers = strings.Join(layer_sha, ":")
+	afile, ferr := filepath.Abs(file)
+	if ferr != nil {
+		cerr := ErrNew(ferr, fmt.Sprintf("could not parse to the absolute path: %s", file))
+		return cerr
+	}
 
-		LOGGER.WithFields(logrus.Fields{
-			"docinfo": docinfo,
-		}).Debug("DockerLoad debug, docinfo debug")
+	//configure Docker related info locally
+	var doc Image
+	err = unmarshalObj(rootdir, &doc)
+	if err != nil && err.Err != ErrNExist {
+		return err
+	}
 
-		dinfodata, _ := StructMarshal(docinfo)
-		err = WriteToFile(dinfodata, fmt.Sprintf("%s/.info", mdata["rootdir"].(string)))
-		if err != nil {
+	if err != nil && err.Err == ErrNExist {
+		ret, err := MakeDir(rootdir)
+		doc.RootDir = rootdir
+		doc.Images = make(map[string]interface{})
+		if !ret {
 			return err
 		}
-		//end
+	}
 
-		workspace := fmt.Sprintf("%s/workspace", mdata["rootdir"])
-		if !FolderExist(workspace) {
-			MakeDir(workspace)
+	//oci-archive is extracted firstly
+	layout := afile
+	if !FolderExist(afile) {
+		if !FileExist(afile) {
+			cerr := ErrNew(ErrNExist, fmt.Sprintf("%s does not exist", afile))
+			return cerr
 		}
-		mdata["workspace"] = workspace
-
-		/**
-		patchfolder := fmt.Sprintf("%s/patch", mdata["rootdir"])
-		if !FolderExist(patchfolder) {
-			MakeDir(patchfolder)
+		tmpdir, terr := CreateTempDir(tempdir)
+		if terr != nil {
+			return terr
 		}
-		**/
-
-		//extract layers
-		base := fmt.Sprintf("%s/.base", rootdir)
-		if !FolderExist(base) {
-			MakeDir(base)
+		uerr := Untar(afile, tmpdir)
+		if uerr != nil {
+			return uerr
 		}
-		mdata["base"] = base
+		layout = tmpdir
+	}
 
-		for _, k := range layer_order {
-			k = path.Base(k)
-			tar_path := fmt.Sprintf("%s/%s", image_dir, k)
-			layerfolder := fmt.Sprintf("%s/%s", mdata["base"], k)
-			if !FolderExist(layerfolder) {
-				MakeDir(layerfolder)
-			}
+	image_dir := fmt.Sprintf("%s/.image", rootdir)
+	if !FolderExist(image_dir) {
+		MakeDir(image_dir)
+	}
+	name, ret, layer_order, config, lerr := LoadOCILayout(layout, image_dir, name)
+	if lerr != nil {
+		return lerr
+	}
+	return registerDockerImage(&doc, name, fmt.Sprintf("oci:%s", afile), ret, layer_order, config)
+}
 
-			err := Untar(tar_path, layerfolder)
-			if err != nil {
-				return err
-			}
-		}
+//registerDockerImage records the layers stored inside $/.lpmxdata/.image as docker image name, extracts them into base folder and fetches setting.yml,
+//source describes where the image comes from, config is the image configuration, it could be nil if the source does not provide it
+func registerDockerImage(doc *Image, name, source string, ret map[string]int64, layer_order []string, config *ocispec.Image) *Error {
+	if _, ok := doc.Images[name]; ok {
+		cerr := ErrNew(ErrExist, fmt.Sprintf("%s already exists", name))
+		return cerr
+	}
+	currdir, err := GetConfigDir()
+	if err != nil {
+		return err
+	}
+	sysdir := fmt.Sprintf("%s/.lpmxsys", currdir)
+	image_dir := fmt.Sprintf("%s/.image", doc.RootDir)
 
-		//download setting from github
-		rdir, _ := mdata["rootdir"].(string)
+	tdata := strings.Split(name, ":")
+	tname := tdata[0]
+	ttag := tdata[1]
+	mdata := make(map[string]interface{})
+	mdata["rootdir"] = fmt.Sprintf("%s/%s/%s", doc.RootDir, tname, ttag)
+	mdata["config"] = fmt.Sprintf("%s/setting.yml", mdata["rootdir"].(string))
+	mdata["image"] = image_dir
+	mdata["layer"] = ret
+	mdata["layer_order"] = strings.Join(layer_order, ":")
+	mdata["imagetype"] = "Docker"
+	recordImageSource(mdata, source)
 
-		yaml := fmt.Sprintf("%s/distro.management.yml", sysdir)
-		err = DownloadFilefromGithubPlus(tname, ttag, "setting.yml", SETTING_URL, rdir, yaml)
-		if err != nil {
-			LOGGER.WithFields(logrus.Fields{
-				"err":    err,
-				"toPath": rdir,
-			}).Error("Download setting from github failure and could not rollback to default one")
-			return err
+	//add docker info file(.info)
+	if !FolderExist(mdata["rootdir"].(string)) {
+		merr := os.MkdirAll(mdata["rootdir"].(string), os.FileMode(FOLDER_MODE))
+		if merr != nil {
+			cerr := ErrNew(merr, fmt.Sprintf("could not mkdir %s", mdata["rootdir"].(string)))
+			return cerr
 		}
+	}
+	var docinfo ImageInfo
+	docinfo.Name = name
+	docinfo.ImageType = "Docker"
+	// layer_order is absolute path
+	//docinfo layers map should remove absolute path of host
+	layersmap := make(map[string]int64)
+	for k, v := range ret {
+		layersmap[path.Base(k)] = v
+	}
+	docinfo.LayersMap = layersmap
 
-		/**
-		//here we start downloading patch tar ball to rdir/patch folder
-		pdir := fmt.Sprintf("%s/patch", rdir)
-		//save patch.tar.gz into rdir and untar it to pdir
-		err = DownloadFilefromGithubPlus(tname, ttag, "patch.tar.gz", SETTING_URL, rdir, yaml)
+	var layer_sha []string
+	for _, layer := range layer_order {
+		layer_sha = append(layer_sha, path.Base(layer))
+	}
+	docinfo.Layers = strings.Join(layer_sha, ":")
+
+	LOGGER.WithFields(logrus.Fields{
+		"docinfo": docinfo,
+	}).Debug("registerDockerImage debug, docinfo debug")
+
+	dinfodata, _ := StructMarshal(docinfo)
+	err = WriteToFile(dinfodata, fmt.Sprintf("%s/.info", mdata["rootdir"].(string)))
+	if err != nil {
+		return err
+	}
+	//end
+
+	if config != nil {
+		err = SaveImageConfig(config, fmt.Sprintf("%s/%s", mdata["rootdir"].(string), IMAGE_CONFIG))
 		if err != nil {
-			LOGGER.WithFields(logrus.Fields{
-				"err":    err,
-				"toPath": rdir,
-			}).Error("Download patch.tar.gz from github failure and could not rollback to default one")
 			return err
-		} else {
-			//if download success, we have to untar it
-			err = Untar(fmt.Sprintf("%s/patch.tar.gz", rdir), pdir)
-			if err != nil {
-				return err
-			}
 		}
-		**/
+	}
 
-		//add map to this image
-		doc.Images[name] = mdata
+	workspace := fmt.Sprintf("%s/workspace", mdata["rootdir"])
+	if !FolderExist(workspace) {
+		MakeDir(workspace)
+	}
+	mdata["workspace"] = workspace
+
+	//extract layers
+	base := fmt.Sprintf("%s/.base", doc.RootDir)
+	if !FolderExist(base) {
+		MakeDir(base)
+	}
+	mdata["base"] = base
+
+	for _, k := range layer_order {
+		k = path.Base(k)
+		tar_path := fmt.Sprintf("%s/%s", image_dir, k)
+		layerfolder := fmt.Sprintf("%s/%s", mdata["base"], k)
+		if !FolderExist(layerfolder) {
+			MakeDir(layerfolder)
+		}
 
-		ddata, _ := StructMarshal(doc)
-		err = WriteToFile(ddata, fmt.Sprintf("%s/.info", doc.RootDir))
+		err := extractLayer(tar_path, layerfolder)
 		if err != nil {
 			return err
 		}
 	}
-	return nil
+
+	//download setting from github
+	rdir, _ := mdata["rootdir"].(string)
+
+	yaml := fmt.Sprintf("%s/distro.management.yml", sysdir)
+	err = downloadSetting(tname, ttag, yaml, mdata)
+	if err != nil {
+		LOGGER.WithFields(logrus.Fields{
+			"err":    err,
+			"toPath": rdir,
+		}).Error("Download setting from github failure and could not rollback to default one")
+		return err
+	}
+
+	//add map to this image
+	doc.Images[name] = mdata
+
+	return marshalObj(doc.RootDir, doc)
 }
 
 func DockerDownload(name string, user string, pass string) *Error {
@@ -2234,6 +2277,10 @@ func DockerDownload(name string, user string, pass string) *Error {
 		mdata["layer"] = ret
 		mdata["layer_order"] = strings.Join(layer_order, ":")
 		mdata["imagetype"] = "Docker"
+		recordImageSource(mdata, fmt.Sprintf("registry:%s", name))
+		if digest, derr := GetDigest(user, pass, tname, ttag); derr == nil {
+			mdata["digest"] = digest
+		}
 
 		//add docker info file(.info)
 		if !FolderExist(mdata["rootdir"].(string)) {
@@ -2298,7 +2345,7 @@ func DockerDownload(name string, user string, pass string) *Error {
 				MakeDir(layerfolder)
 			}
 
-			err := Untar(tar_path, layerfolder)
+			err := extractLayer(tar_path, layerfolder)
 			if err != nil {
 				return err
 			}
@@ -2308,7 +2355,7 @@ func DockerDownload(name string, user string, pass string) *Error {
 		rdir, _ := mdata["rootdir"].(string)
 
 		yaml := fmt.Sprintf("%s/distro.management.yml", sysdir)
-		err = DownloadFilefromGithubPlus(tname, ttag, "setting.yml", SETTING_URL, rdir, yaml)
+		err = downloadSetting(tname, ttag, yaml, mdata)
 		if err != nil {
 			LOGGER.WithFields(logrus.Fields{
 				"err":    err,
@@ -2322,7 +2369,7 @@ func DockerDownload(name string, user string, pass string) *Error {
 		//here we start downloading patch tar ball to rdir/patch folder
 		pdir := fmt.Sprintf("%s/patch", rdir)
 		//save patch.tar.gz into rdir and untar it to pdir
-		err = DownloadFilefromGithubPlus(tname, ttag, "patch.tar.gz", SETTING_URL, rdir, yaml)
+		err = DownloadFilefromGithubPlus(tname, ttag, "patch.tar.gz", SettingURL(), rdir, yaml)
 		if err != nil {
 			LOGGER.WithFields(logrus.Fields{
 				"err":    err,
@@ -2347,8 +2394,7 @@ func DockerDownload(name string, user string, pass string) *Error {
 		LOGGER.WithFields(logrus.Fields{
 			"doc": doc,
 		}).Debug("DockerDownload debug, add image info to global images")
-		ddata, _ := StructMarshal(doc)
-		err = WriteToFile(ddata, fmt.Sprintf("%s/.info", doc.RootDir))
+		err = marshalObj(doc.RootDir, &doc)
 		if err != nil {
 			return err
 		}
@@ -2378,57 +2424,94 @@ func DockerPush(user string, pass string, name string, tag string, id string) *E
 				pidfile := fmt.Sprintf("%s/container.pid", path.Dir(con.RootPath))
 
 				if pok, _ := PidIsActive(pidfile); !pok {
-					//parameters are src/target folder, target file name, and layer paths
 					//step 1: tar rw layer
 					layers := strings.Split(con.Layers, ":")
 					layers = layers[1:]
-					layers_full_path := []string{con.RootPath}
-					for _, layer := range layers {
-						layers_full_path = append(layers_full_path, fmt.Sprintf("%s/%s", con.BaseLayerPath, layer))
-					}
 					fmt.Println("taring rw layers...")
-					cerr := TarLayer(con.RootPath, "/tmp", con.Id, layers_full_path)
+					compression := COMPRESSION_GZIP
+					src_tar_path := fmt.Sprintf("/tmp/%s%s", con.Id, CompressionExtension(compression))
+					cerr := TarLayerCompress(con.RootPath, src_tar_path, nil, compression)
+					if cerr != nil {
+						return cerr
+					}
+					defer os.Remove(src_tar_path)
+
+					//step 2: describe all layers from the bottom to the top, the rw layer is the last one
+					image_dir := fmt.Sprintf("%s/.image", filepath.Dir(con.BaseLayerPath))
+					var descriptors []*LayerDescriptor
+					for _, layer := range ReverseStrArray(layers) {
+						descriptor, cerr := DescribeLayer(fmt.Sprintf("%s/%s", image_dir, layer))
+						if cerr != nil {
+							return cerr
+						}
+						descriptors = append(descriptors, descriptor)
+					}
+					rw_descriptor, cerr := DescribeLayer(src_tar_path)
 					if cerr != nil {
 						return cerr
 					}
-					//step 2: upload this tar ball to docker hub and backup inside lpmx
+
+					//step 3: generate image config based on the one of base image if it is available
+					var base_config *ocispec.Image
+					mount_from := ""
+					if strings.EqualFold(con.BaseType, "Docker") {
+						base_info := strings.Split(con.ImageBase, ":")
+						if len(base_info) == 2 {
+							base_config, cerr = FetchImageConfig(user, pass, base_info[0], base_info[1])
+							if cerr != nil {
+								LOGGER.WithFields(logrus.Fields{
+									"image": con.ImageBase,
+									"err":   cerr.Error(),
+								}).Warn("could not fetch base image config, will generate a new one")
+							}
+							mount_from = base_info[0]
+						}
+					}
+					config := RebaseImageConfig(base_config, descriptors)
+					AppendLayer(config, rw_descriptor, fmt.Sprintf("lpmx push from container %s", con.Id), user, "")
+
+					//step 4: upload missing layers, config and manifest
 					fmt.Println("uploading layers...")
-					shasum, cerr := UploadLayers(user, pass, name, tag, fmt.Sprintf("/tmp/%s.tar.gz", con.Id), con.ImageBase)
+					manifest_digest, cerr := PushImage(user, pass, name, tag, append(descriptors, rw_descriptor), config, mount_from)
 					if cerr != nil {
 						return cerr
 					}
-					image_dir := fmt.Sprintf("%s/image", filepath.Dir(con.BaseLayerPath))
-					src_tar_path := fmt.Sprintf("/tmp/%s.tar.gz", con.Id)
+					fmt.Println(fmt.Sprintf("pushed %s:%s with digest %s", name, tag, manifest_digest))
+
+					//step 5: backup the pushed layer inside lpmx, froze rw layer and create new rw layer
+					shasum := rw_descriptor.Digest.Hex()
 					target_tar_path := fmt.Sprintf("%s/%s", image_dir, shasum)
-					err := os.Rename(src_tar_path, target_tar_path)
-					if err != nil {
-						cerr := ErrNew(err, fmt.Sprintf("could not rename(move): %s to %s", src_tar_path, target_tar_path))
+					_, cerr = CopyFile(src_tar_path, target_tar_path)
+					if cerr != nil {
 						return cerr
 					}
 
-					err = os.Rename(con.RootPath, fmt.Sprintf("%s/%s", con.BaseLayerPath, shasum))
+					err := os.Rename(con.RootPath, fmt.Sprintf("%s/%s", con.BaseLayerPath, shasum))
 					if err != nil {
 						cerr := ErrNew(err, fmt.Sprintf("could not rename(move): %s to %s", con.RootPath, fmt.Sprintf("%s/%s", con.BaseLayerPath, shasum)))
 						return cerr
 					}
-					//step 3: froze rw layer and create new rw layer
+					err = os.Symlink(fmt.Sprintf("%s/%s", con.BaseLayerPath, shasum), fmt.Sprintf("%s/%s", filepath.Dir(con.RootPath), shasum))
+					if err != nil {
+						cerr := ErrNew(err, fmt.Sprintf("could not create symlink of layer %s", shasum))
+						return cerr
+					}
 					fmt.Println("cleaning up...")
 					err = os.Mkdir(con.RootPath, os.FileMode(FOLDER_MODE))
 					if err != nil {
 						cerr := ErrNew(err, fmt.Sprintf("could not make new folder: %s", con.RootPath))
 						return cerr
 					}
-					//step 4: modify container info
+					//step 6: modify container info
 					new_layers := []string{"rw", shasum}
 					new_layers = append(new_layers, layers...)
 					con.Layers = strings.Join(new_layers, ":")
+					con.ImageBase = fmt.Sprintf("%s:%s", name, tag)
 
-					data, _ := StructMarshal(&con)
-					cerr = WriteToFile(data, fmt.Sprintf("%s/.info", con.ConfigPath))
+					cerr = marshalObj(con.ConfigPath, &con)
 					if cerr != nil {
 						return cerr
 					}
-					con.ImageBase = fmt.Sprintf("%s:%s", name, tag)
 					con.appendToSys()
 					//done
 				} else {
@@ -2505,7 +2588,7 @@ func DockerReset(name string) *Error {
 					MakeDir(layerfolder)
 				}
 
-				err := Untar(tar_path, layerfolder)
+				err := extractLayer(tar_path, layerfolder)
 				if err != nil {
 					return err
 				}
@@ -2518,6 +2601,57 @@ func DockerReset(name string) *Error {
 	return err
 }
 
+func DockerSave(name, target, format string) *Error {
+	if !strings.Contains(name, ":") {
+		name = name + ":latest"
+	}
+	currdir, err := GetConfigDir()
+	if err != nil {
+		return err
+	}
+	rootdir := fmt.Sprintf("%s/.lpmxdata", currdir)
+	var doc Image
+	err = unmarshalObj(rootdir, &doc)
+	if err != nil {
+		return err
+	}
+	name_data, name_ok := doc.Images[name].(map[string]interface{})
+	if !name_ok {
+		cerr := ErrNew(ErrNExist, fmt.Sprintf("name: %s is not found", name))
+		return cerr
+	}
+	if imagetype, _ := name_data["imagetype"].(string); imagetype != "Docker" {
+		cerr := ErrNew(ErrType, fmt.Sprintf("%s is a %s image, only Docker images could be saved", name, imagetype))
+		return cerr
+	}
+
+	image_dir, _ := name_data["image"].(string)
+	layer_order, _ := name_data["layer_order"].(string)
+	var layers []string
+	for _, k := range strings.Split(layer_order, ":") {
+		if k != "" {
+			layers = append(layers, fmt.Sprintf("%s/%s", image_dir, path.Base(k)))
+		}
+	}
+
+	//image config is recorded by lpmx, e.g, commit, older images do not have it
+	var config *ocispec.Image
+	if rdir, ok := name_data["rootdir"].(string); ok {
+		config, err = LoadImageConfig(fmt.Sprintf("%s/%s", rdir, IMAGE_CONFIG))
+		if err != nil && err.Err != ErrNExist {
+			return err
+		}
+	}
+
+	atarget, aerr := filepath.Abs(target)
+	if aerr != nil {
+		cerr := ErrNew(aerr, fmt.Sprintf("could not parse to the absolute path: %s", target))
+		return cerr
+	}
+	fmt.Printf("saving %s to %s in %s format...\n", name, atarget, format)
+	return SaveImage(name, layers, config, format, atarget)
+}
+
 func CommonFastRun(name, volume_map, engine, execmaps, mountfile string, env *map[string]string, args ...string) *Error {
 	configmap, err := generateContainer(name, "", volume_map, engine, mountfile)
 	if err != nil {
@@ -2527,7 +2661,7 @@ func CommonFastRun(name, volume_map, engine, execmaps, mountfile string, env *ma
 	if len(execmaps) > 0 {
 		(*configmap)["execmaps"] = execmaps
 	}
-	err = Run(configmap, env, args...)
+	err = Run(configmap, env, defaultArgs(configmap, args)...)
 	//remove container
 	if err != nil {
 		err = Destroy(id)
@@ -2537,17 +2671,86 @@ func CommonFastRun(name, volume_map, engine, execmaps, mountfile string, env *ma
 	return err
 }
 
-func CommonComposeRun(name, container_name, volume_map, execmaps, mountfile, command string, env *map[string]string) (string, *Error) {
+func CommonComposeRun(ctx context.Context, name, container_name, volume_map, execmaps, mountfile, command, hash string, env *map[string]string, stdout, stderr io.Writer, health *HealthCheck, healthy func()) (string, *Error) {
+	composeLock.Lock()
 	configmap, err := generateContainer(name, container_name, volume_map, "", mountfile)
+	composeLock.Unlock()
 	if err != nil {
 		return "", err
 	}
 	if len(execmaps) > 0 {
 		(*configmap)["execmaps"] = execmaps
 	}
+	(*configmap)["compose_hash"] = hash
+	setComposeRuntime(configmap, ctx, stdout, stderr, health, healthy)
+
+	err = Run(configmap, env, defaultArgs(configmap, commandArgs(command))...)
+	return (*configmap)["id"].(string), err
+}
+
+//commandArgs splits command of compose app into args, empty command has no args
+func commandArgs(command string) []string {
+	if command == "" {
+		return nil
+	}
+	return strings.Split(command, " ")
+}
+
+//defaultArgs returns args if they are given, otherwise the default command of image(entrypoint followed by cmd) like docker run does,
+//e.g, the runscript of singularity images. Images without configuration have no default command and nil is returned
+func defaultArgs(configmap *map[string]interface{}, args []string) []string {
+	if len(args) > 0 {
+		return args
+	}
+	setting_path, _ := (*configmap)["config"].(string)
+	config, err := LoadImageConfig(fmt.Sprintf("%s/%s", filepath.Dir(setting_path), IMAGE_CONFIG))
+	if err != nil {
+		return nil
+	}
+	var cmd []string
+	cmd = append(cmd, config.Config.Entrypoint...)
+	cmd = append(cmd, config.Config.Cmd...)
+	for _, arg := range cmd {
+		args = append(args, ShellQuote(arg))
+	}
+	return args
+}
+
+//CommonComposeResume runs the command of compose app inside the existing container
+func CommonComposeResume(ctx context.Context, id, command string, env *map[string]string, stdout, stderr io.Writer, health *HealthCheck, healthy func()) *Error {
+	currdir, err := GetConfigDir()
+	if err != nil {
+		return err
+	}
+	var sys Sys
+	err = unmarshalObj(fmt.Sprintf("%s/.lpmxsys", currdir), &sys)
+	if err != nil {
+		return err
+	}
+	v, ok := sys.Containers[id].(map[string]interface{})
+	if !ok {
+		cerr := ErrNew(ErrNExist, fmt.Sprintf("conatiner with id: %s doesn't exist", id))
+		return cerr
+	}
+
+	var con Container
+	err = unmarshalObj(v["ConfigPath"].(string), &con)
+	if err != nil {
+		return err
+	}
+	configmap := con.resumeConfig()
+	setComposeRuntime(&configmap, ctx, stdout, stderr, health, healthy)
+	return Run(&configmap, env, defaultArgs(&configmap, commandArgs(command))...)
+}
 
-	err = Run(configmap, env, strings.Split(command," ")...)
-	return (*configmap)["id"].(string), nil
+func setComposeRuntime(configmap *map[string]interface{}, ctx context.Context, stdout, stderr io.Writer, health *HealthCheck, healthy func()) {
+	(*configmap)["context"] = ctx
+	(*configmap)["stdout"] = stdout
+	(*configmap)["stderr"] = stderr
+	if health != nil {
+		(*configmap)["healthcheck"] = health
+		(*configmap)["healthy"] = healthy
+	}
 }
 
 //create container based on images
@@ -2608,8 +2811,17 @@ func CommonDelete(name string, permernant bool) *Error {
 					image_dir := vval["image"].(string)
 					base_dir := vval["base"].(string)
 					layer_order := vval["layer_order"].(string)
+					//layers still used by other images, e.g, tags or committed images, are kept
+					refs := layerRefCount(&doc, name)
 					for _, layer := range strings.Split(layer_order, ":") {
 						layer_name := filepath.Base(layer)
+						if refs[layer_name] > 0 {
+							LOGGER.WithFields(logrus.Fields{
+								"layer":      layer_name,
+								"references": refs[layer_name],
+							}).Debug("Docker delete, layer is still used by other images")
+							continue
+						}
 						LOGGER.WithFields(logrus.Fields{
 							"folder to delete": fmt.Sprintf("%s/%s", base_dir, layer_name),
 							"file to delete":   fmt.Sprintf("%s/%s", image_dir, layer_name),
@@ -2623,13 +2835,17 @@ func CommonDelete(name string, permernant bool) *Error {
 							return rerr
 						}
 					}
+					//objects only used by deleted layers are released
+					rerr := gcObjects(base_dir)
+					if rerr != nil {
+						return rerr
+					}
 				}
 				dir, _ := vval["rootdir"].(string)
 				rok, rerr := RemoveAll(dir)
 				if rok {
 					delete(doc.Images, name)
-					ddata, _ := StructMarshal(doc)
-					err = WriteToFile(ddata, fmt.Sprintf("%s/.info", doc.RootDir))
+					err = marshalObj(doc.RootDir, &doc)
 					if err != nil {
 						return err
 					}
@@ -2660,12 +2876,8 @@ func Expose(id string, ipath string, name string) *Error {
 				var con Container
 				info := fmt.Sprintf("%s/.lpmx/.info", filepath.Dir(val["RootPath"].(string)))
 				if FileExist(info) {
-					data, err := ReadFromFile(info)
+					err := unmarshalObj(filepath.Dir(info), &con)
 					if err == nil {
-						err := StructUnmarshal(data, &con)
-						if err != nil {
-							return err
-						}
 						if !strings.Contains(con.ExposeExe, ipath) {
 							if con.ExposeExe == "" {
 								con.ExposeExe = ipath
@@ -2693,8 +2905,12 @@ func Expose(id string, ipath string, name string) *Error {
 							return cerr
 						}
 
-						ppath := fmt.Sprintf("%s/%s", currdir, os.Args[0])
-						ppath = path.Clean(ppath)
+						//wrappers locate lpmx relative to themselves, so that they keep working after lpmx directory is moved
+						ppath := fmt.Sprintf("\"$(dirname \"$(readlink -f \"$0\")\")/../%s\"", path.Base(os.Args[0]))
+						//lpmx may live outside of its root when LPMX_HOME is used, then wrappers call it by absolute path and pass the root
+						if exe, eerr := os.Executable(); eerr == nil && filepath.Dir(exe) != currdir {
+							ppath = fmt.Sprintf("%s=\"$(dirname \"$(readlink -f \"$0\")\")/..\" \"%s\"", ENV_LPMX_HOME, exe)
+						}
 						code := "#!/bin/bash\n" + ppath +
 							" resume " + id + " -- " + ipath + " " + "\"$@\"" +
 							"\n"
@@ -2703,8 +2919,9 @@ func Expose(id string, ipath string, name string) *Error {
 						defer f.Close()
 
 						//write back
-						data, _ := StructMarshal(&con)
-						WriteToFile(data, fmt.Sprintf("%s/.info", con.ConfigPath))
+						marshalObj(con.ConfigPath, &con)
+					} else {
+						return err
 					}
 				} else {
 					cerr := ErrNew(ErrNExist, fmt.Sprintf("%s/.info doesn't exist", val["RootPath"].(string)))
@@ -2728,6 +2945,27 @@ func Expose(id string, ipath string, name string) *Error {
 container methods
 **/
 
+//resumeConfig generates the configmap used by Run for starting an existing container again
+func (con *Container) resumeConfig() map[string]interface{} {
+	configmap := make(map[string]interface{})
+	configmap["dir"] = con.RootPath
+	configmap["config"] = con.SettingPath
+	configmap["passive"] = false
+	configmap["docker"] = true
+	configmap["layers"] = con.Layers
+	configmap["id"] = con.Id
+	configmap["image"] = con.ImageBase
+	configmap["baselayerpath"] = con.BaseLayerPath
+	configmap["elf_loader"] = con.PatchedELFLoader
+	configmap["parent_dir"] = filepath.Dir(con.RootPath)
+	configmap["sync_folder"] = con.DataSyncFolder
+	configmap["sync_ori_folder"] = con.DataSyncMap
+	configmap["imagetype"] = con.BaseType
+	configmap["engine"] = con.Engine
+	configmap["mountfile"] = con.FileSyncMap
+	return configmap
+}
+
 func (con *Container) setupContainer() *Error {
 	_, err := MakeDir(con.ConfigPath)
 	if err != nil {
@@ -2748,7 +2986,13 @@ func (con *Container) setupContainer() *Error {
 	return nil
 }
 
-func (con *Container) refreshElf(key string, value []string, prog string) *Error {
+//refreshElf records the edit of key into the patch of prog, patches are applied once all edits of patchBineries are collected
+func (con *Container) refreshElf(patches map[string]*ElfPatch, key string, value []string, prog string) *Error {
+	patch, ok := patches[prog]
+	if !ok {
+		patch = NewElfPatch(prog)
+		patches[prog] = patch
+	}
 	switch key {
 	case "add_rpath":
 		{
@@ -2759,29 +3003,21 @@ func (con *Container) refreshElf(key string, value []string, prog string) *Error
 			if rpath != "" {
 				rpath = strings.TrimSuffix(rpath, ":")
 			}
-			if val, err := ElfRPath(con.ElfPatcherPath, rpath, prog); val || err != nil {
-				return err
-			}
+			patch.SetRPath(rpath)
 		}
 	case "remove_rpath":
 		{
 			for _, path := range value {
-				if val, err := ElfRemoveRPath(con.ElfPatcherPath, path, prog); val || err != nil {
-					return err
-				}
+				patch.RemoveRPath(path)
 			}
 		}
 	case "add_needed":
 		{
-			if val, err := ElfAddNeeded(con.ElfPatcherPath, value, prog); val || err != nil {
-				return err
-			}
+			patch.AddNeeded(value...)
 		}
 	case "remove_needed":
 		{
-			if val, err := ElfRemoveNeeded(con.ElfPatcherPath, value, prog); val || err != nil {
-				return err
-			}
+			patch.RemoveNeeded(value...)
 		}
 	default:
 		{
@@ -2862,6 +3098,18 @@ func (con *Container) genEnv(envmap map[string]string) (map[string]string, *Erro
 	exe_path, _ := os.Executable()
 	env["LPMX_EXECUTABLE"] = exe_path
 
+	//apply runtime configuration of image, e.g, the env and workdir changed by commit
+	if config, cerr := LoadImageConfig(fmt.Sprintf("%s/%s", filepath.Dir(con.SettingPath), IMAGE_CONFIG)); cerr == nil {
+		for _, kv := range config.Config.Env {
+			if v := strings.SplitN(kv, "=", 2); len(v) == 2 {
+				env[v[0]] = v[1]
+			}
+		}
+		if config.Config.WorkingDir != "" {
+			env["PWD"] = config.Config.WorkingDir
+		}
+	}
+
 	//export env
 	if data, data_ok := con.SettingConf["export_env"]; data_ok {
 		if d1, o1 := data.([]interface{}); o1 {
@@ -3032,6 +3280,13 @@ func (con *Container) bashShell(envmap map[string]string, args ...string) *Error
 	}
 
 	if FolderExist(con.RootPath) {
+		//fakechroot maps the real cwd under rw layer to the one inside container, so the shell starts from host folder of PWD
+		workdir, err := con.workDir(env["PWD"])
+		if err != nil {
+			return err
+		}
+		pid_file := fmt.Sprintf("%s/container.pid", filepath.Dir(con.RootPath))
+
 		//here we firstly check if FAKECHROOTKEY is already set, meaning that we are inside fakeroot env as fakeroot does not support nested call
 		fakerootkey, fok := os.LookupEnv("FAKEROOTKEY")
 		if !fok {
@@ -3051,7 +3306,7 @@ func (con *Container) bashShell(envmap map[string]string, args ...string) *Error
 
 			//only when we created faked-sysv instance then we need to kill it, otherwise we wait
 			defer func() {
-				fmt.Sprintf("cleanning up faked-sysv with pid: %s\n", faked_str[1])
+				LOGGER.Debug(fmt.Sprintf("cleanning up faked-sysv with pid: %s", faked_str[1]))
 				KillProcessByPid(faked_str[1])
 			}()
 		} else {
@@ -3059,7 +3314,33 @@ func (con *Container) bashShell(envmap map[string]string, args ...string) *Error
 			env["FAKEROOTPID"] = strings.TrimSuffix(os.Getenv("FAKEROOTPID"), "\n")
 		}
 
-		cerr := ShellEnvPid(con.UserShell, env, con.RootPath, args...)
+		if con.ctx != nil {
+			ctx, cancel := context.WithCancel(con.ctx)
+			defer cancel()
+			unhealthy := make(chan struct{})
+			if con.health != nil {
+				go func() {
+					if !con.runHealthCheck(ctx, env, workdir) && ctx.Err() == nil {
+						close(unhealthy)
+						cancel()
+					}
+				}()
+			}
+
+			cerr := ShellEnvPidOutput(ctx, con.UserShell, env, workdir, pid_file, con.stdout, con.stderr, args...)
+			select {
+			case <-unhealthy:
+				cerr := ErrNew(ErrStatus, fmt.Sprintf("container %s is unhealthy, healthcheck '%s' keeps failing", con.Id, con.health.Command))
+				return cerr
+			default:
+			}
+			if cerr != nil {
+				return cerr
+			}
+			return nil
+		}
+
+		cerr := ShellEnvPid(con.UserShell, env, workdir, pid_file, args...)
 		if cerr != nil {
 			return cerr
 		}
@@ -3069,6 +3350,64 @@ func (con *Container) bashShell(envmap map[string]string, args ...string) *Error
 	return cerr
 }
 
+//workDir returns the host folder of working directory pwd inside container, like docker it is created if it is missing.
+//It is created inside rw layer, which is fine as fakechroot looks up lower layers for entries not inside rw layer
+func (con *Container) workDir(pwd string) (string, *Error) {
+	dir := filepath.Join(con.RootPath, filepath.Clean("/"+pwd))
+	if !FolderExist(dir) {
+		if _, err := MakeDir(dir); err != nil {
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+//runHealthCheck executes the health check command from workdir inside the container until it succeeds or fails more than the retries
+//after start period, healthy callback is called on success
+func (con *Container) runHealthCheck(ctx context.Context, env map[string]string, workdir string) bool {
+	interval, timeout, startPeriod, err := con.health.Durations()
+	if err != nil {
+		LOGGER.WithFields(logrus.Fields{
+			"err": err.Error(),
+		}).Error("healthcheck configuration error")
+		return false
+	}
+
+	begin := time.Now()
+	failures := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(interval):
+		}
+
+		cerr := ShellEnvTimeout(ctx, con.UserShell, env, workdir, timeout, con.health.Command)
+		if cerr == nil {
+			LOGGER.WithFields(logrus.Fields{
+				"id": con.Id,
+			}).Info("container becomes healthy")
+			if con.healthy != nil {
+				con.healthy()
+			}
+			return true
+		}
+
+		LOGGER.WithFields(logrus.Fields{
+			"id":  con.Id,
+			"err": cerr.Error(),
+		}).Debug("healthcheck fails")
+		//failures during start period are not counted
+		if time.Since(begin) < startPeriod {
+			continue
+		}
+		failures++
+		if failures >= con.health.GetRetries() {
+			return false
+		}
+	}
+}
+
 func (con *Container) createContainer() *Error {
 	con.LogPath = fmt.Sprintf("%s/log", con.ConfigPath)
 	con.ElfPatcherPath = con.SysDir
@@ -3108,6 +3447,17 @@ func (con *Container) createContainer() *Error {
 }
 
 func (con *Container) patchBineries() *Error {
+	patches, err := con.collectPatches()
+	if err != nil {
+		return err
+	}
+	return applyPatches(patches)
+}
+
+//collectPatches returns the edits of elf files configured inside setting file, keyed by the files
+func (con *Container) collectPatches() (map[string]*ElfPatch, *Error) {
+	//each file is read and written once no matter how many edits it gets
+	patches := make(map[string]*ElfPatch)
 	for _, op := range ELFOP {
 		if data, ok := con.SettingConf[op]; ok {
 			switch op {
@@ -3130,9 +3480,9 @@ func (con *Container) patchBineries() *Error {
 										if err != nil {
 											continue
 										}
-										err = con.refreshElf(op, libs, k1_abs)
+										err = con.refreshElf(patches, op, libs, k1_abs)
 										if err != nil {
-											return err
+											return nil, err
 										}
 									}
 								}
@@ -3159,23 +3509,24 @@ func (con *Container) patchBineries() *Error {
 
 								k_abs := AddConPath(con.RootPath, k.(string))
 								if FileExist(k_abs) {
-									err := con.refreshElf(op, libs, k_abs)
+									err := con.refreshElf(patches, op, libs, k_abs)
 									if err != nil {
-										return err
+										return nil, err
 									}
 								}
 								if FolderExist(k_abs) {
 									bineries, err := walkSpecificDir(k_abs)
 									if err != nil {
-										return err
+										return nil, err
 									}
 									for _, binery := range bineries {
-										if FileExist(binery) {
+										//scripts inside folders are skipped, only elf files could be patched
+										if FileExist(binery) && IsElf(binery) {
 											var paths []string
 											paths = append(paths, v.(string))
-											err := con.refreshElf(op, paths, binery)
+											err := con.refreshElf(patches, op, paths, binery)
 											if err != nil {
-												return err
+												return nil, err
 											}
 										}
 									}
@@ -3187,10 +3538,29 @@ func (con *Container) patchBineries() *Error {
 			}
 		}
 	}
+
+	return patches, nil
+}
+
+//applyPatches applies patches in the order of file names
+func applyPatches(patches map[string]*ElfPatch) *Error {
+	progs := make([]string, 0, len(patches))
+	for prog := range patches {
+		progs = append(progs, prog)
+	}
+	sort.Strings(progs)
+	for _, prog := range progs {
+		if err := patches[prog].Apply(); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 func (con *Container) appendToSys() *Error {
+	sysLock.Lock()
+	defer sysLock.Unlock()
+
 	currdir, err := GetConfigDir()
 	if err != nil {
 		return err
@@ -3217,6 +3587,7 @@ func (con *Container) appendToSys() *Error {
 			cmap["BaseType"] = con.BaseType
 			cmap["Engine"] = con.Engine
 			cmap["MountFile"] = con.FileSyncMap
+			cmap["ComposeHash"] = con.ComposeHash
 			sys.Containers[con.Id] = cmap
 		} else {
 			vvalue, vok := value.(map[string]interface{})
@@ -3229,11 +3600,11 @@ func (con *Container) appendToSys() *Error {
 			vvalue["ConfigPath"] = con.ConfigPath
 			vvalue["Image"] = con.ImageBase
 			vvalue["BaseType"] = con.BaseType
+			vvalue["ComposeHash"] = con.ComposeHash
 			sys.Containers[con.Id] = vvalue
 		}
 		con.SysDir = rootdir
-		data, _ := StructMarshal(&sys)
-		err := WriteToFile(data, fmt.Sprintf("%s/.info", sys.RootDir))
+		err := marshalObj(sys.RootDir, &sys)
 		if err != nil {
 			return err
 		}
@@ -3307,7 +3678,12 @@ func generateContainer(name, container_name, volume_map, engine, mountfile strin
 					k = path.Base(k)
 					src_path := fmt.Sprintf("%s/%s", base, k)
 					target_path := fmt.Sprintf("%s/%s", rootfolder, k)
-					err := os.Symlink(src_path, target_path)
+					//relative symlinks keep working after lpmx directory is moved
+					link := src_path
+					if rel, rerr := filepath.Rel(rootfolder, src_path); rerr == nil {
+						link = rel
+					}
+					err := os.Symlink(link, target_path)
 					if err != nil {
 						cerr := ErrNew(err, fmt.Sprintf("can't create symlink from path: %s to %s", src_path, target_path))
 						return nil, cerr
@@ -3338,6 +3714,9 @@ func generateContainer(name, container_name, volume_map, engine, mountfile strin
 				configmap["layers"] = strings.Join(reverse_keys, ":")
 				configmap["baselayerpath"] = base
 				configmap["container_name"] = container_name
+				if engine == "" {
+					engine = DEFAULT_ENGINE
+				}
 				if _, fok := FindStringArray(engine, ENGINE_TYPE); fok {
 					//set engine type
 					configmap["engine"] = strings.ToUpper(engine)
@@ -3388,6 +3767,8 @@ func generateContainer(name, container_name, volume_map, engine, mountfile strin
 				if !strings.Contains(volume_map, default_sync_folder) {
 					volume_map = fmt.Sprintf("%s=/lpmx:%s", default_sync_folder, volume_map)
 				}
+				//add default volumes of global config
+				volume_map = mergeVolumes(volume_map, DEFAULT_VOLUMES)
 				//add user defined ones
 				for _, volume := range strings.Split(volume_map, ":") {
 					if len(volume) > 0 {
@@ -3696,6 +4077,7 @@ func walkfs(dir string) ([]string, *Error) {
 	return fileList, nil
 }
 
+//unmarshalObj reads rootdir/.info, paths stored relative to the root of lpmx are resolved
 func unmarshalObj(rootdir string, inf interface{}) *Error {
 	info := fmt.Sprintf("%s/.info", rootdir)
 	if FileExist(info) {
@@ -3703,13 +4085,20 @@ func unmarshalObj(rootdir string, inf interface{}) *Error {
 		if err != nil {
 			return err
 		}
+		currdir, cerr := GetConfigDir()
+		if cerr != nil {
+			return cerr
+		}
 		switch inf.(type) {
 		case *Sys:
 			err = StructUnmarshal(data, inf.(*Sys))
+			*inf.(*Sys) = inf.(*Sys).withPaths(absoluteTo(currdir))
 		case *Container:
 			err = StructUnmarshal(data, inf.(*Container))
+			*inf.(*Container) = inf.(*Container).withPaths(absoluteTo(currdir))
 		case *Image:
 			err = StructUnmarshal(data, inf.(*Image))
+			*inf.(*Image) = inf.(*Image).withPaths(absoluteTo(currdir))
 		case *ImageInfo:
 			err = StructUnmarshal(data, inf.(*ImageInfo))
 		default:
@@ -3726,6 +4115,33 @@ func unmarshalObj(rootdir string, inf interface{}) *Error {
 	return nil
 }
 
+//marshalObj writes inf into rootdir/.info, paths inside the root of lpmx are stored relative to it so that lpmx directory could be moved
+func marshalObj(rootdir string, inf interface{}) *Error {
+	currdir, err := GetConfigDir()
+	if err != nil {
+		return err
+	}
+	var obj interface{}
+	switch inf.(type) {
+	case *Sys:
+		obj = inf.(*Sys).withPaths(relativeTo(currdir))
+	case *Container:
+		obj = inf.(*Container).withPaths(relativeTo(currdir))
+	case *Image:
+		obj = inf.(*Image).withPaths(relativeTo(currdir))
+	case *ImageInfo:
+		obj = inf
+	default:
+		cerr := ErrNew(ErrMismatch, "interface type mismatched, should be *Sys, *Image, *ImageInfo or *Container")
+		return cerr
+	}
+	data, err := StructMarshal(obj)
+	if err != nil {
+		return err
+	}
+	return WriteToFile(data, fmt.Sprintf("%s/.info", rootdir))
+}
+
 func setExec(id, tp, name, value string) *Error {
 	//read config location
 	currdir, err := GetConfigDir()
@@ -3875,37 +4291,40 @@ func autoDownload(targetApp AppLevel) (string, *Error) {
 	if err != nil {
 		return "", err
 	}
+
+	//singularity images are registered with the name of the app
+	name := image
+	if strings.Compare(imageType, TypeSingularity) == 0 {
+		name = fmt.Sprintf("%s:latest", targetApp.Name)
+	} else if !strings.Contains(name, ":") {
+		name = name + ":latest"
+	}
+
 	rootdir := fmt.Sprintf("%s/.lpmxdata", currdir)
 	var doc Image
 	err = unmarshalObj(rootdir, &doc)
+	if err != nil && err.Err != ErrNExist {
+		return "", err
+	}
 	if err == nil {
-		if _, ok := doc.Images[image]; !ok {
-			if strings.Compare(imageType, TypeDocker) == 0 {
-				LOGGER.WithFields(logrus.Fields{
-					"name": image,
-				}).Info("could not find the image, will download it from repo")
-				return image, DockerDownload(image, "", "")
-			} else if strings.Compare(imageType, TypeSingularity) == 0 {
-				LOGGER.WithFields(logrus.Fields{
-					"name": image,
-				}).Info("could not find the image, will extract it from the file")
-				return fmt.Sprintf("%s:latest", targetApp.Name), SingularityLoad(image, targetApp.Name, "latest")
-			}
-		}
-	} else {
-		if strings.Compare(imageType, TypeDocker) == 0 {
-			LOGGER.WithFields(logrus.Fields{
-				"name": image,
-			}).Info("could not find the image, will download it from repo")
-			return image, DockerDownload(image, "", "")
-		} else if strings.Compare(imageType, TypeSingularity) == 0 {
-			LOGGER.WithFields(logrus.Fields{
-				"name": image,
-			}).Info("could not find the image, will extract it from the file")
-			return fmt.Sprintf("%s:latest", targetApp.Name), SingularityLoad(image, targetApp.Name, "latest")
+		if _, ok := doc.Images[name]; ok {
+			return name, nil
 		}
 	}
-	return "", err
+
+	if strings.Compare(imageType, TypeDocker) == 0 {
+		LOGGER.WithFields(logrus.Fields{
+			"name": image,
+		}).Info("could not find the image, will download it from repo")
+		return name, DockerDownload(image, "", "")
+	} else if strings.Compare(imageType, TypeSingularity) == 0 {
+		LOGGER.WithFields(logrus.Fields{
+			"name": image,
+		}).Info("could not find the image, will extract it from the file")
+		return name, SingularityLoad(image, targetApp.Name, "latest", false, VERIFY_AUTO, nil)
+	}
+	cerr := ErrNew(ErrMismatch, fmt.Sprintf("image type %s is not supported", imageType))
+	return "", cerr
 }
 
 func convertMapValue (values []string) string {
@@ -3919,7 +4338,7 @@ func convertMapValue (values []string) string {
 	return ""
 }
 
-func runComposeApp (targetApp AppLevel) *Error {
+func runComposeApp(ctx context.Context, targetApp AppLevel, healthy func(), recreate string) *Error {
 	container_name := targetApp.Name
 	volume_map := convertMapValue(targetApp.Share)
 	exec_map := convertMapValue(targetApp.Inject)
@@ -3933,19 +4352,57 @@ func runComposeApp (targetApp AppLevel) *Error {
 		}
 	}
 
+	hash, cerr := targetApp.Hash()
+	if cerr != nil {
+		return cerr
+	}
+
+	composeLock.Lock()
 	name, cerr := autoDownload(targetApp)
+	if cerr != nil {
+		composeLock.Unlock()
+		return cerr
+	}
+	container_id, cerr := reconcileComposeContainer(targetApp, name, hash, recreate)
+	composeLock.Unlock()
+	if cerr != nil {
+		return cerr
+	}
+
+	forwarders, cerr := setupComposePorts(targetApp, envmap)
 	if cerr != nil {
 		return cerr
 	}
+	defer releaseComposePorts(targetApp, forwarders)
+
+	LOGGER.WithFields(logrus.Fields{
+		"app":   targetApp.Name,
+		"image": name,
+	}).Info("starting compose app")
 
-	container_id, cerr := CommonComposeRun(name, container_name, volume_map, exec_map, mountfile, command, &envmap)
-	if cerr != nil{
+	stdout := NewPrefixWriter(fmt.Sprintf("[%s] ", targetApp.Name), os.Stdout, &composeOutputLock)
+	stderr := NewPrefixWriter(fmt.Sprintf("[%s] ", targetApp.Name), os.Stderr, &composeOutputLock)
+	if container_id != "" {
+		LOGGER.WithFields(logrus.Fields{
+			"app": targetApp.Name,
+			"id":  container_id,
+		}).Info("reusing existing container")
+		cerr = CommonComposeResume(ctx, container_id, command, &envmap, stdout, stderr, targetApp.HealthCheck, healthy)
+	} else {
+		container_id, cerr = CommonComposeRun(ctx, name, container_name, volume_map, exec_map, mountfile, command, hash, &envmap, stdout, stderr, targetApp.HealthCheck, healthy)
+	}
+	stdout.Flush()
+	stderr.Flush()
+	if cerr != nil {
+		cerr.AddMsg(fmt.Sprintf("compose app: %s encounters error", targetApp.Name))
 		return cerr
 	}
 
 	if len(targetApp.Expose) > 0 {
 		for _, expose := range targetApp.Expose {
+			composeLock.Lock()
 			eerr := Expose(container_id, strings.Split(expose, ":")[0], strings.Split(expose, ":")[1])
+			composeLock.Unlock()
 			if eerr != nil {
 				return eerr
 			}
@@ -3954,3 +4411,138 @@ func runComposeApp (targetApp AppLevel) *Error {
 
 	return nil
 }
+
+//reconcileComposeContainer looks for the container created by previous compose runs of the same app, it returns the id of container
+//to be reused, or empty string if a new container should be created, in which case the outdated container is destroyed
+func reconcileComposeContainer(targetApp AppLevel, image, hash, recreate string) (string, *Error) {
+	currdir, err := GetConfigDir()
+	if err != nil {
+		return "", err
+	}
+	var sys Sys
+	err = unmarshalObj(fmt.Sprintf("%s/.lpmxsys", currdir), &sys)
+	if err != nil {
+		return "", err
+	}
+
+	for id, v := range sys.Containers {
+		val, vok := v.(map[string]interface{})
+		if !vok || val["ContainerName"] != targetApp.Name {
+			continue
+		}
+
+		root := path.Dir(val["RootPath"].(string))
+		if pok, _ := PidIsActive(fmt.Sprintf("%s/container.pid", root)); pok {
+			cerr := ErrNew(ErrExist, fmt.Sprintf("container %s of app %s is still running", id, targetApp.Name))
+			return "", cerr
+		}
+
+		changed := val["Image"] != image || val["ComposeHash"] != hash
+		if recreate == RecreateNever || (recreate != RecreateForce && !changed) {
+			return id, nil
+		}
+
+		LOGGER.WithFields(logrus.Fields{
+			"app":     targetApp.Name,
+			"id":      id,
+			"changed": changed,
+		}).Info("recreating container of compose app")
+		derr := Destroy(id)
+		if derr != nil {
+			return "", derr
+		}
+	}
+	return "", nil
+}
+
+//setupComposePorts allocates or verifies the host ports of app, exports the mapping via envmap and starts tcp forwarders
+//for ports whose host side differs from container side, the ports occupied by app are given by BoundPorts
+func setupComposePorts(targetApp AppLevel, envmap map[string]string) ([]*Forwarder, *Error) {
+	composeLock.Lock()
+	defer composeLock.Unlock()
+
+	var forwarders []*Forwarder
+	var mappings []string
+	cleanup := func() {
+		for _, f := range forwarders {
+			f.Stop()
+		}
+		for port, owner := range composePorts {
+			if owner == targetApp.Name {
+				delete(composePorts, port)
+			}
+		}
+	}
+
+	for _, port := range targetApp.Port {
+		mapping, err := ParsePort(port)
+		if err != nil {
+			cleanup()
+			return nil, err
+		}
+
+		if mapping.Host == 0 {
+			for {
+				free, ferr := FreePort()
+				if ferr != nil {
+					cleanup()
+					return nil, ferr
+				}
+				if _, ok := composePorts[free]; !ok && free != mapping.Container {
+					mapping.Host = free
+					break
+				}
+			}
+		}
+
+		for _, p := range mapping.BoundPorts() {
+			if owner, ok := composePorts[p]; ok {
+				cleanup()
+				cerr := ErrNew(ErrExist, fmt.Sprintf("port %d of %s is already used by compose app %s", p, targetApp.Name, owner))
+				return nil, cerr
+			}
+			if !PortAvailable(p) {
+				cerr := ErrNew(ErrExist, fmt.Sprintf("port %d of %s is already in use on the host", p, targetApp.Name))
+				cleanup()
+				return nil, cerr
+			}
+			composePorts[p] = targetApp.Name
+		}
+
+		if mapping.Host != mapping.Container {
+			f := NewForwarder(mapping.Host, mapping.Container)
+			ferr := f.Start()
+			if ferr != nil {
+				cleanup()
+				return nil, ferr
+			}
+			forwarders = append(forwarders, f)
+		}
+
+		envmap[fmt.Sprintf("LPMX_PORT_%d", mapping.Container)] = strconv.Itoa(mapping.Host)
+		mappings = append(mappings, fmt.Sprintf("%d:%d", mapping.Host, mapping.Container))
+		LOGGER.WithFields(logrus.Fields{
+			"app":       targetApp.Name,
+			"host":      mapping.Host,
+			"container": mapping.Container,
+		}).Info("compose app port mapping")
+	}
+
+	if len(mappings) > 0 {
+		envmap["LPMX_PORTS"] = strings.Join(mappings, ",")
+	}
+	return forwarders, nil
+}
+
+func releaseComposePorts(targetApp AppLevel, forwarders []*Forwarder) {
+	composeLock.Lock()
+	defer composeLock.Unlock()
+	for _, f := range forwarders {
+		f.Stop()
+	}
+	for port, owner := range composePorts {
+		if owner == targetApp.Name {
+			delete(composePorts, port)
+		}
+	}
+}
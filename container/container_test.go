@@ -1,14 +1,22 @@
 package container
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	. "github.com/JasonYangShadow/lpmx/docker"
 	. "github.com/JasonYangShadow/lpmx/msgpack"
 	. "github.com/JasonYangShadow/lpmx/utils"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestContainerMarshal(t *testing.T) {
@@ -68,3 +76,84 @@ func TestJsonUnmarshal(t *testing.T) {
 
 	fmt.Println(dockerSaveInfos)
 }
+
+func TestBashShellWorkDir(t *testing.T) {
+	dir := t.TempDir()
+	dir, _ = filepath.EvalSymlinks(dir)
+	t.Setenv(ENV_LPMX_HOME, dir)
+	//pretend to be inside fakeroot already, so that faked-sysv is not needed
+	t.Setenv("FAKEROOTKEY", "1")
+	t.Setenv("FAKEROOTPID", "1")
+
+	var config ocispec.Image
+	config.Config.WorkingDir = "/app"
+	data, _ := json.Marshal(config)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, IMAGE_CONFIG), data, 0644))
+
+	var stdout bytes.Buffer
+	con := &Container{
+		Id:          "test",
+		RootPath:    filepath.Join(dir, "rw"),
+		SettingPath: filepath.Join(dir, "setting.yml"),
+		UserShell:   "/bin/sh",
+		SysDir:      dir,
+		ctx:         context.Background(),
+		stdout:      &stdout,
+		stderr:      ioutil.Discard,
+	}
+	_, err := MakeDir(con.RootPath)
+	assert.Nil(t, err)
+
+	//without fakechroot the real cwd is visible, it must be the workdir under rw layer rather than the root
+	err = con.bashShell(nil, "pwd", "-P")
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(con.RootPath, "app"), strings.TrimSpace(stdout.String()))
+	assert.True(t, FileExist(filepath.Join(dir, "container.pid")))
+}
+
+func TestDefaultArgs(t *testing.T) {
+	dir := t.TempDir()
+	configmap := map[string]interface{}{"config": filepath.Join(dir, "setting.yml")}
+
+	//no image configuration, no default command
+	assert.Nil(t, defaultArgs(&configmap, nil))
+
+	var config ocispec.Image
+	config.Config.Entrypoint = []string{"/bin/sh", "-c"}
+	config.Config.Cmd = []string{"#!/bin/sh\necho \"it's $0\""}
+	data, _ := json.Marshal(config)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, IMAGE_CONFIG), data, 0644))
+
+	assert.Equal(t, []string{"ls"}, defaultArgs(&configmap, []string{"ls"}))
+	args := defaultArgs(&configmap, nil)
+	assert.Len(t, args, 3)
+	//args are joined and passed to sh -c by the container shell, the script must survive as one word
+	out, err := exec.Command("/bin/sh", "-c", strings.Join(args, " ")).Output()
+	assert.Nil(t, err)
+	assert.Equal(t, "it's /bin/sh\n", string(out))
+
+	assert.Nil(t, commandArgs(""))
+	assert.Equal(t, []string{"echo", "hi"}, commandArgs("echo hi"))
+}
+
+func TestComposeValidateExposeWrapper(t *testing.T) {
+	datadir := newTestImageStore(t)
+	currdir := filepath.Dir(datadir)
+	file := filepath.Join(t.TempDir(), "compose.yaml")
+	ioutil.WriteFile(file, []byte("version: 1\napps:\n  - name: web\n    image: test:v1\n    type: docker\n    expose:\n      - /bin/ls:tool\n"), 0644)
+	os.MkdirAll(filepath.Join(currdir, "bin"), 0755)
+
+	//wrapper created by the previous run of the same app
+	ioutil.WriteFile(filepath.Join(currdir, "bin", "tool"), []byte("#!/bin/bash\n\"lpmx\" resume c1 -- /bin/ls \"$@\"\n"), 0755)
+	problems, err := ComposeValidate(file, true)
+	assert.Nil(t, err)
+	assert.Empty(t, problems)
+
+	//wrapper of another container
+	ioutil.WriteFile(filepath.Join(currdir, "bin", "tool"), []byte("#!/bin/bash\n\"lpmx\" resume c2 -- /bin/ls \"$@\"\n"), 0755)
+	problems, err = ComposeValidate(file, true)
+	assert.Nil(t, err)
+	if assert.Len(t, problems, 1) {
+		assert.Contains(t, problems[0].Msg, "collides with existing wrapper")
+	}
+}
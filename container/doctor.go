@@ -0,0 +1,410 @@
+package container
+
+import (
+	"debug/elf"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	. "github.com/JasonYangShadow/lpmx/error"
+	. "github.com/JasonYangShadow/lpmx/paeudo"
+	. "github.com/JasonYangShadow/lpmx/pid"
+	. "github.com/JasonYangShadow/lpmx/utils"
+)
+
+const (
+	DOCTOR_OK   = "ok"
+	DOCTOR_WARN = "warn"
+	DOCTOR_FAIL = "fail"
+)
+
+//SYS_DEPENDENCIES are the files extracted from dependency.tar.gz into .lpmxsys by Init, all of them should be executable
+var SYS_DEPENDENCIES = []string{"faked-sysv", "libfakechroot.so", "libfakeroot.so"}
+
+//Diagnostic is the result of one check done by doctor, Fix tells how to solve the problem if the check does not pass
+type Diagnostic struct {
+	Check  string `json:"check"`
+	Status string `json:"status"`
+	Detail string `json:"detail"`
+	Fix    string `json:"fix,omitempty"`
+}
+
+type diagnostics []Diagnostic
+
+func (d *diagnostics) add(check, status, detail, fix string) {
+	*d = append(*d, Diagnostic{Check: check, Status: status, Detail: detail, Fix: fix})
+}
+
+//parseGlibcVersion converts version like 2.31 to comparable numbers
+func parseGlibcVersion(version string) []int {
+	var ret []int
+	for _, v := range strings.Split(strings.TrimSpace(version), ".") {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			break
+		}
+		ret = append(ret, n)
+	}
+	return ret
+}
+
+//compareGlibcVersion returns -1, 0 or 1 if a is older, equal to or newer than b
+func compareGlibcVersion(a, b string) int {
+	va, vb := parseGlibcVersion(a), parseGlibcVersion(b)
+	for i := 0; i < len(va) || i < len(vb); i++ {
+		var x, y int
+		if i < len(va) {
+			x = va[i]
+		}
+		if i < len(vb) {
+			y = vb[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+//hostGlibcVersion returns the glibc version of host, it is empty if host does not use glibc
+func hostGlibcVersion() string {
+	//output is like 'glibc 2.31'
+	if out, err := Command("getconf", "GNU_LIBC_VERSION"); err == nil {
+		if fields := strings.Fields(out); len(fields) == 2 {
+			return fields[1]
+		}
+	}
+	//first line of output is like 'ldd (Ubuntu GLIBC 2.31-0ubuntu9) 2.31'
+	if out, err := CommandBash("ldd --version"); err == nil {
+		if fields := strings.Fields(strings.SplitN(out, "\n", 2)[0]); len(fields) > 0 {
+			if version := fields[len(fields)-1]; len(parseGlibcVersion(version)) > 0 {
+				return version
+			}
+		}
+	}
+	return ""
+}
+
+//requiredGlibcVersion returns the newest GLIBC_x.y symbol version needed by elf file
+func requiredGlibcVersion(file string) (string, *Error) {
+	f, err := elf.Open(file)
+	if err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("could not open elf file %s", file))
+		return "", cerr
+	}
+	defer f.Close()
+	symbols, err := f.ImportedSymbols()
+	if err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("could not read imported symbols of %s", file))
+		return "", cerr
+	}
+	required := ""
+	for _, symbol := range symbols {
+		if !strings.HasPrefix(symbol.Version, "GLIBC_") {
+			continue
+		}
+		version := strings.TrimPrefix(symbol.Version, "GLIBC_")
+		if len(parseGlibcVersion(version)) > 0 && compareGlibcVersion(version, required) > 0 {
+			required = version
+		}
+	}
+	return required, nil
+}
+
+//checkDependencies checks the files of .lpmxsys expected by Init, false is returned if lpmx is not initialized
+func (d *diagnostics) checkDependencies(sysdir string) bool {
+	if !FileExist(fmt.Sprintf("%s/.info", sysdir)) {
+		d.add("dependencies", DOCTOR_FAIL, fmt.Sprintf("%s is not initialized", sysdir), "run 'lpmx init'")
+		return false
+	}
+	ok := true
+	for _, dep := range SYS_DEPENDENCIES {
+		file := fmt.Sprintf("%s/%s", sysdir, dep)
+		fi, err := os.Stat(file)
+		if err != nil {
+			d.add("dependencies", DOCTOR_FAIL, fmt.Sprintf("%s is missing", file), "run 'lpmx init -r' to download dependencies again")
+			ok = false
+			continue
+		}
+		if fi.Mode().Perm()&0111 == 0 {
+			d.add("dependencies", DOCTOR_FAIL, fmt.Sprintf("%s is not executable", file), fmt.Sprintf("run 'chmod 755 %s'", file))
+			ok = false
+		}
+	}
+	if ok {
+		d.add("dependencies", DOCTOR_OK, fmt.Sprintf("%s are found inside %s", strings.Join(SYS_DEPENDENCIES, ", "), sysdir), "")
+	}
+	return true
+}
+
+//checkConfig reports whether the global config file could be loaded, defaults are used if it is invalid
+func (d *diagnostics) checkConfig() {
+	config, err := readGlobalConfig()
+	if err != nil {
+		var msgs []string
+		for m := err.Msg.Front(); m != nil; m = m.Next() {
+			msgs = append(msgs, m.Value.(string))
+		}
+		d.add("config", DOCTOR_FAIL, fmt.Sprintf("%s, defaults are used instead", strings.Join(msgs, ", ")), fmt.Sprintf("correct the global config file, or point %s to a valid one", ENV_LPMX_CONFIG))
+		return
+	}
+	if config == nil {
+		d.add("config", DOCTOR_OK, "no global config file, defaults are used", "")
+		return
+	}
+	d.add("config", DOCTOR_OK, fmt.Sprintf("%s is loaded", config.file), "")
+}
+
+//checkHost reports the distribution, kernel and glibc of host, glibc is compared with the one required by dependencies
+func (d *diagnostics) checkHost(sysdir string, initialized bool) {
+	dist, release, err := GetHostOSInfo()
+	if err != nil || dist == "" {
+		d.add("host os", DOCTOR_WARN, "could not detect the distribution of host, default dependencies are used", "make sure /etc/os-release or /etc/lsb-release is readable")
+	} else {
+		d.add("host os", DOCTOR_OK, fmt.Sprintf("%s %s", dist, release), "")
+	}
+
+	ostype, oerr := ioutil.ReadFile("/proc/sys/kernel/ostype")
+	osrelease, rerr := ioutil.ReadFile("/proc/sys/kernel/osrelease")
+	if oerr != nil || rerr != nil {
+		d.add("kernel", DOCTOR_WARN, "could not read kernel version from /proc/sys/kernel", "make sure /proc is mounted")
+	} else {
+		d.add("kernel", DOCTOR_OK, fmt.Sprintf("%s %s", strings.TrimSpace(string(ostype)), strings.TrimSpace(string(osrelease))), "")
+	}
+
+	host := hostGlibcVersion()
+	if host == "" {
+		d.add("glibc", DOCTOR_WARN, "could not detect glibc of host, e.g, host uses musl", "dependencies of lpmx need glibc, run 'lpmx init -r -d <tarball>' with dependencies built for this host")
+		return
+	}
+	if !initialized {
+		d.add("glibc", DOCTOR_OK, fmt.Sprintf("host glibc %s", host), "")
+		return
+	}
+	required, requiredBy := "", ""
+	for _, dep := range SYS_DEPENDENCIES {
+		version, err := requiredGlibcVersion(fmt.Sprintf("%s/%s", sysdir, dep))
+		if err != nil {
+			continue
+		}
+		if compareGlibcVersion(version, required) > 0 {
+			required, requiredBy = version, dep
+		}
+	}
+	if required != "" && compareGlibcVersion(host, required) < 0 {
+		d.add("glibc", DOCTOR_FAIL, fmt.Sprintf("host glibc %s is older than glibc %s required by %s", host, required, requiredBy), "run 'lpmx init -g' to download dependencies built for host distribution, or 'lpmx init -r -d <tarball>' with dependencies built for this host")
+		return
+	}
+	d.add("glibc", DOCTOR_OK, fmt.Sprintf("host glibc %s, dependencies require glibc %s", host, required), "")
+}
+
+//checkFilesystem checks whether programs could be executed inside dir and whether it supports symlinks, hardlinks and xattrs
+func (d *diagnostics) checkFilesystem(dir string) {
+	if !FolderExist(dir) {
+		return
+	}
+	check := "filesystem"
+	tmpdir, err := ioutil.TempDir(dir, ".lpmx-doctor")
+	if err != nil {
+		d.add(check, DOCTOR_FAIL, fmt.Sprintf("could not create files inside %s: %s", dir, err.Error()), fmt.Sprintf("make %s writable for the current user", dir))
+		return
+	}
+	defer os.RemoveAll(tmpdir)
+
+	var problems []string
+	status, fix := DOCTOR_OK, ""
+	script := filepath.Join(tmpdir, "exec.sh")
+	ioutil.WriteFile(script, []byte("#!/bin/sh\nexit 0\n"), 0755)
+	if err := exec.Command(script).Run(); err != nil {
+		problems = append(problems, "programs could not be executed(mounted with noexec)")
+		status = DOCTOR_FAIL
+		fix = "install lpmx on a filesystem mounted without noexec, e.g, move it out of the noexec home directory"
+	}
+	if err := os.Symlink("exec.sh", filepath.Join(tmpdir, "symlink")); err != nil {
+		problems = append(problems, "symlinks are not supported")
+		status = DOCTOR_FAIL
+		fix = "install lpmx on a filesystem supporting symlinks"
+	}
+	if err := os.Link(script, filepath.Join(tmpdir, "hardlink")); err != nil {
+		problems = append(problems, "hardlinks are not supported, layers are copied instead of shared")
+		if status == DOCTOR_OK {
+			status = DOCTOR_WARN
+		}
+	}
+	if err := syscall.Setxattr(script, "user.lpmx", []byte("doctor"), 0); err != nil {
+		problems = append(problems, "extended attributes are not supported, xattrs of layer files are lost")
+		if status == DOCTOR_OK {
+			status = DOCTOR_WARN
+		}
+	}
+	if len(problems) == 0 {
+		d.add(check, DOCTOR_OK, fmt.Sprintf("%s supports exec, symlinks, hardlinks and xattrs", dir), "")
+		return
+	}
+	d.add(check, status, fmt.Sprintf("%s: %s", dir, strings.Join(problems, "; ")), fix)
+}
+
+//checkState checks that containers and images recorded inside .lpmxsys and .lpmxdata still have their files
+func (d *diagnostics) checkState(sysdir, datadir string) {
+	var doc Image
+	err := unmarshalObj(datadir, &doc)
+	if err != nil && err.Err != ErrNExist {
+		d.add("images", DOCTOR_FAIL, fmt.Sprintf("could not read %s/.info", datadir), "restore it from backup, or remove .lpmxdata and download images again")
+		return
+	}
+	var names []string
+	for name := range doc.Images {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	broken := 0
+	for _, name := range names {
+		mdata, ok := doc.Images[name].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		imagetype, _ := mdata["imagetype"].(string)
+		delete_cmd := fmt.Sprintf("run 'lpmx docker delete %s' and load it again", name)
+		if strings.HasPrefix(strings.ToLower(imagetype), "singularity") {
+			delete_cmd = fmt.Sprintf("run 'lpmx singularity delete %s' and load it again", name)
+		}
+		image_dir, _ := mdata["image"].(string)
+		base, _ := mdata["base"].(string)
+		layer_order, _ := mdata["layer_order"].(string)
+		for _, layer := range strings.Split(layer_order, ":") {
+			if layer == "" {
+				continue
+			}
+			layer = path.Base(layer)
+			if !FolderExist(fmt.Sprintf("%s/%s", base, layer)) {
+				d.add("images", DOCTOR_FAIL, fmt.Sprintf("extracted layer %s of %s is missing", layer, name), delete_cmd)
+				broken++
+			} else if image_dir != "" && !FileExist(fmt.Sprintf("%s/%s", image_dir, layer)) {
+				d.add("images", DOCTOR_WARN, fmt.Sprintf("layer tarball %s of %s is missing, it could not be packaged or pushed", layer, name), delete_cmd)
+				broken++
+			}
+		}
+		if config, _ := mdata["config"].(string); !FileExist(config) {
+			d.add("images", DOCTOR_WARN, fmt.Sprintf("setting %s of %s is missing", config, name), fmt.Sprintf("run 'lpmx image profile --regenerate %s'", name))
+			broken++
+		}
+	}
+	if broken == 0 {
+		d.add("images", DOCTOR_OK, fmt.Sprintf("%d images are consistent", len(names)), "")
+	}
+
+	var sys Sys
+	err = unmarshalObj(sysdir, &sys)
+	if err != nil {
+		return
+	}
+	var ids []string
+	for id := range sys.Containers {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	broken = 0
+	for _, id := range ids {
+		cmap, ok := sys.Containers[id].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		if config_path, _ := cmap["ConfigPath"].(string); !FileExist(fmt.Sprintf("%s/.info", config_path)) {
+			d.add("containers", DOCTOR_FAIL, fmt.Sprintf("state of container %s is missing", id), fmt.Sprintf("run 'lpmx destroy %s'", id))
+			broken++
+			continue
+		}
+		if image, _ := cmap["Image"].(string); image != "" && doc.Images[image] == nil {
+			d.add("containers", DOCTOR_WARN, fmt.Sprintf("image %s of container %s does not exist any longer", image, id), fmt.Sprintf("run 'lpmx destroy %s' if container is no longer needed", id))
+			broken++
+		}
+		root_path, _ := cmap["RootPath"].(string)
+		if root_path == "" {
+			continue
+		}
+		if !FolderExist(root_path) {
+			d.add("containers", DOCTOR_FAIL, fmt.Sprintf("rw layer %s of container %s is missing", root_path, id), fmt.Sprintf("run 'lpmx destroy %s'", id))
+			broken++
+			continue
+		}
+		pidfile := fmt.Sprintf("%s/container.pid", path.Dir(root_path))
+		if FileExist(pidfile) {
+			if active, _ := PidIsActive(pidfile); !active {
+				d.add("containers", DOCTOR_WARN, fmt.Sprintf("%s of container %s is stale, container is not running", pidfile, id), fmt.Sprintf("run 'rm %s'", pidfile))
+				broken++
+			}
+		}
+	}
+	if broken == 0 {
+		d.add("containers", DOCTOR_OK, fmt.Sprintf("%d containers are consistent", len(ids)), "")
+	}
+}
+
+//Diagnose checks the host, dependencies, filesystem and state files of lpmx
+func Diagnose() ([]Diagnostic, *Error) {
+	currdir, err := GetConfigDir()
+	if err != nil {
+		return nil, err
+	}
+	sysdir := fmt.Sprintf("%s/.lpmxsys", currdir)
+	datadir := fmt.Sprintf("%s/.lpmxdata", currdir)
+
+	d := new(diagnostics)
+	d.checkConfig()
+	initialized := d.checkDependencies(sysdir)
+	d.checkHost(sysdir, initialized)
+	d.checkFilesystem(currdir)
+	//.lpmxdata could be a symlink to another filesystem
+	if real, rerr := filepath.EvalSymlinks(datadir); rerr == nil && real != datadir {
+		d.checkFilesystem(real)
+	}
+	d.checkState(sysdir, datadir)
+	return *d, nil
+}
+
+//Doctor prints the result of Diagnose, either human readable or json, error is returned if any check fails
+func Doctor(asJson bool) *Error {
+	results, err := Diagnose()
+	if err != nil {
+		return err
+	}
+	failures := 0
+	for _, result := range results {
+		if result.Status == DOCTOR_FAIL {
+			failures++
+		}
+	}
+
+	if asJson {
+		data, jerr := json.MarshalIndent(results, "", "  ")
+		if jerr != nil {
+			cerr := ErrNew(jerr, "could not encode diagnostics")
+			return cerr
+		}
+		fmt.Println(string(data))
+	} else {
+		for _, result := range results {
+			fmt.Printf("[%-4s] %-16s%s\n", strings.ToUpper(result.Status), result.Check, result.Detail)
+			if result.Fix != "" {
+				fmt.Printf("%-24sfix: %s\n", "", result.Fix)
+			}
+		}
+	}
+
+	if failures > 0 {
+		cerr := ErrNew(ErrStatus, fmt.Sprintf("%d checks failed", failures))
+		return cerr
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package container
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	. "github.com/JasonYangShadow/lpmx/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompareGlibcVersion(t *testing.T) {
+	assert.Equal(t, -1, compareGlibcVersion("2.17", "2.27"))
+	assert.Equal(t, 1, compareGlibcVersion("2.3.4", "2.3"))
+	assert.Equal(t, 0, compareGlibcVersion("2.31", "2.31"))
+	assert.Equal(t, 1, compareGlibcVersion("2.2.5", ""))
+}
+
+//findDiagnostics returns the results of check
+func findDiagnostics(results []Diagnostic, check string) []Diagnostic {
+	var ret []Diagnostic
+	for _, result := range results {
+		if result.Check == check {
+			ret = append(ret, result)
+		}
+	}
+	return ret
+}
+
+func TestDiagnoseState(t *testing.T) {
+	datadir := newTestImageStore(t)
+	currdir, _ := GetConfigDir()
+	sysdir := fmt.Sprintf("%s/.lpmxsys", currdir)
+	for _, dep := range SYS_DEPENDENCIES {
+		ioutil.WriteFile(fmt.Sprintf("%s/%s", sysdir, dep), nil, 0644)
+	}
+
+	//container whose rw layer exists but pid file is stale, and another whose state is gone
+	rootpath := fmt.Sprintf("%s/test/v1/workspace/c1/rw", datadir)
+	os.MkdirAll(rootpath, 0755)
+	ioutil.WriteFile(fmt.Sprintf("%s/test/v1/workspace/c1/container.pid", datadir), []byte("999999999"), 0644)
+	writeTestSys(t, map[string]interface{}{
+		"c1": map[string]string{"Image": "test:v1", "ConfigPath": fmt.Sprintf("%s/test/v1/workspace/c1/.lpmx", datadir), "RootPath": rootpath},
+		"c2": map[string]string{"Image": "gone:v1", "ConfigPath": "/nonexistent"},
+	})
+	//extracted layer b is lost
+	os.RemoveAll(datadir + "/.base/b.tar.gz")
+
+	results, err := Diagnose()
+	assert.Nil(t, err)
+
+	deps := findDiagnostics(results, "dependencies")
+	if assert.Len(t, deps, len(SYS_DEPENDENCIES)) {
+		assert.Equal(t, DOCTOR_FAIL, deps[0].Status)
+		assert.Contains(t, deps[0].Fix, "chmod 755")
+	}
+
+	images := findDiagnostics(results, "images")
+	if assert.Len(t, images, 1) {
+		assert.Equal(t, DOCTOR_FAIL, images[0].Status)
+		assert.Contains(t, images[0].Detail, "b.tar.gz")
+		assert.Equal(t, "run 'lpmx docker delete test:v1' and load it again", images[0].Fix)
+	}
+
+	containers := findDiagnostics(results, "containers")
+	if assert.Len(t, containers, 2) {
+		assert.Equal(t, DOCTOR_WARN, containers[0].Status)
+		assert.Contains(t, containers[0].Detail, "container.pid")
+		assert.Equal(t, DOCTOR_FAIL, containers[1].Status)
+		assert.Equal(t, "run 'lpmx destroy c2'", containers[1].Fix)
+	}
+
+	fs := findDiagnostics(results, "filesystem")
+	if assert.NotEmpty(t, fs) {
+		assert.NotEqual(t, DOCTOR_FAIL, fs[0].Status)
+	}
+	assert.NotNil(t, Doctor(false))
+}
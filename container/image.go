@@ -0,0 +1,345 @@
+package container
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	. "github.com/JasonYangShadow/lpmx/docker"
+	. "github.com/JasonYangShadow/lpmx/error"
+	. "github.com/JasonYangShadow/lpmx/msgpack"
+	. "github.com/JasonYangShadow/lpmx/utils"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+//ImageInspection is the detailed information of an image shown by image inspect
+type ImageInspection struct {
+	Name           string            `json:"name"`
+	Type           string            `json:"type"`
+	Digest         string            `json:"digest"`
+	Source         string            `json:"source"`
+	Created        string            `json:"created"`
+	Size           int64             `json:"size"`
+	Layers         []LayerInspection `json:"layers"` //from lower to higher layers
+	Setting        string            `json:"setting"`
+	SettingContent string            `json:"setting_content"`
+	Env            []string          `json:"env,omitempty"`
+	WorkingDir     string            `json:"workdir,omitempty"`
+	Cmd            []string          `json:"cmd,omitempty"`
+	Labels         map[string]string `json:"labels,omitempty"`
+	History        []ocispec.History `json:"history,omitempty"`
+	Containers     []string          `json:"containers"`
+}
+
+type LayerInspection struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+//recordImageSource keeps where the image comes from and when it is created, they are shown by image inspect
+func recordImageSource(mdata map[string]interface{}, source string) {
+	mdata["source"] = source
+	mdata["created"] = time.Now().Format(time.RFC3339)
+}
+
+//InspectImage collects the information of image name:tag
+func InspectImage(name string) (*ImageInspection, *Error) {
+	if !strings.Contains(name, ":") {
+		name = name + ":latest"
+	}
+	currdir, err := GetConfigDir()
+	if err != nil {
+		return nil, err
+	}
+	var doc Image
+	err = unmarshalObj(fmt.Sprintf("%s/.lpmxdata", currdir), &doc)
+	if err != nil {
+		return nil, err
+	}
+	mdata, ok := doc.Images[name].(map[string]interface{})
+	if !ok {
+		cerr := ErrNew(ErrNExist, fmt.Sprintf("name: %s is not found", name))
+		return nil, cerr
+	}
+
+	inspection := new(ImageInspection)
+	inspection.Name = name
+	inspection.Type, _ = mdata["imagetype"].(string)
+	if _, merged := mdata["orig_layer_order"]; merged {
+		inspection.Type = fmt.Sprintf("%s (merged)", inspection.Type)
+	}
+	inspection.Digest, _ = mdata["digest"].(string)
+	inspection.Source, _ = mdata["source"].(string)
+	inspection.Created, _ = mdata["created"].(string)
+	inspection.Setting, _ = mdata["config"].(string)
+	if data, rerr := ioutil.ReadFile(inspection.Setting); rerr == nil {
+		inspection.SettingContent = string(data)
+	}
+
+	rootdir, _ := mdata["rootdir"].(string)
+	var info ImageInfo
+	err = unmarshalObj(rootdir, &info)
+	if err != nil {
+		return nil, err
+	}
+	for _, layer := range strings.Split(info.Layers, ":") {
+		if layer == "" {
+			continue
+		}
+		size := info.LayersMap[path.Base(layer)]
+		inspection.Layers = append(inspection.Layers, LayerInspection{Name: path.Base(layer), Size: size})
+		inspection.Size += size
+	}
+
+	//image config is only recorded for some images, e.g, committed or imported from oci layout
+	config_path := fmt.Sprintf("%s/%s", rootdir, IMAGE_CONFIG)
+	if config, cerr := LoadImageConfig(config_path); cerr == nil {
+		inspection.Env = config.Config.Env
+		inspection.WorkingDir = config.Config.WorkingDir
+		inspection.Cmd = config.Config.Cmd
+		inspection.Labels = config.Config.Labels
+		inspection.History = config.History
+		if inspection.Created == "" && config.Created != nil {
+			inspection.Created = config.Created.Format(time.RFC3339)
+		}
+		if inspection.Digest == "" {
+			if data, rerr := ioutil.ReadFile(config_path); rerr == nil {
+				inspection.Digest = digest.FromBytes(data).String()
+			}
+		}
+	}
+
+	containers, err := imageContainers(name)
+	if err != nil {
+		return nil, err
+	}
+	inspection.Containers = containers
+	return inspection, nil
+}
+
+//imageContainers returns the containers(id and name) created from image name:tag
+func imageContainers(name string) ([]string, *Error) {
+	currdir, err := GetConfigDir()
+	if err != nil {
+		return nil, err
+	}
+	var sys Sys
+	err = unmarshalObj(fmt.Sprintf("%s/.lpmxsys", currdir), &sys)
+	if err != nil {
+		if err.Err == ErrNExist {
+			return []string{}, nil
+		}
+		return nil, err
+	}
+
+	containers := []string{}
+	for id, v := range sys.Containers {
+		cmap, ok := v.(map[string]interface{})
+		if !ok || cmap["Image"] != name {
+			continue
+		}
+		if cname, _ := cmap["ContainerName"].(string); cname != "" {
+			containers = append(containers, fmt.Sprintf("%s(%s)", id, cname))
+		} else {
+			containers = append(containers, id)
+		}
+	}
+	sort.Strings(containers)
+	return containers, nil
+}
+
+//ImageInspect prints the information of image name:tag, either human readable or json
+func ImageInspect(name string, asJson bool) *Error {
+	inspection, err := InspectImage(name)
+	if err != nil {
+		return err
+	}
+
+	if asJson {
+		data, jerr := json.MarshalIndent(inspection, "", "  ")
+		if jerr != nil {
+			cerr := ErrNew(jerr, "could not encode image inspection")
+			return cerr
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+
+	unknown := func(s string) string {
+		if s == "" {
+			return "unknown"
+		}
+		return s
+	}
+	fmt.Printf("%-12s%s\n", "Name:", inspection.Name)
+	fmt.Printf("%-12s%s\n", "Type:", inspection.Type)
+	fmt.Printf("%-12s%s\n", "Digest:", unknown(inspection.Digest))
+	fmt.Printf("%-12s%s\n", "Source:", unknown(inspection.Source))
+	fmt.Printf("%-12s%s\n", "Created:", unknown(inspection.Created))
+	fmt.Printf("%-12s%d\n", "Size:", inspection.Size)
+	if inspection.WorkingDir != "" {
+		fmt.Printf("%-12s%s\n", "WorkDir:", inspection.WorkingDir)
+	}
+	if len(inspection.Env) > 0 {
+		fmt.Printf("%-12s%s\n", "Env:", strings.Join(inspection.Env, " "))
+	}
+	if len(inspection.Cmd) > 0 {
+		fmt.Printf("%-12s%q\n", "Cmd:", inspection.Cmd)
+	}
+	if len(inspection.Labels) > 0 {
+		var labels []string
+		for k, v := range inspection.Labels {
+			labels = append(labels, fmt.Sprintf("%s=%s", k, v))
+		}
+		sort.Strings(labels)
+		fmt.Printf("%-12s%s\n", "Labels:", strings.Join(labels, ", "))
+	}
+	fmt.Printf("%-12s%s\n", "Containers:", strings.Join(inspection.Containers, ", "))
+
+	fmt.Println("Layers:")
+	for _, layer := range inspection.Layers {
+		fmt.Printf("  %-80s%15d\n", layer.Name, layer.Size)
+	}
+
+	if len(inspection.History) > 0 {
+		fmt.Println("History:")
+		for _, history := range inspection.History {
+			created := ""
+			if history.Created != nil {
+				created = history.Created.Format(time.RFC3339)
+			}
+			fmt.Printf("  %-27s%s\n", created, history.CreatedBy)
+			if history.Author != "" {
+				fmt.Printf("  %-27sauthor: %s\n", "", history.Author)
+			}
+			if history.Comment != "" {
+				fmt.Printf("  %-27scomment: %s\n", "", history.Comment)
+			}
+		}
+	}
+
+	fmt.Printf("Setting(%s):\n", inspection.Setting)
+	for _, line := range strings.Split(strings.TrimRight(inspection.SettingContent, "\n"), "\n") {
+		fmt.Printf("  %s\n", line)
+	}
+	return nil
+}
+
+//ImageTag gives image src another name dst, both of them share the same layers, setting.yml and image config
+func ImageTag(src, dst string) *Error {
+	if !strings.Contains(src, ":") {
+		src = src + ":latest"
+	}
+	if !strings.Contains(dst, ":") {
+		dst = dst + ":latest"
+	}
+	currdir, err := GetConfigDir()
+	if err != nil {
+		return err
+	}
+	var doc Image
+	err = unmarshalObj(fmt.Sprintf("%s/.lpmxdata", currdir), &doc)
+	if err != nil {
+		return err
+	}
+	src_data, ok := doc.Images[src].(map[string]interface{})
+	if !ok {
+		cerr := ErrNew(ErrNExist, fmt.Sprintf("name: %s is not found", src))
+		return cerr
+	}
+	if _, ok := doc.Images[dst]; ok {
+		cerr := ErrNew(ErrExist, fmt.Sprintf("%s already exists", dst))
+		return cerr
+	}
+	src_rootdir, _ := src_data["rootdir"].(string)
+
+	tdata := strings.Split(dst, ":")
+	mdata := CopyMap(src_data)
+	mdata["rootdir"] = fmt.Sprintf("%s/%s/%s", doc.RootDir, tdata[0], tdata[1])
+	mdata["config"] = fmt.Sprintf("%s/setting.yml", mdata["rootdir"])
+	mdata["workspace"] = fmt.Sprintf("%s/workspace", mdata["rootdir"])
+	recordImageSource(mdata, fmt.Sprintf("tag:%s", src))
+
+	rootdir := mdata["rootdir"].(string)
+	if FolderExist(rootdir) {
+		cerr := ErrNew(ErrExist, fmt.Sprintf("%s already exists", rootdir))
+		return cerr
+	}
+	derr := os.MkdirAll(mdata["workspace"].(string), os.FileMode(FOLDER_MODE))
+	if derr != nil {
+		cerr := ErrNew(derr, fmt.Sprintf("could not make dir %s", mdata["workspace"]))
+		return cerr
+	}
+
+	//setting.yml and image config are hard linked, so that they are still there if src is deleted
+	if src_setting, _ := src_data["config"].(string); FileExist(src_setting) {
+		err = linkOrCopy(src_setting, mdata["config"].(string))
+		if err != nil {
+			os.RemoveAll(rootdir)
+			return err
+		}
+	}
+	if FileExist(fmt.Sprintf("%s/%s", src_rootdir, IMAGE_CONFIG)) {
+		err = linkOrCopy(fmt.Sprintf("%s/%s", src_rootdir, IMAGE_CONFIG), fmt.Sprintf("%s/%s", rootdir, IMAGE_CONFIG))
+		if err != nil {
+			os.RemoveAll(rootdir)
+			return err
+		}
+	}
+
+	var info ImageInfo
+	err = unmarshalObj(src_rootdir, &info)
+	if err != nil {
+		os.RemoveAll(rootdir)
+		return err
+	}
+	info.Name = dst
+	data, _ := StructMarshal(info)
+	err = WriteToFile(data, fmt.Sprintf("%s/.info", rootdir))
+	if err != nil {
+		os.RemoveAll(rootdir)
+		return err
+	}
+
+	doc.Images[dst] = mdata
+	return marshalObj(doc.RootDir, &doc)
+}
+
+func linkOrCopy(src, dst string) *Error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	_, err := CopyFile(src, dst)
+	return err
+}
+
+//layerRefCount counts how many images use each layer(by its file name), the image exclude is not counted
+func layerRefCount(doc *Image, exclude string) map[string]int {
+	refs := make(map[string]int)
+	for name, v := range doc.Images {
+		mdata, ok := v.(map[string]interface{})
+		if !ok || name == exclude {
+			continue
+		}
+		//merged images keep their original layers for packaging
+		used := make(map[string]bool)
+		for _, key := range []string{"layer_order", "orig_layer_order"} {
+			order, _ := mdata[key].(string)
+			for _, layer := range strings.Split(order, ":") {
+				if layer != "" {
+					used[path.Base(layer)] = true
+				}
+			}
+		}
+		for layer := range used {
+			refs[layer]++
+		}
+	}
+	return refs
+}
@@ -0,0 +1,115 @@
+package container
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	. "github.com/JasonYangShadow/lpmx/msgpack"
+	. "github.com/JasonYangShadow/lpmx/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+//newTestImageStore creates $/.lpmxdata and $/.lpmxsys with one image test:v1 inside a temporary LPMX_HOME, so that the real lpmx folder is never touched
+func newTestImageStore(t *testing.T) string {
+	t.Setenv(ENV_LPMX_HOME, t.TempDir())
+	currdir, err := GetConfigDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	datadir := fmt.Sprintf("%s/.lpmxdata", currdir)
+	sysdir := fmt.Sprintf("%s/.lpmxsys", currdir)
+	rootdir := fmt.Sprintf("%s/test/v1", datadir)
+	for _, dir := range []string{rootdir + "/workspace", datadir + "/.image", datadir + "/.base/a.tar.gz", datadir + "/.base/b.tar.gz", sysdir} {
+		os.MkdirAll(dir, 0755)
+	}
+	ioutil.WriteFile(fmt.Sprintf("%s/setting.yml", rootdir), []byte("allow_list:\n"), 0644)
+	ioutil.WriteFile(datadir+"/.image/a.tar.gz", []byte("a"), 0644)
+	ioutil.WriteFile(datadir+"/.image/b.tar.gz", []byte("bb"), 0644)
+
+	mdata := map[string]interface{}{
+		"rootdir":     rootdir,
+		"config":      fmt.Sprintf("%s/setting.yml", rootdir),
+		"image":       datadir + "/.image",
+		"base":        datadir + "/.base",
+		"workspace":   rootdir + "/workspace",
+		"imagetype":   "Docker",
+		"layer":       map[string]interface{}{datadir + "/.image/a.tar.gz": int64(1), datadir + "/.image/b.tar.gz": int64(2)},
+		"layer_order": fmt.Sprintf("%s/.image/a.tar.gz:%s/.image/b.tar.gz", datadir, datadir),
+	}
+	recordImageSource(mdata, "registry:test:v1")
+	doc := Image{RootDir: datadir, Images: map[string]interface{}{"test:v1": mdata}}
+	data, _ := StructMarshal(doc)
+	WriteToFile(data, datadir+"/.info")
+
+	info := ImageInfo{Name: "test:v1", ImageType: "Docker", LayersMap: map[string]int64{"a.tar.gz": 1, "b.tar.gz": 2}, Layers: "a.tar.gz:b.tar.gz"}
+	data, _ = StructMarshal(info)
+	WriteToFile(data, rootdir+"/.info")
+
+	condir := fmt.Sprintf("%s/workspace/c1/.lpmx", rootdir)
+	os.MkdirAll(condir, 0755)
+	data, _ = StructMarshal(Container{Id: "c1", ImageBase: "test:v1"})
+	WriteToFile(data, condir+"/.info")
+	writeTestSys(t, map[string]interface{}{"c1": map[string]string{"Image": "test:v1", "ContainerName": "web", "ConfigPath": condir}})
+
+	t.Cleanup(func() {
+		os.RemoveAll(datadir)
+		os.RemoveAll(sysdir)
+	})
+	return datadir
+}
+
+func writeTestSys(t *testing.T, containers map[string]interface{}) {
+	currdir, err := GetConfigDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sysdir := fmt.Sprintf("%s/.lpmxsys", currdir)
+	data, _ := StructMarshal(Sys{RootDir: sysdir, Containers: containers})
+	WriteToFile(data, sysdir+"/.info")
+}
+
+func TestInspectImage(t *testing.T) {
+	newTestImageStore(t)
+
+	inspection, err := InspectImage("test:v1")
+	assert.Nil(t, err)
+	assert.Equal(t, "Docker", inspection.Type)
+	assert.Equal(t, "registry:test:v1", inspection.Source)
+	assert.NotEmpty(t, inspection.Created)
+	assert.Equal(t, []LayerInspection{{Name: "a.tar.gz", Size: 1}, {Name: "b.tar.gz", Size: 2}}, inspection.Layers)
+	assert.Equal(t, int64(3), inspection.Size)
+	assert.Equal(t, "allow_list:\n", inspection.SettingContent)
+	assert.Equal(t, []string{"c1(web)"}, inspection.Containers)
+
+	_, err = InspectImage("missing:v1")
+	assert.NotNil(t, err)
+}
+
+func TestImageTag(t *testing.T) {
+	datadir := newTestImageStore(t)
+
+	assert.Nil(t, ImageTag("test:v1", "alias:v1"))
+	assert.NotNil(t, ImageTag("test:v1", "alias:v1"), "existing name could not be tagged again")
+	assert.NotNil(t, ImageTag("missing:v1", "alias:v2"))
+
+	inspection, err := InspectImage("alias:v1")
+	assert.Nil(t, err)
+	assert.Equal(t, "tag:test:v1", inspection.Source)
+	assert.Equal(t, 2, len(inspection.Layers))
+	assert.Equal(t, "allow_list:\n", inspection.SettingContent)
+
+	//the container still relies on test:v1
+	assert.NotNil(t, CommonDelete("test:v1", true))
+	writeTestSys(t, map[string]interface{}{})
+
+	assert.Nil(t, CommonDelete("test:v1", true))
+	assert.True(t, FileExist(datadir+"/.image/a.tar.gz"), "layers used by alias should be kept")
+	assert.True(t, FolderExist(datadir+"/.base/b.tar.gz"))
+	assert.True(t, FileExist(datadir+"/alias/v1/setting.yml"), "setting of alias should survive")
+
+	assert.Nil(t, CommonDelete("alias:v1", true))
+	assert.False(t, FileExist(datadir+"/.image/a.tar.gz"), "unreferenced layers should be deleted")
+	assert.False(t, FolderExist(datadir+"/.base/b.tar.gz"))
+}
@@ -0,0 +1,273 @@
+package container
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"strings"
+
+	. "github.com/JasonYangShadow/lpmx/docker"
+	. "github.com/JasonYangShadow/lpmx/error"
+	. "github.com/JasonYangShadow/lpmx/log"
+	. "github.com/JasonYangShadow/lpmx/utils"
+	"github.com/goccy/go-yaml"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	LIBC_GLIBC   = "glibc"
+	LIBC_MUSL    = "musl"
+	LIBC_UNKNOWN = "unknown"
+)
+
+var (
+	//dynamic loaders of glibc and musl on supported architectures
+	PROFILE_LOADERS = []string{"ld-linux-x86-64.so.2", "ld-musl-x86_64.so.1", "ld-linux-aarch64.so.1", "ld-musl-aarch64.so.1", "ld64.so.2", "ld-musl-powerpc64le.so.1", "ld-linux.so.2", "ld-musl-i386.so.1"}
+	//folders searched for dynamic loaders
+	PROFILE_LOADER_DIRS = []string{"lib64", "lib", "lib/x86_64-linux-gnu", "lib/aarch64-linux-gnu", "lib/powerpc64le-linux-gnu", "lib/i386-linux-gnu", "usr/lib64", "usr/lib", "usr/lib/x86_64-linux-gnu", "usr/lib/aarch64-linux-gnu", "usr/lib/powerpc64le-linux-gnu", "usr/lib/i386-linux-gnu"}
+	//shells in the order of preference for user_shell
+	PROFILE_SHELLS = []string{"bin/bash", "usr/bin/bash", "bin/sh", "usr/bin/sh", "bin/ash", "bin/dash", "bin/zsh", "usr/bin/zsh"}
+)
+
+//ImageProfile is what is found inside the layers of image, it is used for generating setting.yml if setting repository does not publish one for image.
+//All paths are relative to the root of layers, just like the ones inside setting.yml
+type ImageProfile struct {
+	Loader  string   `json:"loader"`   //dynamic loader
+	Libc    string   `json:"libc"`     //glibc, musl or unknown
+	Shells  []string `json:"shells"`   //available shells, the first one is used as user_shell
+	LibDirs []string `json:"lib_dirs"` //folders of LD_LIBRARY_PATH_DEFAULT existing inside layers
+}
+
+//layerExist checks whether rel exists inside the union of layers(from higher to lower), files removed by whiteouts of higher layers do not exist
+func layerExist(base string, layers []string, rel string, dir bool) bool {
+	parent, name := filepath.Split(rel)
+	for _, layer := range layers {
+		root := filepath.Join(base, layer)
+		target := filepath.Join(root, rel)
+		if (dir && FolderExist(target)) || (!dir && FileExist(target)) {
+			return true
+		}
+		if FileExist(filepath.Join(root, parent, ".wh."+name)) {
+			return false
+		}
+	}
+	return false
+}
+
+//InspectLayers scans extracted layers(folder names inside base, from higher to lower) for the dynamic loader, shells, libc flavour and library folders
+func InspectLayers(base string, layers []string) *ImageProfile {
+	profile := &ImageProfile{Libc: LIBC_UNKNOWN, Shells: []string{}, LibDirs: []string{}}
+	for _, loader := range PROFILE_LOADERS {
+		for _, dir := range PROFILE_LOADER_DIRS {
+			if rel := fmt.Sprintf("%s/%s", dir, loader); layerExist(base, layers, rel, false) {
+				profile.Loader = rel
+				break
+			}
+		}
+		if profile.Loader != "" {
+			if strings.HasPrefix(loader, "ld-musl") {
+				profile.Libc = LIBC_MUSL
+			} else {
+				profile.Libc = LIBC_GLIBC
+			}
+			break
+		}
+	}
+
+	for _, shell := range PROFILE_SHELLS {
+		if layerExist(base, layers, shell, false) {
+			profile.Shells = append(profile.Shells, shell)
+		}
+	}
+
+	for _, dir := range LD_LIBRARY_PATH_DEFAULT {
+		if layerExist(base, layers, dir, true) {
+			profile.LibDirs = append(profile.LibDirs, dir)
+		}
+	}
+	return profile
+}
+
+//profileImage inspects the layers of image map mdata
+func profileImage(mdata map[string]interface{}) (*ImageProfile, *Error) {
+	base, _ := mdata["base"].(string)
+	layer_order, _ := mdata["layer_order"].(string)
+	if base == "" || layer_order == "" {
+		cerr := ErrNew(ErrNil, "image does not record its extracted layers")
+		return nil, cerr
+	}
+	var layers []string
+	for _, layer := range strings.Split(layer_order, ":") {
+		if layer != "" {
+			layers = append(layers, path.Base(layer))
+		}
+	}
+	return InspectLayers(base, ReverseStrArray(layers)), nil
+}
+
+//setItem replaces the value of key inside s, it is appended if key does not exist
+func setItem(s yaml.MapSlice, key string, value interface{}) yaml.MapSlice {
+	for i := range s {
+		if s[i].Key == key {
+			s[i].Value = value
+			return s
+		}
+	}
+	return append(s, yaml.MapItem{Key: key, Value: value})
+}
+
+//hasEnv checks whether one item of export_env sets env
+func hasEnv(item interface{}, env string) bool {
+	switch m := item.(type) {
+	case map[string]interface{}:
+		_, ok := m[env]
+		return ok
+	case map[interface{}]interface{}:
+		_, ok := m[env]
+		return ok
+	case yaml.MapSlice:
+		for _, i := range m {
+			if i.Key == env {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+//Apply sets user_shell, fakechroot_elfloader and LD_LIBRARY_PATH of export_env inside setting according to profile, other settings are kept
+func (profile *ImageProfile) Apply(setting yaml.MapSlice) yaml.MapSlice {
+	if len(profile.Shells) > 0 {
+		setting = setItem(setting, "user_shell", profile.Shells[0])
+	}
+	if profile.Loader != "" {
+		setting = setItem(setting, "fakechroot_elfloader", profile.Loader)
+	}
+	if len(profile.LibDirs) > 0 {
+		var envs []interface{}
+		for _, item := range setting {
+			if item.Key != "export_env" {
+				continue
+			}
+			if list, ok := item.Value.([]interface{}); ok {
+				for _, env := range list {
+					if !hasEnv(env, "LD_LIBRARY_PATH") {
+						envs = append(envs, env)
+					}
+				}
+			}
+		}
+		envs = append(envs, yaml.MapSlice{{Key: "LD_LIBRARY_PATH", Value: profile.LibDirs}})
+		setting = setItem(setting, "export_env", envs)
+	}
+	return setting
+}
+
+//writeProfileSetting applies profile to setting file config, a new one is created if it does not exist
+func writeProfileSetting(config, name string, profile *ImageProfile) *Error {
+	var setting yaml.MapSlice
+	if data, rerr := ioutil.ReadFile(config); rerr == nil {
+		if yerr := yaml.Unmarshal(data, &setting); yerr != nil {
+			cerr := ErrNew(yerr, fmt.Sprintf("could not parse %s", config))
+			return cerr
+		}
+	}
+	data, yerr := yaml.Marshal(profile.Apply(setting))
+	if yerr != nil {
+		cerr := ErrNew(yerr, fmt.Sprintf("could not encode setting of %s", name))
+		return cerr
+	}
+	header := fmt.Sprintf("#generated from the contents of %s(libc: %s), run 'lpmx image profile --regenerate %s' to redo it\n", name, profile.Libc, name)
+	return WriteToFile(append([]byte(header), data...), config)
+}
+
+//downloadSetting fetches setting.yml of image name:tag into its rootdir, if setting repository only provides the default one,
+//it is tailored according to the extracted layers of image
+func downloadSetting(name, tag, yaml string, mdata map[string]interface{}) *Error {
+	rdir, _ := mdata["rootdir"].(string)
+	source, err := DownloadFilefromGithubSource(name, tag, "setting.yml", SettingURL(), rdir, yaml)
+	if err != nil && err.Err != ErrNExist {
+		return err
+	}
+	if err == nil && source != DefaultSettingSource(SettingURL(), "setting.yml") {
+		return nil
+	}
+
+	profile, perr := profileImage(mdata)
+	if perr == nil {
+		config := fmt.Sprintf("%s/setting.yml", rdir)
+		perr = writeProfileSetting(config, fmt.Sprintf("%s:%s", name, tag), profile)
+	}
+	if perr != nil {
+		//the default setting is still usable
+		if err == nil {
+			LOGGER.WithFields(logrus.Fields{
+				"err":   perr,
+				"image": name,
+			}).Warn("could not generate setting.yml from image contents, default one is used")
+			return nil
+		}
+		return err
+	}
+	fmt.Printf("setting.yml of %s:%s is not published, it is generated from image contents(loader: %s, libc: %s)\n", name, tag, profile.Loader, profile.Libc)
+	return nil
+}
+
+//ProfileImage prints what is found inside the layers of image name:tag, setting.yml of image is regenerated if regenerate is true
+func ProfileImage(name string, regenerate, asJson bool) *Error {
+	if !strings.Contains(name, ":") {
+		name = name + ":latest"
+	}
+	currdir, err := GetConfigDir()
+	if err != nil {
+		return err
+	}
+	var doc Image
+	err = unmarshalObj(fmt.Sprintf("%s/.lpmxdata", currdir), &doc)
+	if err != nil {
+		return err
+	}
+	mdata, ok := doc.Images[name].(map[string]interface{})
+	if !ok {
+		cerr := ErrNew(ErrNExist, fmt.Sprintf("name: %s is not found", name))
+		return cerr
+	}
+	profile, err := profileImage(mdata)
+	if err != nil {
+		return err
+	}
+	config, _ := mdata["config"].(string)
+	if regenerate {
+		err = writeProfileSetting(config, name, profile)
+		if err != nil {
+			return err
+		}
+	}
+
+	if asJson {
+		data, jerr := json.MarshalIndent(profile, "", "  ")
+		if jerr != nil {
+			cerr := ErrNew(jerr, "could not encode image profile")
+			return cerr
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+	unknown := func(s string) string {
+		if s == "" {
+			return "unknown"
+		}
+		return s
+	}
+	fmt.Printf("%-12s%s\n", "Name:", name)
+	fmt.Printf("%-12s%s\n", "Loader:", unknown(profile.Loader))
+	fmt.Printf("%-12s%s\n", "Libc:", profile.Libc)
+	fmt.Printf("%-12s%s\n", "Shells:", strings.Join(profile.Shells, ", "))
+	fmt.Printf("%-12s%s\n", "LibDirs:", strings.Join(profile.LibDirs, ", "))
+	if regenerate {
+		fmt.Printf("%s is regenerated\n", config)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package container
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/JasonYangShadow/lpmx/yaml"
+	"github.com/goccy/go-yaml"
+	"github.com/stretchr/testify/assert"
+)
+
+//writeLayerFiles creates files(empty) inside layer folder of base
+func writeLayerFiles(t *testing.T, base, layer string, files ...string) {
+	for _, file := range files {
+		target := filepath.Join(base, layer, file)
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(target, nil, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestInspectLayers(t *testing.T) {
+	base, err := ioutil.TempDir("", "lpmx-profile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(base)
+
+	writeLayerFiles(t, base, "lower", "lib/ld-musl-x86_64.so.1", "bin/sh", "bin/bash", "usr/lib/libc.so")
+	//higher layer removes bash
+	writeLayerFiles(t, base, "upper", "bin/.wh.bash", "bin/ash", "usr/local/lib/libfoo.so")
+	profile := InspectLayers(base, []string{"upper", "lower"})
+	assert.Equal(t, "lib/ld-musl-x86_64.so.1", profile.Loader)
+	assert.Equal(t, LIBC_MUSL, profile.Libc)
+	assert.Equal(t, []string{"bin/sh", "bin/ash"}, profile.Shells)
+	assert.Equal(t, []string{"lib", "usr/lib", "usr/local/lib"}, profile.LibDirs)
+
+	writeLayerFiles(t, base, "glibc", "lib64/ld-linux-x86-64.so.2")
+	profile = InspectLayers(base, []string{"glibc"})
+	assert.Equal(t, LIBC_GLIBC, profile.Libc)
+	assert.Equal(t, "lib64/ld-linux-x86-64.so.2", profile.Loader)
+	assert.Empty(t, profile.Shells)
+}
+
+func TestApplyProfile(t *testing.T) {
+	var setting yaml.MapSlice
+	assert.Nil(t, yaml.Unmarshal([]byte("user_shell: /bin/bash\nadd_map:\n  - a\nexport_env:\n  - PATH: $/usr/bin\n  - LD_LIBRARY_PATH:\n      - lib\n"), &setting))
+	profile := &ImageProfile{Loader: "lib/ld-musl-x86_64.so.1", Libc: LIBC_MUSL, Shells: []string{"bin/ash"}, LibDirs: []string{"lib", "usr/lib"}}
+
+	var applied map[string]interface{}
+	data, err := yaml.Marshal(profile.Apply(setting))
+	assert.Nil(t, err)
+	assert.Nil(t, yaml.Unmarshal(data, &applied))
+	assert.Equal(t, "bin/ash", applied["user_shell"])
+	assert.Equal(t, "lib/ld-musl-x86_64.so.1", applied["fakechroot_elfloader"])
+	assert.Equal(t, []interface{}{"a"}, applied["add_map"])
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"PATH": "$/usr/bin"},
+		map[string]interface{}{"LD_LIBRARY_PATH": []interface{}{"lib", "usr/lib"}},
+	}, applied["export_env"])
+}
+
+func TestProfileImageRegenerate(t *testing.T) {
+	datadir := newTestImageStore(t)
+	writeLayerFiles(t, datadir+"/.base", "a.tar.gz", "lib64/ld-linux-x86-64.so.2", "bin/bash")
+	writeLayerFiles(t, datadir+"/.base", "b.tar.gz", "usr/lib64/libfoo.so")
+
+	assert.Nil(t, ProfileImage("test:v1", true, false))
+	_, setting, err := LoadConfig(fmt.Sprintf("%s/test/v1/setting.yml", datadir))
+	assert.Nil(t, err)
+	assert.Equal(t, "bin/bash", setting["user_shell"])
+	assert.Equal(t, "lib64/ld-linux-x86-64.so.2", setting["fakechroot_elfloader"])
+	//existing settings are kept
+	data, _ := ioutil.ReadFile(fmt.Sprintf("%s/test/v1/setting.yml", datadir))
+	assert.Contains(t, string(data), "allow_list:")
+
+	assert.NotNil(t, ProfileImage("missing:v1", true, false))
+}
@@ -0,0 +1,414 @@
+package container
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/JasonYangShadow/lpmx/error"
+	. "github.com/JasonYangShadow/lpmx/log"
+	. "github.com/JasonYangShadow/lpmx/utils"
+	. "github.com/JasonYangShadow/lpmx/yaml"
+	"github.com/sirupsen/logrus"
+)
+
+//pathFn converts one path recorded inside state files
+type pathFn func(string) string
+
+//underRoot returns p relative to root, ok is false if p is not inside root
+func underRoot(root, p string) (string, bool) {
+	if p == root {
+		return ".", true
+	}
+	if strings.HasPrefix(p, root+"/") {
+		return strings.TrimPrefix(p, root+"/"), true
+	}
+	return "", false
+}
+
+//relativeTo converts absolute paths inside root to relative ones, paths outside root are kept as they are
+func relativeTo(root string) pathFn {
+	root = filepath.Clean(root)
+	return func(p string) string {
+		if rel, ok := underRoot(root, filepath.Clean(p)); ok && p != "" {
+			return rel
+		}
+		return p
+	}
+}
+
+//absoluteTo resolves relative paths against root
+func absoluteTo(root string) pathFn {
+	return func(p string) string {
+		if p == "" || filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(root, p)
+	}
+}
+
+//movedTo converts absolute paths inside oldroot to the same paths inside newroot
+func movedTo(oldroot, newroot string) pathFn {
+	oldroot = filepath.Clean(oldroot)
+	newroot = filepath.Clean(newroot)
+	return func(p string) string {
+		if rel, ok := underRoot(oldroot, filepath.Clean(p)); ok && p != "" {
+			return filepath.Join(newroot, rel)
+		}
+		return p
+	}
+}
+
+//mapList converts each path of list separated by sep
+func mapList(list, sep string, fn pathFn) string {
+	if list == "" {
+		return list
+	}
+	items := strings.Split(list, sep)
+	for i, item := range items {
+		items[i] = fn(item)
+	}
+	return strings.Join(items, sep)
+}
+
+//mapPairs converts host paths of list like host1=container1:host2=container2, container paths are kept
+func mapPairs(list string, fn pathFn) string {
+	return mapList(list, ":", func(pair string) string {
+		if kv := strings.SplitN(pair, "=", 2); len(kv) == 2 {
+			return fmt.Sprintf("%s=%s", fn(kv[0]), kv[1])
+		}
+		return pair
+	})
+}
+
+//withPaths returns the copy of container with all host paths converted by fn
+func (con Container) withPaths(fn pathFn) Container {
+	con.RootPath = fn(con.RootPath)
+	con.ConfigPath = fn(con.ConfigPath)
+	con.BaseLayerPath = fn(con.BaseLayerPath)
+	con.LogPath = fn(con.LogPath)
+	con.ElfPatcherPath = fn(con.ElfPatcherPath)
+	con.PatchedELFLoader = fn(con.PatchedELFLoader)
+	con.SettingPath = fn(con.SettingPath)
+	con.SysDir = fn(con.SysDir)
+	con.PidFile = fn(con.PidFile)
+	//the shell is found inside layers when the container is created, so it is a host path as well
+	con.UserShell = fn(con.UserShell)
+	con.DataSyncFolder = mapList(con.DataSyncFolder, ":", fn)
+	con.DataSyncMap = mapPairs(con.DataSyncMap, fn)
+	con.FileSyncMap = mapPairs(con.FileSyncMap, fn)
+	return con
+}
+
+//withPaths returns the copy of sys with all host paths(including the ones of registered containers) converted by fn
+func (sys Sys) withPaths(fn pathFn) Sys {
+	sys.RootDir = fn(sys.RootDir)
+	sys.LogPath = fn(sys.LogPath)
+	containers := make(map[string]interface{})
+	for id, v := range sys.Containers {
+		var cmap map[string]interface{}
+		switch m := v.(type) {
+		case map[string]interface{}:
+			cmap = CopyMap(m)
+		case map[string]string:
+			cmap = make(map[string]interface{})
+			for k, s := range m {
+				cmap[k] = s
+			}
+		default:
+			containers[id] = v
+			continue
+		}
+		for _, key := range []string{"RootPath", "SettingPath", "ConfigPath", "BaseLayerPath"} {
+			if s, ok := cmap[key].(string); ok {
+				cmap[key] = fn(s)
+			}
+		}
+		if s, ok := cmap["DataSyncFolder"].(string); ok {
+			cmap["DataSyncFolder"] = mapList(s, ":", fn)
+		}
+		for _, key := range []string{"DataSyncMap", "MountFile"} {
+			if s, ok := cmap[key].(string); ok {
+				cmap[key] = mapPairs(s, fn)
+			}
+		}
+		containers[id] = cmap
+	}
+	if sys.Containers != nil {
+		sys.Containers = containers
+	}
+	return sys
+}
+
+//withPaths returns the copy of doc with all host paths of images converted by fn
+func (doc Image) withPaths(fn pathFn) Image {
+	doc.RootDir = fn(doc.RootDir)
+	images := make(map[string]interface{})
+	for name, v := range doc.Images {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			images[name] = v
+			continue
+		}
+		mdata := CopyMap(m)
+		for _, key := range []string{"rootdir", "config", "image", "base", "workspace"} {
+			if s, ok := mdata[key].(string); ok {
+				mdata[key] = fn(s)
+			}
+		}
+		for _, key := range []string{"layer_order", "orig_layer_order"} {
+			if s, ok := mdata[key].(string); ok {
+				mdata[key] = mapList(s, ":", fn)
+			}
+		}
+		//layer maps tarballs to their sizes
+		switch layers := mdata["layer"].(type) {
+		case map[string]interface{}:
+			lmap := make(map[string]interface{})
+			for k, size := range layers {
+				lmap[fn(k)] = size
+			}
+			mdata["layer"] = lmap
+		case map[string]int64:
+			lmap := make(map[string]int64)
+			for k, size := range layers {
+				lmap[fn(k)] = size
+			}
+			mdata["layer"] = lmap
+		}
+		images[name] = mdata
+	}
+	if doc.Images != nil {
+		doc.Images = images
+	}
+	return doc
+}
+
+//replaceRoot replaces oldroot inside text with newroot, oldroot should be followed by '/' or characters not used in paths
+func replaceRoot(text, oldroot, newroot string) (string, int) {
+	var buf strings.Builder
+	count := 0
+	for {
+		idx := strings.Index(text, oldroot)
+		if idx < 0 {
+			buf.WriteString(text)
+			break
+		}
+		end := idx + len(oldroot)
+		if end < len(text) && text[end] != '/' && !strings.ContainsRune(" \t\n\"':=;", rune(text[end])) {
+			buf.WriteString(text[:end])
+			text = text[end:]
+			continue
+		}
+		buf.WriteString(text[:idx])
+		buf.WriteString(newroot)
+		text = text[end:]
+		count++
+	}
+	return buf.String(), count
+}
+
+//relocateFile replaces oldroot inside file with newroot, it returns whether file is changed
+func relocateFile(file, oldroot, newroot string) (bool, *Error) {
+	fi, err := os.Stat(file)
+	if err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("could not stat %s", file))
+		return false, cerr
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("could not read %s", file))
+		return false, cerr
+	}
+	text, count := replaceRoot(string(data), oldroot, newroot)
+	if count == 0 {
+		return false, nil
+	}
+	if err := ioutil.WriteFile(file, []byte(text), fi.Mode().Perm()); err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("could not write %s", file))
+		return false, cerr
+	}
+	return true, nil
+}
+
+//relocateSymlinks retargets symlinks inside folder pointing into oldroot, targets inside newroot become relative
+func relocateSymlinks(folder, oldroot, newroot string) (int, *Error) {
+	fn := movedTo(oldroot, newroot)
+	count := 0
+	err := filepath.Walk(folder, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			return nil
+		}
+		target, err := os.Readlink(file)
+		if err != nil || !filepath.IsAbs(target) {
+			return err
+		}
+		moved := fn(target)
+		if moved == target {
+			return nil
+		}
+		if _, ok := underRoot(filepath.Clean(newroot), moved); ok {
+			if rel, rerr := filepath.Rel(filepath.Dir(file), moved); rerr == nil {
+				moved = rel
+			}
+		}
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+		if err := os.Symlink(moved, file); err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("could not relocate symlinks inside %s", folder))
+		return count, cerr
+	}
+	return count, nil
+}
+
+//Relocate rewrites the state files, setting files, patched elf files, symlinks of containers and exposed wrappers after lpmx directory is moved from oldroot to newroot,
+//newroot should be the directory managed by the running lpmx
+func Relocate(oldroot, newroot string) *Error {
+	currdir, err := GetConfigDir()
+	if err != nil {
+		return err
+	}
+	oldroot, _ = filepath.Abs(oldroot)
+	newroot, _ = filepath.Abs(newroot)
+	if filepath.Clean(newroot) != filepath.Clean(currdir) {
+		cerr := ErrNew(ErrMismatch, fmt.Sprintf("lpmx manages %s rather than %s, please run relocate with lpmx inside %s", currdir, newroot, newroot))
+		return cerr
+	}
+	if oldroot == newroot {
+		return nil
+	}
+	fn := movedTo(oldroot, newroot)
+	sysdir := fmt.Sprintf("%s/.lpmxsys", currdir)
+	datadir := fmt.Sprintf("%s/.lpmxdata", currdir)
+
+	var sys Sys
+	err = unmarshalObj(sysdir, &sys)
+	if err != nil {
+		return err
+	}
+	sys = sys.withPaths(fn)
+	err = marshalObj(sysdir, &sys)
+	if err != nil {
+		return err
+	}
+
+	containers, symlinks := 0, 0
+	var relocated []Container
+	for id, v := range sys.Containers {
+		cmap, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		config_path, _ := cmap["ConfigPath"].(string)
+		var con Container
+		if cerr := unmarshalObj(config_path, &con); cerr != nil {
+			LOGGER.WithFields(logrus.Fields{
+				"id":  id,
+				"err": cerr,
+			}).Warn("could not relocate container, state file is missing")
+			continue
+		}
+		con = con.withPaths(fn)
+		err = marshalObj(config_path, &con)
+		if err != nil {
+			return err
+		}
+		containers++
+		relocated = append(relocated, con)
+		if root_path, _ := cmap["RootPath"].(string); root_path != "" {
+			count, err := relocateSymlinks(filepath.Dir(root_path), oldroot, newroot)
+			if err != nil {
+				return err
+			}
+			symlinks += count
+		}
+	}
+
+	var doc Image
+	images, settings := 0, 0
+	err = unmarshalObj(datadir, &doc)
+	if err != nil && err.Err != ErrNExist {
+		return err
+	}
+	if err == nil {
+		doc = doc.withPaths(fn)
+		err = marshalObj(datadir, &doc)
+		if err != nil {
+			return err
+		}
+		images = len(doc.Images)
+		for _, v := range doc.Images {
+			mdata, ok := v.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if config, _ := mdata["config"].(string); FileExist(config) {
+				changed, err := relocateFile(config, oldroot, newroot)
+				if err != nil {
+					return err
+				}
+				if changed {
+					settings++
+				}
+			}
+		}
+	}
+
+	//elf files patched when containers were created point into oldroot, the patching is redone with the relocated setting files
+	elfs := 0
+	for _, con := range relocated {
+		_, conf, err := LoadConfig(con.SettingPath)
+		if err != nil {
+			LOGGER.WithFields(logrus.Fields{
+				"id":  con.Id,
+				"err": err,
+			}).Warn("could not relocate elf files of container, setting file is missing")
+			continue
+		}
+		con.SettingConf = conf
+		patches, err := con.collectPatches()
+		if err != nil {
+			return err
+		}
+		for _, patch := range patches {
+			patch.MoveRoot(oldroot, newroot)
+		}
+		err = applyPatches(patches)
+		if err != nil {
+			return err
+		}
+		elfs += len(patches)
+	}
+
+	wrappers := 0
+	bindir := fmt.Sprintf("%s/bin", currdir)
+	if files, rerr := ioutil.ReadDir(bindir); rerr == nil {
+		for _, file := range files {
+			if !file.Mode().IsRegular() {
+				continue
+			}
+			changed, err := relocateFile(filepath.Join(bindir, file.Name()), oldroot, newroot)
+			if err != nil {
+				return err
+			}
+			if changed {
+				wrappers++
+			}
+		}
+	}
+
+	fmt.Printf("relocated from %s to %s: %d containers, %d images, %d setting files, %d elf files, %d exposed wrappers, %d symlinks\n", oldroot, newroot, containers, images, settings, elfs, wrappers, symlinks)
+	return nil
+}
@@ -0,0 +1,110 @@
+package container
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/JasonYangShadow/lpmx/msgpack"
+	. "github.com/JasonYangShadow/lpmx/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatePathsRelative(t *testing.T) {
+	datadir := newTestImageStore(t)
+	currdir, _ := GetConfigDir()
+
+	var doc Image
+	assert.Nil(t, unmarshalObj(datadir, &doc))
+	mdata := doc.Images["test:v1"].(map[string]interface{})
+	mdata["source"] = "oci:/somewhere/else"
+	mdata["image"] = "/somewhere/else"
+	assert.Nil(t, marshalObj(datadir, &doc))
+	//in memory object is not changed
+	assert.Equal(t, datadir, doc.RootDir)
+
+	var raw Image
+	data, _ := ReadFromFile(datadir + "/.info")
+	assert.Nil(t, StructUnmarshal(data, &raw))
+	assert.Equal(t, ".lpmxdata", raw.RootDir)
+	rmdata := raw.Images["test:v1"].(map[string]interface{})
+	assert.Equal(t, ".lpmxdata/test/v1", rmdata["rootdir"])
+	assert.Equal(t, ".lpmxdata/.image/a.tar.gz:.lpmxdata/.image/b.tar.gz", rmdata["layer_order"])
+	assert.Contains(t, rmdata["layer"], ".lpmxdata/.image/a.tar.gz")
+	//paths outside lpmx are kept
+	assert.Equal(t, "/somewhere/else", rmdata["image"])
+
+	var loaded Image
+	assert.Nil(t, unmarshalObj(datadir, &loaded))
+	lmdata := loaded.Images["test:v1"].(map[string]interface{})
+	assert.Equal(t, fmt.Sprintf("%s/.lpmxdata/test/v1", currdir), lmdata["rootdir"])
+	assert.Equal(t, fmt.Sprintf("%s/.lpmxdata/.image/a.tar.gz:%s/.lpmxdata/.image/b.tar.gz", currdir, currdir), lmdata["layer_order"])
+}
+
+func TestReplaceRoot(t *testing.T) {
+	text, count := replaceRoot("/old/lpmx/bin:/old/lpmx2/bin /old/lpmx\n\"/old/lpmx\"", "/old/lpmx", "/new")
+	assert.Equal(t, 3, count)
+	assert.Equal(t, "/new/bin:/old/lpmx2/bin /new\n\"/new\"", text)
+}
+
+func TestRelocate(t *testing.T) {
+	datadir := newTestImageStore(t)
+	currdir, _ := GetConfigDir()
+	oldroot := "/old/lpmx"
+	old := movedTo(currdir, oldroot)
+
+	//state written by lpmx at the old location with absolute paths
+	var doc Image
+	assert.Nil(t, unmarshalObj(datadir, &doc))
+	data, _ := StructMarshal(doc.withPaths(old))
+	WriteToFile(data, datadir+"/.info")
+
+	condir := fmt.Sprintf("%s/test/v1/workspace/c1", datadir)
+	os.MkdirAll(condir+"/rw", 0755)
+	con := Container{Id: "c1", ImageBase: "test:v1", RootPath: condir + "/rw", ConfigPath: condir + "/.lpmx", SettingPath: datadir + "/test/v1/setting.yml", UserShell: datadir + "/.base/a.tar.gz/bin/bash", DataSyncMap: fmt.Sprintf("%s/sync/c1=/lpmx:/host=/data", currdir)}
+	oldcon := con.withPaths(old)
+	assert.Equal(t, oldroot+"/.lpmxdata/.base/a.tar.gz/bin/bash", oldcon.UserShell)
+	data, _ = StructMarshal(oldcon)
+	WriteToFile(data, condir+"/.lpmx/.info")
+	sys := Sys{RootDir: currdir + "/.lpmxsys", Containers: map[string]interface{}{"c1": map[string]interface{}{"Image": "test:v1", "RootPath": con.RootPath, "ConfigPath": con.ConfigPath}}}
+	data, _ = StructMarshal(sys.withPaths(old))
+	WriteToFile(data, currdir+"/.lpmxsys/.info")
+
+	os.Symlink(oldroot+"/.lpmxdata/.base/a.tar.gz", condir+"/a.tar.gz")
+	os.Symlink("/host", condir+"/rw/data")
+	ioutil.WriteFile(datadir+"/test/v1/setting.yml", []byte("fakechroot_elfloader: /old/lpmx/.lpmxsys/ld.so\n"), 0644)
+	os.MkdirAll(currdir+"/bin", 0755)
+	defer os.RemoveAll(currdir + "/bin")
+	ioutil.WriteFile(currdir+"/bin/python", []byte("#!/bin/bash\n/old/lpmx/lpmx resume c1 -- /usr/bin/python \"$@\"\n"), 0755)
+
+	assert.NotNil(t, Relocate(oldroot, "/somewhere/else"))
+	assert.Nil(t, Relocate(oldroot, currdir))
+
+	var relocated Container
+	assert.Nil(t, unmarshalObj(condir+"/.lpmx", &relocated))
+	assert.Equal(t, condir+"/rw", relocated.RootPath)
+	assert.Equal(t, datadir+"/test/v1/setting.yml", relocated.SettingPath)
+	assert.Equal(t, fmt.Sprintf("%s/sync/c1=/lpmx:/host=/data", currdir), relocated.DataSyncMap)
+	assert.Equal(t, datadir+"/.base/a.tar.gz/bin/bash", relocated.UserShell)
+
+	var rsys Sys
+	assert.Nil(t, unmarshalObj(currdir+"/.lpmxsys", &rsys))
+	assert.Equal(t, condir+"/rw", rsys.Containers["c1"].(map[string]interface{})["RootPath"])
+
+	var rdoc Image
+	assert.Nil(t, unmarshalObj(datadir, &rdoc))
+	assert.Equal(t, datadir+"/.base", rdoc.Images["test:v1"].(map[string]interface{})["base"])
+
+	link, _ := os.Readlink(condir + "/a.tar.gz")
+	assert.Equal(t, "../../../../.base/a.tar.gz", link)
+	assert.True(t, FolderExist(filepath.Join(condir, link)))
+	link, _ = os.Readlink(condir + "/rw/data")
+	assert.Equal(t, "/host", link)
+
+	setting, _ := ioutil.ReadFile(datadir + "/test/v1/setting.yml")
+	assert.Equal(t, fmt.Sprintf("fakechroot_elfloader: %s/.lpmxsys/ld.so\n", currdir), string(setting))
+	wrapper, _ := ioutil.ReadFile(currdir + "/bin/python")
+	assert.Contains(t, string(wrapper), currdir+"/lpmx resume c1")
+}
@@ -0,0 +1,241 @@
+package container
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	. "github.com/JasonYangShadow/lpmx/error"
+	. "github.com/JasonYangShadow/lpmx/log"
+	. "github.com/JasonYangShadow/lpmx/utils"
+	"github.com/sirupsen/logrus"
+)
+
+//OBJECT_STORE is the folder inside .lpmxdata keeping the contents of extracted layer files keyed by hash,
+//layer folders hardlink them. The store is optional, deduplication is enabled once it exists
+const OBJECT_STORE = ".objects"
+
+//StoreUsage is the disk usage reported by lpmx df
+type StoreUsage struct {
+	Images        int              `json:"images"`
+	Tarballs      int64            `json:"tarballs"`       //size of layer tarballs
+	Layers        int              `json:"layers"`         //number of extracted layers
+	LayerApparent int64            `json:"layer_apparent"` //size of extracted layers if nothing was shared
+	LayerActual   int64            `json:"layer_actual"`   //size of extracted layers occupying the disk
+	Objects       int              `json:"objects"`        //number of objects inside the store
+	Dedup         bool             `json:"dedup"`          //whether the object store is enabled
+	Containers    map[string]int64 `json:"containers"`     //size of the rw layer of each container
+}
+
+//objectStore returns the object store of the layer folder(.lpmxdata/.base/<layer>), it is empty if deduplication is not enabled
+func objectStore(layerfolder string) string {
+	store := filepath.Join(filepath.Dir(filepath.Dir(filepath.Clean(layerfolder))), OBJECT_STORE)
+	if !FolderExist(store) {
+		return ""
+	}
+	return store
+}
+
+//dedupLayer hardlinks the files of extracted layer folder to the object store if it is enabled
+func dedupLayer(layerfolder string) *Error {
+	store := objectStore(layerfolder)
+	if store == "" {
+		return nil
+	}
+	stats, err := DedupFolder(layerfolder, store)
+	if err != nil {
+		return err
+	}
+	LOGGER.WithFields(logrus.Fields{
+		"layer":  layerfolder,
+		"files":  stats.Files,
+		"linked": stats.Linked,
+		"saved":  stats.Saved,
+	}).Debug("dedupLayer finished")
+	return nil
+}
+
+//extractLayer extracts layer tarball into layerfolder and deduplicates its files
+func extractLayer(tar_path, layerfolder string) *Error {
+	err := Untar(tar_path, layerfolder)
+	if err != nil {
+		return err
+	}
+	return dedupLayer(layerfolder)
+}
+
+//gcObjects removes objects not used by any layer of base folder(.lpmxdata/.base) any longer
+func gcObjects(base string) *Error {
+	store := filepath.Join(filepath.Dir(filepath.Clean(base)), OBJECT_STORE)
+	removed, freed, err := GCObjects(store)
+	if err != nil {
+		return err
+	}
+	LOGGER.WithFields(logrus.Fields{
+		"store":   store,
+		"removed": removed,
+		"freed":   freed,
+	}).Debug("gcObjects finished")
+	return nil
+}
+
+//Dedup enables the object store and deduplicates all extracted layers, objects no longer used are removed
+func Dedup() *Error {
+	currdir, err := GetConfigDir()
+	if err != nil {
+		return err
+	}
+	rootdir := fmt.Sprintf("%s/.lpmxdata", currdir)
+	base := fmt.Sprintf("%s/.base", rootdir)
+	store := fmt.Sprintf("%s/%s", rootdir, OBJECT_STORE)
+	if !FolderExist(store) {
+		derr := os.MkdirAll(store, os.FileMode(FOLDER_MODE))
+		if derr != nil {
+			cerr := ErrNew(derr, fmt.Sprintf("could not make dir %s", store))
+			return cerr
+		}
+	}
+
+	layers, rerr := ioutil.ReadDir(base)
+	if rerr != nil && !os.IsNotExist(rerr) {
+		cerr := ErrNew(rerr, fmt.Sprintf("could not read dir %s", base))
+		return cerr
+	}
+	total := new(DedupStats)
+	for _, layer := range layers {
+		if !layer.IsDir() {
+			continue
+		}
+		fmt.Printf("deduplicating layer %s...\n", layer.Name())
+		stats, err := DedupFolder(filepath.Join(base, layer.Name()), store)
+		if err != nil {
+			return err
+		}
+		total.Files += stats.Files
+		total.Linked += stats.Linked
+		total.Saved += stats.Saved
+	}
+	err = gcObjects(base)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d files inspected, %d files replaced with hardlinks, %d bytes saved\n", total.Files, total.Linked, total.Saved)
+	return nil
+}
+
+//GetStoreUsage calculates the disk usage of images, layers and containers
+func GetStoreUsage() (*StoreUsage, *Error) {
+	currdir, err := GetConfigDir()
+	if err != nil {
+		return nil, err
+	}
+	rootdir := fmt.Sprintf("%s/.lpmxdata", currdir)
+	usage := new(StoreUsage)
+	usage.Containers = make(map[string]int64)
+
+	var doc Image
+	err = unmarshalObj(rootdir, &doc)
+	if err != nil && err.Err != ErrNExist {
+		return nil, err
+	}
+	usage.Images = len(doc.Images)
+
+	tarballs, err := GetDiskUsage(fmt.Sprintf("%s/.image", rootdir))
+	if err != nil {
+		return nil, err
+	}
+	usage.Tarballs = tarballs.Actual
+
+	base := fmt.Sprintf("%s/.base", rootdir)
+	if layers, rerr := ioutil.ReadDir(base); rerr == nil {
+		for _, layer := range layers {
+			if layer.IsDir() {
+				usage.Layers++
+			}
+		}
+	}
+	store := fmt.Sprintf("%s/%s", rootdir, OBJECT_STORE)
+	usage.Dedup = FolderExist(store)
+	//objects are counted once together with the layers linking them
+	layer_usage, err := GetDiskUsage(base, store)
+	if err != nil {
+		return nil, err
+	}
+	objects, err := GetDiskUsage(store)
+	if err != nil {
+		return nil, err
+	}
+	usage.Objects = objects.Files
+	usage.LayerApparent = layer_usage.Apparent - objects.Apparent
+	usage.LayerActual = layer_usage.Actual
+
+	var sys Sys
+	err = unmarshalObj(fmt.Sprintf("%s/.lpmxsys", currdir), &sys)
+	if err != nil && err.Err != ErrNExist {
+		return nil, err
+	}
+	for id, v := range sys.Containers {
+		cmap, ok := v.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		config_path, _ := cmap["ConfigPath"].(string)
+		var con Container
+		if cerr := unmarshalObj(config_path, &con); cerr != nil {
+			continue
+		}
+		rw, err := GetDiskUsage(con.RootPath)
+		if err != nil {
+			return nil, err
+		}
+		usage.Containers[id] = rw.Actual
+	}
+	return usage, nil
+}
+
+//Df prints disk usage of lpmx, either human readable or json
+func Df(asJson bool) *Error {
+	usage, err := GetStoreUsage()
+	if err != nil {
+		return err
+	}
+	if asJson {
+		data, jerr := json.MarshalIndent(usage, "", "  ")
+		if jerr != nil {
+			cerr := ErrNew(jerr, "could not encode disk usage")
+			return cerr
+		}
+		fmt.Println(string(data))
+		return nil
+	}
+
+	var rw int64
+	for _, size := range usage.Containers {
+		rw += size
+	}
+	fmt.Printf("%-12s%-8s%15s%15s\n", "TYPE", "TOTAL", "SIZE", "SAVED")
+	fmt.Printf("%-12s%-8d%15d%15s\n", "Images", usage.Images, usage.Tarballs, "-")
+	fmt.Printf("%-12s%-8d%15d%15d\n", "Layers", usage.Layers, usage.LayerActual, usage.LayerApparent-usage.LayerActual)
+	fmt.Printf("%-12s%-8d%15d%15s\n", "Containers", len(usage.Containers), rw, "-")
+	if usage.Dedup {
+		fmt.Printf("deduplication is enabled, %d objects are shared by layers\n", usage.Objects)
+	} else {
+		fmt.Println("deduplication is disabled, run 'lpmx dedup' to enable it")
+	}
+
+	if len(usage.Containers) > 0 {
+		var ids []string
+		for id := range usage.Containers {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+		fmt.Println("Containers:")
+		for _, id := range ids {
+			fmt.Printf("  %-40s%15d\n", id, usage.Containers[id])
+		}
+	}
+	return nil
+}
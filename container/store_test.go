@@ -0,0 +1,39 @@
+package container
+
+import (
+	"io/ioutil"
+	"testing"
+
+	. "github.com/JasonYangShadow/lpmx/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDedupAndDf(t *testing.T) {
+	datadir := newTestImageStore(t)
+	for _, layer := range []string{"a.tar.gz", "b.tar.gz"} {
+		ioutil.WriteFile(datadir+"/.base/"+layer+"/libc.so", []byte("libc"), 0755)
+	}
+
+	usage, err := GetStoreUsage()
+	assert.Nil(t, err)
+	assert.False(t, usage.Dedup)
+	assert.Equal(t, 1, usage.Images)
+	assert.Equal(t, 2, usage.Layers)
+	assert.Equal(t, usage.LayerApparent, usage.LayerActual)
+
+	assert.Nil(t, Dedup())
+	usage, err = GetStoreUsage()
+	assert.Nil(t, err)
+	assert.True(t, usage.Dedup)
+	assert.Equal(t, 1, usage.Objects)
+	assert.Equal(t, int64(8), usage.LayerApparent)
+	assert.Equal(t, int64(4), usage.LayerActual)
+	assert.Contains(t, usage.Containers, "c1")
+
+	//deleting the image releases its objects
+	writeTestSys(t, map[string]interface{}{})
+	assert.Nil(t, CommonDelete("test:v1", true))
+	objects, err := GetDiskUsage(datadir + "/" + OBJECT_STORE)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, objects.Files)
+}
@@ -0,0 +1,271 @@
+package docker
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	. "github.com/JasonYangShadow/lpmx/error"
+	. "github.com/JasonYangShadow/lpmx/utils"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	FORMAT_DOCKER_ARCHIVE = "docker-archive" //the tarball produced by docker save
+	FORMAT_OCI            = "oci"            //oci image layout directory
+	FORMAT_OCI_ARCHIVE    = "oci-archive"    //oci image layout packed in a tarball
+
+	//AnnotationImageName keeps the full image name inside index.json, as ref.name only contains the tag
+	AnnotationImageName = "io.containerd.image.name"
+)
+
+//archiveWriter stores files of an image archive either into a directory or a tarball
+type archiveWriter interface {
+	Add(name string, size int64, r io.Reader) error
+	Close() error
+}
+
+type dirArchiveWriter struct {
+	root string
+}
+
+func (w *dirArchiveWriter) Add(name string, size int64, r io.Reader) error {
+	target := filepath.Join(w.root, name)
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(f, r)
+	return err
+}
+
+func (w *dirArchiveWriter) Close() error {
+	return nil
+}
+
+type tarArchiveWriter struct {
+	file *os.File
+	tw   *tar.Writer
+}
+
+func (w *tarArchiveWriter) Add(name string, size int64, r io.Reader) error {
+	header := &tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  time.Now(),
+		Typeflag: tar.TypeReg,
+	}
+	if err := w.tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := io.Copy(w.tw, r)
+	return err
+}
+
+func (w *tarArchiveWriter) Close() error {
+	if err := w.tw.Close(); err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+func addBytes(w archiveWriter, name string, data []byte) error {
+	return w.Add(name, int64(len(data)), bytes.NewReader(data))
+}
+
+//addLayer adds the layer file, uncompress is true if the layer should be stored as plain tar
+func addLayer(w archiveWriter, name string, layer *LayerDescriptor, uncompress bool) error {
+	f, err := os.Open(layer.File)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if !uncompress || layer.DiffID == layer.Digest {
+		return w.Add(name, layer.Size, f)
+	}
+	r, _, cerr := Decompress(f)
+	if cerr != nil {
+		return cerr
+	}
+	defer r.Close()
+	return w.Add(name, layer.DiffSize, r)
+}
+
+//SaveImage exports the image consisting of layers(from lower to higher) to target in the given format,
+//base is the image configuration recorded by lpmx, it could be nil if there is none
+func SaveImage(name string, layers []string, base *ocispec.Image, format, target string) *Error {
+	if format != FORMAT_DOCKER_ARCHIVE && format != FORMAT_OCI && format != FORMAT_OCI_ARCHIVE {
+		cerr := ErrNew(ErrType, fmt.Sprintf("format %s is not supported, should be one of %s, %s and %s", format, FORMAT_DOCKER_ARCHIVE, FORMAT_OCI, FORMAT_OCI_ARCHIVE))
+		return cerr
+	}
+	if _, err := os.Stat(target); err == nil {
+		cerr := ErrNew(ErrExist, fmt.Sprintf("%s already exists", target))
+		return cerr
+	}
+	if !strings.Contains(name, ":") {
+		name = name + ":latest"
+	}
+
+	var descs []*LayerDescriptor
+	for _, layer := range layers {
+		desc, err := DescribeLayer(layer)
+		if err != nil {
+			return err
+		}
+		descs = append(descs, desc)
+	}
+	config := RebaseImageConfig(base, descs)
+	config_data, err := json.Marshal(config)
+	if err != nil {
+		cerr := ErrNew(err, "could not encode image config")
+		return cerr
+	}
+
+	var w archiveWriter
+	if format == FORMAT_OCI {
+		w = &dirArchiveWriter{root: target}
+	} else {
+		f, err := os.Create(target)
+		if err != nil {
+			cerr := ErrNew(err, fmt.Sprintf("could not create %s", target))
+			return cerr
+		}
+		w = &tarArchiveWriter{file: f, tw: tar.NewWriter(f)}
+	}
+
+	if format == FORMAT_DOCKER_ARCHIVE {
+		err = writeDockerArchive(w, name, descs, config_data)
+	} else {
+		err = writeOCILayout(w, name, descs, config_data)
+	}
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.RemoveAll(target)
+		cerr := ErrNew(err, fmt.Sprintf("could not save image %s to %s", name, target))
+		return cerr
+	}
+	return nil
+}
+
+func writeDockerArchive(w archiveWriter, name string, layers []*LayerDescriptor, config_data []byte) error {
+	info := DockerSaveInfo{
+		Config:   fmt.Sprintf("%s.json", digest.FromBytes(config_data).Hex()),
+		RepoTags: []string{name},
+	}
+	if err := addBytes(w, info.Config, config_data); err != nil {
+		return err
+	}
+
+	added := make(map[string]bool)
+	for _, layer := range layers {
+		layer_name := fmt.Sprintf("%s/layer.tar", layer.DiffID.Hex())
+		info.Layers = append(info.Layers, layer_name)
+		if added[layer_name] {
+			continue
+		}
+		added[layer_name] = true
+		if err := addLayer(w, layer_name, layer, true); err != nil {
+			return err
+		}
+	}
+
+	manifest, err := json.Marshal([]DockerSaveInfo{info})
+	if err != nil {
+		return err
+	}
+	return addBytes(w, "manifest.json", manifest)
+}
+
+func writeOCILayout(w archiveWriter, name string, layers []*LayerDescriptor, config_data []byte) error {
+	layout, err := json.Marshal(ocispec.ImageLayout{Version: ocispec.ImageLayoutVersion})
+	if err != nil {
+		return err
+	}
+	if err := addBytes(w, ocispec.ImageLayoutFile, layout); err != nil {
+		return err
+	}
+
+	manifest := ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config: ocispec.Descriptor{
+			MediaType: ocispec.MediaTypeImageConfig,
+			Digest:    digest.FromBytes(config_data),
+			Size:      int64(len(config_data)),
+		},
+	}
+	if err := addBytes(w, blobPath(manifest.Config.Digest), config_data); err != nil {
+		return err
+	}
+
+	added := make(map[digest.Digest]bool)
+	for _, layer := range layers {
+		compression, cerr := LayerCompression(layer.MediaType)
+		if cerr != nil {
+			return cerr
+		}
+		media_type := LayerMediaType(compression, true)
+		manifest.Layers = append(manifest.Layers, ocispec.Descriptor{
+			MediaType: media_type,
+			Digest:    layer.Digest,
+			Size:      layer.Size,
+		})
+		if added[layer.Digest] {
+			continue
+		}
+		added[layer.Digest] = true
+		if err := addLayer(w, blobPath(layer.Digest), layer, false); err != nil {
+			return err
+		}
+	}
+
+	manifest_data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	manifest_digest := digest.FromBytes(manifest_data)
+	if err := addBytes(w, blobPath(manifest_digest), manifest_data); err != nil {
+		return err
+	}
+
+	index := ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Manifests: []ocispec.Descriptor{
+			{
+				MediaType: ocispec.MediaTypeImageManifest,
+				Digest:    manifest_digest,
+				Size:      int64(len(manifest_data)),
+				Annotations: map[string]string{
+					ocispec.AnnotationRefName: name[strings.LastIndex(name, ":")+1:],
+					AnnotationImageName:       name,
+				},
+			},
+		},
+	}
+	index_data, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	return addBytes(w, "index.json", index_data)
+}
+
+//blobPath returns the path of blob inside oci image layout
+func blobPath(dgst digest.Digest) string {
+	return fmt.Sprintf("blobs/%s/%s", dgst.Algorithm(), dgst.Hex())
+}
@@ -0,0 +1,131 @@
+package docker
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/JasonYangShadow/lpmx/utils"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+//writeTestLayer creates a gzip compressed layer containing a single file and returns its path and uncompressed content
+func writeTestLayer(t *testing.T, dir, name, content string) (string, []byte) {
+	var tbuf bytes.Buffer
+	tw := tar.NewWriter(&tbuf)
+	tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg})
+	tw.Write([]byte(content))
+	tw.Close()
+
+	var gbuf bytes.Buffer
+	gzw := gzip.NewWriter(&gbuf)
+	gzw.Write(tbuf.Bytes())
+	gzw.Close()
+
+	file := filepath.Join(dir, name+".tar.gz")
+	if err := ioutil.WriteFile(file, gbuf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file, tbuf.Bytes()
+}
+
+func readTar(t *testing.T, file string) map[string][]byte {
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	files := make(map[string][]byte)
+	tr := tar.NewReader(f)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(tr)
+		files[header.Name] = data
+	}
+	return files
+}
+
+func TestSaveDockerArchive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lpmx-save")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l1, raw1 := writeTestLayer(t, dir, "a", "first")
+	l2, raw2 := writeTestLayer(t, dir, "b", "second")
+	target := filepath.Join(dir, "image.tar")
+	cerr := SaveImage("test", []string{l1, l2}, nil, FORMAT_DOCKER_ARCHIVE, target)
+	assert.Nil(t, cerr)
+
+	files := readTar(t, target)
+	var infos []DockerSaveInfo
+	assert.Nil(t, json.Unmarshal(files["manifest.json"], &infos))
+	assert.Equal(t, []string{"test:latest"}, infos[0].RepoTags)
+	assert.Equal(t, []string{digest.FromBytes(raw1).Hex() + "/layer.tar", digest.FromBytes(raw2).Hex() + "/layer.tar"}, infos[0].Layers)
+	assert.Equal(t, raw1, files[infos[0].Layers[0]], "layers should be stored uncompressed")
+
+	var config ocispec.Image
+	assert.Nil(t, json.Unmarshal(files[infos[0].Config], &config))
+	assert.Equal(t, []digest.Digest{digest.FromBytes(raw1), digest.FromBytes(raw2)}, config.RootFS.DiffIDs)
+
+	cerr = SaveImage("test", []string{l1, l2}, nil, FORMAT_DOCKER_ARCHIVE, target)
+	assert.NotNil(t, cerr, "existing target should not be overwritten")
+}
+
+func TestSaveOCILayout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lpmx-save")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l1, raw1 := writeTestLayer(t, dir, "a", "first")
+	target := filepath.Join(dir, "layout")
+	cerr := SaveImage("test:v1", []string{l1}, nil, FORMAT_OCI, target)
+	assert.Nil(t, cerr)
+
+	var index ocispec.Index
+	data, _ := ioutil.ReadFile(filepath.Join(target, "index.json"))
+	assert.Nil(t, json.Unmarshal(data, &index))
+	assert.Equal(t, "v1", index.Manifests[0].Annotations[ocispec.AnnotationRefName])
+	assert.Equal(t, "test:v1", index.Manifests[0].Annotations[AnnotationImageName])
+
+	var manifest ocispec.Manifest
+	data, _ = ioutil.ReadFile(filepath.Join(target, blobPath(index.Manifests[0].Digest)))
+	assert.Equal(t, index.Manifests[0].Digest, digest.FromBytes(data))
+	assert.Nil(t, json.Unmarshal(data, &manifest))
+	assert.Equal(t, ocispec.MediaTypeImageLayerGzip, manifest.Layers[0].MediaType)
+
+	layer, _ := ioutil.ReadFile(filepath.Join(target, blobPath(manifest.Layers[0].Digest)))
+	assert.Equal(t, manifest.Layers[0].Digest, digest.FromBytes(layer))
+	gzr, _ := gzip.NewReader(bytes.NewReader(layer))
+	uncompressed, _ := ioutil.ReadAll(gzr)
+	assert.Equal(t, raw1, uncompressed)
+	assert.True(t, FileExist(filepath.Join(target, ocispec.ImageLayoutFile)))
+
+	archive := filepath.Join(dir, "layout.tar")
+	cerr = SaveImage("test:v1", []string{l1}, nil, FORMAT_OCI_ARCHIVE, archive)
+	assert.Nil(t, cerr)
+	files := readTar(t, archive)
+	assert.Contains(t, files, "index.json")
+	assert.Contains(t, files, blobPath(manifest.Layers[0].Digest))
+
+	cerr = SaveImage("test:v1", []string{l1}, nil, "unknown", filepath.Join(dir, "x"))
+	assert.NotNil(t, cerr)
+}
+
@@ -1,7 +1,7 @@
 package docker
 
 import (
-	"crypto/rand"
+	"bytes"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -14,23 +14,42 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
 	. "github.com/JasonYangShadow/lpmx/error"
 	registry "github.com/JasonYangShadow/lpmx/registry"
 	. "github.com/JasonYangShadow/lpmx/utils"
 	. "github.com/JasonYangShadow/lpmx/yaml"
-	. "github.com/docker/distribution/manifest"
-	"github.com/docker/distribution/manifest/schema1"
-	"github.com/docker/libtrust"
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/manifest/ocischema"
+	"github.com/docker/distribution/manifest/schema2"
 	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 )
 
 const (
-	DOCKER_URL  = "https://registry-1.docker.io"
 	SETTING_URL = "https://raw.githubusercontent.com/JasonYangShadow/LPMXSettingRepository/master/v1.9"
 )
 
+var (
+	//DOCKER_URL is the registry used by docker commands, registry.url of config.yaml overrides it
+	DOCKER_URL = "https://registry-1.docker.io"
+	//REGISTRY_USER and REGISTRY_PASS are used when no credentials are given on the command line
+	REGISTRY_USER = ""
+	REGISTRY_PASS = ""
+	//DOWNLOAD_WORKERS is the number of layers downloaded concurrently
+	DOWNLOAD_WORKERS = 1
+)
+
+//newRegistry connects to DOCKER_URL, the default credentials are used if neither username nor pass is given
+func newRegistry(username, pass string) (*registry.Registry, error) {
+	if username == "" && pass == "" {
+		username, pass = REGISTRY_USER, REGISTRY_PASS
+	}
+	return registry.New(DOCKER_URL, username, pass)
+}
+
 //Docker load image structure
 type DockerSaveInfo struct {
 	Config   string   //config json file name
@@ -55,7 +74,7 @@ type SkopeoManifest struct {
 
 func ListRepositories(username string, pass string) ([]string, *Error) {
 	log.SetOutput(ioutil.Discard)
-	hub, err := registry.New(DOCKER_URL, username, pass)
+	hub, err := newRegistry(username, pass)
 	if err != nil {
 		cerr := ErrNew(err, "create docker registry instance failure")
 		return nil, cerr
@@ -73,7 +92,7 @@ func ListTags(username string, pass string, name string) ([]string, *Error) {
 	if !strings.Contains(name, "library/") && !strings.Contains(name, "/") {
 		name = "library/" + name
 	}
-	hub, err := registry.New(DOCKER_URL, username, pass)
+	hub, err := newRegistry(username, pass)
 	if err != nil {
 		cerr := ErrNew(err, "create docker registry instance failure")
 		return nil, cerr
@@ -91,7 +110,7 @@ func GetDigest(username string, pass string, name string, tag string) (string, *
 	if !strings.Contains(name, "library/") && !strings.Contains(name, "/") {
 		name = "library/" + name
 	}
-	hub, err := registry.New(DOCKER_URL, username, pass)
+	hub, err := newRegistry(username, pass)
 	if err != nil {
 		cerr := ErrNew(err, "create docker registry instance failure")
 		return "", cerr
@@ -104,234 +123,146 @@ func GetDigest(username string, pass string, name string, tag string) (string, *
 	return digest.String(), nil
 }
 
-func MakeManifestV1(registry *registry.Registry, name, tag, layer_sha, base_image string) (*schema1.SignedManifest, *Error) {
+//PushImage uploads layers and image configuration to docker hub and tags the resulting manifest as name:tag.
+//It is a schema2 manifest unless some layer is compressed with zstd, which only has oci media type, then an oci manifest is pushed.
+//Layers already in the repository are skipped, and those of base repository mountFrom are mounted instead of uploaded if possible.
+//The tag is only updated after all blobs are in place, so that a failed push never leaves a broken tag behind
+func PushImage(username, pass, name, tag string, layers []*LayerDescriptor, config *ocispec.Image, mountFrom string) (digest.Digest, *Error) {
 	log.SetOutput(ioutil.Discard)
-
-	if !strings.Contains(base_image, "library/") && !strings.Contains(base_image, "/") {
-		base_image = "library/" + base_image
-	}
-	base_info := strings.Split(base_image, ":")
-	man_base, man_err := registry.Manifest(base_info[0], base_info[1])
-	if man_err != nil {
-		cerr := ErrNew(man_err, fmt.Sprintf("unable to parse base image manifest: %s", base_image))
-		return nil, cerr
-	}
-
-	manifest := schema1.Manifest{
-		Versioned: Versioned{
-			SchemaVersion: 1,
-		},
-		Name: name,
-		Tag:  tag,
+	if !strings.Contains(name, "library/") && !strings.Contains(name, "/") {
+		name = "library/" + name
 	}
-	//modification starts
-	//FSLayers assemble
-	dig := digest.NewDigestFromHex("sha256", layer_sha)
-	new_fslayer := schema1.FSLayer{
-		BlobSum: dig,
+	if mountFrom != "" && !strings.Contains(mountFrom, "library/") && !strings.Contains(mountFrom, "/") {
+		mountFrom = "library/" + mountFrom
 	}
-	layers := []schema1.FSLayer{new_fslayer}
-	layers = append(layers, man_base.FSLayers...)
-	manifest.FSLayers = layers
 
-	//history assemble
-	//replacing the original top V1
-	orig_v1 := make(map[string]*json.RawMessage)
-	err := json.Unmarshal([]byte(man_base.History[0].V1Compatibility), &orig_v1)
+	hub, err := newRegistry(username, pass)
 	if err != nil {
-		cerr := ErrNew(err, "could not unmarshal V1Compatibility object")
-		return nil, cerr
-	}
-
-	type v1comp struct {
-		ID              string `json:"id"`
-		Parent          string `json:"parent,omitempty"`
-		Comment         string `json:"comment,omitempty"`
-		Created         string `json:"created"`
-		ContainerConfig struct {
-			Cmd []string
-		} `json:"container_config,omitempty"`
-		Author    string `json:"author,omitempty"`
-		ThrowAway bool   `json:"throwaway,omitempty"`
-	}
-
-	var oid, oparent, ocreated string
-	json.Unmarshal(*orig_v1["id"], &oid)
-	json.Unmarshal(*orig_v1["parent"], &oparent)
-	json.Unmarshal(*orig_v1["created"], &ocreated)
-	v1 := v1comp{
-		ID:      oid,
-		Parent:  oparent,
-		Created: ocreated,
-		ContainerConfig: struct {
-			Cmd []string
-		}{
-			Cmd: []string{""},
-		},
-	}
-	v1_json, _ := json.Marshal(&v1)
-	man_base.History[0].V1Compatibility = string(v1_json)
-
-	//create new top layer V1Compatibility
-	if _, ok := orig_v1["container"]; ok {
-		delete(orig_v1, "container")
-	}
-	if _, ok := orig_v1["throwaway"]; ok {
-		delete(orig_v1, "throwaway")
-	}
-	orig_v1["parent"] = orig_v1["id"]
-	id, cerr := randomRead(32)
-	if cerr != nil {
-		return nil, cerr
+		cerr := ErrNew(err, "create docker registry instance failure")
+		return "", cerr
 	}
 
-	sha_id, cerr := Sha256str(string(id))
-	if cerr != nil {
-		return nil, cerr
-	}
-	orig_v1["id"] = rawJson(sha_id)
-	orig_v1["created"] = rawJson(time.Now().UTC().Format(time.RFC3339))
-	//modify container_config & config
-	if cconfig, ok := orig_v1["container_config"]; ok {
-		cconfig_map := make(map[string]*json.RawMessage)
-		err := json.Unmarshal([]byte(*cconfig), &cconfig_map)
+	for _, layer := range layers {
+		ok, err := hub.HasBlob(name, layer.Digest)
 		if err != nil {
-			cerr := ErrNew(err, "unable to unmarshal container_config object")
-			return nil, cerr
+			cerr := ErrNew(err, fmt.Sprintf("could not check blob %s", layer.Digest))
+			return "", cerr
+		}
+		if ok {
+			fmt.Println(fmt.Sprintf("layer %s exists, skip...", layer.Digest))
+			continue
 		}
 
-		if _, ok := cconfig_map["Image"]; ok {
-			if !strings.HasPrefix(layer_sha, "sha256:") {
-				layer_sha = "sha256:" + layer_sha
+		if mountFrom != "" && mountFrom != name {
+			if mounted, _ := hub.MountBlob(name, layer.Digest, mountFrom); mounted {
+				fmt.Println(fmt.Sprintf("layer %s is mounted from %s", layer.Digest, mountFrom))
+				continue
 			}
-			cconfig_map["Image"] = rawJson(layer_sha)
 		}
 
-		//write back
-		orig_v1["container_config"] = rawJson(cconfig_map)
-	}
-
-	if _, ok := orig_v1["config"]; ok {
-		delete(orig_v1, "config")
-		/**
-		config_map := make(map[string]*json.RawMessage)
-		err := json.Unmarshal([]byte(rawJsonToStr(config)), &config_map)
+		fmt.Println(fmt.Sprintf("uploading layer %s, size: %d", layer.Digest, layer.Size))
+		f, err := os.Open(layer.File)
 		if err != nil {
-			cerr := ErrNew(err, "unable to unmarshal config object")
-			return nil, cerr
+			cerr := ErrNew(err, fmt.Sprintf("could not open file: %s", layer.File))
+			return "", cerr
 		}
-		if _, ok := config_map["Image"]; ok {
-			if !strings.HasPrefix(layer_sha, "sha256:") {
-				layer_sha = "sha256:" + layer_sha
-			}
-			config_map["Image"] = rawJson(layer_sha)
+		err = hub.UploadBlob(name, layer.Digest, f)
+		f.Close()
+		if err != nil {
+			cerr := ErrNew(err, fmt.Sprintf("could not upload layer %s", layer.Digest))
+			return "", cerr
 		}
-		//write back
-		orig_v1["config"] = rawJson(config_map)
-		**/
-	}
-
-	histories := []schema1.History{schema1.History{V1Compatibility: rawJsonToStr(rawJson(orig_v1))}}
-	histories = append(histories, man_base.History...)
-	manifest.History = histories
-
-	//modification ends
-	pk, err := libtrust.GenerateECP256PrivateKey()
-	if err != nil {
-		cerr := ErrNew(err, "unexpected error generating private key")
-		return nil, cerr
-	}
-
-	signedManifest, err := schema1.Sign(&manifest, pk)
-	if err != nil {
-		cerr := ErrNew(err, "error signning manifest")
-		return nil, cerr
-	}
-
-	return signedManifest, nil
-}
-
-func rawJsonToStr(rjson *json.RawMessage) string {
-	j, _ := json.Marshal(rjson)
-	return string(j)
-}
-
-func rawJson(value interface{}) *json.RawMessage {
-	jsonval, err := json.Marshal(value)
-	if err != nil {
-		return nil
 	}
-	return (*json.RawMessage)(&jsonval)
-}
 
-func randomRead(num int) ([]byte, *Error) {
-	b := make([]byte, num)
-	_, err := rand.Read(b)
+	config_data, err := json.Marshal(config)
 	if err != nil {
-		cerr := ErrNew(err, "error while generating random bytes")
-		return nil, cerr
+		cerr := ErrNew(err, "could not marshal image config")
+		return "", cerr
 	}
-	return b, nil
-}
-
-func UploadManifests(username, pass, name, tag, layer_sha, base_image string) *Error {
-	log.SetOutput(ioutil.Discard)
-	hub, err := registry.New(DOCKER_URL, username, pass)
-	if err != nil {
-		cerr := ErrNew(err, "create docker registry instance failure")
-		return cerr
+	config_digest := digest.FromBytes(config_data)
+	if ok, _ := hub.HasBlob(name, config_digest); !ok {
+		err = hub.UploadBlob(name, config_digest, bytes.NewReader(config_data))
+		if err != nil {
+			cerr := ErrNew(err, "could not upload image config")
+			return "", cerr
+		}
 	}
 
-	signedManifest, serr := MakeManifestV1(hub, name, tag, layer_sha, base_image)
-	if serr != nil {
-		return serr
+	manifest, cerr := imageManifest(layers, int64(len(config_data)), config_digest)
+	if cerr != nil {
+		return "", cerr
 	}
 
-	err = hub.PutManifest(name, tag, *signedManifest)
+	err = hub.PutManifest(name, tag, manifest)
 	if err != nil {
 		cerr := ErrNew(err, "putting manifest error")
-		return cerr
-	}
-	return nil
-}
-
-func UploadLayers(username, pass, name, tag, file, base_image string) (string, *Error) {
-	log.SetOutput(ioutil.Discard)
-
-	if !strings.Contains(name, "library/") && !strings.Contains(name, "/") {
-		name = "library/" + name
+		return "", cerr
 	}
 
-	sha256, err := Sha256file(file)
-	if err != nil {
-		return "", err
-	}
+	_, payload, _ := manifest.Payload()
+	return digest.FromBytes(payload), nil
+}
 
-	token, err := GetToken(name, username, pass, "pull,push")
-	if err != nil {
-		return "", err
+//imageManifest creates the manifest of layers and image configuration. Docker media types have no zstd, so an oci manifest
+//with oci media types of all layers is created if any layer is zstd compressed, otherwise it is a schema2 manifest
+func imageManifest(layers []*LayerDescriptor, config_size int64, config_digest digest.Digest) (distribution.Manifest, *Error) {
+	oci := false
+	for _, layer := range layers {
+		compression, cerr := LayerCompression(layer.MediaType)
+		if cerr != nil {
+			return nil, cerr
+		}
+		if compression == COMPRESSION_ZSTD {
+			oci = true
+			break
+		}
 	}
 
-	hok, herr := HasBlob(name, token, sha256)
-	if herr != nil {
-		return "", herr
-	}
-	if !hok {
-		//step 1: uploading blob
-		_, err := UploadBlob(name, token, file)
-		if err != nil {
-			return "", err
+	var descriptors []distribution.Descriptor
+	for _, layer := range layers {
+		media_type := layer.MediaType
+		if oci {
+			compression, _ := LayerCompression(layer.MediaType)
+			media_type = LayerMediaType(compression, true)
 		}
-
-		//step 2: uploading new manifest
-		err = UploadManifests(username, pass, name, tag, sha256, base_image)
+		descriptors = append(descriptors, distribution.Descriptor{
+			MediaType: media_type,
+			Size:      layer.Size,
+			Digest:    layer.Digest,
+		})
+	}
+
+	if oci {
+		manifest, err := ocischema.FromStruct(ocischema.Manifest{
+			Versioned: ocischema.SchemaVersion,
+			Config: distribution.Descriptor{
+				MediaType: ocispec.MediaTypeImageConfig,
+				Size:      config_size,
+				Digest:    config_digest,
+			},
+			Layers: descriptors,
+		})
 		if err != nil {
-			return "", err
+			cerr := ErrNew(err, "could not create oci manifest")
+			return nil, cerr
 		}
-	} else {
-		return sha256, nil
+		return manifest, nil
+	}
+
+	manifest, err := schema2.FromStruct(schema2.Manifest{
+		Versioned: schema2.SchemaVersion,
+		Config: distribution.Descriptor{
+			MediaType: schema2.MediaTypeImageConfig,
+			Size:      config_size,
+			Digest:    config_digest,
+		},
+		Layers: descriptors,
+	})
+	if err != nil {
+		cerr := ErrNew(err, "could not create schema2 manifest")
+		return nil, cerr
 	}
-	return sha256, nil
+	return manifest, nil
 }
 
 func DeleteManifest(username string, pass string, name string, tag string) *Error {
@@ -339,7 +270,7 @@ func DeleteManifest(username string, pass string, name string, tag string) *Erro
 	if !strings.Contains(name, "library/") && !strings.Contains(name, "/") {
 		name = "library/" + name
 	}
-	hub, err := registry.New(DOCKER_URL, username, pass)
+	hub, err := newRegistry(username, pass)
 	if err != nil {
 		cerr := ErrNew(err, "create docker registry instance failure")
 		return cerr
@@ -382,7 +313,15 @@ func LoadSkopeoTar(dir, imagedir string) (map[string]int64, []string, *Error) {
 	for _, item := range info.Layers {
 		shavalue := strings.Split(item.Digest, ":")[1]
 		layer_path := fmt.Sprintf("%s/%s", dir, shavalue)
-		target_path := fmt.Sprintf("%s/%s.tar.gz", imagedir, shavalue)
+		compression, cerr := LayerCompression(item.MediaType)
+		if cerr != nil {
+			return nil, nil, cerr
+		}
+		cerr = checkCompression(layer_path, compression)
+		if cerr != nil {
+			return nil, nil, cerr
+		}
+		target_path := fmt.Sprintf("%s/%s", imagedir, shavalue)
 		_, rerr := CopyFile(layer_path, target_path)
 		if rerr != nil {
 			return nil, nil, rerr
@@ -425,15 +364,28 @@ func LoadDockerTar(dir, imagedir string) (string, map[string]int64, []string, *E
 	for _, k := range infos[0].Layers {
 		// k is sha256/layer.tar
 		layer_path := fmt.Sprintf("%s/%s", dir, k)
-		shavalue := filepath.Dir(k)
-		//create tar.gz package of current tar package
-		cerr := ConvertTar2Gzip(layer_path, fmt.Sprintf("%s/%s/%s", dir, shavalue, shavalue))
+		temp_path := fmt.Sprintf("%s.gz", layer_path)
+		//layers of docker archive are plain tar, they are compressed to save space unless they are already compressed
+		compression, cerr := FileCompression(layer_path)
 		if cerr != nil {
 			return "", nil, nil, cerr
 		}
+		if compression == COMPRESSION_NONE {
+			cerr := ConvertTar2Gzip(layer_path, temp_path)
+			if cerr != nil {
+				return "", nil, nil, cerr
+			}
+		} else {
+			temp_path = layer_path
+		}
 
-		target_path := fmt.Sprintf("%s/%s.tar.gz", imagedir, shavalue)
-		rerr := Rename(fmt.Sprintf("%s/%s/%s", dir, shavalue, shavalue), target_path)
+		//stored layer is named by the digest of its content
+		layer, cerr := DescribeLayer(temp_path)
+		if cerr != nil {
+			return "", nil, nil, cerr
+		}
+		target_path := fmt.Sprintf("%s/%s", imagedir, layer.Digest.Hex())
+		rerr := Rename(temp_path, target_path)
 		if rerr != nil {
 			return "", nil, nil, rerr
 		}
@@ -448,68 +400,47 @@ func LoadDockerTar(dir, imagedir string) (string, map[string]int64, []string, *E
 	return name, layer_data, layers, nil
 }
 
-func DownloadLayers(username string, pass string, name string, tag string, folder string) (map[string]int64, []string, *Error) {
-	log.SetOutput(ioutil.Discard)
-	if !strings.Contains(name, "library/") && !strings.Contains(name, "/") {
-		name = "library/" + name
+//downloadLayer downloads blob element of image name into folder, blobs already downloaded are skipped, it returns the path of blob
+func downloadLayer(hub *registry.Registry, name string, element distribution.Descriptor, folder string, progress bool) (string, *Error) {
+	dig := element.Digest
+	//layers could be gzip, zstd compressed or plain tar, stored blobs are named by digest only
+	if _, cerr := LayerCompression(element.MediaType); cerr != nil {
+		return "", cerr
 	}
-	if !FolderExist(folder) {
-		_, err := MakeDir(folder)
-		if err != nil {
-			return nil, nil, err
+	filename := folder + "/" + dig.Hex()
+	//layers downloaded by older versions are named with .tar.gz suffix
+	if legacy := filename + ".tar.gz"; !FileExist(filename) && FileExist(legacy) {
+		filename = legacy
+	}
+
+	//if file exists, we skip to next file
+	if FileExist(filename) {
+		if size, err := GetFileSize(filename); err == nil && size == element.Size {
+			fmt.Println(fmt.Sprintf("File %s exists, skip...", filepath.Base(filename)))
+			return filename, nil
 		}
 	}
-	hub, err := registry.New(DOCKER_URL, username, pass)
+
+	//reader, err := hub.DownloadLayer(name, dig)
+	//function name is changed
+	reader, err := hub.DownloadBlob(name, dig)
 	if err != nil {
-		cerr := ErrNew(err, "create docker registry instance failure")
-		return nil, nil, cerr
+		cerr := ErrNew(err, "download docker layers failure")
+		return "", cerr
 	}
-	man, err := hub.ManifestV2(name, tag)
+	defer reader.Close()
+
+	//else not exist
+	to, err := os.Create(filename)
 	if err != nil {
-		cerr := ErrNew(err, "query docker manifest failure")
-		return nil, nil, cerr
+		cerr := ErrNew(err, fmt.Sprintf("create file %s failure", filename))
+		return "", cerr
 	}
-	data := make(map[string]int64)
-	var layer_order []string
-	for _, element := range man.Layers {
-		dig := element.Digest
-		//reader, err := hub.DownloadLayer(name, dig)
-		//function name is changed
-		reader, err := hub.DownloadBlob(name, dig)
-		if err != nil {
-			cerr := ErrNew(err, "download docker layers failure")
-			return nil, nil, cerr
-		}
-		defer reader.Close()
-		if strings.HasSuffix(folder, "/") {
-			folder = strings.TrimSuffix(folder, "/")
-		}
-		filename := folder + "/" + strings.TrimPrefix(dig.String(), "sha256:") + ".tar.gz"
-
-		//if file exists, we skip to next file
-		if FileExist(filename) {
-			if size, err := GetFileSize(filename); err == nil {
-				if size == element.Size {
-					if _, ok := data[filename]; !ok {
-						data[filename] = element.Size
-						layer_order = append(layer_order, filename)
-					}
-					fmt.Println(fmt.Sprintf("File %s exists, skip...", filepath.Base(filename)))
-					continue
-				}
-			}
-		}
+	defer to.Close()
+	fmt.Println(fmt.Sprintf("Downloading file with type: %s, size: %d", element.MediaType, element.Size))
 
-		//else not exist
-		to, err := os.Create(filename)
-		if err != nil {
-			cerr := ErrNew(err, fmt.Sprintf("create file %s failure", filename))
-			return nil, nil, cerr
-		}
-		defer to.Close()
-		fmt.Println(fmt.Sprintf("Downloading file with type: %s, size: %d", element.MediaType, element.Size))
-
-		//printing download percentage using anonymous functions
+	//printing download percentage using anonymous functions, progress lines of concurrent downloads would overwrite each other
+	if progress {
 		go func(filename string, size int64) {
 			f, err := os.Open(filename)
 			if err != nil {
@@ -530,13 +461,89 @@ func DownloadLayers(username string, pass string, name string, tag string, folde
 				fmt.Printf("\r")
 			}
 		}(filename, element.Size)
+	}
 
-		if _, err := io.Copy(to, reader); err != nil {
-			cerr := ErrNew(err, fmt.Sprintf("copy file %s content failure", filename))
-			return nil, nil, cerr
+	verifier := dig.Verifier()
+	if _, err := io.Copy(io.MultiWriter(to, verifier), reader); err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("copy file %s content failure", filename))
+		return "", cerr
+	}
+	if !verifier.Verified() {
+		to.Close()
+		os.Remove(filename)
+		cerr := ErrNew(ErrMismatch, fmt.Sprintf("downloaded layer %s does not match its digest", dig))
+		return "", cerr
+	}
+	return filename, nil
+}
+
+func DownloadLayers(username string, pass string, name string, tag string, folder string) (map[string]int64, []string, *Error) {
+	log.SetOutput(ioutil.Discard)
+	if !strings.Contains(name, "library/") && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	if !FolderExist(folder) {
+		_, err := MakeDir(folder)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	folder = strings.TrimSuffix(folder, "/")
+	hub, err := newRegistry(username, pass)
+	if err != nil {
+		cerr := ErrNew(err, "create docker registry instance failure")
+		return nil, nil, cerr
+	}
+	man, err := hub.ManifestV2(name, tag)
+	if err != nil {
+		cerr := ErrNew(err, "query docker manifest failure")
+		return nil, nil, cerr
+	}
+
+	//the same blob may appear several times inside manifest, it is downloaded once
+	var elements []distribution.Descriptor
+	seen := make(map[digest.Digest]bool)
+	for _, element := range man.Layers {
+		if !seen[element.Digest] {
+			seen[element.Digest] = true
+			elements = append(elements, element)
+		}
+	}
+
+	workers := DOWNLOAD_WORKERS
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(elements) {
+		workers = len(elements)
+	}
+	filenames := make([]string, len(elements))
+	errs := make([]*Error, len(elements))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range jobs {
+				filenames[idx], errs[idx] = downloadLayer(hub, name, elements[idx], folder, workers == 1)
+			}
+		}()
+	}
+	for idx := range elements {
+		jobs <- idx
+	}
+	close(jobs)
+	wg.Wait()
+
+	data := make(map[string]int64)
+	var layer_order []string
+	for idx, element := range elements {
+		if errs[idx] != nil {
+			return nil, nil, errs[idx]
 		}
-		data[filename] = element.Size
-		layer_order = append(layer_order, filename)
+		data[filenames[idx]] = element.Size
+		layer_order = append(layer_order, filenames[idx])
 	}
 	//data is map[string]int64, string is filename, int64 is the size of the layer
 	//layer_order is the array of filenames
@@ -586,44 +593,50 @@ func GenGithubURLfromYaml(name, tag, url, yaml, target_file string) (string, *Er
 }
 
 //a patched version that could search file from different level and auto-select the closet one
-//name: is the name of distro, tag: version of distro, filename: the target request file on github, url: fixed github prefix, folder: local folder saving downloaded file, yaml: yaml file saving distro info located on github
+//name: is the name of distro, tag: version of distro, filename: the target request file on github, url: setting repository, folder: local folder saving downloaded file, yaml: yaml file saving distro info located on github
 func DownloadFilefromGithubPlus(name, tag, filename, url, folder, yaml string) *Error {
-	filepath := fmt.Sprintf("%s/%s", folder, filename)
+	_, err := DownloadFilefromGithubSource(name, tag, filename, url, folder, yaml)
+	return err
+}
+
+//DownloadFilefromGithubSource works as DownloadFilefromGithubPlus and returns the url filename is finally downloaded from,
+//so that callers could tell whether it falls back to the default one, i.e, DefaultSettingSource
+func DownloadFilefromGithubSource(name, tag, filename, url, folder, yaml string) (string, *Error) {
 	if !FolderExist(folder) {
 		_, err := MakeDir(folder)
 		if err != nil {
-			return err
+			return "", err
 		}
 	}
 
-	out, err := os.Create(filepath)
-	if err != nil {
-		cerr := ErrNew(ErrFileStat, fmt.Sprintf("%s file create error", filepath))
-		return cerr
-	}
-	defer out.Close()
-
 	gen_url, _ := GenGithubURLfromYaml(name, tag, url, yaml, filename)
 
 	derr := DirectDownloadFilefromGithub(filename, gen_url, folder)
-	if derr != nil {
+	//only missing files fall back to the upper levels, files failing verification are never replaced by others
+	if derr != nil && derr.Err == ErrNExist {
 		//change to fallback search
 		gen_url = fmt.Sprintf("%s/%s/%s", url, name, filename)
 		derr = DirectDownloadFilefromGithub(filename, gen_url, folder)
-		if derr != nil {
-			gen_url = fmt.Sprintf("%s/default.%s", url, filename)
+		if derr != nil && derr.Err == ErrNExist {
+			gen_url = DefaultSettingSource(url, filename)
 			derr = DirectDownloadFilefromGithub(filename, gen_url, folder)
-			if derr != nil {
-				return derr
-			}
 		}
 	}
+	if derr != nil {
+		return "", derr
+	}
 
 	fmt.Printf("Downloading %s from %s\n", filename, gen_url)
-	return nil
+	return gen_url, nil
+}
+
+//DefaultSettingSource returns the url of the default filename inside setting repository url, used when nothing is published for the image
+func DefaultSettingSource(url, filename string) string {
+	return fmt.Sprintf("%s/default.%s", url, filename)
 }
 
-//url is github url
+//url is the url of file inside setting repository(http(s) url, file:// url or local path),
+//file is verified against the checksums of setting repository before it is saved as folder/filename
 func DirectDownloadFilefromGithub(filename string, url string, folder string) *Error {
 	filepath := fmt.Sprintf("%s/%s", folder, filename)
 	if !FolderExist(folder) {
@@ -633,88 +646,44 @@ func DirectDownloadFilefromGithub(filename string, url string, folder string) *E
 		}
 	}
 
-	resp, err := http.Get(url)
-	if err != nil {
-		cerr := ErrNew(ErrHttpNotFound, fmt.Sprintf("http request to %s encounters failure", url))
+	in, cerr := openSettingSource(url)
+	if cerr != nil {
 		return cerr
 	}
-	defer resp.Body.Close()
+	defer in.Close()
 
-	if resp.StatusCode == 404 {
-		cerr := ErrNew(ErrNExist, fmt.Sprintf("%s returns 404", url))
+	temp := fmt.Sprintf("%s.download", filepath)
+	out, err := os.Create(temp)
+	if err != nil {
+		cerr := ErrNew(ErrFileStat, fmt.Sprintf("%s file create error", temp))
 		return cerr
 	}
+	defer os.Remove(temp)
 
-	out, err := os.Create(filepath)
+	_, err = io.Copy(out, in)
+	out.Close()
 	if err != nil {
-		cerr := ErrNew(ErrFileStat, fmt.Sprintf("%s file create error", filepath))
+		cerr := ErrNew(ErrFileIO, fmt.Sprintf("io copy from %s to %s encounters error", url, temp))
 		return cerr
 	}
-	defer out.Close()
 
-	_, err = io.Copy(out, resp.Body)
-	if err != nil {
-		cerr := ErrNew(ErrFileIO, fmt.Sprintf("io copy from %s to %s encounters error", url, filepath))
+	cerr = verifySetting(url, temp)
+	if cerr != nil {
 		return cerr
 	}
-	return nil
-
+	return Rename(temp, filepath)
 }
 
 func DownloadFilefromGithub(name string, tag string, filename string, url string, folder string) *Error {
-	filepath := fmt.Sprintf("%s/%s", folder, filename)
-	if !FolderExist(folder) {
-		_, err := MakeDir(folder)
-		if err != nil {
-			return err
-		}
-	}
-
-	out, err := os.Create(filepath)
-	if err != nil {
-		cerr := ErrNew(ErrFileStat, fmt.Sprintf("%s file create error", filepath))
-		return cerr
-	}
-	defer out.Close()
-
 	name = strings.ToLower(name)
 	tag = strings.ToLower(tag)
 	http_req := fmt.Sprintf("%s/%s/%s/%s", url, name, tag, filename)
-	resp, err := http.Get(http_req)
-	if err != nil {
-		cerr := ErrNew(ErrHttpNotFound, fmt.Sprintf("http request to %s encounters failure", http_req))
-		return cerr
+	err := DirectDownloadFilefromGithub(filename, http_req, folder)
+	if err != nil && err.Err == ErrNExist {
+		http_req = fmt.Sprintf("%s/default.%s", url, filename)
+		err = DirectDownloadFilefromGithub(filename, http_req, folder)
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode == 404 {
-		http_req := fmt.Sprintf("%s/default.%s", url, filename)
-		resp, err := http.Get(http_req)
-		if err != nil {
-			cerr := ErrNew(ErrHttpNotFound, fmt.Sprintf("http request to %s encounters failure", http_req))
-			return cerr
-		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode == 404 {
-			cerr := ErrNew(ErrHttpNotFound, fmt.Sprintf("http request to %s encounters failure", http_req))
-			return cerr
-		}
-		_, err = io.Copy(out, resp.Body)
-		if err != nil {
-			cerr := ErrNew(ErrFileIO, fmt.Sprintf("io copy from %s to %s encounters error", http_req, filepath))
-			return cerr
-		}
-		return nil
-	}
-
-	_, err = io.Copy(out, resp.Body)
-	if err != nil {
-		cerr := ErrNew(ErrFileIO, fmt.Sprintf("io copy from %s to %s encounters error", http_req, filepath))
-		return cerr
-	}
-	return nil
-
+	return err
 }
 
 type DockerHubToken struct {
@@ -732,6 +701,9 @@ func GetToken(repository, username, password, action string) (string, *Error) {
 		cerr := ErrNew(err, "could not create new http request")
 		return "", cerr
 	}
+	if username == "" && password == "" {
+		username, password = REGISTRY_USER, REGISTRY_PASS
+	}
 	if username != "" && password != "" {
 		encoded := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", username, password)))
 		req.Header.Set("Authorization", fmt.Sprintf("Basic %s", encoded))
@@ -756,7 +728,7 @@ func GetToken(repository, username, password, action string) (string, *Error) {
 }
 
 func UploadBlob(repository, token, file string) (bool, *Error) {
-	initial_url := fmt.Sprintf("https://registry-1.docker.io/v2/%s/blobs/uploads/", repository)
+	initial_url := fmt.Sprintf("%s/v2/%s/blobs/uploads/", DOCKER_URL, repository)
 	client := &http.Client{}
 	req, err := http.NewRequest("POST", initial_url, nil)
 	if err != nil {
@@ -807,7 +779,7 @@ func UploadBlob(repository, token, file string) (bool, *Error) {
 }
 
 func HasBlob(repository, token, sha256 string) (bool, *Error) {
-	checkUrl := fmt.Sprintf("https://registry-1.docker.io/v2/%s/blobs/sha256:%s", repository, sha256)
+	checkUrl := fmt.Sprintf("%s/v2/%s/blobs/sha256:%s", DOCKER_URL, repository, sha256)
 	client := &http.Client{}
 	req, err := http.NewRequest("HEAD", checkUrl, nil)
 	if err != nil {
@@ -824,16 +796,18 @@ func HasBlob(repository, token, sha256 string) (bool, *Error) {
 		defer resp.Body.Close()
 	}
 	if resp.StatusCode == 200 {
-		fmt.Println(resp)
 		return true, nil
 	}
+	if resp.StatusCode == 404 {
+		return false, nil
+	}
 	data, _ := ioutil.ReadAll(resp.Body)
 	cerr := ErrNew(ErrHttpNotFound, string(data))
 	return false, cerr
 }
 
 func DownloadBlob(repository, token, sha256 string) (io.ReadCloser, *Error) {
-	download_url := fmt.Sprintf("https://registry-1.docker.io/v2/%s/blobs/sha256:%s", repository, sha256)
+	download_url := fmt.Sprintf("%s/v2/%s/blobs/sha256:%s", DOCKER_URL, repository, sha256)
 	req, err := http.NewRequest("GET", download_url, nil)
 	if err != nil {
 		cerr := ErrNew(err, "could not create http request")
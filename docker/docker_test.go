@@ -4,6 +4,12 @@ import (
 	"io"
 	"os"
 	"testing"
+
+	"github.com/docker/distribution/manifest/ocischema"
+	"github.com/docker/distribution/manifest/schema2"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestGetToken(t *testing.T) {
@@ -51,12 +57,45 @@ func TestDownloadBlob(t *testing.T) {
 	}
 }
 
-func TestUploadManifest(t *testing.T) {
+func TestPushImage(t *testing.T) {
 	t.Skip("skip test")
-	err := UploadManifests("JasonYangShadow", "", "JasonYangShadow/ubuntu", "test", "45e43933efa9dab764a881ee4a87b4ffde3965584cd03b76f51d17de4b538ee0", "ubuntu:16.04")
+	layer, err := DescribeLayer("/tmp/jRAT9GNac5.tar.gz")
 	if err != nil {
 		t.Error(err)
+		return
 	}
+	config := NewImageConfig()
+	AppendLayer(config, layer, "lpmx test", "", "")
+	_, err = PushImage("JasonYangShadow", "", "JasonYangShadow/ubuntu", "test", []*LayerDescriptor{layer}, config, "ubuntu")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestImageManifest(t *testing.T) {
+	gz := &LayerDescriptor{MediaType: schema2.MediaTypeLayer, Size: 1, Digest: digest.FromString("gzip")}
+	zst := &LayerDescriptor{MediaType: MediaTypeImageLayerZstd, Size: 2, Digest: digest.FromString("zstd")}
+	config_digest := digest.FromString("config")
+
+	manifest, err := imageManifest([]*LayerDescriptor{gz}, 3, config_digest)
+	assert.Nil(t, err)
+	media_type, _, _ := manifest.Payload()
+	assert.Equal(t, schema2.MediaTypeManifest, media_type)
+	assert.Equal(t, schema2.MediaTypeLayer, manifest.References()[1].MediaType)
+
+	//zstd layers have no docker media type, so the whole manifest turns into oci
+	manifest, err = imageManifest([]*LayerDescriptor{gz, zst}, 3, config_digest)
+	assert.Nil(t, err)
+	media_type, _, _ = manifest.Payload()
+	assert.Equal(t, ocispec.MediaTypeImageManifest, media_type)
+	oci := manifest.(*ocischema.DeserializedManifest)
+	assert.Equal(t, ocispec.MediaTypeImageConfig, oci.Config.MediaType)
+	assert.Equal(t, config_digest, oci.Config.Digest)
+	assert.Equal(t, ocispec.MediaTypeImageLayerGzip, oci.Layers[0].MediaType)
+	assert.Equal(t, MediaTypeImageLayerZstd, oci.Layers[1].MediaType)
+
+	_, err = imageManifest([]*LayerDescriptor{{MediaType: "unknown"}}, 3, config_digest)
+	assert.NotNil(t, err)
 }
 
 func TestDownloadGithub(t *testing.T) {
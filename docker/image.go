@@ -0,0 +1,276 @@
+package docker
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	. "github.com/JasonYangShadow/lpmx/error"
+	. "github.com/JasonYangShadow/lpmx/utils"
+	"github.com/docker/distribution/manifest/schema2"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+//IMAGE_CONFIG is the file name of image configuration stored inside image rootdir, e.g, $/.lpmxdata/name/tag/config.json
+const IMAGE_CONFIG = "config.json"
+
+//zstd media types are defined by image-spec v1.1.0 which is newer than the vendored one
+const (
+	MediaTypeImageLayerZstd                 = "application/vnd.oci.image.layer.v1.tar+zstd"
+	MediaTypeImageLayerNonDistributableZstd = "application/vnd.oci.image.layer.nondistributable.v1.tar+zstd"
+)
+
+//LayerDescriptor describes a layer tarball stored inside lpmx
+type LayerDescriptor struct {
+	File      string
+	MediaType string
+	Digest    digest.Digest //digest of the file as it is stored, i.e, compressed
+	DiffID    digest.Digest //digest of the uncompressed tar stream
+	Size      int64
+	DiffSize  int64 //size of the uncompressed tar stream
+}
+
+//DescribeLayer calculates digests and size of layer tarball, gzip, zstd compressed and plain tar are supported
+func DescribeLayer(file string) (*LayerDescriptor, *Error) {
+	f, err := os.Open(file)
+	if err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("could not open layer %s", file))
+		return nil, cerr
+	}
+	defer f.Close()
+
+	layer := new(LayerDescriptor)
+	layer.File = file
+
+	compressed := sha256.New()
+	tee := io.TeeReader(f, compressed)
+	r, compression, cerr := Decompress(tee)
+	if cerr != nil {
+		cerr.AddMsg(fmt.Sprintf("could not read layer %s", file))
+		return nil, cerr
+	}
+	defer r.Close()
+	diff := sha256.New()
+	n, err := io.Copy(diff, r)
+	if err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("could not decompress layer %s", file))
+		return nil, cerr
+	}
+	//drain the remaining bytes, e.g, gzip trailer
+	io.Copy(ioutil.Discard, tee)
+
+	layer.MediaType = LayerMediaType(compression, false)
+	layer.Digest = digest.NewDigest(digest.SHA256, compressed)
+	layer.DiffID = digest.NewDigest(digest.SHA256, diff)
+	layer.DiffSize = n
+
+	fi, err := f.Stat()
+	if err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("could not stat layer %s", file))
+		return nil, cerr
+	}
+	layer.Size = fi.Size()
+	return layer, nil
+}
+
+//LayerCompression returns the compression of layer media type, both docker and oci media types are supported
+func LayerCompression(mediaType string) (string, *Error) {
+	switch mediaType {
+	case ocispec.MediaTypeImageLayerGzip, ocispec.MediaTypeImageLayerNonDistributableGzip, schema2.MediaTypeLayer, schema2.MediaTypeForeignLayer:
+		return COMPRESSION_GZIP, nil
+	case MediaTypeImageLayerZstd, MediaTypeImageLayerNonDistributableZstd:
+		return COMPRESSION_ZSTD, nil
+	case ocispec.MediaTypeImageLayer, ocispec.MediaTypeImageLayerNonDistributable, schema2.MediaTypeUncompressedLayer:
+		return COMPRESSION_NONE, nil
+	default:
+		cerr := ErrNew(ErrType, fmt.Sprintf("layer media type %s is not supported", mediaType))
+		return "", cerr
+	}
+}
+
+//LayerMediaType returns the media type of layer compressed with compression, oci selects oci media types rather than docker ones.
+//Docker does not define zstd media type, so the oci one is always used for zstd
+func LayerMediaType(compression string, oci bool) string {
+	switch compression {
+	case COMPRESSION_ZSTD:
+		return MediaTypeImageLayerZstd
+	case COMPRESSION_NONE:
+		if oci {
+			return ocispec.MediaTypeImageLayer
+		}
+		return schema2.MediaTypeUncompressedLayer
+	default:
+		if oci {
+			return ocispec.MediaTypeImageLayerGzip
+		}
+		return schema2.MediaTypeLayer
+	}
+}
+
+//NewImageConfig creates an empty linux/amd64 image configuration
+func NewImageConfig() *ocispec.Image {
+	now := time.Now().UTC()
+	config := new(ocispec.Image)
+	config.Created = &now
+	config.Architecture = "amd64"
+	config.OS = "linux"
+	config.RootFS.Type = "layers"
+	return config
+}
+
+//AppendLayer adds the layer on top of image configuration together with its history entry
+func AppendLayer(config *ocispec.Image, layer *LayerDescriptor, createdBy, author, comment string) {
+	now := time.Now().UTC()
+	config.Created = &now
+	config.RootFS.Type = "layers"
+	config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, layer.DiffID)
+	config.History = append(config.History, ocispec.History{
+		Created:   &now,
+		CreatedBy: createdBy,
+		Author:    author,
+		Comment:   comment,
+	})
+}
+
+//RebaseImageConfig keeps the runtime configuration(env, cmd and so on) of base but replaces its rootfs with layers,
+//history is preserved only if base describes exactly the same layers
+func RebaseImageConfig(base *ocispec.Image, layers []*LayerDescriptor) *ocispec.Image {
+	config := NewImageConfig()
+	if base != nil {
+		config.Config = base.Config
+		config.Author = base.Author
+		if base.Architecture != "" {
+			config.Architecture = base.Architecture
+		}
+		if base.OS != "" {
+			config.OS = base.OS
+		}
+	}
+
+	same := base != nil && len(base.RootFS.DiffIDs) == len(layers)
+	for idx, layer := range layers {
+		if same && base.RootFS.DiffIDs[idx] != layer.DiffID {
+			same = false
+		}
+	}
+	if same {
+		config.RootFS.DiffIDs = base.RootFS.DiffIDs
+		config.History = base.History
+		return config
+	}
+
+	for _, layer := range layers {
+		AppendLayer(config, layer, fmt.Sprintf("lpmx imported layer %s", layer.Digest), "", "")
+	}
+	return config
+}
+
+//FetchImageConfig downloads the image configuration of name:tag from docker hub
+func FetchImageConfig(username, pass, name, tag string) (*ocispec.Image, *Error) {
+	log.SetOutput(ioutil.Discard)
+	if !strings.Contains(name, "library/") && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	hub, err := newRegistry(username, pass)
+	if err != nil {
+		cerr := ErrNew(err, "create docker registry instance failure")
+		return nil, cerr
+	}
+	man, err := hub.ManifestV2(name, tag)
+	if err != nil {
+		cerr := ErrNew(err, "query docker manifest failure")
+		return nil, cerr
+	}
+	reader, err := hub.DownloadBlob(name, man.Config.Digest)
+	if err != nil {
+		cerr := ErrNew(err, "download docker image config failure")
+		return nil, cerr
+	}
+	defer reader.Close()
+
+	var config ocispec.Image
+	if err := json.NewDecoder(reader).Decode(&config); err != nil {
+		cerr := ErrNew(err, "could not decode docker image config")
+		return nil, cerr
+	}
+	return &config, nil
+}
+
+//LoadImageConfig reads image configuration from file
+func LoadImageConfig(file string) (*ocispec.Image, *Error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			cerr := ErrNew(ErrNExist, fmt.Sprintf("image config %s does not exist", file))
+			return nil, cerr
+		}
+		cerr := ErrNew(err, fmt.Sprintf("could not read image config %s", file))
+		return nil, cerr
+	}
+	var config ocispec.Image
+	if err := json.Unmarshal(data, &config); err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("could not decode image config %s", file))
+		return nil, cerr
+	}
+	return &config, nil
+}
+
+//SaveImageConfig writes image configuration to file
+func SaveImageConfig(config *ocispec.Image, file string) *Error {
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		cerr := ErrNew(err, "could not encode image config")
+		return cerr
+	}
+	if err := ioutil.WriteFile(file, data, 0644); err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("could not write image config %s", file))
+		return cerr
+	}
+	return nil
+}
+
+//ApplyChange applies a dockerfile like instruction to the runtime configuration of image,
+//both 'ENV KEY=VALUE' and 'ENV=KEY=VALUE' are accepted, supported instructions are ENV and WORKDIR
+func ApplyChange(config *ocispec.Image, change string) *Error {
+	change = strings.TrimSpace(change)
+	idx := strings.IndexAny(change, " =")
+	if idx <= 0 || strings.TrimSpace(change[idx+1:]) == "" {
+		cerr := ErrNew(ErrType, fmt.Sprintf("change '%s' should be in the format of 'INSTRUCTION=VALUE'", change))
+		return cerr
+	}
+	instruction := strings.ToUpper(change[:idx])
+	value := strings.TrimSpace(change[idx+1:])
+
+	switch instruction {
+	case "ENV":
+		kv := strings.SplitN(value, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			cerr := ErrNew(ErrType, fmt.Sprintf("ENV '%s' should be in the format of 'KEY=VALUE'", value))
+			return cerr
+		}
+		for i, env := range config.Config.Env {
+			if strings.SplitN(env, "=", 2)[0] == kv[0] {
+				config.Config.Env[i] = value
+				return nil
+			}
+		}
+		config.Config.Env = append(config.Config.Env, value)
+	case "WORKDIR":
+		if !strings.HasPrefix(value, "/") {
+			cerr := ErrNew(ErrType, fmt.Sprintf("WORKDIR '%s' should be an absolute path", value))
+			return cerr
+		}
+		config.Config.WorkingDir = value
+	default:
+		cerr := ErrNew(ErrType, fmt.Sprintf("instruction %s is not supported, only ENV and WORKDIR could be changed", instruction))
+		return cerr
+	}
+	return nil
+}
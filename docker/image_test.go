@@ -0,0 +1,99 @@
+package docker
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/docker/distribution/manifest/schema2"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDescribeLayer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lpmx-layer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	content := []byte("pretend this is a tar stream")
+	var buf bytes.Buffer
+	gzw := gzip.NewWriter(&buf)
+	gzw.Write(content)
+	gzw.Close()
+
+	gzfile := filepath.Join(dir, "layer.tar.gz")
+	ioutil.WriteFile(gzfile, buf.Bytes(), 0644)
+	layer, cerr := DescribeLayer(gzfile)
+	assert.Nil(t, cerr)
+	assert.Equal(t, schema2.MediaTypeLayer, layer.MediaType)
+	assert.Equal(t, digest.FromBytes(buf.Bytes()), layer.Digest)
+	assert.Equal(t, digest.FromBytes(content), layer.DiffID)
+	assert.Equal(t, int64(buf.Len()), layer.Size)
+
+	tarfile := filepath.Join(dir, "layer.tar")
+	ioutil.WriteFile(tarfile, content, 0644)
+	layer, cerr = DescribeLayer(tarfile)
+	assert.Nil(t, cerr)
+	assert.Equal(t, schema2.MediaTypeUncompressedLayer, layer.MediaType)
+	assert.Equal(t, layer.Digest, layer.DiffID)
+}
+
+func TestRebaseImageConfig(t *testing.T) {
+	l1 := &LayerDescriptor{DiffID: digest.FromString("l1")}
+	l2 := &LayerDescriptor{DiffID: digest.FromString("l2")}
+
+	base := NewImageConfig()
+	base.Config.Env = []string{"PATH=/usr/bin"}
+	AppendLayer(base, l1, "base layer", "", "")
+
+	config := RebaseImageConfig(base, []*LayerDescriptor{l1})
+	assert.Equal(t, base.History, config.History, "history should be kept for the same layers")
+	assert.Equal(t, base.Config.Env, config.Config.Env)
+
+	config = RebaseImageConfig(base, []*LayerDescriptor{l1, l2})
+	assert.Equal(t, 2, len(config.RootFS.DiffIDs))
+	assert.Equal(t, 2, len(config.History), "history should be regenerated for different layers")
+	assert.Equal(t, base.Config.Env, config.Config.Env)
+}
+
+func TestApplyChange(t *testing.T) {
+	config := NewImageConfig()
+	assert.Nil(t, ApplyChange(config, "ENV=FOO=bar"))
+	assert.Nil(t, ApplyChange(config, "ENV BAR=a=b"))
+	assert.Nil(t, ApplyChange(config, "env FOO=baz"))
+	assert.Equal(t, []string{"FOO=baz", "BAR=a=b"}, config.Config.Env)
+
+	assert.Nil(t, ApplyChange(config, "WORKDIR=/opt/app"))
+	assert.Equal(t, "/opt/app", config.Config.WorkingDir)
+
+	assert.NotNil(t, ApplyChange(config, "WORKDIR=relative"))
+	assert.NotNil(t, ApplyChange(config, "ENV=FOO"))
+	assert.NotNil(t, ApplyChange(config, "CMD=/bin/sh"))
+	assert.NotNil(t, ApplyChange(config, "ENV"))
+}
+
+func TestSaveImageConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lpmx-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, IMAGE_CONFIG)
+	_, cerr := LoadImageConfig(file)
+	assert.NotNil(t, cerr)
+
+	config := NewImageConfig()
+	AppendLayer(config, &LayerDescriptor{DiffID: digest.FromString("layer")}, "lpmx commit", "someone", "message")
+	assert.Nil(t, SaveImageConfig(config, file))
+	loaded, cerr := LoadImageConfig(file)
+	assert.Nil(t, cerr)
+	assert.Equal(t, config.RootFS.DiffIDs, loaded.RootFS.DiffIDs)
+	assert.Equal(t, "someone", loaded.History[0].Author)
+	assert.Equal(t, "message", loaded.History[0].Comment)
+}
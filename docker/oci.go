@@ -0,0 +1,251 @@
+package docker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/JasonYangShadow/lpmx/error"
+	. "github.com/JasonYangShadow/lpmx/utils"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+//NormalizeImageName removes default registry and namespace from name and appends latest tag if it is missing,
+//e.g, docker.io/library/ubuntu becomes ubuntu:latest
+func NormalizeImageName(name string) string {
+	name = strings.TrimPrefix(name, "docker.io/")
+	name = strings.TrimPrefix(name, "library/")
+	if !strings.Contains(name[strings.LastIndex(name, "/")+1:], ":") {
+		name = name + ":latest"
+	}
+	return name
+}
+
+//readBlob reads the blob of oci layout and verifies its digest
+func readBlob(dir string, desc ocispec.Descriptor) ([]byte, *Error) {
+	if err := desc.Digest.Validate(); err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("invalid digest %s", desc.Digest))
+		return nil, cerr
+	}
+	file := filepath.Join(dir, blobPath(desc.Digest))
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("could not read blob %s", file))
+		return nil, cerr
+	}
+	if digest.FromBytes(data) != desc.Digest {
+		cerr := ErrNew(ErrMismatch, fmt.Sprintf("blob %s does not match its digest", file))
+		return nil, cerr
+	}
+	return data, nil
+}
+
+//matchRef checks whether the descriptor is annotated with ref, which is either the full image name or the tag
+func matchRef(desc ocispec.Descriptor, ref string) bool {
+	if name, ok := desc.Annotations[AnnotationImageName]; ok && NormalizeImageName(name) == NormalizeImageName(ref) {
+		return true
+	}
+	tag, ok := desc.Annotations[ocispec.AnnotationRefName]
+	return ok && (tag == ref || NormalizeImageName(tag) == NormalizeImageName(ref) || strings.HasSuffix(ref, ":"+tag))
+}
+
+//selectManifest finds the manifest descriptor inside index matching ref(tag or full image name),
+//the only image is selected if index contains just one. Nested indexes are resolved to linux/amd64 image
+func selectManifest(dir string, index *ocispec.Index, ref string) (*ocispec.Descriptor, *Error) {
+	candidates := index.Manifests
+	if len(candidates) > 1 && ref != "" {
+		candidates = nil
+		for _, desc := range index.Manifests {
+			if matchRef(desc, ref) {
+				candidates = append(candidates, desc)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		cerr := ErrNew(ErrNExist, fmt.Sprintf("could not find image %s inside %s", ref, dir))
+		return nil, cerr
+	}
+
+	//prefer linux/amd64 if platforms are declared
+	desc := candidates[0]
+	for _, candidate := range candidates {
+		if candidate.Platform != nil && candidate.Platform.OS == "linux" && candidate.Platform.Architecture == "amd64" {
+			desc = candidate
+			break
+		}
+	}
+	if len(candidates) > 1 && desc.Platform == nil {
+		cerr := ErrNew(ErrMismatch, fmt.Sprintf("%s contains multiple images, please specify one of them by name", dir))
+		return nil, cerr
+	}
+
+	if desc.MediaType == ocispec.MediaTypeImageIndex {
+		data, err := readBlob(dir, desc)
+		if err != nil {
+			return nil, err
+		}
+		var nested ocispec.Index
+		if jerr := json.Unmarshal(data, &nested); jerr != nil {
+			cerr := ErrNew(jerr, "could not unmarshal nested index")
+			return nil, cerr
+		}
+		selected, err := selectManifest(dir, &nested, "")
+		if err != nil {
+			return nil, err
+		}
+		//annotations of outer descriptor carry the image name
+		if selected.Annotations == nil {
+			selected.Annotations = desc.Annotations
+		}
+		return selected, nil
+	}
+	return &desc, nil
+}
+
+//storeLayer copies the layer blob into imagedir as it is, the stored file is named by the digest of its content.
+//Compression declared by media type should match the one detected from the content
+func storeLayer(dir, imagedir string, desc ocispec.Descriptor) (string, *Error) {
+	if err := desc.Digest.Validate(); err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("invalid digest %s", desc.Digest))
+		return "", cerr
+	}
+	compression, cerr := LayerCompression(desc.MediaType)
+	if cerr != nil {
+		return "", cerr
+	}
+	src := filepath.Join(dir, blobPath(desc.Digest))
+	if cerr := checkCompression(src, compression); cerr != nil {
+		return "", cerr
+	}
+	target := fmt.Sprintf("%s/%s", imagedir, desc.Digest.Hex())
+	if !FileExist(target) {
+		if err := copyVerified(src, target, desc.Digest); err != nil {
+			return "", err
+		}
+	}
+	return target, nil
+}
+
+//checkCompression makes sure the content of file is compressed with compression
+func checkCompression(file, compression string) *Error {
+	detected, cerr := FileCompression(file)
+	if cerr != nil {
+		return cerr
+	}
+	if detected != compression {
+		cerr := ErrNew(ErrMismatch, fmt.Sprintf("blob %s is declared as %s but its content is %s", file, compression, detected))
+		return cerr
+	}
+	return nil
+}
+
+func copyVerified(src, target string, dgst digest.Digest) *Error {
+	in, err := os.Open(src)
+	if err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("could not open blob %s", src))
+		return cerr
+	}
+	defer in.Close()
+
+	temp := target + ".tmp"
+	out, err := os.Create(temp)
+	if err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("could not create %s", temp))
+		return cerr
+	}
+	verifier := dgst.Verifier()
+	_, err = io.Copy(io.MultiWriter(out, verifier), in)
+	out.Close()
+	if err != nil {
+		os.Remove(temp)
+		cerr := ErrNew(err, fmt.Sprintf("could not copy blob %s", src))
+		return cerr
+	}
+	if !verifier.Verified() {
+		os.Remove(temp)
+		cerr := ErrNew(ErrMismatch, fmt.Sprintf("blob %s does not match its digest", src))
+		return cerr
+	}
+	return Rename(temp, target)
+}
+
+//LoadOCILayout imports the image inside oci image layout dir into imagedir, ref selects the image if layout contains several ones,
+//it is also used as the image name if given. It returns the image name, layers map(path -> size), layers from lower to higher and the image config
+func LoadOCILayout(dir, imagedir, ref string) (string, map[string]int64, []string, *ocispec.Image, *Error) {
+	var layout ocispec.ImageLayout
+	data, err := ioutil.ReadFile(filepath.Join(dir, ocispec.ImageLayoutFile))
+	if err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("%s is not an oci image layout", dir))
+		return "", nil, nil, nil, cerr
+	}
+	if jerr := json.Unmarshal(data, &layout); jerr != nil || layout.Version != ocispec.ImageLayoutVersion {
+		cerr := ErrNew(ErrMismatch, fmt.Sprintf("oci image layout version %s is not supported", layout.Version))
+		return "", nil, nil, nil, cerr
+	}
+
+	var index ocispec.Index
+	data, err = ioutil.ReadFile(filepath.Join(dir, "index.json"))
+	if err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("could not read index.json inside %s", dir))
+		return "", nil, nil, nil, cerr
+	}
+	if jerr := json.Unmarshal(data, &index); jerr != nil {
+		cerr := ErrNew(jerr, "could not unmarshal index.json")
+		return "", nil, nil, nil, cerr
+	}
+
+	desc, cerr := selectManifest(dir, &index, ref)
+	if cerr != nil {
+		return "", nil, nil, nil, cerr
+	}
+	name := ref
+	if name == "" {
+		name = desc.Annotations[AnnotationImageName]
+	}
+	if name == "" {
+		cerr := ErrNew(ErrNExist, fmt.Sprintf("%s does not record image name, please specify it", dir))
+		return "", nil, nil, nil, cerr
+	}
+	name = NormalizeImageName(name)
+
+	data, cerr = readBlob(dir, *desc)
+	if cerr != nil {
+		return "", nil, nil, nil, cerr
+	}
+	var manifest ocispec.Manifest
+	if jerr := json.Unmarshal(data, &manifest); jerr != nil {
+		cerr := ErrNew(jerr, "could not unmarshal image manifest")
+		return "", nil, nil, nil, cerr
+	}
+
+	data, cerr = readBlob(dir, manifest.Config)
+	if cerr != nil {
+		return "", nil, nil, nil, cerr
+	}
+	var config ocispec.Image
+	if jerr := json.Unmarshal(data, &config); jerr != nil {
+		cerr := ErrNew(jerr, "could not unmarshal image config")
+		return "", nil, nil, nil, cerr
+	}
+
+	layer_data := make(map[string]int64)
+	var layers []string
+	for _, item := range manifest.Layers {
+		target_path, cerr := storeLayer(dir, imagedir, item)
+		if cerr != nil {
+			return "", nil, nil, nil, cerr
+		}
+		file_length, cerr := GetFileLength(target_path)
+		if cerr != nil {
+			return "", nil, nil, nil, cerr
+		}
+		layer_data[target_path] = file_length
+		layers = append(layers, target_path)
+	}
+	return name, layer_data, layers, &config, nil
+}
@@ -0,0 +1,145 @@
+package docker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/JasonYangShadow/lpmx/error"
+	. "github.com/JasonYangShadow/lpmx/utils"
+	"github.com/docker/distribution/manifest/schema2"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeImageName(t *testing.T) {
+	assert.Equal(t, "ubuntu:latest", NormalizeImageName("docker.io/library/ubuntu"))
+	assert.Equal(t, "user/app:1.0", NormalizeImageName("docker.io/user/app:1.0"))
+	assert.Equal(t, "localhost:5000/app:latest", NormalizeImageName("localhost:5000/app"))
+}
+
+func TestLoadOCILayout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lpmx-oci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	l1, raw1 := writeTestLayer(t, dir, "a", "first")
+	layout := filepath.Join(dir, "layout")
+	assert.Nil(t, SaveImage("docker.io/library/test:v1", []string{l1}, nil, FORMAT_OCI, layout))
+
+	imagedir := filepath.Join(dir, "image")
+	os.MkdirAll(imagedir, 0755)
+	name, layers, order, config, cerr := LoadOCILayout(layout, imagedir, "")
+	assert.Nil(t, cerr)
+	assert.Equal(t, "test:v1", name)
+	assert.Equal(t, 1, len(order))
+	assert.Contains(t, layers, order[0])
+	assert.Equal(t, []digest.Digest{digest.FromBytes(raw1)}, config.RootFS.DiffIDs)
+
+	name, _, _, _, cerr = LoadOCILayout(layout, imagedir, "other:v2")
+	assert.Nil(t, cerr)
+	assert.Equal(t, "other:v2", name, "given name should be used for importing")
+}
+
+//writeSingleLayerLayout creates oci layout inside dir containing one image with the layer blob declared as mediaType
+func writeSingleLayerLayout(t *testing.T, dir, mediaType string, blob, raw []byte) {
+	writeBlob := func(data []byte) digest.Digest {
+		dgst := digest.FromBytes(data)
+		os.MkdirAll(filepath.Join(dir, "blobs", "sha256"), 0755)
+		ioutil.WriteFile(filepath.Join(dir, blobPath(dgst)), data, 0644)
+		return dgst
+	}
+
+	config, _ := json.Marshal(ocispec.Image{RootFS: ocispec.RootFS{Type: "layers", DiffIDs: []digest.Digest{digest.FromBytes(raw)}}})
+	manifest, _ := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Config:    ocispec.Descriptor{MediaType: ocispec.MediaTypeImageConfig, Digest: writeBlob(config), Size: int64(len(config))},
+		Layers:    []ocispec.Descriptor{{MediaType: mediaType, Digest: writeBlob(blob), Size: int64(len(blob))}},
+	})
+	index, _ := json.Marshal(ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		Manifests: []ocispec.Descriptor{{MediaType: ocispec.MediaTypeImageManifest, Digest: writeBlob(manifest), Size: int64(len(manifest)), Annotations: map[string]string{ocispec.AnnotationRefName: "v1"}}},
+	})
+	ioutil.WriteFile(filepath.Join(dir, "index.json"), index, 0644)
+	ioutil.WriteFile(filepath.Join(dir, ocispec.ImageLayoutFile), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644)
+}
+
+func TestLoadOCILayoutUncompressed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lpmx-oci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, raw := writeTestLayer(t, dir, "a", "plain")
+	writeSingleLayerLayout(t, dir, ocispec.MediaTypeImageLayer, raw, raw)
+
+	imagedir := filepath.Join(dir, "image")
+	os.MkdirAll(imagedir, 0755)
+	_, _, _, _, cerr := LoadOCILayout(dir, imagedir, "")
+	assert.NotNil(t, cerr, "name is required if layout does not record it")
+
+	name, _, order, _, cerr := LoadOCILayout(dir, imagedir, "plain:v1")
+	assert.Nil(t, cerr)
+	assert.Equal(t, "plain:v1", name)
+	layer, cerr := DescribeLayer(order[0])
+	assert.Nil(t, cerr)
+	assert.Equal(t, digest.FromBytes(raw), layer.DiffID)
+	assert.Equal(t, layer.DiffID, layer.Digest, "plain layer should be stored as it is")
+	assert.Equal(t, schema2.MediaTypeUncompressedLayer, layer.MediaType)
+	assert.Equal(t, layer.Digest.Hex(), filepath.Base(order[0]), "layer should be named by digest only")
+
+	//corrupted blobs are rejected
+	ioutil.WriteFile(filepath.Join(dir, blobPath(digest.FromBytes(raw))), []byte("corrupted"), 0644)
+	os.MkdirAll(filepath.Join(dir, "image2"), 0755)
+	_, _, _, _, cerr = LoadOCILayout(dir, filepath.Join(dir, "image2"), "plain:v1")
+	assert.NotNil(t, cerr)
+	assert.Equal(t, ErrMismatch, cerr.Err)
+}
+
+func TestLoadOCILayoutZstd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lpmx-oci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, raw := writeTestLayer(t, dir, "a", "zstd")
+	var buf bytes.Buffer
+	zw, cerr := Compress(&buf, COMPRESSION_ZSTD)
+	assert.Nil(t, cerr)
+	zw.Write(raw)
+	zw.Close()
+	writeSingleLayerLayout(t, dir, MediaTypeImageLayerZstd, buf.Bytes(), raw)
+
+	imagedir := filepath.Join(dir, "image")
+	os.MkdirAll(imagedir, 0755)
+	_, _, order, _, cerr := LoadOCILayout(dir, imagedir, "zstd:v1")
+	assert.Nil(t, cerr)
+	layer, cerr := DescribeLayer(order[0])
+	assert.Nil(t, cerr)
+	assert.Equal(t, MediaTypeImageLayerZstd, layer.MediaType)
+	assert.Equal(t, digest.FromBytes(raw), layer.DiffID)
+	assert.Equal(t, digest.FromBytes(buf.Bytes()).Hex(), filepath.Base(order[0]))
+
+	//zstd layers are decompressed for docker archive
+	target := filepath.Join(dir, "out.tar")
+	assert.Nil(t, SaveImage("zstd:v1", order, nil, FORMAT_DOCKER_ARCHIVE, target))
+	files := readTar(t, target)
+	assert.Equal(t, raw, files[fmt.Sprintf("%s/layer.tar", layer.DiffID.Hex())])
+
+	//media type should match the content
+	other := filepath.Join(dir, "other")
+	writeSingleLayerLayout(t, other, ocispec.MediaTypeImageLayerGzip, buf.Bytes(), raw)
+	_, _, _, _, cerr = LoadOCILayout(other, imagedir, "zstd:v2")
+	assert.NotNil(t, cerr)
+	assert.Equal(t, ErrMismatch, cerr.Err)
+}
@@ -0,0 +1,220 @@
+package docker
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	. "github.com/JasonYangShadow/lpmx/error"
+	. "github.com/JasonYangShadow/lpmx/log"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	//SETTING_INDEX lists the sha256 checksums of all artifacts inside setting repository, the format is the output of sha256sum
+	SETTING_INDEX = "SHA256SUMS"
+
+	//ENV_SETTING_REPO overrides SETTING_REPO, it could be http(s) url, local directory or file:// url of a mirror
+	ENV_SETTING_REPO = "LPMX_SETTING_REPO"
+	//ENV_SETTING_INDEX_DIGEST overrides SETTING_INDEX_SHA256
+	ENV_SETTING_INDEX_DIGEST = "LPMX_SETTING_INDEX_SHA256"
+	//ENV_SETTING_VERIFY overrides SETTING_VERIFY
+	ENV_SETTING_VERIFY = "LPMX_SETTING_VERIFY"
+
+	//SETTING_VERIFY_STRICT requires SETTING_INDEX and checks every downloaded file against it, it is opt-in for the default repository
+	SETTING_VERIFY_STRICT = "strict"
+	//SETTING_VERIFY_AUTO accepts the default repository without SETTING_INDEX, files are still verified whenever SETTING_INDEX is provided.
+	//Verification is always strict for mirrors and pinned indexes
+	SETTING_VERIFY_AUTO = "auto"
+)
+
+var (
+	//SETTING_REPO is the mirror of setting repository, setting.repo of config.yaml sets it
+	SETTING_REPO = ""
+	//SETTING_INDEX_SHA256 pins the sha256 digest of SETTING_INDEX, so that neither the repository nor mirrors could modify it.
+	//Releases built by build.sh pin the index of SETTING_URL, setting.index_sha256 of config.yaml overrides it
+	SETTING_INDEX_SHA256 = ""
+	//SETTING_VERIFY is the verification policy of setting repository, setting.verify of config.yaml sets it
+	SETTING_VERIFY = SETTING_VERIFY_AUTO
+)
+
+//SettingIndex maps artifact paths relative to the setting repository to their digests
+type SettingIndex map[string]digest.Digest
+
+//setting indexes already loaded, keyed by repository
+var settingIndexes = make(map[string]SettingIndex)
+
+//SettingURL returns the setting repository in use
+func SettingURL() string {
+	if repo := os.Getenv(ENV_SETTING_REPO); repo != "" {
+		return strings.TrimSuffix(repo, "/")
+	}
+	if SETTING_REPO != "" {
+		return strings.TrimSuffix(SETTING_REPO, "/")
+	}
+	return SETTING_URL
+}
+
+//settingIndexDigest returns the pinned digest of SETTING_INDEX, it is empty if nothing is pinned
+func settingIndexDigest() string {
+	if pinned := os.Getenv(ENV_SETTING_INDEX_DIGEST); pinned != "" {
+		return pinned
+	}
+	return SETTING_INDEX_SHA256
+}
+
+//strictSetting tells whether repo must provide SETTING_INDEX. Only the default repository without pinned index could be
+//relaxed by SETTING_VERIFY_AUTO, as mirrors and pinned indexes are meaningless without verification
+func strictSetting(repo string) bool {
+	verify := SETTING_VERIFY
+	if env := os.Getenv(ENV_SETTING_VERIFY); env != "" {
+		verify = env
+	}
+	return verify != SETTING_VERIFY_AUTO || repo != SETTING_URL || settingIndexDigest() != ""
+}
+
+//openSettingSource opens url of setting repository, which is either http(s) url, file:// url or local path
+func openSettingSource(url string) (io.ReadCloser, *Error) {
+	if strings.HasPrefix(url, "http://") || strings.HasPrefix(url, "https://") {
+		resp, err := http.Get(url)
+		if err != nil {
+			cerr := ErrNew(ErrHttpNotFound, fmt.Sprintf("http request to %s encounters failure", url))
+			return nil, cerr
+		}
+		if resp.StatusCode == 404 {
+			resp.Body.Close()
+			cerr := ErrNew(ErrNExist, fmt.Sprintf("%s returns 404", url))
+			return nil, cerr
+		}
+		if resp.StatusCode != 200 {
+			resp.Body.Close()
+			cerr := ErrNew(ErrStatus, fmt.Sprintf("%s returns %s", url, resp.Status))
+			return nil, cerr
+		}
+		return resp.Body, nil
+	}
+
+	file := strings.TrimPrefix(url, "file://")
+	f, err := os.Open(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			cerr := ErrNew(ErrNExist, fmt.Sprintf("%s does not exist", file))
+			return nil, cerr
+		}
+		cerr := ErrNew(err, fmt.Sprintf("could not open %s", file))
+		return nil, cerr
+	}
+	return f, nil
+}
+
+//ParseSettingIndex parses the lines of sha256sum output, i.e, '<hex>  <path>'
+func ParseSettingIndex(r io.Reader) (SettingIndex, *Error) {
+	index := make(SettingIndex)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			cerr := ErrNew(ErrMismatch, fmt.Sprintf("invalid line of setting index: %s", line))
+			return nil, cerr
+		}
+		dgst := digest.NewDigestFromHex(string(digest.SHA256), fields[0])
+		if err := dgst.Validate(); err != nil {
+			cerr := ErrNew(err, fmt.Sprintf("invalid checksum of setting index: %s", line))
+			return nil, cerr
+		}
+		//sha256sum marks binary mode with '*'
+		index[strings.TrimPrefix(strings.TrimPrefix(fields[1], "*"), "./")] = dgst
+	}
+	if err := scanner.Err(); err != nil {
+		cerr := ErrNew(err, "could not read setting index")
+		return nil, cerr
+	}
+	return index, nil
+}
+
+//loadSettingIndex fetches SETTING_INDEX of repo, nil is returned if repo does not provide it and verification is not strict
+func loadSettingIndex(repo string) (SettingIndex, *Error) {
+	if index, ok := settingIndexes[repo]; ok {
+		return index, nil
+	}
+
+	url := fmt.Sprintf("%s/%s", repo, SETTING_INDEX)
+	r, err := openSettingSource(url)
+	if err != nil {
+		if err.Err == ErrNExist && !strictSetting(repo) {
+			LOGGER.WithFields(logrus.Fields{
+				"repo": repo,
+			}).Warn("setting repository does not provide checksums, downloaded files are not verified")
+			settingIndexes[repo] = nil
+			return nil, nil
+		}
+		if repo == SETTING_URL && settingIndexDigest() == "" {
+			err.AddMsg(fmt.Sprintf("could not fetch checksums of setting repository %s, set %s=%s to accept the default repository without them", repo, ENV_SETTING_VERIFY, SETTING_VERIFY_AUTO))
+		} else {
+			err.AddMsg(fmt.Sprintf("could not fetch checksums of setting repository %s", repo))
+		}
+		return nil, err
+	}
+	defer r.Close()
+
+	verifier := digest.SHA256.Digester()
+	index, err := ParseSettingIndex(io.TeeReader(r, verifier.Hash()))
+	if err != nil {
+		return nil, err
+	}
+	if pinned := settingIndexDigest(); pinned != "" {
+		if actual := verifier.Digest(); strings.TrimPrefix(pinned, "sha256:") != actual.Hex() {
+			cerr := ErrNew(ErrMismatch, fmt.Sprintf("%s is %s, but %s is expected", url, actual, pinned))
+			return nil, cerr
+		}
+	}
+	settingIndexes[repo] = index
+	return index, nil
+}
+
+//verifySetting checks file downloaded from url against the index of setting repository,
+//files not coming from the setting repository are not verified
+func verifySetting(url, file string) *Error {
+	repo := SettingURL()
+	if !strings.HasPrefix(url, repo+"/") {
+		return nil
+	}
+	index, err := loadSettingIndex(repo)
+	if err != nil {
+		return err
+	}
+	if index == nil {
+		return nil
+	}
+
+	name := strings.TrimPrefix(url, repo+"/")
+	expected, ok := index[name]
+	if !ok {
+		cerr := ErrNew(ErrNExist, fmt.Sprintf("%s is not listed inside %s of %s", name, SETTING_INDEX, repo))
+		return cerr
+	}
+	f, ferr := os.Open(file)
+	if ferr != nil {
+		cerr := ErrNew(ferr, fmt.Sprintf("could not open %s", file))
+		return cerr
+	}
+	defer f.Close()
+	verifier := expected.Verifier()
+	if _, ferr := io.Copy(verifier, f); ferr != nil {
+		cerr := ErrNew(ferr, fmt.Sprintf("could not read %s", file))
+		return cerr
+	}
+	if !verifier.Verified() {
+		cerr := ErrNew(ErrMismatch, fmt.Sprintf("%s does not match its checksum %s", url, expected))
+		return cerr
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package docker
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/JasonYangShadow/lpmx/error"
+	. "github.com/JasonYangShadow/lpmx/utils"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+)
+
+//newTestSettingRepo creates a local setting repository with files and the checksums of listed ones
+func newTestSettingRepo(t *testing.T, files map[string]string, listed ...string) string {
+	repo, err := ioutil.TempDir("", "lpmx-setting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(repo)
+	})
+	var sums []string
+	for name, content := range files {
+		os.MkdirAll(filepath.Dir(filepath.Join(repo, name)), 0755)
+		ioutil.WriteFile(filepath.Join(repo, name), []byte(content), 0644)
+	}
+	for _, name := range listed {
+		sums = append(sums, fmt.Sprintf("%s  ./%s", digest.FromString(files[name]).Hex(), name))
+	}
+	if len(listed) > 0 {
+		ioutil.WriteFile(filepath.Join(repo, SETTING_INDEX), []byte(strings.Join(sums, "\n")+"\n"), 0644)
+	}
+	return repo
+}
+
+func TestDownloadVerifiedSetting(t *testing.T) {
+	files := map[string]string{
+		"default.setting.yml":       "default",
+		"ubuntu/16.04/setting.yml":  "ubuntu",
+		"default.dependency.tar.gz": "dependency",
+		"unlisted.yml":              "unlisted",
+	}
+	repo := newTestSettingRepo(t, files, "default.setting.yml", "ubuntu/16.04/setting.yml", "default.dependency.tar.gz")
+	os.Setenv(ENV_SETTING_REPO, "file://"+repo)
+	defer os.Unsetenv(ENV_SETTING_REPO)
+	url := SettingURL()
+	folder := filepath.Join(repo, "out")
+
+	assert.Nil(t, DirectDownloadFilefromGithub("dependency.tar.gz", url+"/default.dependency.tar.gz", folder))
+	data, _ := ioutil.ReadFile(filepath.Join(folder, "dependency.tar.gz"))
+	assert.Equal(t, "dependency", string(data))
+
+	//files missing at the distro level fall back to default ones
+	assert.Nil(t, DownloadFilefromGithubPlus("centos", "7", "setting.yml", url, folder, filepath.Join(folder, "distro.management.yml")))
+	data, _ = ioutil.ReadFile(filepath.Join(folder, "setting.yml"))
+	assert.Equal(t, "default", string(data))
+	source, err := DownloadFilefromGithubSource("centos", "7", "setting.yml", url, folder, filepath.Join(folder, "distro.management.yml"))
+	assert.Nil(t, err)
+	assert.Equal(t, DefaultSettingSource(url, "setting.yml"), source)
+	assert.Nil(t, DownloadFilefromGithub("Ubuntu", "16.04", "setting.yml", url, folder))
+	data, _ = ioutil.ReadFile(filepath.Join(folder, "setting.yml"))
+	assert.Equal(t, "ubuntu", string(data))
+
+	err = DirectDownloadFilefromGithub("unlisted.yml", url+"/unlisted.yml", folder)
+	assert.NotNil(t, err)
+	assert.False(t, FileExist(filepath.Join(folder, "unlisted.yml")))
+
+	//tampered files are neither saved nor replaced by fallbacks
+	ioutil.WriteFile(filepath.Join(repo, "ubuntu/16.04/setting.yml"), []byte("tampered"), 0644)
+	err = DownloadFilefromGithubPlus("ubuntu", "16.04", "setting.yml", url, filepath.Join(repo, "out2"), filepath.Join(folder, "distro.management.yml"))
+	if assert.NotNil(t, err) {
+		assert.Equal(t, ErrMismatch, err.Err)
+	}
+	assert.False(t, FileExist(filepath.Join(repo, "out2", "setting.yml")))
+}
+
+func TestSettingIndexPolicy(t *testing.T) {
+	files := map[string]string{"default.setting.yml": "default"}
+	repo := newTestSettingRepo(t, files)
+	os.Setenv(ENV_SETTING_REPO, repo)
+	defer os.Unsetenv(ENV_SETTING_REPO)
+	folder := filepath.Join(repo, "out")
+
+	//mirrors without checksums are refused even if verification is relaxed, it only applies to the default repository
+	assert.NotNil(t, DirectDownloadFilefromGithub("setting.yml", repo+"/default.setting.yml", folder))
+	//the default repository is accepted without checksums unless strict verification is opted in
+	assert.False(t, strictSetting(SETTING_URL))
+	os.Setenv(ENV_SETTING_VERIFY, SETTING_VERIFY_AUTO)
+	defer os.Unsetenv(ENV_SETTING_VERIFY)
+	delete(settingIndexes, repo)
+	assert.NotNil(t, DirectDownloadFilefromGithub("setting.yml", repo+"/default.setting.yml", folder))
+	assert.True(t, strictSetting(repo))
+	assert.False(t, strictSetting(SETTING_URL))
+	os.Setenv(ENV_SETTING_VERIFY, SETTING_VERIFY_STRICT)
+	assert.True(t, strictSetting(SETTING_URL))
+	os.Setenv(ENV_SETTING_VERIFY, SETTING_VERIFY_AUTO)
+	pinned := SETTING_INDEX_SHA256
+	SETTING_INDEX_SHA256 = digest.FromString("index").Hex()
+	assert.True(t, strictSetting(SETTING_URL))
+	SETTING_INDEX_SHA256 = pinned
+
+	//pinned index digest
+	listed := newTestSettingRepo(t, files, "default.setting.yml")
+	os.Setenv(ENV_SETTING_REPO, listed)
+	os.Setenv(ENV_SETTING_INDEX_DIGEST, "sha256:"+digest.FromString("other").Hex())
+	defer os.Unsetenv(ENV_SETTING_INDEX_DIGEST)
+	err := DirectDownloadFilefromGithub("setting.yml", listed+"/default.setting.yml", folder)
+	if assert.NotNil(t, err) {
+		assert.Equal(t, ErrMismatch, err.Err)
+	}
+	index, _ := ioutil.ReadFile(filepath.Join(listed, SETTING_INDEX))
+	os.Setenv(ENV_SETTING_INDEX_DIGEST, digest.FromBytes(index).Hex())
+	assert.Nil(t, DirectDownloadFilefromGithub("setting.yml", listed+"/default.setting.yml", folder))
+}
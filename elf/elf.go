@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"fmt"
 	. "github.com/JasonYangShadow/lpmx/error"
-	. "github.com/JasonYangShadow/lpmx/paeudo"
 	. "github.com/JasonYangShadow/lpmx/utils"
 	"io/ioutil"
 	"os"
@@ -18,77 +17,62 @@ const (
 	REMOVE_RPATH
 	REMOVE_NEEDED
 	REPLACE_NEEDED
+	MOVE_ROOT
 )
 
-var PARAMS = []string{"--set-interpreter", "--set-soname", "--set-rpath", "--add-needed", "--remove-rpath", "--remove-needed", "--replace-needed"}
+//PARAMS are the names of edits, they are the same as the options of patchelf except --move-root
+var PARAMS = []string{"--set-interpreter", "--set-soname", "--set-rpath", "--add-needed", "--remove-rpath", "--remove-needed", "--replace-needed", "--move-root"}
 
-func elfPatch(elfpath string, arg ...string) (string, *Error) {
-	cmd := fmt.Sprintf("%s/patchelf", elfpath)
-	out, err := Command(cmd, arg...)
+//the functions below apply a single edit each, elfpath(the folder of patchelf) is not used anymore as elf files are patched natively.
+//Use ElfPatch to apply several edits of one file at once
+func elfPatch(patch *ElfPatch) (bool, *Error) {
+	err := patch.Apply()
 	if err == nil {
-		return out, nil
+		return true, nil
 	}
-	return "", err
+	return false, err
 }
 
 func ElfSetInterpreter(elfpath string, lib string, prog string) (bool, *Error) {
-	_, err := elfPatch(elfpath, PARAMS[SET_INTERPRETER], lib, prog)
-	if err == nil {
-		return true, nil
-	}
-	return false, err
+	patch := NewElfPatch(prog)
+	patch.SetInterpreter(lib)
+	return elfPatch(patch)
 }
 
 func ElfSetSoname(elfpath string, lib string, prog string) (bool, *Error) {
-	_, err := elfPatch(elfpath, PARAMS[SET_SONAME], lib, prog)
-	if err == nil {
-		return true, nil
-	}
-	return false, err
+	patch := NewElfPatch(prog)
+	patch.SetSoname(lib)
+	return elfPatch(patch)
 }
 
 func ElfRPath(elfpath string, lib string, prog string) (bool, *Error) {
-	_, err := elfPatch(elfpath, PARAMS[SET_RPATH], lib, prog)
-	if err == nil {
-		return true, nil
-	}
-	return false, err
+	patch := NewElfPatch(prog)
+	patch.SetRPath(lib)
+	return elfPatch(patch)
 }
 
 func ElfAddNeeded(elfpath string, libs []string, prog string) (bool, *Error) {
-	for _, lib := range libs {
-		_, err := elfPatch(elfpath, PARAMS[ADD_NEEDED], lib, prog)
-		if err != nil {
-			return false, err
-		}
-	}
-	return true, nil
+	patch := NewElfPatch(prog)
+	patch.AddNeeded(libs...)
+	return elfPatch(patch)
 }
 
 func ElfRemoveNeeded(elfpath string, libs []string, prog string) (bool, *Error) {
-	for _, lib := range libs {
-		_, err := elfPatch(elfpath, PARAMS[REMOVE_NEEDED], lib, prog)
-		if err != nil {
-			return false, err
-		}
-	}
-	return true, nil
+	patch := NewElfPatch(prog)
+	patch.RemoveNeeded(libs...)
+	return elfPatch(patch)
 }
 
 func ElfRemoveRPath(elfpath string, lib string, prog string) (bool, *Error) {
-	_, err := elfPatch(elfpath, PARAMS[REMOVE_RPATH], lib, prog)
-	if err != nil {
-		return false, err
-	}
-	return true, nil
+	patch := NewElfPatch(prog)
+	patch.RemoveRPath(lib)
+	return elfPatch(patch)
 }
 
 func ElfReplaceNeeded(elfpath string, lib_old string, lib_new string, prog string) (bool, *Error) {
-	_, err := elfPatch(elfpath, PARAMS[REPLACE_NEEDED], lib_old, lib_new, prog)
-	if err != nil {
-		return false, err
-	}
-	return true, nil
+	patch := NewElfPatch(prog)
+	patch.ReplaceNeeded(lib_old, lib_new)
+	return elfPatch(patch)
 }
 
 func Patchldso(elfpath string, newpath string) *Error {
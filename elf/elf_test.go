@@ -9,8 +9,8 @@ import (
 var name string
 
 func init() {
+	//flags are parsed by go test, e.g, go test -args -name /lib64/ld-linux-x86-64.so.2
 	flag.StringVar(&name, "name", "", "the name for ld.so")
-	flag.Parse()
 }
 
 func TestELF1(t *testing.T) {
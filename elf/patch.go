@@ -0,0 +1,845 @@
+package elf
+
+import (
+	"bytes"
+	delf "debug/elf"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/JasonYangShadow/lpmx/error"
+)
+
+//ElfError is the Err of *Error returned when patching elf files, it tells which file and which edit fails
+type ElfError struct {
+	File string //elf file being patched
+	Op   string //edit failing, one of PARAMS, it is empty if the file itself could not be handled
+	Err  error  //ErrType for files which are not elf or not supported, ErrNExist for missing parts, e.g, PT_INTERP of libraries
+}
+
+func (e *ElfError) Error() string {
+	if e.Op == "" {
+		return fmt.Sprintf("%s: %s", e.File, e.Err.Error())
+	}
+	return fmt.Sprintf("%s %s: %s", e.Op, e.File, e.Err.Error())
+}
+
+func (e *ElfError) Unwrap() error {
+	return e.Err
+}
+
+func elfErr(file string, op int, err error, msg string) *Error {
+	elferr := &ElfError{File: file, Err: err}
+	if op >= 0 {
+		elferr.Op = PARAMS[op]
+	}
+	cerr := ErrNew(elferr, msg)
+	return cerr
+}
+
+//elfEdit is one edit recorded by ElfPatch, op is one of SET_INTERPRETER...MOVE_ROOT
+type elfEdit struct {
+	op   int
+	args []string
+}
+
+//ElfPatch collects the edits of one elf file, they are applied with one read and one write of the file
+type ElfPatch struct {
+	File  string
+	edits []elfEdit
+}
+
+func NewElfPatch(file string) *ElfPatch {
+	return &ElfPatch{File: file}
+}
+
+func (p *ElfPatch) add(op int, args ...string) {
+	p.edits = append(p.edits, elfEdit{op: op, args: args})
+}
+
+//SetInterpreter changes PT_INTERP of executables
+func (p *ElfPatch) SetInterpreter(lib string) {
+	p.add(SET_INTERPRETER, lib)
+}
+
+//SetSoname changes DT_SONAME of libraries
+func (p *ElfPatch) SetSoname(soname string) {
+	p.add(SET_SONAME, soname)
+}
+
+//SetRPath replaces DT_RPATH and DT_RUNPATH with DT_RUNPATH rpath like patchelf does
+func (p *ElfPatch) SetRPath(rpath string) {
+	p.add(SET_RPATH, rpath)
+}
+
+//RemoveRPath removes path from DT_RPATH and DT_RUNPATH, both of them are removed if path is empty
+func (p *ElfPatch) RemoveRPath(path string) {
+	p.add(REMOVE_RPATH, path)
+}
+
+//AddNeeded adds DT_NEEDED libs before the existing ones, libs already needed are skipped
+func (p *ElfPatch) AddNeeded(libs ...string) {
+	for _, lib := range libs {
+		p.add(ADD_NEEDED, lib)
+	}
+}
+
+func (p *ElfPatch) RemoveNeeded(libs ...string) {
+	for _, lib := range libs {
+		p.add(REMOVE_NEEDED, lib)
+	}
+}
+
+//ReplaceNeeded renames DT_NEEDED lib_old as well as the version requirements of it
+func (p *ElfPatch) ReplaceNeeded(lib_old string, lib_new string) {
+	p.add(REPLACE_NEEDED, lib_old, lib_new)
+}
+
+//MoveRoot changes the interpreter, rpath and DT_NEEDED entries inside oldroot to the same paths inside newroot,
+//it is applied before the other edits no matter when it is called
+func (p *ElfPatch) MoveRoot(oldroot string, newroot string) {
+	p.edits = append([]elfEdit{{op: MOVE_ROOT, args: []string{oldroot, newroot}}}, p.edits...)
+}
+
+func (p *ElfPatch) Empty() bool {
+	return len(p.edits) == 0
+}
+
+//Apply rewrites the file with all edits, the file is left untouched if any edit fails
+func (p *ElfPatch) Apply() *Error {
+	if p.Empty() {
+		return nil
+	}
+	f, err := readElf(p.File)
+	if err != nil {
+		return err
+	}
+	for _, edit := range p.edits {
+		if err := f.edit(edit); err != nil {
+			return err
+		}
+	}
+	if !f.changed {
+		return nil
+	}
+	if err := f.layout(); err != nil {
+		return err
+	}
+	return f.write()
+}
+
+type elfProg struct {
+	Type, Flags                             uint32
+	Off, Vaddr, Paddr, Filesz, Memsz, Align uint64
+}
+
+type elfDyn struct {
+	Tag int64
+	Val uint64
+}
+
+//elfFile is the parsed elf file, only the parts touched by edits are decoded
+type elfFile struct {
+	file    string
+	data    []byte
+	order   binary.ByteOrder
+	is64    bool
+	machine delf.Machine
+	progs   []elfProg
+	phent   uint64
+
+	dynIdx  int //index of PT_DYNAMIC inside progs, -1 if it is static
+	dyns    []elfDyn
+	dynCap  int    //number of entries the current dynamic section could hold, including DT_NULL
+	dynstr  []byte //the original string table
+	strs    []byte //strings appended to dynstr
+	renames map[string]uint64
+
+	interpIdx int //index of PT_INTERP inside progs, -1 if there is none
+	interp    string
+	interpSet bool
+
+	changed bool
+	newSeg  *elfProg
+	segData []byte
+}
+
+func (f *elfFile) uint(b []byte, size int) uint64 {
+	switch size {
+	case 2:
+		return uint64(f.order.Uint16(b))
+	case 4:
+		return uint64(f.order.Uint32(b))
+	}
+	return f.order.Uint64(b)
+}
+
+func (f *elfFile) putUint(b []byte, size int, v uint64) {
+	switch size {
+	case 2:
+		f.order.PutUint16(b, uint16(v))
+	case 4:
+		f.order.PutUint32(b, uint32(v))
+	default:
+		f.order.PutUint64(b, v)
+	}
+}
+
+//addrSize is the size of addresses and offsets
+func (f *elfFile) addrSize() int {
+	if f.is64 {
+		return 8
+	}
+	return 4
+}
+
+//dynSize is the size of one dynamic entry
+func (f *elfFile) dynSize() uint64 {
+	return uint64(2 * f.addrSize())
+}
+
+//header returns the offset of e_phoff and e_phnum inside elf header
+func (f *elfFile) header() (phoff int, phnum int) {
+	if f.is64 {
+		return 32, 56
+	}
+	return 28, 44
+}
+
+func (f *elfFile) readProg(b []byte) elfProg {
+	if f.is64 {
+		return elfProg{
+			Type:   uint32(f.uint(b[0:], 4)),
+			Flags:  uint32(f.uint(b[4:], 4)),
+			Off:    f.uint(b[8:], 8),
+			Vaddr:  f.uint(b[16:], 8),
+			Paddr:  f.uint(b[24:], 8),
+			Filesz: f.uint(b[32:], 8),
+			Memsz:  f.uint(b[40:], 8),
+			Align:  f.uint(b[48:], 8),
+		}
+	}
+	return elfProg{
+		Type:   uint32(f.uint(b[0:], 4)),
+		Off:    f.uint(b[4:], 4),
+		Vaddr:  f.uint(b[8:], 4),
+		Paddr:  f.uint(b[12:], 4),
+		Filesz: f.uint(b[16:], 4),
+		Memsz:  f.uint(b[20:], 4),
+		Flags:  uint32(f.uint(b[24:], 4)),
+		Align:  f.uint(b[28:], 4),
+	}
+}
+
+func (f *elfFile) writeProg(b []byte, p elfProg) {
+	if f.is64 {
+		f.putUint(b[0:], 4, uint64(p.Type))
+		f.putUint(b[4:], 4, uint64(p.Flags))
+		f.putUint(b[8:], 8, p.Off)
+		f.putUint(b[16:], 8, p.Vaddr)
+		f.putUint(b[24:], 8, p.Paddr)
+		f.putUint(b[32:], 8, p.Filesz)
+		f.putUint(b[40:], 8, p.Memsz)
+		f.putUint(b[48:], 8, p.Align)
+		return
+	}
+	f.putUint(b[0:], 4, uint64(p.Type))
+	f.putUint(b[4:], 4, p.Off)
+	f.putUint(b[8:], 4, p.Vaddr)
+	f.putUint(b[12:], 4, p.Paddr)
+	f.putUint(b[16:], 4, p.Filesz)
+	f.putUint(b[20:], 4, p.Memsz)
+	f.putUint(b[24:], 4, uint64(p.Flags))
+	f.putUint(b[28:], 4, p.Align)
+}
+
+//section returns the offsets of sh_type, sh_addr, sh_offset and sh_size inside section header
+func (f *elfFile) section() (typ, addr, off, size int) {
+	if f.is64 {
+		return 4, 16, 24, 32
+	}
+	return 4, 12, 16, 20
+}
+
+//offset converts virtual address to file offset by the PT_LOAD segment containing it
+func (f *elfFile) offset(vaddr uint64, size uint64) (uint64, bool) {
+	for _, p := range f.progs {
+		if p.Type == uint32(delf.PT_LOAD) && vaddr >= p.Vaddr && vaddr+size <= p.Vaddr+p.Filesz {
+			off := p.Off + vaddr - p.Vaddr
+			return off, off+size <= uint64(len(f.data))
+		}
+	}
+	return 0, false
+}
+
+func readElf(file string) (*elfFile, *Error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, elfErr(file, -1, ErrFileIO, fmt.Sprintf("could not read elf file %s: %s", file, err.Error()))
+	}
+	if len(data) < delf.EI_NIDENT || !bytes.Equal(data[:4], []byte(delf.ELFMAG)) {
+		return nil, elfErr(file, -1, ErrType, fmt.Sprintf("%s is not an elf file", file))
+	}
+	f := &elfFile{file: file, data: data, dynIdx: -1, interpIdx: -1, renames: make(map[string]uint64)}
+	switch delf.Class(data[delf.EI_CLASS]) {
+	case delf.ELFCLASS64:
+		f.is64 = true
+	case delf.ELFCLASS32:
+	default:
+		return nil, elfErr(file, -1, ErrType, fmt.Sprintf("elf class %d of %s is not supported", data[delf.EI_CLASS], file))
+	}
+	switch delf.Data(data[delf.EI_DATA]) {
+	case delf.ELFDATA2LSB:
+		f.order = binary.LittleEndian
+	case delf.ELFDATA2MSB:
+		f.order = binary.BigEndian
+	default:
+		return nil, elfErr(file, -1, ErrType, fmt.Sprintf("byte order %d of %s is not supported", data[delf.EI_DATA], file))
+	}
+	phoff_pos, phnum_pos := f.header()
+	if len(data) < phnum_pos+2 {
+		return nil, elfErr(file, -1, ErrType, fmt.Sprintf("elf header of %s is truncated", file))
+	}
+	f.machine = delf.Machine(f.uint(data[18:], 2))
+	phoff := f.uint(data[phoff_pos:], f.addrSize())
+	f.phent = f.uint(data[phnum_pos-2:], 2)
+	phnum := f.uint(data[phnum_pos:], 2)
+	min_phent := uint64(32)
+	if f.is64 {
+		min_phent = 56
+	}
+	if phnum == 0xffff || f.phent < min_phent || phoff+phnum*f.phent > uint64(len(data)) {
+		return nil, elfErr(file, -1, ErrType, fmt.Sprintf("program headers of %s are not supported", file))
+	}
+	for i := uint64(0); i < phnum; i++ {
+		p := f.readProg(data[phoff+i*f.phent:])
+		switch delf.ProgType(p.Type) {
+		case delf.PT_DYNAMIC:
+			f.dynIdx = len(f.progs)
+		case delf.PT_INTERP:
+			f.interpIdx = len(f.progs)
+		}
+		f.progs = append(f.progs, p)
+	}
+
+	if f.interpIdx >= 0 {
+		p := f.progs[f.interpIdx]
+		if p.Off+p.Filesz > uint64(len(data)) {
+			return nil, elfErr(file, -1, ErrType, fmt.Sprintf("PT_INTERP of %s is out of file", file))
+		}
+		f.interp = string(bytes.TrimRight(data[p.Off:p.Off+p.Filesz], "\x00"))
+	}
+	if f.dynIdx >= 0 {
+		if err := f.readDynamic(); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+//readDynamic decodes dynamic entries and the string table used by them
+func (f *elfFile) readDynamic() *Error {
+	p := f.progs[f.dynIdx]
+	if p.Off+p.Filesz > uint64(len(f.data)) {
+		return elfErr(f.file, -1, ErrType, fmt.Sprintf("PT_DYNAMIC of %s is out of file", f.file))
+	}
+	size := f.addrSize()
+	f.dynCap = int(p.Filesz / f.dynSize())
+	for i := 0; i < f.dynCap; i++ {
+		b := f.data[p.Off+uint64(i)*f.dynSize():]
+		tag := int64(f.uint(b, size))
+		if !f.is64 {
+			tag = int64(int32(tag))
+		}
+		if delf.DynTag(tag) == delf.DT_NULL {
+			break
+		}
+		f.dyns = append(f.dyns, elfDyn{Tag: tag, Val: f.uint(b[size:], size)})
+	}
+
+	strtab, strsz := f.dynVal(delf.DT_STRTAB), f.dynVal(delf.DT_STRSZ)
+	off, ok := f.offset(strtab, strsz)
+	if strtab == 0 || !ok {
+		return elfErr(f.file, -1, ErrType, fmt.Sprintf("dynamic string table of %s is not found", f.file))
+	}
+	f.dynstr = append([]byte(nil), f.data[off:off+strsz]...)
+	return nil
+}
+
+func (f *elfFile) dynVal(tag delf.DynTag) uint64 {
+	for _, d := range f.dyns {
+		if delf.DynTag(d.Tag) == tag {
+			return d.Val
+		}
+	}
+	return 0
+}
+
+//str returns the string at offset off of dynamic string table
+func (f *elfFile) str(off uint64) string {
+	table := f.dynstr
+	if off >= uint64(len(table)) {
+		off -= uint64(len(table))
+		table = f.strs
+	}
+	if off >= uint64(len(table)) {
+		return ""
+	}
+	if end := bytes.IndexByte(table[off:], 0); end >= 0 {
+		return string(table[off : off+uint64(end)])
+	}
+	return string(table[off:])
+}
+
+//addStr returns the offset of s inside dynamic string table, s is appended if it is not there
+func (f *elfFile) addStr(s string) uint64 {
+	key := append([]byte(s), 0)
+	if idx := bytes.Index(f.dynstr, key); idx >= 0 {
+		return uint64(idx)
+	}
+	if idx := bytes.Index(f.strs, key); idx >= 0 {
+		return uint64(len(f.dynstr) + idx)
+	}
+	off := uint64(len(f.dynstr) + len(f.strs))
+	f.strs = append(f.strs, key...)
+	return off
+}
+
+//insertDyn inserts d before the entry at idx
+func (f *elfFile) insertDyn(idx int, d elfDyn) {
+	f.dyns = append(f.dyns, elfDyn{})
+	copy(f.dyns[idx+1:], f.dyns[idx:])
+	f.dyns[idx] = d
+}
+
+//afterNeeded returns the index following the last DT_NEEDED
+func (f *elfFile) afterNeeded() int {
+	idx := 0
+	for i, d := range f.dyns {
+		if delf.DynTag(d.Tag) == delf.DT_NEEDED {
+			idx = i + 1
+		}
+	}
+	return idx
+}
+
+func isRPath(d elfDyn) bool {
+	return delf.DynTag(d.Tag) == delf.DT_RPATH || delf.DynTag(d.Tag) == delf.DT_RUNPATH
+}
+
+//movePath returns p inside newroot if it is inside oldroot, otherwise p is returned
+func movePath(p, oldroot, newroot string) string {
+	if p == oldroot || strings.HasPrefix(p, oldroot+"/") {
+		return newroot + strings.TrimPrefix(p, oldroot)
+	}
+	return p
+}
+
+//edit applies one edit to the decoded file
+func (f *elfFile) edit(e elfEdit) *Error {
+	if e.op == MOVE_ROOT {
+		//files without interpreter or dynamic section are fine, there is simply nothing to move
+		if f.interpIdx >= 0 {
+			if interp := movePath(f.interp, e.args[0], e.args[1]); interp != f.interp {
+				f.interp, f.interpSet, f.changed = interp, true, true
+			}
+		}
+		if f.dynIdx < 0 {
+			return nil
+		}
+	}
+	if e.op == SET_INTERPRETER {
+		if f.interpIdx < 0 {
+			return elfErr(f.file, e.op, ErrNExist, fmt.Sprintf("%s does not have PT_INTERP, it is either static or a library", f.file))
+		}
+		if f.interp != e.args[0] {
+			f.interp, f.interpSet, f.changed = e.args[0], true, true
+		}
+		return nil
+	}
+	if f.dynIdx < 0 {
+		return elfErr(f.file, e.op, ErrNExist, fmt.Sprintf("%s is not dynamically linked", f.file))
+	}
+
+	changed := false
+	switch e.op {
+	case SET_SONAME:
+		val := f.addStr(e.args[0])
+		found := false
+		for i, d := range f.dyns {
+			if delf.DynTag(d.Tag) == delf.DT_SONAME {
+				changed = changed || d.Val != val
+				f.dyns[i].Val, found = val, true
+			}
+		}
+		if !found {
+			f.insertDyn(f.afterNeeded(), elfDyn{Tag: int64(delf.DT_SONAME), Val: val})
+			changed = true
+		}
+	case SET_RPATH:
+		val := f.addStr(e.args[0])
+		idx, count := -1, 0
+		var dyns []elfDyn
+		for _, d := range f.dyns {
+			if isRPath(d) {
+				if idx < 0 {
+					idx = len(dyns)
+				}
+				//the file is kept untouched if it already has the same DT_RUNPATH only
+				count++
+				changed = changed || delf.DynTag(d.Tag) != delf.DT_RUNPATH || d.Val != val || count > 1
+				continue
+			}
+			dyns = append(dyns, d)
+		}
+		if idx < 0 {
+			f.dyns = dyns
+			idx, changed = f.afterNeeded(), true
+		}
+		if changed {
+			f.dyns = dyns
+			f.insertDyn(idx, elfDyn{Tag: int64(delf.DT_RUNPATH), Val: val})
+		}
+	case REMOVE_RPATH:
+		var dyns []elfDyn
+		for _, d := range f.dyns {
+			if isRPath(d) {
+				var paths []string
+				for _, path := range strings.Split(f.str(d.Val), ":") {
+					if e.args[0] != "" && path != e.args[0] {
+						paths = append(paths, path)
+					}
+				}
+				if rpath := strings.Join(paths, ":"); rpath != f.str(d.Val) {
+					changed = true
+					if len(paths) == 0 {
+						continue
+					}
+					d.Val = f.addStr(rpath)
+				}
+			}
+			dyns = append(dyns, d)
+		}
+		f.dyns = dyns
+	case ADD_NEEDED:
+		for _, d := range f.dyns {
+			if delf.DynTag(d.Tag) == delf.DT_NEEDED && f.str(d.Val) == e.args[0] {
+				return nil
+			}
+		}
+		f.insertDyn(0, elfDyn{Tag: int64(delf.DT_NEEDED), Val: f.addStr(e.args[0])})
+		changed = true
+	case REMOVE_NEEDED:
+		var dyns []elfDyn
+		for _, d := range f.dyns {
+			if delf.DynTag(d.Tag) == delf.DT_NEEDED && f.str(d.Val) == e.args[0] {
+				changed = true
+				continue
+			}
+			dyns = append(dyns, d)
+		}
+		f.dyns = dyns
+	case REPLACE_NEEDED:
+		for i, d := range f.dyns {
+			if delf.DynTag(d.Tag) == delf.DT_NEEDED && f.str(d.Val) == e.args[0] && e.args[0] != e.args[1] {
+				f.dyns[i].Val = f.addStr(e.args[1])
+				f.renames[e.args[0]] = f.dyns[i].Val
+				changed = true
+			}
+		}
+	case MOVE_ROOT:
+		for i, d := range f.dyns {
+			if isRPath(d) {
+				paths := strings.Split(f.str(d.Val), ":")
+				for j, path := range paths {
+					paths[j] = movePath(path, e.args[0], e.args[1])
+				}
+				if rpath := strings.Join(paths, ":"); rpath != f.str(d.Val) {
+					f.dyns[i].Val = f.addStr(rpath)
+					changed = true
+				}
+			}
+			if delf.DynTag(d.Tag) == delf.DT_NEEDED {
+				lib := f.str(d.Val)
+				if moved := movePath(lib, e.args[0], e.args[1]); moved != lib {
+					f.dyns[i].Val = f.addStr(moved)
+					f.renames[lib] = f.dyns[i].Val
+					changed = true
+				}
+			}
+		}
+	default:
+		return elfErr(f.file, -1, ErrType, fmt.Sprintf("unknown elf edit %d", e.op))
+	}
+	f.changed = f.changed || changed
+	return nil
+}
+
+func alignUp(v, align uint64) uint64 {
+	if align <= 1 {
+		return v
+	}
+	return (v + align - 1) / align * align
+}
+
+//pageSize is the largest page size of machine, segments are mapped at its multiples, the same values are used by patchelf
+func pageSize(machine delf.Machine) uint64 {
+	switch machine {
+	case delf.EM_IA_64, delf.EM_MIPS, delf.EM_PPC, delf.EM_PPC64, delf.EM_AARCH64, delf.EM_TILEGX:
+		return 0x10000
+	case delf.EM_SPARC, delf.EM_SPARCV9:
+		return 0x2000
+	}
+	return 0x1000
+}
+
+//layout decides whether the edited parts still fit where they are. Otherwise a new PT_LOAD segment holding the program headers,
+//the interpreter, the string table and the dynamic entries that outgrow their space is appended to the file
+func (f *elfFile) layout() *Error {
+	newStrs := len(f.strs) > 0
+	moveDyn := f.dynIdx >= 0 && len(f.dyns)+1 > f.dynCap
+	moveInterp := f.interpSet && uint64(len(f.interp)+1) > f.progs[f.interpIdx].Filesz
+	if !newStrs && !moveDyn && !moveInterp {
+		return nil
+	}
+	if moveDyn && (f.machine == delf.EM_MIPS || f.machine == delf.EM_MIPS_RS3_LE) {
+		return elfErr(f.file, -1, ErrType, fmt.Sprintf("moving dynamic section of mips file %s is not supported", f.file))
+	}
+
+	var first *elfProg
+	var end uint64
+	last := -1
+	for i, p := range f.progs {
+		if p.Type != uint32(delf.PT_LOAD) {
+			continue
+		}
+		if first == nil || p.Vaddr < first.Vaddr {
+			first = &f.progs[i]
+		}
+		if p.Vaddr+p.Memsz > end {
+			end = p.Vaddr + p.Memsz
+		}
+		last = i
+	}
+	if first == nil {
+		return elfErr(f.file, -1, ErrType, fmt.Sprintf("%s does not have any PT_LOAD segment", f.file))
+	}
+	page := pageSize(f.machine)
+
+	//the segment starts with program headers, the new PT_LOAD needs one more entry
+	size := uint64(len(f.progs)+1) * f.phent
+	var interpOff, strOff, dynOff uint64
+	if moveInterp {
+		interpOff = size
+		size += uint64(len(f.interp) + 1)
+	}
+	if newStrs {
+		strOff = size
+		size += uint64(len(f.dynstr) + len(f.strs))
+	}
+	if moveDyn {
+		dynOff = alignUp(size, uint64(f.addrSize()))
+		size = dynOff + uint64(len(f.dyns)+1)*f.dynSize()
+	}
+
+	var off, vaddr uint64
+	if f.interpIdx >= 0 {
+		//older kernels pass AT_PHDR as e_phoff plus the distance between address and offset of the first PT_LOAD segment,
+		//so program headers of executables keep the same distance
+		delta := first.Vaddr - first.Off
+		if first.Vaddr < first.Off || delta%page != 0 {
+			return elfErr(f.file, -1, ErrType, fmt.Sprintf("segments of %s are not page aligned", f.file))
+		}
+		off = uint64(len(f.data))
+		if end-delta > off {
+			off = end - delta
+		}
+		off = alignUp(off, page)
+		vaddr = off + delta
+	} else {
+		off = alignUp(uint64(len(f.data)), uint64(f.addrSize()))
+		vaddr = alignUp(end, page) + off%page
+	}
+
+	seg := elfProg{Type: uint32(delf.PT_LOAD), Flags: uint32(delf.PF_R | delf.PF_W), Off: off, Vaddr: vaddr, Paddr: vaddr, Filesz: size, Memsz: size, Align: page}
+	f.segData = make([]byte, size)
+	if moveInterp {
+		p := &f.progs[f.interpIdx]
+		f.moveSection(delf.SHT_PROGBITS, p.Vaddr, off+interpOff, vaddr+interpOff, uint64(len(f.interp)+1))
+		p.Off, p.Vaddr, p.Paddr = off+interpOff, vaddr+interpOff, vaddr+interpOff
+		p.Filesz, p.Memsz = uint64(len(f.interp)+1), uint64(len(f.interp)+1)
+		copy(f.segData[interpOff:], f.interp)
+	}
+	if newStrs {
+		f.moveSection(delf.SHT_STRTAB, f.dynVal(delf.DT_STRTAB), off+strOff, vaddr+strOff, uint64(len(f.dynstr)+len(f.strs)))
+		copy(f.segData[strOff:], f.dynstr)
+		copy(f.segData[strOff+uint64(len(f.dynstr)):], f.strs)
+		for i, d := range f.dyns {
+			switch delf.DynTag(d.Tag) {
+			case delf.DT_STRTAB:
+				f.dyns[i].Val = vaddr + strOff
+			case delf.DT_STRSZ:
+				f.dyns[i].Val = uint64(len(f.dynstr) + len(f.strs))
+			}
+		}
+	}
+	if moveDyn {
+		p := &f.progs[f.dynIdx]
+		f.moveSection(delf.SHT_DYNAMIC, p.Vaddr, off+dynOff, vaddr+dynOff, size-dynOff)
+		p.Off, p.Vaddr, p.Paddr = off+dynOff, vaddr+dynOff, vaddr+dynOff
+		p.Filesz, p.Memsz = size-dynOff, size-dynOff
+		f.dynCap = len(f.dyns) + 1
+	}
+
+	//PT_LOAD segments are sorted by address, the new one has the highest address
+	progs := append([]elfProg{}, f.progs[:last+1]...)
+	progs = append(progs, seg)
+	f.progs = append(progs, f.progs[last+1:]...)
+	if f.dynIdx > last {
+		f.dynIdx++
+	}
+	if f.interpIdx > last {
+		f.interpIdx++
+	}
+	for i, p := range f.progs {
+		if p.Type == uint32(delf.PT_PHDR) {
+			f.progs[i].Off, f.progs[i].Vaddr, f.progs[i].Paddr = off, vaddr, vaddr
+			f.progs[i].Filesz, f.progs[i].Memsz = uint64(len(f.progs))*f.phent, uint64(len(f.progs))*f.phent
+		}
+	}
+	f.newSeg = &seg
+	return nil
+}
+
+//moveSection points the section header of type typ at address addr to its new place, so that tools reading sections see the edits
+func (f *elfFile) moveSection(typ delf.SectionType, addr, off, vaddr, size uint64) {
+	shoff_pos, _ := f.header()
+	shoff := f.uint(f.data[shoff_pos+f.addrSize():], f.addrSize())
+	shent_pos := shoff_pos + 2*f.addrSize() + 10
+	shent := f.uint(f.data[shent_pos:], 2)
+	shnum := f.uint(f.data[shent_pos+2:], 2)
+	if shoff == 0 || shnum == 0 || shoff+shnum*shent > uint64(len(f.data)) {
+		return
+	}
+	typ_pos, addr_pos, off_pos, size_pos := f.section()
+	for i := uint64(0); i < shnum; i++ {
+		b := f.data[shoff+i*shent:]
+		if delf.SectionType(f.uint(b[typ_pos:], 4)) == typ && f.uint(b[addr_pos:], f.addrSize()) == addr && addr != 0 {
+			f.putUint(b[addr_pos:], f.addrSize(), vaddr)
+			f.putUint(b[off_pos:], f.addrSize(), off)
+			f.putUint(b[size_pos:], f.addrSize(), size)
+			return
+		}
+	}
+}
+
+//write stores the edits into a temp file next to the target of the file and renames it over the target, hardlinks sharing the
+//original are left untouched on purpose. The permission bits and setuid/setgid/sticky bits of the original are copied before renaming
+func (f *elfFile) write() *Error {
+	if f.dynIdx >= 0 {
+		p := f.progs[f.dynIdx]
+		table := make([]byte, uint64(f.dynCap)*f.dynSize())
+		size := f.addrSize()
+		for i, d := range f.dyns {
+			f.putUint(table[uint64(i)*f.dynSize():], size, uint64(d.Tag))
+			f.putUint(table[uint64(i)*f.dynSize()+uint64(size):], size, d.Val)
+		}
+		if f.newSeg != nil && p.Off >= f.newSeg.Off {
+			copy(f.segData[p.Off-f.newSeg.Off:], table)
+		} else {
+			copy(f.data[p.Off:p.Off+p.Filesz], table)
+		}
+		f.renameVersions()
+	}
+	if f.interpSet && (f.newSeg == nil || f.progs[f.interpIdx].Off < f.newSeg.Off) {
+		p := f.progs[f.interpIdx]
+		interp := make([]byte, p.Filesz)
+		copy(interp, f.interp)
+		copy(f.data[p.Off:], interp)
+	}
+
+	if seg := f.newSeg; seg != nil {
+		table := make([]byte, uint64(len(f.progs))*f.phent)
+		for i, p := range f.progs {
+			f.writeProg(table[uint64(i)*f.phent:], p)
+		}
+		copy(f.segData, table)
+		phoff_pos, phnum_pos := f.header()
+		f.putUint(f.data[phoff_pos:], f.addrSize(), seg.Off)
+		f.putUint(f.data[phnum_pos:], 2, uint64(len(f.progs)))
+		f.data = append(f.data, make([]byte, seg.Off-uint64(len(f.data)))...)
+		f.data = append(f.data, f.segData...)
+	}
+
+	//patched file is written aside and renamed over the original one, so that the original is intact if writing fails and
+	//running processes or hard links sharing it are not affected. Symlinks are resolved to keep them as they are
+	file, err := filepath.EvalSymlinks(f.file)
+	if err != nil {
+		return elfErr(f.file, -1, ErrFileIO, fmt.Sprintf("could not resolve %s: %s", f.file, err.Error()))
+	}
+	fi, err := os.Stat(file)
+	if err != nil {
+		return elfErr(f.file, -1, ErrFileIO, fmt.Sprintf("could not stat %s: %s", file, err.Error()))
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(file), fmt.Sprintf(".%s.", filepath.Base(file)))
+	if err != nil {
+		return elfErr(f.file, -1, ErrFileIO, fmt.Sprintf("could not create temp file for %s: %s", file, err.Error()))
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(f.data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return elfErr(f.file, -1, ErrFileIO, fmt.Sprintf("could not write %s: %s", tmp.Name(), err.Error()))
+	}
+	if err := os.Chmod(tmp.Name(), fi.Mode()&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+		return elfErr(f.file, -1, ErrFileIO, fmt.Sprintf("could not change mode of %s: %s", tmp.Name(), err.Error()))
+	}
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		return elfErr(f.file, -1, ErrFileIO, fmt.Sprintf("could not replace %s: %s", file, err.Error()))
+	}
+	return nil
+}
+
+//renameVersions points the version requirements of renamed DT_NEEDED to their new names, otherwise the dynamic loader
+//could not find the library providing the required versions
+func (f *elfFile) renameVersions() {
+	if len(f.renames) == 0 {
+		return
+	}
+	verneed, num := f.dynVal(delf.DT_VERNEED), f.dynVal(delf.DT_VERNEEDNUM)
+	off, ok := f.offset(verneed, 16)
+	if verneed == 0 || !ok {
+		return
+	}
+	for i := uint64(0); i < num && off+16 <= uint64(len(f.data)); i++ {
+		b := f.data[off:]
+		if val, ok := f.renames[f.str(f.uint(b[4:], 4))]; ok {
+			f.putUint(b[4:], 4, val)
+		}
+		next := f.uint(b[12:], 4)
+		if next == 0 {
+			break
+		}
+		off += next
+	}
+}
+
+//IsElf tells whether file starts with the magic number of elf
+func IsElf(file string) bool {
+	f, err := os.Open(file)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	magic := make([]byte, len(delf.ELFMAG))
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return false
+	}
+	return string(magic) == delf.ELFMAG
+}
@@ -0,0 +1,280 @@
+package elf
+
+import (
+	delf "debug/elf"
+	"errors"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/JasonYangShadow/lpmx/error"
+	"github.com/stretchr/testify/assert"
+)
+
+//hostElf copies a dynamically linked executable of host into dir
+func hostElf(t *testing.T, dir string) (string, string) {
+	prog, err := exec.LookPath("true")
+	if err != nil {
+		t.Skip("true is not found")
+	}
+	ef, err := delf.Open(prog)
+	if err != nil {
+		t.Skipf("%s is not an elf file", prog)
+	}
+	defer ef.Close()
+	interp := ""
+	for _, p := range ef.Progs {
+		if p.Type == delf.PT_INTERP {
+			data, _ := ioutil.ReadAll(p.Open())
+			interp = strings.TrimRight(string(data), "\x00")
+		}
+	}
+	if interp == "" {
+		t.Skipf("%s is not dynamically linked", prog)
+	}
+	data, _ := ioutil.ReadFile(prog)
+	file := filepath.Join(dir, "true")
+	assert.Nil(t, ioutil.WriteFile(file, data, 0555))
+	return file, interp
+}
+
+func readDynamic(t *testing.T, file string) (needed []string, runpath []string, interp string) {
+	ef, err := delf.Open(file)
+	assert.Nil(t, err)
+	defer ef.Close()
+	needed, err = ef.ImportedLibraries()
+	assert.Nil(t, err)
+	runpath, _ = ef.DynString(delf.DT_RUNPATH)
+	for _, p := range ef.Progs {
+		if p.Type == delf.PT_INTERP {
+			data, _ := ioutil.ReadAll(p.Open())
+			interp = strings.TrimRight(string(data), "\x00")
+		}
+	}
+	return needed, runpath, interp
+}
+
+func TestElfPatch(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "lpmx-elf")
+	defer os.RemoveAll(dir)
+	file, interp := hostElf(t, dir)
+	needed, _, _ := readDynamic(t, file)
+
+	//edits of one file are applied together
+	patch := NewElfPatch(file)
+	patch.SetRPath("/opt/lpmx/lib:$ORIGIN")
+	patch.AddNeeded("libm.so.6", needed[0])
+	assert.Nil(t, patch.Apply())
+	pneeded, runpath, _ := readDynamic(t, file)
+	assert.Equal(t, append([]string{"libm.so.6"}, needed...), pneeded)
+	assert.Equal(t, []string{"/opt/lpmx/lib:$ORIGIN"}, runpath)
+	assert.Nil(t, exec.Command(file).Run())
+	fi, _ := os.Stat(file)
+	assert.Equal(t, os.FileMode(0555), fi.Mode().Perm())
+
+	//applying the same edits again does not touch the file
+	size := fi.Size()
+	assert.Nil(t, patch.Apply())
+	fi, _ = os.Stat(file)
+	assert.Equal(t, size, fi.Size())
+
+	ok, err := ElfRemoveRPath("", "/opt/lpmx/lib", file)
+	assert.True(t, ok)
+	assert.Nil(t, err)
+	_, runpath, _ = readDynamic(t, file)
+	assert.Equal(t, []string{"$ORIGIN"}, runpath)
+	ok, err = ElfRemoveNeeded("", []string{"libm.so.6"}, file)
+	assert.True(t, ok)
+	assert.Nil(t, err)
+	ok, err = ElfRemoveRPath("", "", file)
+	assert.True(t, ok)
+	assert.Nil(t, err)
+	pneeded, runpath, _ = readDynamic(t, file)
+	assert.Equal(t, needed, pneeded)
+	assert.Empty(t, runpath)
+	assert.Nil(t, exec.Command(file).Run())
+
+	//longer interpreter and renamed library are moved into new segment, the version requirements follow the renamed library
+	libdir := filepath.Join(dir, strings.Repeat("lib", 30))
+	assert.Nil(t, os.MkdirAll(libdir, 0755))
+	ld := filepath.Join(libdir, filepath.Base(interp))
+	assert.Nil(t, os.Symlink(interp, ld))
+	ok, err = ElfSetInterpreter("", ld, file)
+	assert.True(t, ok)
+	assert.Nil(t, err)
+	libc := ""
+	for _, lib := range needed {
+		if strings.HasPrefix(lib, "libc.so") {
+			libc = lib
+		}
+	}
+	if real, lerr := exec.Command(ld, "--list", file).Output(); libc != "" && lerr == nil {
+		for _, line := range strings.Split(string(real), "\n") {
+			if fields := strings.Fields(line); len(fields) > 2 && fields[0] == libc {
+				assert.Nil(t, os.Symlink(fields[2], filepath.Join(libdir, "liblpmx.so.6")))
+			}
+		}
+		patch = NewElfPatch(file)
+		patch.ReplaceNeeded(libc, "liblpmx.so.6")
+		patch.SetRPath(libdir)
+		assert.Nil(t, patch.Apply())
+		pneeded, _, _ = readDynamic(t, file)
+		assert.Contains(t, pneeded, "liblpmx.so.6")
+		assert.NotContains(t, pneeded, libc)
+	}
+	_, _, pinterp := readDynamic(t, file)
+	assert.Equal(t, ld, pinterp)
+	out, rerr := exec.Command(file).CombinedOutput()
+	assert.Nil(t, rerr, string(out))
+
+	//errors tell the file and the edit failing
+	text := filepath.Join(dir, "text")
+	ioutil.WriteFile(text, []byte("#!/bin/sh\n"), 0755)
+	ok, err = ElfRPath("", "/lib", text)
+	assert.False(t, ok)
+	var elferr *ElfError
+	assert.True(t, errors.As(err.Err, &elferr))
+	assert.Equal(t, text, elferr.File)
+	assert.Equal(t, ErrType, elferr.Err)
+
+	//libraries do not have PT_INTERP, the file stays untouched as the whole patch fails
+	lib := filepath.Join(dir, "lib.so")
+	real, _ := filepath.EvalSymlinks(filepath.Join(libdir, "liblpmx.so.6"))
+	data, _ := ioutil.ReadFile(filepath.Join(filepath.Dir(real), "libm.so.6"))
+	if len(data) > 0 {
+		ioutil.WriteFile(lib, data, 0755)
+		patch = NewElfPatch(lib)
+		patch.AddNeeded("libm.so.6")
+		patch.SetInterpreter("/lib/ld.so")
+		err = patch.Apply()
+		assert.NotNil(t, err)
+		assert.True(t, errors.As(err.Err, &elferr))
+		assert.Equal(t, PARAMS[SET_INTERPRETER], elferr.Op)
+		assert.Equal(t, ErrNExist, elferr.Err)
+		pdata, _ := ioutil.ReadFile(lib)
+		assert.Equal(t, data, pdata)
+
+		patch = NewElfPatch(lib)
+		patch.SetSoname("liblpmx.so.6")
+		assert.Nil(t, patch.Apply())
+		ef, oerr := delf.Open(lib)
+		assert.Nil(t, oerr)
+		soname, _ := ef.DynString(delf.DT_SONAME)
+		ef.Close()
+		assert.Equal(t, []string{"liblpmx.so.6"}, soname)
+	}
+}
+
+func TestElfMoveRoot(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "lpmx-elf")
+	defer os.RemoveAll(dir)
+	file, interp := hostElf(t, dir)
+	libc := ""
+	if out, err := exec.Command(interp, "--list", file).Output(); err == nil {
+		for _, line := range strings.Split(string(out), "\n") {
+			if fields := strings.Fields(line); len(fields) > 2 && strings.HasPrefix(fields[0], "libc.so") {
+				libc = fields[2]
+			}
+		}
+	}
+	libm := filepath.Join(filepath.Dir(libc), "libm.so.6")
+	if libc == "" || !IsElf(libm) {
+		t.Skip("libm is not found")
+	}
+
+	//interpreter, rpath and needed libraries point into the old root
+	oldroot, newroot := filepath.Join(dir, "old"), filepath.Join(dir, "new")
+	assert.Nil(t, os.MkdirAll(filepath.Join(oldroot, "lib"), 0755))
+	assert.Nil(t, os.Symlink(interp, filepath.Join(oldroot, "ld.so")))
+	assert.Nil(t, os.Symlink(libm, filepath.Join(oldroot, "lib", "libm.so.6")))
+	patch := NewElfPatch(file)
+	patch.SetInterpreter(filepath.Join(oldroot, "ld.so"))
+	patch.SetRPath(filepath.Join(oldroot, "lib") + ":/usr/lib")
+	patch.AddNeeded(filepath.Join(oldroot, "lib", "libm.so.6"))
+	assert.Nil(t, patch.Apply())
+	assert.Nil(t, exec.Command(file).Run())
+
+	assert.Nil(t, os.Rename(oldroot, newroot))
+	//the edits recorded for the new root are applied after the old paths are moved, so nothing is duplicated
+	patch = NewElfPatch(file)
+	patch.AddNeeded(filepath.Join(newroot, "lib", "libm.so.6"))
+	patch.MoveRoot(oldroot, newroot)
+	assert.Nil(t, patch.Apply())
+	needed, runpath, pinterp := readDynamic(t, file)
+	assert.Equal(t, filepath.Join(newroot, "ld.so"), pinterp)
+	assert.Equal(t, []string{filepath.Join(newroot, "lib") + ":/usr/lib"}, runpath)
+	assert.Equal(t, filepath.Join(newroot, "lib", "libm.so.6"), needed[0])
+	assert.NotContains(t, needed[1:], filepath.Join(newroot, "lib", "libm.so.6"))
+	out, err := exec.Command(file).CombinedOutput()
+	assert.Nil(t, err, string(out))
+
+	//moving again does not touch the file
+	fi, _ := os.Stat(file)
+	patch = NewElfPatch(file)
+	patch.MoveRoot(oldroot, newroot)
+	assert.Nil(t, patch.Apply())
+	pfi, _ := os.Stat(file)
+	assert.Equal(t, fi.ModTime(), pfi.ModTime())
+}
+
+func TestElfPatchLibrary(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "lpmx-elf")
+	defer os.RemoveAll(dir)
+	file, interp := hostElf(t, dir)
+	libc, libm := "", ""
+	if out, err := exec.Command(interp, "--list", file).Output(); err == nil {
+		for _, line := range strings.Split(string(out), "\n") {
+			if fields := strings.Fields(line); len(fields) > 2 && strings.HasPrefix(fields[0], "libc.so") {
+				libc = fields[2]
+				libm = filepath.Join(filepath.Dir(libc), "libm.so.6")
+			}
+		}
+	}
+	if libc == "" || !IsElf(libm) {
+		t.Skip("libc or libm is not found")
+	}
+
+	//the copy of libc needs libm which is only found by its rpath
+	libdir, depdir := filepath.Join(dir, "lib"), filepath.Join(dir, "deps")
+	assert.Nil(t, os.MkdirAll(libdir, 0755))
+	assert.Nil(t, os.MkdirAll(depdir, 0755))
+	data, _ := ioutil.ReadFile(libc)
+	lib := filepath.Join(libdir, filepath.Base(libc))
+	assert.Nil(t, ioutil.WriteFile(lib, data, 0555))
+	data, _ = ioutil.ReadFile(libm)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(depdir, "libm.so.6"), data, 0644))
+	//hard links of the original stay as they are, as the patched file replaces it
+	link := filepath.Join(dir, "link")
+	assert.Nil(t, os.Link(lib, link))
+	orig, _ := ioutil.ReadFile(link)
+
+	patch := NewElfPatch(lib)
+	patch.AddNeeded("libm.so.6")
+	patch.SetRPath(depdir)
+	assert.Nil(t, patch.Apply())
+	needed, runpath, _ := readDynamic(t, lib)
+	assert.Equal(t, "libm.so.6", needed[0])
+	assert.Equal(t, []string{depdir}, runpath)
+	fi, _ := os.Stat(lib)
+	assert.Equal(t, os.FileMode(0555), fi.Mode().Perm())
+	data, _ = ioutil.ReadFile(link)
+	assert.Equal(t, orig, data)
+	files, _ := ioutil.ReadDir(libdir)
+	assert.Len(t, files, 1)
+
+	//the host binary runs against the patched library, which loads its new dependency
+	env := append(os.Environ(), "LD_LIBRARY_PATH="+libdir)
+	cmd := exec.Command(interp, "--list", file)
+	cmd.Env = env
+	out, err := cmd.CombinedOutput()
+	assert.Nil(t, err, string(out))
+	assert.Contains(t, string(out), lib)
+	assert.Contains(t, string(out), filepath.Join(depdir, "libm.so.6"))
+	cmd = exec.Command(file)
+	cmd.Env = env
+	out, err = cmd.CombinedOutput()
+	assert.Nil(t, err, string(out))
+}
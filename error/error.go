@@ -28,6 +28,7 @@ var (
 	ErrPidLive          = errors.New("pid file still lives")
 	ErrOperation        = errors.New("operations can not be done")
 	ErrPermissionRoot   = errors.New("should not use root")
+	ErrUnsafe           = errors.New("unsafe archive entry")
 )
 
 type Error struct {
@@ -0,0 +1,159 @@
+package forward
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+
+	. "github.com/JasonYangShadow/lpmx/error"
+	. "github.com/JasonYangShadow/lpmx/log"
+	"github.com/sirupsen/logrus"
+)
+
+//BIND_ADDRESS is the host address forwarders listen on, only local clients could connect by default,
+//set it to 0.0.0.0 for exposing ports to the network
+var BIND_ADDRESS = "127.0.0.1"
+
+//Forwarder is a userspace tcp forwarder, it accepts connections on host port and relays them to target port on localhost
+type Forwarder struct {
+	Address    string
+	HostPort   int
+	TargetPort int
+	listener   net.Listener
+	wg         sync.WaitGroup
+	mu         sync.Mutex
+	conns      map[net.Conn]struct{}
+	stopped    bool
+}
+
+func NewForwarder(hostPort, targetPort int) *Forwarder {
+	f := new(Forwarder)
+	f.Address = BIND_ADDRESS
+	f.HostPort = hostPort
+	f.TargetPort = targetPort
+	f.conns = make(map[net.Conn]struct{})
+	return f
+}
+
+//Start binds the host port and relays connections in background until Stop is called
+func (f *Forwarder) Start() *Error {
+	l, err := net.Listen("tcp", net.JoinHostPort(f.Address, strconv.Itoa(f.HostPort)))
+	if err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("could not listen on %s:%d", f.Address, f.HostPort))
+		return cerr
+	}
+	f.listener = l
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if !f.track(conn) {
+				return
+			}
+			f.wg.Add(1)
+			go f.relay(conn)
+		}
+	}()
+	return nil
+}
+
+//Stop closes the listener and all relayed connections, then waits until every relay returns
+func (f *Forwarder) Stop() {
+	if f.listener != nil {
+		f.listener.Close()
+		f.mu.Lock()
+		f.stopped = true
+		for conn := range f.conns {
+			conn.Close()
+		}
+		f.mu.Unlock()
+		f.wg.Wait()
+	}
+}
+
+//track registers conn so that Stop closes it, conn is closed and false is returned if the forwarder is already stopped
+func (f *Forwarder) track(conn net.Conn) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.stopped {
+		conn.Close()
+		return false
+	}
+	f.conns[conn] = struct{}{}
+	return true
+}
+
+func (f *Forwarder) untrack(conn net.Conn) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.conns, conn)
+	conn.Close()
+}
+
+func (f *Forwarder) relay(conn net.Conn) {
+	defer f.wg.Done()
+	defer f.untrack(conn)
+	target, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", f.TargetPort))
+	if err != nil {
+		LOGGER.WithFields(logrus.Fields{
+			"host":   f.HostPort,
+			"target": f.TargetPort,
+			"err":    err,
+		}).Debug("could not connect to target port")
+		return
+	}
+	if !f.track(target) {
+		return
+	}
+	defer f.untrack(target)
+
+	//each direction is half closed when its source reaches eof, so that responses still in flight are delivered
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		copyAndCloseWrite(target, conn)
+	}()
+	go func() {
+		defer wg.Done()
+		copyAndCloseWrite(conn, target)
+	}()
+	wg.Wait()
+}
+
+//copyAndCloseWrite copies src to dst and then shuts down the writing side of dst
+func copyAndCloseWrite(dst, src net.Conn) {
+	io.Copy(dst, src)
+	if tcp, ok := dst.(*net.TCPConn); ok {
+		tcp.CloseWrite()
+	} else {
+		dst.Close()
+	}
+}
+
+//PortAvailable checks if the tcp port could be bound on BIND_ADDRESS of the host
+func PortAvailable(port int) bool {
+	l, err := net.Listen("tcp", net.JoinHostPort(BIND_ADDRESS, strconv.Itoa(port)))
+	if err != nil {
+		return false
+	}
+	l.Close()
+	return true
+}
+
+//FreePort asks the kernel for a free tcp port on BIND_ADDRESS
+func FreePort() (int, *Error) {
+	l, err := net.Listen("tcp", net.JoinHostPort(BIND_ADDRESS, "0"))
+	if err != nil {
+		cerr := ErrNew(err, "could not allocate free port")
+		return -1, cerr
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
@@ -0,0 +1,150 @@
+package forward
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForwarder(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		conn.Write([]byte("echo " + line))
+	}()
+
+	hostPort, cerr := FreePort()
+	if cerr != nil {
+		t.Fatal(cerr)
+	}
+	f := NewForwarder(hostPort, target.Addr().(*net.TCPAddr).Port)
+	cerr = f.Start()
+	if cerr != nil {
+		t.Fatal(cerr)
+	}
+	defer f.Stop()
+	assert.False(t, PortAvailable(hostPort), "host port should be occupied by forwarder")
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", hostPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("hello\n"))
+	line, _ := bufio.NewReader(conn).ReadString('\n')
+	assert.Equal(t, "echo hello\n", line)
+}
+
+func TestForwarderHalfClose(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	//the target responds only after the client finishes sending
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		data, _ := ioutil.ReadAll(conn)
+		conn.Write([]byte("got " + string(data)))
+	}()
+
+	hostPort, cerr := FreePort()
+	if cerr != nil {
+		t.Fatal(cerr)
+	}
+	f := NewForwarder(hostPort, target.Addr().(*net.TCPAddr).Port)
+	assert.Equal(t, "127.0.0.1", f.Address, "forwarder should only listen on loopback by default")
+	cerr = f.Start()
+	if cerr != nil {
+		t.Fatal(cerr)
+	}
+	defer f.Stop()
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", hostPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("request"))
+	conn.(*net.TCPConn).CloseWrite()
+	data, err := ioutil.ReadAll(conn)
+	assert.Nil(t, err)
+	assert.Equal(t, "got request", string(data))
+}
+
+func TestForwarderStopClosesConnections(t *testing.T) {
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	//the target never hangs up by itself
+	closed := make(chan struct{})
+	go func() {
+		conn, err := target.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("ready\n"))
+		ioutil.ReadAll(conn)
+		close(closed)
+	}()
+
+	hostPort, cerr := FreePort()
+	if cerr != nil {
+		t.Fatal(cerr)
+	}
+	f := NewForwarder(hostPort, target.Addr().(*net.TCPAddr).Port)
+	cerr = f.Start()
+	if cerr != nil {
+		t.Fatal(cerr)
+	}
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", hostPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	line, _ := reader.ReadString('\n')
+	assert.Equal(t, "ready\n", line)
+
+	stopped := make(chan struct{})
+	go func() {
+		f.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop should not wait for peers to hang up")
+	}
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection to target should be closed by Stop")
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = reader.ReadString('\n')
+	assert.Equal(t, io.EOF, err, "client connection should be closed by Stop")
+}
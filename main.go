@@ -10,13 +10,14 @@ import (
 	. "github.com/JasonYangShadow/lpmx/container"
 	. "github.com/JasonYangShadow/lpmx/error"
 	. "github.com/JasonYangShadow/lpmx/log"
+	"github.com/JasonYangShadow/lpmx/singularity"
 	. "github.com/JasonYangShadow/lpmx/utils"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
 var (
-	checklist = []string{"faked-sysv", "libfakechroot.so", "libfakeroot.so"}
+	checklist = SYS_DEPENDENCIES
 )
 
 const (
@@ -399,10 +400,14 @@ func main() {
 	var DockerCommitId string
 	var DockerCommitName string
 	var DockerCommitTag string
+	var DockerCommitAuthor string
+	var DockerCommitMessage string
+	var DockerCommitChanges []string
+	var DockerCommitCompression string
 	var dockerCommitCmd = &cobra.Command{
 		Use:   "commit",
 		Short: "commit docker container",
-		Long:  "docker commit sub-command is the advanced command of lpmx, which is used for committing container to new image",
+		Long:  "docker commit sub-command is the advanced command of lpmx, which is used for committing container to new image, the changes of container are appended as a new layer and the container itself is left untouched",
 		Args:  cobra.ExactArgs(0),
 		PreRun: func(cmd *cobra.Command, args []string) {
 			err := checkCompleteness()
@@ -412,7 +417,7 @@ func main() {
 			}
 		},
 		Run: func(cmd *cobra.Command, args []string) {
-			err := DockerCommit(DockerCommitId, DockerCommitName, DockerCommitTag)
+			err := DockerCommit(DockerCommitId, DockerCommitName, DockerCommitTag, DockerCommitAuthor, DockerCommitMessage, DockerCommitCompression, DockerCommitChanges)
 			if err != nil {
 				LOGGER.Fatal(err.Error())
 				return
@@ -428,6 +433,10 @@ func main() {
 	dockerCommitCmd.MarkFlagRequired("name")
 	dockerCommitCmd.Flags().StringVarP(&DockerCommitTag, "tag", "t", "", "required")
 	dockerCommitCmd.MarkFlagRequired("tag")
+	dockerCommitCmd.Flags().StringVarP(&DockerCommitAuthor, "author", "a", "", "author recorded in image history")
+	dockerCommitCmd.Flags().StringVarP(&DockerCommitMessage, "message", "m", "", "commit message recorded in image history")
+	dockerCommitCmd.Flags().StringArrayVarP(&DockerCommitChanges, "change", "c", []string{}, "apply instruction to the new image, e.g, ENV=KEY=VALUE or WORKDIR=/path")
+	dockerCommitCmd.Flags().StringVar(&DockerCommitCompression, "compression", "gzip", "compression of the new layer, one of gzip, zstd and none")
 
 	var DockerCreateName string
 	var DockerCreateVolume string
@@ -468,7 +477,7 @@ func main() {
 	var dockerRunCmd = &cobra.Command{
 		Use:   "fastrun",
 		Short: "run container in a fast way without switching into shell",
-		Long:  "docker run sub-command is the advanced command of lpmx, which is used for fast running the container created from Docker image",
+		Long:  "docker run sub-command is the advanced command of lpmx, which is used for fast running the container created from Docker image, the default command of image is run if no command is given",
 		Args:  cobra.MinimumNArgs(1),
 		PreRun: func(cmd *cobra.Command, args []string) {
 			err := checkCompleteness()
@@ -583,6 +592,35 @@ func main() {
 		},
 	}
 
+	var DockerSaveOutput string
+	var DockerSaveFormat string
+	var dockerSaveCmd = &cobra.Command{
+		Use:   "save",
+		Short: "save local docker image to archive",
+		Long:  "docker save sub-command is the advanced command of lpmx, which is used for exporting local docker image(name:tag) to docker-archive tarball, oci layout directory or oci-archive tarball, so that it could be loaded by docker or podman",
+		Args:  cobra.ExactArgs(1),
+		PreRun: func(cmd *cobra.Command, args []string) {
+			err := checkCompleteness()
+			if err != nil {
+				LOGGER.Fatal(err.Error())
+				return
+			}
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			err := DockerSave(args[0], DockerSaveOutput, DockerSaveFormat)
+			if err != nil {
+				LOGGER.Fatal(err.Error())
+				return
+			} else {
+				LOGGER.Info("DONE")
+				return
+			}
+		},
+	}
+	dockerSaveCmd.Flags().StringVarP(&DockerSaveOutput, "output", "o", "", "required, target file(directory for oci format)")
+	dockerSaveCmd.MarkFlagRequired("output")
+	dockerSaveCmd.Flags().StringVarP(&DockerSaveFormat, "format", "f", "docker-archive", "optional, docker-archive, oci or oci-archive")
+
 	var DockerPushUser string
 	var DockerPushPass string
 	var DockerPushName string
@@ -601,7 +639,7 @@ func main() {
 			}
 		},
 		Run: func(cmd *cobra.Command, args []string) {
-			err := DockerPush(DockerPushUser, DockerPushPass, DockerPushName, DockerPushPass, DockerPushId)
+			err := DockerPush(DockerPushUser, DockerPushPass, DockerPushName, DockerPushTag, DockerPushId)
 			if err != nil {
 				LOGGER.Error(err.Error())
 				return
@@ -620,10 +658,12 @@ func main() {
 	dockerPushCmd.Flags().StringVarP(&DockerPushId, "id", "i", "", "required")
 	dockerPushCmd.MarkFlagRequired("id")
 
+	var DockerLoadFormat string
+	var DockerLoadName string
 	var dockerLoadCmd = &cobra.Command{
 		Use:   "load",
-		Short: "load the 'docker save' generated tar ball to system",
-		Long:  "docker load sub-command is one advanced command of lpmx, which is used for importing 'docker save' generated tar ball to system",
+		Short: "load the 'docker save' generated tar ball or oci image to system",
+		Long:  "docker load sub-command is one advanced command of lpmx, which is used for importing 'docker save' generated tar ball, oci image layout directory or oci-archive tar ball to system",
 		Args:  cobra.ExactArgs(1),
 		PreRun: func(cmd *cobra.Command, args []string) {
 			err := checkCompleteness()
@@ -633,7 +673,15 @@ func main() {
 			}
 		},
 		Run: func(cmd *cobra.Command, args []string) {
-			err := DockerLoad(args[0])
+			var err *Error
+			switch DockerLoadFormat {
+			case "docker-archive":
+				err = DockerLoad(args[0])
+			case "oci", "oci-archive":
+				err = OCILoad(args[0], DockerLoadName)
+			default:
+				err = ErrNew(ErrType, fmt.Sprintf("format %s is not supported, should be one of docker-archive, oci and oci-archive", DockerLoadFormat))
+			}
 			if err != nil {
 				LOGGER.Fatal(err.Error())
 				return
@@ -643,6 +691,8 @@ func main() {
 			}
 		},
 	}
+	dockerLoadCmd.Flags().StringVarP(&DockerLoadFormat, "format", "f", "docker-archive", "optional, docker-archive, oci(layout directory) or oci-archive")
+	dockerLoadCmd.Flags().StringVarP(&DockerLoadName, "name", "n", "", "optional, name:tag of image to import from oci layout, required if the layout does not record image name")
 
 	var SkopeoNameTag string
 	var skopeoLoadCmd = &cobra.Command{
@@ -676,10 +726,14 @@ func main() {
 		Short: "docker command",
 		Long:  "docker command is the advanced command of lpmx, which is used for executing docker related commands",
 	}
-	dockerCmd.AddCommand(dockerCreateCmd, dockerSearchCmd, dockerListCmd, dockerDeleteCmd, dockerDownloadCmd, dockerResetCmd, dockerPackageCmd, dockerAddCmd, dockerCommitCmd, dockerLoadCmd, dockerRunCmd, dockerMergeCmd, skopeoLoadCmd)
+	dockerCmd.AddCommand(dockerCreateCmd, dockerSearchCmd, dockerListCmd, dockerDeleteCmd, dockerDownloadCmd, dockerResetCmd, dockerPackageCmd, dockerAddCmd, dockerCommitCmd, dockerLoadCmd, dockerSaveCmd, dockerRunCmd, dockerMergeCmd, skopeoLoadCmd)
 
 	var SingularityLoadName string
 	var SingularityLoadTag string
+	var SingularityLoadOverlay bool
+	var SingularityLoadVerify bool
+	var SingularityLoadNoVerify bool
+	var SingularityLoadKeyrings []string
 	var singularityLoadCmd = &cobra.Command{
 		Use:   "load",
 		Short: "load local sif image",
@@ -693,7 +747,17 @@ func main() {
 			}
 		},
 		Run: func(cmd *cobra.Command, args []string) {
-			err := SingularityLoad(args[0], SingularityLoadName, SingularityLoadTag)
+			if SingularityLoadVerify && SingularityLoadNoVerify {
+				LOGGER.Error("--verify and --no-verify could not be used together")
+				return
+			}
+			verify := singularity.VERIFY_AUTO
+			if SingularityLoadVerify {
+				verify = singularity.VERIFY_REQUIRE
+			} else if SingularityLoadNoVerify {
+				verify = singularity.VERIFY_SKIP
+			}
+			err := SingularityLoad(args[0], SingularityLoadName, SingularityLoadTag, SingularityLoadOverlay, verify, SingularityLoadKeyrings)
 			if err != nil && err != ErrExist {
 				LOGGER.Error(err.Error())
 				return
@@ -707,6 +771,10 @@ func main() {
 	singularityLoadCmd.MarkFlagRequired("name")
 	singularityLoadCmd.Flags().StringVarP(&SingularityLoadTag, "tag", "t", "", "required")
 	singularityLoadCmd.MarkFlagRequired("tag")
+	singularityLoadCmd.Flags().BoolVarP(&SingularityLoadOverlay, "overlay", "o", false, "apply overlay partitions of sif as extra layers(optional)")
+	singularityLoadCmd.Flags().BoolVar(&SingularityLoadVerify, "verify", false, "refuse sif image unless all its partitions are signed by keys inside keyring(optional)")
+	singularityLoadCmd.Flags().BoolVar(&SingularityLoadNoVerify, "no-verify", false, "load sif image without verifying its signatures, tampered images are refused by default(optional)")
+	singularityLoadCmd.Flags().StringArrayVarP(&SingularityLoadKeyrings, "keyring", "k", []string{}, "public keyring used for verifying signatures, default is the keyring of apptainer/singularity inside home folder(optional)")
 
 	var SingularityCreateName string
 	var SingularityCreateVolume string
@@ -794,7 +862,7 @@ func main() {
 	var singularityRunCmd = &cobra.Command{
 		Use:   "fastrun",
 		Short: "run container in a fast way without switching into shell",
-		Long:  "singularity run sub-command is the advanced command of lpmx, which is used for fast running the container created from singularity image",
+		Long:  "singularity run sub-command is the advanced command of lpmx, which is used for fast running the container created from singularity image, the runscript of image is run if no command is given",
 		Args:  cobra.MinimumNArgs(1),
 		PreRun: func(cmd *cobra.Command, args []string) {
 			err := checkCompleteness()
@@ -816,12 +884,36 @@ func main() {
 	singularityRunCmd.Flags().StringVarP(&SingularityRunExecMap, "map", "m", "", "executables map, host_exec1=container_exec1:host_exec2=container_exec2(optional)")
 	singularityRunCmd.Flags().StringVarP(&SingularityRunMountFile, "file", "f", "", "mounted file map, host_exec1=container_exec1:host_exec2=container_exec2(optional)")
 
+	var singularityBuildCmd = &cobra.Command{
+		Use:   "build",
+		Short: "build sif image from local image or container",
+		Long:  "singularity build sub-command is the advanced command of lpmx, which is used for exporting local image or container(by id) as sif image, e.g, lpmx singularity build ubuntu:18.04 ubuntu.sif",
+		Args:  cobra.ExactArgs(2),
+		PreRun: func(cmd *cobra.Command, args []string) {
+			err := checkCompleteness()
+			if err != nil {
+				LOGGER.Fatal(err.Error())
+				return
+			}
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			err := SingularityBuild(args[0], args[1])
+			if err != nil {
+				LOGGER.Error(err.Error())
+				return
+			} else {
+				LOGGER.Info("DONE")
+				return
+			}
+		},
+	}
+
 	var singularityCmd = &cobra.Command{
 		Use:   "singularity",
 		Short: "singularity command",
 		Long:  "singularity command is the advanced command of lpmx, which is used for executing singularity related commands",
 	}
-	singularityCmd.AddCommand(singularityLoadCmd, singularityCreateCmd, singularityDeleteCmd, singularityListCmd, singularityRunCmd)
+	singularityCmd.AddCommand(singularityLoadCmd, singularityCreateCmd, singularityDeleteCmd, singularityListCmd, singularityRunCmd, singularityBuildCmd)
 
 	var ExposeId string
 	var ExposePath string
@@ -1003,6 +1095,10 @@ func main() {
 	}
 
 	var ComposeFile string
+	var ComposeParallel int
+	var ComposeKeepGoing bool
+	var ComposeForceRecreate bool
+	var ComposeNoRecreate bool
 	var composeCmd = &cobra.Command{
 		Use:   "compose",
 		Short: "use yaml file to compose run",
@@ -1015,7 +1111,19 @@ func main() {
 				return
 			}
 
-			err = Compose(ComposeFile)
+			recreate := RecreateChanged
+			if ComposeForceRecreate && ComposeNoRecreate {
+				LOGGER.Error("--force-recreate and --no-recreate could not be used together")
+				return
+			}
+			if ComposeForceRecreate {
+				recreate = RecreateForce
+			}
+			if ComposeNoRecreate {
+				recreate = RecreateNever
+			}
+
+			err = Compose(ComposeFile, ComposeParallel, ComposeKeepGoing, recreate)
 			if err != nil {
 				LOGGER.Error(err.Error())
 				return
@@ -1024,11 +1132,223 @@ func main() {
 	}
 	composeCmd.Flags().StringVarP(&ComposeFile, "file", "f", "", "required(compose yaml file)")
 	composeCmd.MarkFlagRequired("file")
+	composeCmd.Flags().IntVarP(&ComposeParallel, "parallel", "p", 1, "maximum number of apps running concurrently(optional)")
+	composeCmd.Flags().BoolVarP(&ComposeKeepGoing, "keep-going", "k", false, "keep running independent apps when some app fails(optional)")
+	composeCmd.Flags().BoolVar(&ComposeForceRecreate, "force-recreate", false, "recreate containers even if app definitions are not changed(optional)")
+	composeCmd.Flags().BoolVar(&ComposeNoRecreate, "no-recreate", false, "reuse existing containers even if app definitions are changed(optional)")
+
+	var ComposeValidateFile string
+	var ComposeValidateOffline bool
+	var composeValidateCmd = &cobra.Command{
+		Use:   "validate",
+		Short: "validate compose yaml file",
+		Long:  "validate compose yaml file and report all problems with their line and column",
+		Args:  cobra.ExactArgs(0),
+		Run: func(cmd *cobra.Command, args []string) {
+			problems, err := ComposeValidate(ComposeValidateFile, ComposeValidateOffline)
+			if err != nil {
+				LOGGER.Error(err.Error())
+				return
+			}
+			if len(problems) == 0 {
+				fmt.Println(fmt.Sprintf("%s is valid", ComposeValidateFile))
+				return
+			}
+			for _, problem := range problems {
+				fmt.Println(fmt.Sprintf("%s:%s", ComposeValidateFile, problem.String()))
+			}
+			os.Exit(1)
+		},
+	}
+	composeValidateCmd.Flags().StringVarP(&ComposeValidateFile, "file", "f", "", "required(compose yaml file)")
+	composeValidateCmd.MarkFlagRequired("file")
+	composeValidateCmd.Flags().BoolVarP(&ComposeValidateOffline, "offline", "o", false, "do not check if images are pullable from registry(optional)")
+	composeCmd.AddCommand(composeValidateCmd)
 
+	var RootDir string
 	var rootCmd = &cobra.Command{
 		Use:   "lpmx",
 		Short: "lpmx rootless container",
 	}
-	rootCmd.AddCommand(initCmd, destroyCmd, listCmd, setCmd, resumeCmd, getCmd, dockerCmd, singularityCmd, exposeCmd, uninstallCmd, versionCmd, downloadCmd, updateCmd, resetCmd, composeCmd)
+	rootCmd.PersistentFlags().StringVar(&RootDir, "root", "", fmt.Sprintf("folder holding images and containers, overrides %s(optional)", ENV_LPMX_HOME))
+	cobra.OnInitialize(func() {
+		if RootDir != "" {
+			os.Setenv(ENV_LPMX_HOME, RootDir)
+		}
+		//invalid config must not stop lpmx, e.g, doctor reports it
+		err := LoadGlobalConfig()
+		if err != nil {
+			LOGGER.WithFields(logrus.Fields{
+				"err": err.Error(),
+			}).Warn("global config is invalid and ignored, defaults are used, run 'lpmx doctor' for details")
+		}
+	})
+	var imageCmd = &cobra.Command{
+		Use:   "image",
+		Short: "image command",
+		Long:  "image command is the advanced command of lpmx, which is used for managing local images of all types",
+	}
+
+	var ImageInspectJson bool
+	var imageInspectCmd = &cobra.Command{
+		Use:   "inspect",
+		Short: "show the details of local image",
+		Long:  "image inspect sub-command shows the type, digest, layers, setting, source, creation time and dependent containers of local image(name:tag)",
+		Args:  cobra.ExactArgs(1),
+		PreRun: func(cmd *cobra.Command, args []string) {
+			err := checkCompleteness()
+			if err != nil {
+				LOGGER.Fatal(err.Error())
+				return
+			}
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			err := ImageInspect(args[0], ImageInspectJson)
+			if err != nil {
+				LOGGER.Fatal(err.Error())
+				return
+			}
+		},
+	}
+	imageInspectCmd.Flags().BoolVarP(&ImageInspectJson, "json", "j", false, "print in json format(optional)")
+
+	var imageTagCmd = &cobra.Command{
+		Use:   "tag",
+		Short: "give local image another name",
+		Long:  "image tag sub-command creates name:tag(second argument) for local image(first argument), both of them share the same layers and setting, layers are only deleted once no image uses them",
+		Args:  cobra.ExactArgs(2),
+		PreRun: func(cmd *cobra.Command, args []string) {
+			err := checkCompleteness()
+			if err != nil {
+				LOGGER.Fatal(err.Error())
+				return
+			}
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			err := ImageTag(args[0], args[1])
+			if err != nil {
+				LOGGER.Fatal(err.Error())
+				return
+			} else {
+				LOGGER.Info("DONE")
+				return
+			}
+		},
+	}
+
+	var ImageProfileRegenerate bool
+	var ImageProfileJson bool
+	var imageProfileCmd = &cobra.Command{
+		Use:   "profile",
+		Short: "show what is found inside the layers of local image",
+		Long:  "image profile sub-command shows the dynamic loader, libc flavour, shells and library folders found inside the layers of local image(name:tag), with --regenerate setting.yml of image is tailored according to them",
+		Args:  cobra.ExactArgs(1),
+		PreRun: func(cmd *cobra.Command, args []string) {
+			err := checkCompleteness()
+			if err != nil {
+				LOGGER.Fatal(err.Error())
+				return
+			}
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			err := ProfileImage(args[0], ImageProfileRegenerate, ImageProfileJson)
+			if err != nil {
+				LOGGER.Fatal(err.Error())
+				return
+			}
+		},
+	}
+	imageProfileCmd.Flags().BoolVarP(&ImageProfileRegenerate, "regenerate", "r", false, "regenerate setting.yml of image from its contents(optional)")
+	imageProfileCmd.Flags().BoolVarP(&ImageProfileJson, "json", "j", false, "print in json format(optional)")
+	imageCmd.AddCommand(imageInspectCmd, imageTagCmd, imageProfileCmd)
+
+	var DfJson bool
+	var dfCmd = &cobra.Command{
+		Use:   "df",
+		Short: "show disk usage of lpmx",
+		Long:  "df command shows the disk usage of image tarballs, extracted layers and containers, together with the space saved by layer deduplication",
+		Args:  cobra.NoArgs,
+		PreRun: func(cmd *cobra.Command, args []string) {
+			err := checkCompleteness()
+			if err != nil {
+				LOGGER.Fatal(err.Error())
+				return
+			}
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			err := Df(DfJson)
+			if err != nil {
+				LOGGER.Fatal(err.Error())
+				return
+			}
+		},
+	}
+	dfCmd.Flags().BoolVarP(&DfJson, "json", "j", false, "print in json format(optional)")
+
+	var relocateCmd = &cobra.Command{
+		Use:   "relocate",
+		Short: "update lpmx after its directory is moved",
+		Long:  "relocate command rewrites the paths recorded inside state files, setting files, container symlinks and exposed wrappers after lpmx directory is moved from the old location(first argument) to the new one(second argument), it should be run with lpmx inside the new location",
+		Args:  cobra.ExactArgs(2),
+		PreRun: func(cmd *cobra.Command, args []string) {
+			err := checkCompleteness()
+			if err != nil {
+				LOGGER.Fatal(err.Error())
+				return
+			}
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			err := Relocate(args[0], args[1])
+			if err != nil {
+				LOGGER.Fatal(err.Error())
+				return
+			} else {
+				LOGGER.Info("DONE")
+				return
+			}
+		},
+	}
+
+	var DoctorJson bool
+	var doctorCmd = &cobra.Command{
+		Use:   "doctor",
+		Short: "diagnose the environment of lpmx",
+		Long:  "doctor command checks dependencies, host distribution, kernel and glibc, helper binaries, filesystem features and the consistency of images and containers, printing how to fix the problems found",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			err := Doctor(DoctorJson)
+			if err != nil {
+				LOGGER.Fatal(err.Error())
+				return
+			}
+		},
+	}
+	doctorCmd.Flags().BoolVarP(&DoctorJson, "json", "j", false, "print in json format(optional)")
+
+	var dedupCmd = &cobra.Command{
+		Use:   "dedup",
+		Short: "deduplicate files of extracted layers",
+		Long:  "dedup command enables the content addressed object store, files with identical content and permission inside extracted layers are replaced with hardlinks of the same object, layers extracted later are deduplicated automatically",
+		Args:  cobra.NoArgs,
+		PreRun: func(cmd *cobra.Command, args []string) {
+			err := checkCompleteness()
+			if err != nil {
+				LOGGER.Fatal(err.Error())
+				return
+			}
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			err := Dedup()
+			if err != nil {
+				LOGGER.Fatal(err.Error())
+				return
+			} else {
+				LOGGER.Info("DONE")
+				return
+			}
+		},
+	}
+
+	rootCmd.AddCommand(initCmd, destroyCmd, listCmd, setCmd, resumeCmd, getCmd, dockerCmd, singularityCmd, exposeCmd, uninstallCmd, versionCmd, downloadCmd, updateCmd, resetCmd, composeCmd, imageCmd, dfCmd, dedupCmd, doctorCmd, relocateCmd)
 	rootCmd.Execute()
 }
@@ -4,9 +4,9 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
-	"path/filepath"
 	"strings"
 	"time"
 
@@ -68,7 +68,9 @@ func CommandEnv(cmdStr string, env map[string]string, dir string, arg ...string)
 	}
 }
 
-func ShellEnvPid(sh string, env map[string]string, dir string, arg ...string) *Error {
+//ShellEnvPid runs shell sh inside working directory dir with env and the standard streams attached, the pid of shell is written to pid_file.
+//Args are merged and passed to sh -c, an interactive shell is started if there is no arg
+func ShellEnvPid(sh string, env map[string]string, dir, pid_file string, arg ...string) *Error {
 	shpath, err := exec.LookPath(sh)
 	if err != nil {
 		cerr := ErrNew(ErrNil, fmt.Sprintf("shell: %s doesn't exist", sh))
@@ -113,7 +115,6 @@ func ShellEnvPid(sh string, env map[string]string, dir string, arg ...string) *E
 	}
 
 	//starting craeting pid file
-	pid_file := fmt.Sprintf("%s/container.pid", filepath.Dir(dir))
 	cerr := PidCreateByPid(pid_file, cmd.Process.Pid)
 	if cerr != nil {
 		return cerr
@@ -127,6 +128,85 @@ func ShellEnvPid(sh string, env map[string]string, dir string, arg ...string) *E
 	return nil
 }
 
+//ShellEnvPidOutput is similar to ShellEnvPid, but redirects the output to the given writers, does not attach stdin and
+//reports non-zero exit status as error. The process is killed once ctx is cancelled
+func ShellEnvPidOutput(ctx context.Context, sh string, env map[string]string, dir, pid_file string, stdout, stderr io.Writer, arg ...string) *Error {
+	shpath, err := exec.LookPath(sh)
+	if err != nil {
+		cerr := ErrNew(ErrNil, fmt.Sprintf("shell: %s doesn't exist", sh))
+		return cerr
+	}
+	var args []string
+	if len(arg) > 0 {
+		args = append(args, "-c")
+		args = append(args, strings.Join(arg, " "))
+	}
+
+	cmd := exec.CommandContext(ctx, shpath, args...)
+	var envstrs []string
+	for key, value := range env {
+		envstr := fmt.Sprintf("%s=%s", key, value)
+		envstrs = append(envstrs, envstr)
+	}
+	cmd.Env = envstrs
+	cmd.Dir = dir
+	cmd.Stderr = stderr
+	cmd.Stdout = stdout
+
+	LOGGER.WithFields(logrus.Fields{
+		"env":    envstrs,
+		"shpath": shpath,
+		"args":   args,
+		"length": len(args),
+	}).Debug("shell env output debug")
+	err = cmd.Start()
+	if err != nil {
+		cerr := ErrNew(err, "cmd start error")
+		return cerr
+	}
+
+	cerr := PidCreateByPid(pid_file, cmd.Process.Pid)
+	if cerr != nil {
+		return cerr
+	}
+	err = cmd.Wait()
+	if err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("cmd: %s exits with error", strings.Join(arg, " ")))
+		return cerr
+	}
+	return nil
+}
+
+//ShellEnvTimeout runs the command with sh -c and returns error if it fails or does not finish within timeout
+func ShellEnvTimeout(ctx context.Context, sh string, env map[string]string, dir string, timeout time.Duration, arg ...string) *Error {
+	shpath, err := exec.LookPath(sh)
+	if err != nil {
+		cerr := ErrNew(ErrNil, fmt.Sprintf("shell: %s doesn't exist", sh))
+		return cerr
+	}
+
+	tctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	cmd := exec.CommandContext(tctx, shpath, "-c", strings.Join(arg, " "))
+	var envstrs []string
+	for key, value := range env {
+		envstr := fmt.Sprintf("%s=%s", key, value)
+		envstrs = append(envstrs, envstr)
+	}
+	cmd.Env = envstrs
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	if tctx.Err() == context.DeadlineExceeded {
+		cerr := ErrNew(tctx.Err(), fmt.Sprintf("cmd: %s times out after %s", strings.Join(arg, " "), timeout))
+		return cerr
+	}
+	if err != nil {
+		cerr := ErrNew(err, string(out))
+		return cerr
+	}
+	return nil
+}
+
 func ShellEnv(sh string, env map[string]string, dir string, arg ...string) *Error {
 	shpath, err := exec.LookPath(sh)
 	if err != nil {
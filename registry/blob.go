@@ -37,16 +37,35 @@ func (registry *Registry) UploadBlob(repository string, digest digest.Digest, co
 	}
 	upload.Header.Set("Content-Type", "application/octet-stream")
 
-	fmt.Println(upload)
 	rep, err := registry.Client.Do(upload)
 	if err != nil {
 		return err
 	}
-	fmt.Println(rep)
 	defer rep.Body.Close()
+	if rep.StatusCode != http.StatusCreated {
+		return fmt.Errorf("uploading blob %s returns unexpected status %d", digest, rep.StatusCode)
+	}
 	return nil
 }
 
+/*
+ * MountBlob asks the registry to mount the blob from another repository, returns false if the registry
+ * could not mount it, in which case the blob should be uploaded normally.
+ */
+func (registry *Registry) MountBlob(repository string, digest digest.Digest, from string) (bool, error) {
+	mountUrl := registry.url("/v2/%s/blobs/uploads/?mount=%s&from=%s", repository, url.QueryEscape(digest.String()), url.QueryEscape(from))
+	registry.Logf("registry.blob.mount url=%s repository=%s digest=%s from=%s", mountUrl, repository, digest, from)
+
+	resp, err := registry.Client.Post(mountUrl, "application/octet-stream", nil)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return false, err
+	}
+	return resp.StatusCode == http.StatusCreated, nil
+}
+
 func (registry *Registry) HasBlob(repository string, digest digest.Digest) (bool, error) {
 	checkUrl := registry.url("/v2/%s/blobs/%s", repository, digest)
 
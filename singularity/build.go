@@ -0,0 +1,331 @@
+package singularity
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	. "github.com/JasonYangShadow/lpmx/error"
+	. "github.com/JasonYangShadow/lpmx/log"
+	uuid "github.com/satori/go.uuid"
+	"github.com/sirupsen/logrus"
+	sif "github.com/sylabs/sif/pkg/sif"
+)
+
+const (
+	//SIF_DOCKER_ENV is generated from the environment of docker images
+	SIF_DOCKER_ENV = "/.singularity.d/env/10-docker2singularity.sh"
+	//SIF_ENVIRONMENT is generated from %environment
+	SIF_ENVIRONMENT = "/.singularity.d/env/90-environment.sh"
+	//SIF_DEFFILE is the definition file the image is built from
+	SIF_DEFFILE = "/.singularity.d/Singularity"
+)
+
+var (
+	//sifActions are the scripts of /.singularity.d/actions used by singularity exec, run, shell, instance start and test
+	sifActions = map[string]string{
+		"exec": "exec \"$@\"\n",
+		"run": `if test -x "/.singularity.d/runscript"; then
+    exec "/.singularity.d/runscript" "$@"
+else
+    echo "No Singularity runscript found, executing /bin/sh"
+    exec /bin/sh "$@"
+fi
+`,
+		"shell": `if test -n "$SINGULARITY_SHELL" -a -x "$SINGULARITY_SHELL"; then
+    exec $SINGULARITY_SHELL "$@"
+
+    echo "ERROR: Failed running shell as defined by '\$SINGULARITY_SHELL'" 1>&2
+    exit 1
+
+elif test -x /bin/bash; then
+    SHELL=/bin/bash
+    PS1="Singularity $SINGULARITY_CONTAINER:\\w> "
+    export SHELL PS1
+    exec /bin/bash --norc "$@"
+elif test -x /bin/sh; then
+    SHELL=/bin/sh
+    export SHELL
+    exec /bin/sh "$@"
+else
+    echo "ERROR: /bin/sh does not exist in container" 1>&2
+fi
+exit 1
+`,
+		"start": `if test -x "/.singularity.d/startscript"; then
+    exec "/.singularity.d/startscript"
+fi
+`,
+		"test": `if test -x "/.singularity.d/test"; then
+    exec "/.singularity.d/test" "$@"
+else
+    echo "No Singularity container test found, executing /bin/sh"
+    exec /bin/sh "$@"
+fi
+`,
+	}
+	//sifLinks are the symlinks created by singularity build at the root of image
+	sifLinks = map[string]string{
+		".exec":       ".singularity.d/actions/exec",
+		".run":        ".singularity.d/actions/run",
+		".shell":      ".singularity.d/actions/shell",
+		".test":       ".singularity.d/actions/test",
+		"environment": ".singularity.d/env/90-environment.sh",
+		"singularity": ".singularity.d/runscript",
+	}
+	//sifMountPoints are the folders(and files) singularity binds host ones to, they are created if images do not have them
+	sifMountPoints = []string{"dev", "proc", "sys", "tmp", "home", "root", "etc", "var/tmp", "etc/hosts", "etc/resolv.conf"}
+)
+
+//SifBuild is the file system and run configuration of sif image written by BuildSif
+type SifBuild struct {
+	Root        *FsEntry
+	Environment []string //KEY=VALUE pairs
+	Entrypoint  []string
+	Cmd         []string
+	Labels      map[string]string
+	Arch        string //architecture in the form of GOARCH
+	From        string //what the image is built from, it is recorded inside definition file
+}
+
+//shellQuote quotes s with single quotes, so that it is not expanded by shell
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'"'"'`, -1) + "'"
+}
+
+//runscript generates the runscript of image in the way singularity converts docker images, the runscript imported from sif(see RunCmd) is kept as it is
+func (build *SifBuild) runscript() string {
+	if len(build.Entrypoint) == 0 && len(build.Cmd) == 3 && build.Cmd[1] == "-c" && strings.HasPrefix(build.Cmd[2], "#!") {
+		return build.Cmd[2]
+	}
+	if len(build.Entrypoint) == 0 && len(build.Cmd) == 0 {
+		return ""
+	}
+	escape := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`")
+	return fmt.Sprintf(`#!/bin/sh
+OCI_ENTRYPOINT="%s"
+OCI_CMD="%s"
+# ENTRYPOINT only - run entrypoint plus args
+if [ -z "$OCI_CMD" ] && [ -n "$OCI_ENTRYPOINT" ]; then
+    SINGULARITY_OCI_RUN="${OCI_ENTRYPOINT} $@"
+fi
+
+# CMD only - run CMD or override with args
+if [ -n "$OCI_CMD" ] && [ -z "$OCI_ENTRYPOINT" ]; then
+    if [ $# -gt 0 ]; then
+        SINGULARITY_OCI_RUN="$@"
+    else
+        SINGULARITY_OCI_RUN="${OCI_CMD}"
+    fi
+fi
+
+# ENTRYPOINT and CMD - run ENTRYPOINT with CMD as default args
+# override with user provided args
+if [ -n "$OCI_CMD" ] && [ -n "$OCI_ENTRYPOINT" ]; then
+    if [ $# -gt 0 ]; then
+        SINGULARITY_OCI_RUN="${OCI_ENTRYPOINT} $@"
+    else
+        SINGULARITY_OCI_RUN="${OCI_ENTRYPOINT} ${OCI_CMD}"
+    fi
+fi
+
+exec $SINGULARITY_OCI_RUN
+`, escape.Replace(strings.Join(build.Entrypoint, " ")), escape.Replace(strings.Join(build.Cmd, " ")))
+}
+
+//environment returns the script exporting the environment of image
+func (build *SifBuild) environment() string {
+	var buf strings.Builder
+	buf.WriteString("#!/bin/sh\n")
+	for _, item := range build.Environment {
+		if kv := strings.SplitN(item, "=", 2); len(kv) == 2 && kv[0] != "" {
+			fmt.Fprintf(&buf, "export %s=%s\n", kv[0], shellQuote(kv[1]))
+		}
+	}
+	return buf.String()
+}
+
+//labels returns the labels of image including the ones added by singularity build
+func (build *SifBuild) labels() map[string]string {
+	labels := map[string]string{
+		"org.label-schema.schema-version": "1.0",
+		"org.label-schema.build-date":     time.Now().UTC().Format(time.RFC3339),
+	}
+	for k, v := range build.Labels {
+		labels[k] = v
+	}
+	return labels
+}
+
+//deffile generates the definition file recording the run configuration, the file system comes from From rather than any bootstrap agent
+func (build *SifBuild) deffile(labels map[string]string) string {
+	indent := func(text string) string {
+		var buf strings.Builder
+		for _, line := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
+			buf.WriteString("    " + line + "\n")
+		}
+		return buf.String()
+	}
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "# built by lpmx from %s\nBootstrap: scratch\n", build.From)
+	if len(build.Environment) > 0 {
+		buf.WriteString("\n%environment\n")
+		buf.WriteString(indent(strings.TrimPrefix(build.environment(), "#!/bin/sh\n")))
+	}
+	if script := build.runscript(); script != "" {
+		buf.WriteString("\n%runscript\n")
+		buf.WriteString(indent(script))
+	}
+	if len(labels) > 0 {
+		keys := make([]string, 0, len(labels))
+		for k := range labels {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		buf.WriteString("\n%labels\n")
+		for _, k := range keys {
+			fmt.Fprintf(&buf, "    %s %s\n", k, labels[k])
+		}
+	}
+	return buf.String()
+}
+
+//fsPath returns the entry of p(relative to root) inside tree, missing folders are created if create is true
+func fsPath(root *FsEntry, p string, create bool) *FsEntry {
+	node := root
+	for _, name := range strings.Split(strings.Trim(path.Clean("/"+p), "/"), "/") {
+		if name == "" {
+			continue
+		}
+		if node == nil || !node.Mode.IsDir() {
+			return nil
+		}
+		child, ok := node.Children[name]
+		if !ok && create {
+			child = NewFsDir(0755)
+			node.Children[name] = child
+		}
+		node = child
+	}
+	return node
+}
+
+//addFsFile adds regular file p with content data into tree, the existing entry is replaced
+func addFsFile(root *FsEntry, p string, perm os.FileMode, data string) {
+	dir, name := path.Split(path.Clean("/" + p))
+	if parent := fsPath(root, dir, true); parent != nil {
+		parent.Children[name] = &FsEntry{Mode: perm, Mtime: time.Now().Unix(), Data: []byte(data)}
+	}
+}
+
+//scaffold adds /.singularity.d and the mount points required by singularity into tree
+func (build *SifBuild) scaffold(labels map[string]string, deffile string) *Error {
+	root := build.Root
+	//metadata of the image being converted is replaced
+	delete(root.Children, ".singularity.d")
+	for name := range sifActions {
+		addFsFile(root, "/.singularity.d/actions/"+name, 0755, "#!/bin/sh\n\nfor script in /.singularity.d/env/*.sh; do\n    if [ -f \"$script\" ]; then\n        . \"$script\"\n    fi\ndone\n\n"+sifActions[name])
+	}
+	fsPath(root, "/.singularity.d/libs", true)
+	addFsFile(root, SIF_DOCKER_ENV, 0755, build.environment())
+	addFsFile(root, SIF_ENVIRONMENT, 0755, "#!/bin/sh\n# Custom environment shell code should follow\n\n")
+	if script := build.runscript(); script != "" {
+		addFsFile(root, SIF_RUNSCRIPT, 0755, script)
+	}
+	data, err := json.MarshalIndent(labels, "", "\t")
+	if err != nil {
+		cerr := ErrNew(err, "could not encode labels")
+		return cerr
+	}
+	addFsFile(root, SIF_LABELS, 0644, string(data))
+	addFsFile(root, SIF_DEFFILE, 0644, deffile)
+
+	for name, target := range sifLinks {
+		if _, ok := root.Children[name]; !ok {
+			root.Children[name] = &FsEntry{Mode: os.ModeSymlink | 0777, Mtime: time.Now().Unix(), Link: target}
+		}
+	}
+	for _, p := range sifMountPoints {
+		if fsPath(root, p, false) != nil {
+			continue
+		}
+		if strings.HasPrefix(p, "etc/") {
+			addFsFile(root, p, 0644, "")
+			continue
+		}
+		dir := fsPath(root, p, true)
+		if p == "tmp" || p == "var/tmp" {
+			dir.Mode |= os.ModeSticky | 0777
+		}
+	}
+	return nil
+}
+
+//BuildSif writes sif image output containing build.Root as primary squashfs partition, the definition file and environment
+//are stored as data objects. The squashfs partition is written inside tempdir
+func BuildSif(build *SifBuild, output, tempdir string) *Error {
+	labels := build.labels()
+	deffile := build.deffile(labels)
+	if err := build.scaffold(labels, deffile); err != nil {
+		return err
+	}
+
+	squashfs := fmt.Sprintf("%s/%s.squashfs", tempdir, path.Base(output))
+	if err := WriteSquashfs(build.Root, squashfs); err != nil {
+		return err
+	}
+	defer os.Remove(squashfs)
+	f, oerr := os.Open(squashfs)
+	if oerr != nil {
+		cerr := ErrNew(oerr, fmt.Sprintf("could not open %s", squashfs))
+		return cerr
+	}
+	defer f.Close()
+	fi, serr := f.Stat()
+	if serr != nil {
+		cerr := ErrNew(serr, fmt.Sprintf("could not stat %s", squashfs))
+		return cerr
+	}
+
+	env := build.environment()
+	part := sif.DescriptorInput{
+		Datatype: sif.DataPartition,
+		Groupid:  sif.DescrDefaultGroup,
+		Link:     sif.DescrUnusedLink,
+		Size:     fi.Size(),
+		Fname:    squashfs,
+		Fp:       f,
+	}
+	arch := sif.GetSIFArch(build.Arch)
+	if err := part.SetPartExtra(sif.FsSquash, sif.PartPrimSys, arch); err != nil {
+		cerr := ErrNew(err, "could not set the partition information of sif")
+		return cerr
+	}
+	inputs := []sif.DescriptorInput{
+		{Datatype: sif.DataDeffile, Groupid: sif.DescrDefaultGroup, Link: sif.DescrUnusedLink, Size: int64(len(deffile)), Fname: "Singularity", Data: []byte(deffile)},
+		{Datatype: sif.DataEnvVar, Groupid: sif.DescrDefaultGroup, Link: sif.DescrUnusedLink, Size: int64(len(env)), Fname: "env", Data: []byte(env)},
+		part,
+	}
+	_, err := sif.CreateContainer(sif.CreateInfo{
+		Pathname:   output,
+		Launchstr:  sif.HdrLaunch,
+		Sifversion: sif.HdrVersion,
+		ID:         uuid.NewV4(),
+		InputDescr: inputs,
+	})
+	if err != nil {
+		os.Remove(output)
+		cerr := ErrNew(err, fmt.Sprintf("could not create sif image %s", output))
+		return cerr
+	}
+	LOGGER.WithFields(logrus.Fields{
+		"output": output,
+		"arch":   build.Arch,
+		"size":   fi.Size(),
+	}).Debug("BuildSif debug")
+	return nil
+}
@@ -0,0 +1,590 @@
+package singularity
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	. "github.com/JasonYangShadow/lpmx/error"
+	. "github.com/JasonYangShadow/lpmx/utils"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	EXT_MAGIC = 0xEF53
+
+	//superblock is always stored 1024 bytes after the start of image
+	extSuperOffset = 1024
+	extRootInode   = 2
+
+	//incompatible features
+	extFeatureFiletype = 0x2
+	extFeature64bit    = 0x80
+
+	//inode flags
+	extExtentsFlag    = 0x80000
+	extInlineDataFlag = 0x10000000
+
+	extExtentMagic = 0xF30A
+	//extents longer than it are preallocated but not written yet, they are read as zeros
+	extExtentInitMax = 32768
+
+	extXattrMagic = 0xEA020000
+)
+
+var (
+	//prefixes of xattr names, indexed by the name index of entries. Posix acls are stored in their own format and skipped
+	extXattrPrefixes = map[uint8]string{1: "user.", 4: "trusted.", 6: "security.", 7: "system."}
+)
+
+//extInode is the decoded inode of ext2/3/4
+type extInode struct {
+	Number uint32
+	Mode   uint16
+	Uid    uint32
+	Gid    uint32
+	Size   uint64
+	Mtime  uint32
+	Nlink  uint16
+	Blocks uint64 //512-byte sectors used by inode, including the xattr block
+	Flags  uint32
+	Block  [60]byte
+	Acl    uint64 //block of xattrs
+	Extra  []byte //space after the basic 128 bytes, containing in-inode xattrs
+}
+
+func (inode *extInode) kind() uint32 {
+	return uint32(inode.Mode) & unix.S_IFMT
+}
+
+func (inode *extInode) isDir() bool {
+	return inode.kind() == unix.S_IFDIR
+}
+
+//extEntry is one entry of directory listing
+type extEntry struct {
+	Name  string
+	Inode uint32
+}
+
+//extExtent maps Len blocks starting from logical block Logical to the ones starting from Physical, unwritten ones have Physical 0
+type extExtent struct {
+	Logical  uint64
+	Physical uint64
+	Len      uint64
+}
+
+//ExtFs reads ext2/3/4 images natively, it is used for the overlay partitions of SIF
+type ExtFs struct {
+	r              io.ReaderAt
+	blockSize      int64
+	inodesPerGroup uint32
+	inodeSize      int64
+	descSize       int64
+	gdt            int64 //position of group descriptor table
+	inodes         uint32
+	incompat       uint32
+}
+
+//OpenExtFs reads the superblock of ext2/3/4 image r
+func OpenExtFs(r io.ReaderAt) (*ExtFs, *Error) {
+	fs := &ExtFs{r: r}
+	if err := fs.init(); err != nil {
+		cerr := ErrNew(err, "could not open ext image")
+		return nil, cerr
+	}
+	return fs, nil
+}
+
+func (fs *ExtFs) init() error {
+	super := make([]byte, 1024)
+	if _, err := fs.r.ReadAt(super, extSuperOffset); err != nil {
+		return fmt.Errorf("could not read superblock: %s", err.Error())
+	}
+	le := binary.LittleEndian
+	if magic := le.Uint16(super[56:]); magic != EXT_MAGIC {
+		return fmt.Errorf("bad magic 0x%x, it is not ext2/3/4", magic)
+	}
+	logSize := le.Uint32(super[24:])
+	if logSize > 6 {
+		return fmt.Errorf("block size 1024<<%d is invalid", logSize)
+	}
+	fs.blockSize = 1024 << logSize
+	fs.inodes = le.Uint32(super[0:])
+	fs.inodesPerGroup = le.Uint32(super[40:])
+	if fs.inodesPerGroup == 0 {
+		return fmt.Errorf("inodes per group is 0")
+	}
+	fs.inodeSize = 128
+	if le.Uint32(super[76:]) > 0 {
+		fs.inodeSize = int64(le.Uint16(super[88:]))
+	}
+	if fs.inodeSize < 128 || fs.inodeSize > fs.blockSize {
+		return fmt.Errorf("inode size %d is invalid", fs.inodeSize)
+	}
+	fs.incompat = le.Uint32(super[96:])
+	fs.descSize = 32
+	if fs.incompat&extFeature64bit != 0 {
+		fs.descSize = int64(le.Uint16(super[254:]))
+		if fs.descSize < 32 {
+			return fmt.Errorf("group descriptor size %d is invalid", fs.descSize)
+		}
+	}
+	//group descriptors follow the block containing superblock
+	fs.gdt = (int64(le.Uint32(super[20:])) + 1) * fs.blockSize
+	return nil
+}
+
+func (fs *ExtFs) readBlocks(block uint64, count int64) ([]byte, error) {
+	data := make([]byte, count*fs.blockSize)
+	if _, err := fs.r.ReadAt(data, int64(block)*fs.blockSize); err != nil {
+		return nil, fmt.Errorf("could not read block %d: %s", block, err.Error())
+	}
+	return data, nil
+}
+
+func (fs *ExtFs) readInode(num uint32) (*extInode, error) {
+	if num == 0 || num > fs.inodes {
+		return nil, fmt.Errorf("inode %d is out of range", num)
+	}
+	le := binary.LittleEndian
+	group := int64((num - 1) / fs.inodesPerGroup)
+	desc := make([]byte, fs.descSize)
+	if _, err := fs.r.ReadAt(desc, fs.gdt+group*fs.descSize); err != nil {
+		return nil, fmt.Errorf("could not read group descriptor %d: %s", group, err.Error())
+	}
+	table := uint64(le.Uint32(desc[8:]))
+	if fs.descSize >= 64 {
+		table |= uint64(le.Uint32(desc[0x28:])) << 32
+	}
+	data := make([]byte, fs.inodeSize)
+	pos := int64(table)*fs.blockSize + int64((num-1)%fs.inodesPerGroup)*fs.inodeSize
+	if _, err := fs.r.ReadAt(data, pos); err != nil {
+		return nil, fmt.Errorf("could not read inode %d: %s", num, err.Error())
+	}
+
+	inode := &extInode{
+		Number: num,
+		Mode:   le.Uint16(data[0:]),
+		Uid:    uint32(le.Uint16(data[2:])) | uint32(le.Uint16(data[120:]))<<16,
+		Size:   uint64(le.Uint32(data[4:])) | uint64(le.Uint32(data[108:]))<<32,
+		Mtime:  le.Uint32(data[16:]),
+		Gid:    uint32(le.Uint16(data[24:])) | uint32(le.Uint16(data[122:]))<<16,
+		Nlink:  le.Uint16(data[26:]),
+		Blocks: uint64(le.Uint32(data[28:])) | uint64(le.Uint16(data[116:]))<<32,
+		Flags:  le.Uint32(data[32:]),
+		Acl:    uint64(le.Uint32(data[104:])) | uint64(le.Uint16(data[118:]))<<32,
+	}
+	copy(inode.Block[:], data[40:100])
+	if fs.inodeSize > 128 {
+		inode.Extra = data[128:]
+	}
+	if inode.Flags&extInlineDataFlag != 0 {
+		return nil, fmt.Errorf("inode %d stores inline data, which is not supported", num)
+	}
+	return inode, nil
+}
+
+//extents returns the sorted block mapping of inode, mapped either by extent tree or by block map of ext2/3
+func (fs *ExtFs) extents(inode *extInode) ([]extExtent, error) {
+	var extents []extExtent
+	var err error
+	if inode.Flags&extExtentsFlag != 0 {
+		err = fs.walkExtents(inode.Block[:], 0, &extents)
+	} else {
+		count := (inode.Size + uint64(fs.blockSize) - 1) / uint64(fs.blockSize)
+		err = fs.walkBlockMap(inode.Block[:], count, &extents)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not map blocks of inode %d: %s", inode.Number, err.Error())
+	}
+	sort.Slice(extents, func(i, j int) bool {
+		return extents[i].Logical < extents[j].Logical
+	})
+	return extents, nil
+}
+
+func (fs *ExtFs) walkExtents(node []byte, level int, extents *[]extExtent) error {
+	le := binary.LittleEndian
+	if len(node) < 12 || le.Uint16(node) != extExtentMagic {
+		return fmt.Errorf("bad extent header")
+	}
+	entries := int(le.Uint16(node[2:]))
+	depth := le.Uint16(node[6:])
+	if level > 5 || 12+12*entries > len(node) {
+		return fmt.Errorf("extent tree is corrupted")
+	}
+	for i := 0; i < entries; i++ {
+		entry := node[12+12*i:]
+		if depth == 0 {
+			length := uint64(le.Uint16(entry[4:]))
+			physical := uint64(le.Uint16(entry[6:]))<<32 | uint64(le.Uint32(entry[8:]))
+			if length > extExtentInitMax {
+				length -= extExtentInitMax
+				physical = 0
+			}
+			*extents = append(*extents, extExtent{Logical: uint64(le.Uint32(entry)), Physical: physical, Len: length})
+			continue
+		}
+		child := uint64(le.Uint16(entry[8:]))<<32 | uint64(le.Uint32(entry[4:]))
+		data, err := fs.readBlocks(child, 1)
+		if err != nil {
+			return err
+		}
+		if err := fs.walkExtents(data, level+1, extents); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//walkBlockMap maps the first count blocks of the 12 direct, indirect, double and triple indirect blocks
+func (fs *ExtFs) walkBlockMap(iblock []byte, count uint64, extents *[]extExtent) error {
+	le := binary.LittleEndian
+	perBlock := uint64(fs.blockSize / 4)
+	logical := uint64(0)
+	add := func(physical uint64) {
+		if physical != 0 {
+			if n := len(*extents); n > 0 {
+				last := &(*extents)[n-1]
+				if last.Physical != 0 && last.Logical+last.Len == logical && last.Physical+last.Len == physical {
+					last.Len++
+					logical++
+					return
+				}
+			}
+			*extents = append(*extents, extExtent{Logical: logical, Physical: physical, Len: 1})
+		}
+		logical++
+	}
+	var walk func(block uint64, level int) error
+	walk = func(block uint64, level int) error {
+		span := uint64(1)
+		for i := 0; i < level; i++ {
+			span *= perBlock
+		}
+		if block == 0 {
+			//holes of indirect blocks
+			logical += span
+			return nil
+		}
+		if level == 0 {
+			add(block)
+			return nil
+		}
+		data, err := fs.readBlocks(block, 1)
+		if err != nil {
+			return err
+		}
+		for i := uint64(0); i < perBlock && logical < count; i++ {
+			if err := walk(uint64(le.Uint32(data[4*i:])), level-1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for i := 0; i < 15 && logical < count; i++ {
+		level := 0
+		if i >= 12 {
+			level = i - 11
+		}
+		if err := walk(uint64(le.Uint32(iblock[4*i:])), level); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//zeroReader produces zeros for the holes of files
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
+
+//writeFile writes the content of inode to w, holes and unwritten extents are written as zeros
+func (fs *ExtFs) writeFile(w io.Writer, inode *extInode) error {
+	extents, err := fs.extents(inode)
+	if err != nil {
+		return err
+	}
+	bs := uint64(fs.blockSize)
+	pos := uint64(0)
+	for _, extent := range extents {
+		start := extent.Logical * bs
+		if start >= inode.Size {
+			break
+		}
+		if start > pos {
+			if _, err := io.CopyN(w, zeroReader{}, int64(start-pos)); err != nil {
+				return err
+			}
+			pos = start
+		}
+		length := extent.Len * bs
+		if start+length > inode.Size {
+			length = inode.Size - start
+		}
+		var r io.Reader = zeroReader{}
+		if extent.Physical != 0 {
+			r = io.NewSectionReader(fs.r, int64(extent.Physical*bs), int64(length))
+		}
+		if _, err := io.CopyN(w, r, int64(length)); err != nil {
+			return fmt.Errorf("could not read data of inode %d: %s", inode.Number, err.Error())
+		}
+		pos += length
+	}
+	if pos < inode.Size {
+		if _, err := io.CopyN(w, zeroReader{}, int64(inode.Size-pos)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//readDir returns the entries of directory inode except . and .., indexed directories are read linearly as their index blocks look like empty entries
+func (fs *ExtFs) readDir(inode *extInode) ([]extEntry, error) {
+	var buf bytes.Buffer
+	if err := fs.writeFile(&buf, inode); err != nil {
+		return nil, err
+	}
+	data := buf.Bytes()
+	le := binary.LittleEndian
+	var entries []extEntry
+	for pos := 0; pos+8 <= len(data); {
+		ino := le.Uint32(data[pos:])
+		reclen := int(le.Uint16(data[pos+4:]))
+		namelen := int(data[pos+6])
+		if fs.incompat&extFeatureFiletype == 0 {
+			namelen = int(le.Uint16(data[pos+6:]))
+		}
+		if reclen < 8 || pos+reclen > len(data) || 8+namelen > reclen {
+			return nil, fmt.Errorf("directory inode %d is corrupted", inode.Number)
+		}
+		name := string(data[pos+8 : pos+8+namelen])
+		if ino != 0 && name != "." && name != ".." {
+			entries = append(entries, extEntry{Name: name, Inode: ino})
+		}
+		pos += reclen
+	}
+	return entries, nil
+}
+
+//parseXattrs decodes the xattr entries of data starting from start, value offsets are relative to base
+func parseXattrs(data []byte, start, base int, xattrs map[string][]byte) error {
+	le := binary.LittleEndian
+	for pos := start; pos+4 <= len(data) && le.Uint32(data[pos:]) != 0; {
+		if pos+16 > len(data) {
+			return fmt.Errorf("xattr entry is corrupted")
+		}
+		namelen := int(data[pos])
+		index := data[pos+1]
+		offset := base + int(le.Uint16(data[pos+2:]))
+		inum := le.Uint32(data[pos+4:])
+		size := int(le.Uint32(data[pos+8:]))
+		if pos+16+namelen > len(data) {
+			return fmt.Errorf("xattr entry is corrupted")
+		}
+		name := string(data[pos+16 : pos+16+namelen])
+		pos += (16 + namelen + 3) &^ 3
+		prefix, ok := extXattrPrefixes[index]
+		//values stored inside their own inodes are not supported
+		if !ok || inum != 0 {
+			continue
+		}
+		if offset < 0 || offset+size > len(data) {
+			return fmt.Errorf("value of xattr %s%s is out of range", prefix, name)
+		}
+		xattrs[prefix+name] = append([]byte(nil), data[offset:offset+size]...)
+	}
+	return nil
+}
+
+//readXattrs reads the xattrs stored inside inode and inside its xattr block
+func (fs *ExtFs) readXattrs(inode *extInode) (map[string][]byte, error) {
+	le := binary.LittleEndian
+	xattrs := make(map[string][]byte)
+	if len(inode.Extra) >= 4 {
+		start := 4 + int(le.Uint16(inode.Extra))
+		if start <= len(inode.Extra) && le.Uint32(inode.Extra[start-4:]) == extXattrMagic {
+			if err := parseXattrs(inode.Extra, start, start, xattrs); err != nil {
+				return nil, fmt.Errorf("in-inode xattrs of inode %d: %s", inode.Number, err.Error())
+			}
+		}
+	}
+	if inode.Acl != 0 {
+		data, err := fs.readBlocks(inode.Acl, 1)
+		if err != nil {
+			return nil, err
+		}
+		if le.Uint32(data) != extXattrMagic {
+			return nil, fmt.Errorf("xattr block %d of inode %d has bad magic", inode.Acl, inode.Number)
+		}
+		if err := parseXattrs(data, 32, 0, xattrs); err != nil {
+			return nil, fmt.Errorf("xattr block of inode %d: %s", inode.Number, err.Error())
+		}
+	}
+	return xattrs, nil
+}
+
+//readLink returns the target of symlink inode, short targets are stored inside the block map
+func (fs *ExtFs) readLink(inode *extInode) (string, error) {
+	aclBlocks := uint64(0)
+	if inode.Acl != 0 {
+		aclBlocks = uint64(fs.blockSize / 512)
+	}
+	if inode.Size < 60 && inode.Blocks <= aclBlocks {
+		return string(inode.Block[:inode.Size]), nil
+	}
+	if inode.Size > uint64(fs.blockSize) {
+		return "", fmt.Errorf("symlink inode %d is too long", inode.Number)
+	}
+	var buf bytes.Buffer
+	if err := fs.writeFile(&buf, inode); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+//lookup returns the inode of path p inside image, symlinks are not followed
+func (fs *ExtFs) lookup(p string) (*extInode, error) {
+	inode, err := fs.readInode(extRootInode)
+	if err != nil {
+		return nil, err
+	}
+	for _, part := range strings.Split(strings.Trim(path.Clean("/"+p), "/"), "/") {
+		if part == "" {
+			continue
+		}
+		if !inode.isDir() {
+			return nil, fmt.Errorf("%s is not a directory", p)
+		}
+		entries, err := fs.readDir(inode)
+		if err != nil {
+			return nil, err
+		}
+		var found uint32
+		for _, entry := range entries {
+			if entry.Name == part {
+				found = entry.Inode
+				break
+			}
+		}
+		if found == 0 {
+			return nil, fmt.Errorf("%s does not exist", p)
+		}
+		if inode, err = fs.readInode(found); err != nil {
+			return nil, err
+		}
+	}
+	return inode, nil
+}
+
+//Extract writes the whole tree of image into dest, see Squashfs.Extract
+func (fs *ExtFs) Extract(dest string) *Error {
+	return extractImage(fs, newFsExtractor(), "/", dest)
+}
+
+func (fs *ExtFs) isDir(p string) bool {
+	inode, err := fs.lookup(p)
+	return err == nil && inode.isDir()
+}
+
+func (fs *ExtFs) extractTree(x *fsExtractor, p, dest string) error {
+	inode, err := fs.lookup(p)
+	if err != nil {
+		return err
+	}
+	if !inode.isDir() {
+		return fmt.Errorf("%s is not a directory", p)
+	}
+	return fs.extractDir(x, inode, dest, inode.Number == extRootInode)
+}
+
+func (fs *ExtFs) attrs(inode *extInode) (fsAttrs, error) {
+	xattrs, err := fs.readXattrs(inode)
+	return fsAttrs{Mode: uint32(inode.Mode & 07777), Uid: inode.Uid, Gid: inode.Gid, Mtime: int64(inode.Mtime), Xattrs: xattrs}, err
+}
+
+func (fs *ExtFs) extractDir(x *fsExtractor, inode *extInode, dir string, root bool) error {
+	entries, err := fs.readDir(inode)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		//lost+found only belongs to the file system itself
+		if root && entry.Name == "lost+found" {
+			continue
+		}
+		if err := x.name(dir, entry.Name); err != nil {
+			return err
+		}
+		child, err := fs.readInode(entry.Inode)
+		if err != nil {
+			return err
+		}
+		if err := fs.extract(x, child, filepath.Join(dir, entry.Name)); err != nil {
+			return err
+		}
+	}
+	attrs, err := fs.attrs(inode)
+	if err != nil {
+		return err
+	}
+	return x.attrs(dir, false, attrs)
+}
+
+func (fs *ExtFs) extract(x *fsExtractor, inode *extInode, target string) error {
+	perm := uint32(inode.Mode & 07777)
+	var err error
+	switch kind := inode.kind(); kind {
+	case unix.S_IFDIR:
+		if err := x.mkdir(target); err != nil {
+			return err
+		}
+		return fs.extractDir(x, inode, target, false)
+	case unix.S_IFREG:
+		err = x.file(target, uint64(inode.Number), uint32(inode.Nlink), inode.Size, func(w io.Writer) error {
+			return fs.writeFile(w, inode)
+		})
+	case unix.S_IFLNK:
+		link, lerr := fs.readLink(inode)
+		if lerr != nil {
+			return lerr
+		}
+		err = x.symlink(target, link)
+	case unix.S_IFCHR, unix.S_IFBLK:
+		//devices are stored inside the first two entries of block map, in the old or the new encoding
+		var major, minor uint32
+		if dev := binary.LittleEndian.Uint32(inode.Block[0:]); dev != 0 {
+			major, minor = (dev>>8)&0xff, dev&0xff
+		} else {
+			dev = binary.LittleEndian.Uint32(inode.Block[4:])
+			major, minor = (dev&0xfff00)>>8, (dev&0xff)|((dev>>12)&0xfff00)
+		}
+		err = x.node(target, kind, perm, major, minor)
+		if err == nil && !FileExist(target) {
+			return nil
+		}
+	case unix.S_IFIFO, unix.S_IFSOCK:
+		err = x.node(target, kind, perm, 0, 0)
+	default:
+		return fmt.Errorf("inode %d has unknown type 0%o", inode.Number, kind)
+	}
+	if err != nil {
+		return err
+	}
+	attrs, err := fs.attrs(inode)
+	if err != nil {
+		return err
+	}
+	return x.attrs(target, inode.kind() == unix.S_IFLNK, attrs)
+}
@@ -0,0 +1,233 @@
+package singularity
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/JasonYangShadow/lpmx/error"
+	. "github.com/JasonYangShadow/lpmx/log"
+	. "github.com/JasonYangShadow/lpmx/utils"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/unix"
+)
+
+//OVERLAY_XATTR prefixes the xattrs used by overlayfs, they are not restored
+const OVERLAY_XATTR = "trusted.overlay."
+
+//fileMode converts unix permission bits(including setuid, setgid and sticky) to os.FileMode
+func fileMode(mode uint32) os.FileMode {
+	fmode := os.FileMode(mode & 0777)
+	if mode&unix.S_ISUID != 0 {
+		fmode |= os.ModeSetuid
+	}
+	if mode&unix.S_ISGID != 0 {
+		fmode |= os.ModeSetgid
+	}
+	if mode&unix.S_ISVTX != 0 {
+		fmode |= os.ModeSticky
+	}
+	return fmode
+}
+
+//fsAttrs are the attributes restored after an entry is created
+type fsAttrs struct {
+	Mode   uint32 //permission bits
+	Uid    uint32
+	Gid    uint32
+	Mtime  int64
+	Xattrs map[string][]byte
+}
+
+//fsImage is a file system image which could be extracted into folders
+type fsImage interface {
+	//isDir returns whether path p of image is a directory
+	isDir(p string) bool
+	//extractTree extracts the entries of directory p of image into dest
+	extractTree(x *fsExtractor, p, dest string) error
+}
+
+//fsExtractor writes the entries of file system images into folders and enforces the extraction limits of utils
+type fsExtractor struct {
+	root    bool              //ownership is only restored by root
+	overlay bool              //overlayfs whiteouts and opaque folders are converted to the ones of OCI layers
+	links   map[uint64]string //extracted files with several links, keyed by inode number
+	entries int
+	size    uint64
+	devices int //devices skipped as they could not be created
+	xattrs  int //xattrs skipped as they could not be set
+}
+
+func newFsExtractor() *fsExtractor {
+	return &fsExtractor{root: os.Geteuid() == 0, links: make(map[uint64]string)}
+}
+
+//name validates the name of directory entry
+func (x *fsExtractor) name(dir, name string) error {
+	if name == "" || name == "." || name == ".." || strings.Contains(name, "/") {
+		cerr := ErrNew(ErrUnsafe, fmt.Sprintf("entry %s inside %s escapes destination folder", name, dir))
+		return cerr
+	}
+	x.entries++
+	if SAFE_EXTRACT && x.entries > EXTRACT_MAX_ENTRIES {
+		cerr := ErrNew(ErrFull, fmt.Sprintf("image contains more than %d entries, stopped at %s", EXTRACT_MAX_ENTRIES, name))
+		return cerr
+	}
+	return nil
+}
+
+//replace removes the existing entry at target, existing directories are kept if dir is true. Symlinks are never followed
+func (x *fsExtractor) replace(target string, dir bool) error {
+	fi, err := os.Lstat(target)
+	if err != nil {
+		return nil
+	}
+	if dir && fi.IsDir() {
+		//make sure the entries could be written, the mode is restored afterwards
+		return os.Chmod(target, 0700)
+	}
+	return os.RemoveAll(target)
+}
+
+//mkdir creates directory target, its attributes should be set after its entries are extracted
+func (x *fsExtractor) mkdir(target string) error {
+	if err := x.replace(target, true); err != nil {
+		return err
+	}
+	if err := os.Mkdir(target, 0700); err != nil && !os.IsExist(err) {
+		return err
+	}
+	return nil
+}
+
+//file creates regular file target with the content written by write, files sharing the same inode become hardlinks
+func (x *fsExtractor) file(target string, ino uint64, nlink uint32, size uint64, write func(io.Writer) error) error {
+	if err := x.replace(target, false); err != nil {
+		return err
+	}
+	if link, ok := x.links[ino]; ok {
+		return os.Link(link, target)
+	}
+	x.size += size
+	if SAFE_EXTRACT && x.size > uint64(EXTRACT_MAX_SIZE) {
+		cerr := ErrNew(ErrFull, fmt.Sprintf("image is larger than %d bytes, stopped at %s", EXTRACT_MAX_SIZE, target))
+		return cerr
+	}
+	f, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if nlink > 1 {
+		x.links[ino] = target
+	}
+	return nil
+}
+
+func (x *fsExtractor) symlink(target, link string) error {
+	if err := x.replace(target, false); err != nil {
+		return err
+	}
+	return os.Symlink(link, target)
+}
+
+//node creates device, fifo or socket target, kind is one of unix.S_IFCHR, S_IFBLK, S_IFIFO and S_IFSOCK.
+//Devices which could not be created without privileges are skipped
+func (x *fsExtractor) node(target string, kind, perm, major, minor uint32) error {
+	if err := x.replace(target, false); err != nil {
+		return err
+	}
+	//overlayfs marks deleted entries with character devices 0:0
+	if x.overlay && kind == unix.S_IFCHR && major == 0 && minor == 0 {
+		dir, name := filepath.Split(target)
+		return ioutil.WriteFile(filepath.Join(dir, WHITEOUT_PREFIX+name), nil, 0644)
+	}
+	switch kind {
+	case unix.S_IFIFO:
+		return unix.Mkfifo(target, perm)
+	case unix.S_IFSOCK:
+		return unix.Mknod(target, kind|perm, 0)
+	}
+	if err := unix.Mknod(target, kind|perm, int(unix.Mkdev(major, minor))); err != nil {
+		LOGGER.WithFields(logrus.Fields{
+			"err":  err,
+			"file": target,
+		}).Debug("could not create device file")
+		x.devices++
+	}
+	return nil
+}
+
+//attrs restores the ownership(only for root), xattrs, mode and modification time of target
+func (x *fsExtractor) attrs(target string, symlink bool, attrs fsAttrs) error {
+	if x.root {
+		if err := os.Lchown(target, int(attrs.Uid), int(attrs.Gid)); err != nil {
+			return err
+		}
+	}
+	for name, value := range attrs.Xattrs {
+		if x.overlay && strings.HasPrefix(name, OVERLAY_XATTR) {
+			if name == OVERLAY_XATTR+"opaque" && string(value) == "y" {
+				if err := ioutil.WriteFile(filepath.Join(target, WHITEOUT_OPAQUE), nil, 0644); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if err := unix.Lsetxattr(target, name, value, 0); err != nil {
+			LOGGER.WithFields(logrus.Fields{
+				"err":   err,
+				"file":  target,
+				"xattr": name,
+			}).Debug("could not set xattr")
+			x.xattrs++
+		}
+	}
+	//chmod comes after chown, which clears setuid and setgid bits
+	if !symlink {
+		if err := os.Chmod(target, fileMode(attrs.Mode)); err != nil {
+			return err
+		}
+	}
+	ts := unix.NsecToTimespec(attrs.Mtime * 1e9)
+	return unix.UtimesNanoAt(unix.AT_FDCWD, target, []unix.Timespec{ts, ts}, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+//done converts err to *Error and reports what is skipped
+func (x *fsExtractor) done(err error, dest string) *Error {
+	if err != nil {
+		if cerr, ok := err.(*Error); ok {
+			return cerr
+		}
+		cerr := ErrNew(err, fmt.Sprintf("could not extract image into %s", dest))
+		return cerr
+	}
+	if x.devices > 0 || x.xattrs > 0 {
+		LOGGER.WithFields(logrus.Fields{
+			"devices": x.devices,
+			"xattrs":  x.xattrs,
+			"dest":    dest,
+		}).Warn("some device files and xattrs of image are skipped, they require privileges")
+	}
+	return nil
+}
+
+//extractImage extracts directory p of img into dest
+func extractImage(img fsImage, x *fsExtractor, p, dest string) *Error {
+	if !FolderExist(dest) {
+		if _, err := MakeDir(dest); err != nil {
+			return err
+		}
+	}
+	err := img.extractTree(x, p, filepath.Clean(dest))
+	return x.done(err, dest)
+}
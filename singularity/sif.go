@@ -0,0 +1,485 @@
+package singularity
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	. "github.com/JasonYangShadow/lpmx/error"
+	. "github.com/JasonYangShadow/lpmx/log"
+	"github.com/sirupsen/logrus"
+	sif "github.com/sylabs/sif/pkg/sif"
+)
+
+const (
+	//SIF_ENV_DIR contains the environment scripts sourced by singularity, only the ones generated from docker images and %environment are imported
+	SIF_ENV_DIR = "/.singularity.d/env"
+	//SIF_RUNSCRIPT is generated from %runscript or the entrypoint of docker images
+	SIF_RUNSCRIPT = "/.singularity.d/runscript"
+	//SIF_LABELS is generated from %labels
+	SIF_LABELS = "/.singularity.d/labels.json"
+	//DEFAULT_PATH is used by environment scripts before PATH is set
+	DEFAULT_PATH = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+	//overlay partitions store the upper folder of overlayfs
+	sifOverlayUpper = "upper"
+	//metadata files larger than it are skipped
+	sifMetaMaxSize = 16 << 20
+)
+
+var (
+	//suffixes of the environment scripts imported from SIF_ENV_DIR
+	sifEnvScripts = []string{"-docker2singularity.sh", "-environment.sh"}
+)
+
+//SifMetadata is the run configuration recorded inside SIF
+type SifMetadata struct {
+	Environment []string          //KEY=VALUE pairs in the order they are set
+	Runscript   string            //the whole script including shebang
+	Labels      map[string]string //labels of %labels and the ones added by singularity build
+	Deffile     string            //definition file the image is built from
+	Arch        string            //architecture of primary partition in the form of GOARCH
+}
+
+//RunCmd returns the command running the runscript, the interpreter is taken from its shebang
+func (meta *SifMetadata) RunCmd() []string {
+	if strings.TrimSpace(meta.Runscript) == "" {
+		return nil
+	}
+	interp := []string{"/bin/sh"}
+	if strings.HasPrefix(meta.Runscript, "#!") {
+		line := strings.SplitN(meta.Runscript, "\n", 2)[0]
+		if fields := strings.Fields(strings.TrimPrefix(line, "#!")); len(fields) > 0 {
+			interp = fields
+		}
+	}
+	return append(interp, "-c", meta.Runscript)
+}
+
+//primaryPartition returns the primary system partition of fimg, images without it fall back to their first system partition
+func primaryPartition(fimg *sif.FileImage) (*sif.Descriptor, *Error) {
+	descr, _, err := fimg.GetPartPrimSys()
+	if err != nil && err != sif.ErrNotFound {
+		cerr := ErrNew(err, "could not find the primary system partition")
+		return nil, cerr
+	}
+	if descr == nil {
+		for i, v := range fimg.DescrArr {
+			if ptype, perr := v.GetPartType(); v.Used && v.Datatype == sif.DataPartition && perr == nil && ptype == sif.PartSystem {
+				descr = &fimg.DescrArr[i]
+				break
+			}
+		}
+	}
+	if descr == nil {
+		cerr := ErrNew(ErrNExist, "image does not contain any system partition")
+		return nil, cerr
+	}
+	fstype, _ := descr.GetFsType()
+	if fstype != sif.FsSquash && fstype != sif.FsExt3 {
+		cerr := ErrNew(ErrType, fmt.Sprintf("%s system partition %d is not supported", fstypeStr(fstype), descr.ID))
+		return nil, cerr
+	}
+	return descr, nil
+}
+
+//overlayPartitions returns the overlay partitions of fimg in the order they are stored
+func overlayPartitions(fimg *sif.FileImage) []*sif.Descriptor {
+	var descrs []*sif.Descriptor
+	for i, v := range fimg.DescrArr {
+		if !v.Used || v.Datatype != sif.DataPartition {
+			continue
+		}
+		ptype, _ := v.GetPartType()
+		fstype, _ := v.GetFsType()
+		if ptype != sif.PartOverlay {
+			continue
+		}
+		if fstype != sif.FsSquash && fstype != sif.FsExt3 {
+			LOGGER.WithFields(logrus.Fields{
+				"id":     v.ID,
+				"fstype": fstypeStr(fstype),
+			}).Warn("overlay partition is skipped, its file system is not supported")
+			continue
+		}
+		descrs = append(descrs, &fimg.DescrArr[i])
+	}
+	return descrs
+}
+
+//descrReader returns the reader of data object descr
+func descrReader(fimg *sif.FileImage, descr *sif.Descriptor) (*io.SectionReader, *Error) {
+	r, ok := fimg.Fp.(io.ReaderAt)
+	if !ok {
+		cerr := ErrNew(ErrType, "sif image does not support random access")
+		return nil, cerr
+	}
+	if descr.Fileoff < 0 || descr.Filelen < 0 || descr.Fileoff+descr.Filelen > fimg.Filesize {
+		cerr := ErrNew(ErrFileIO, fmt.Sprintf("data object %d is out of image", descr.ID))
+		return nil, cerr
+	}
+	return io.NewSectionReader(r, descr.Fileoff, descr.Filelen), nil
+}
+
+//writeDescriptor copies data object descr into new file
+func writeDescriptor(fimg *sif.FileImage, descr *sif.Descriptor, file string) *Error {
+	r, err := descrReader(fimg, descr)
+	if err != nil {
+		return err
+	}
+	to, oerr := os.Create(file)
+	if oerr != nil {
+		cerr := ErrNew(oerr, fmt.Sprintf("could not create file: %s", file))
+		return cerr
+	}
+	defer to.Close()
+	if _, werr := io.Copy(to, r); werr != nil {
+		cerr := ErrNew(werr, fmt.Sprintf("could not write data to file: %s", file))
+		return cerr
+	}
+	return nil
+}
+
+//ExtractOverlays writes the overlay partitions of sif file into folder dir, the paths of written partitions are returned in order
+func ExtractOverlays(file, dir string) ([]string, *Error) {
+	fimg, err := loadSif(file)
+	if err != nil {
+		return nil, err
+	}
+	defer unloadSif(fimg)
+
+	var files []string
+	for _, descr := range overlayPartitions(fimg) {
+		target := fmt.Sprintf("%s/overlay-%d", dir, descr.ID)
+		if err := writeDescriptor(fimg, descr, target); err != nil {
+			return nil, err
+		}
+		files = append(files, target)
+	}
+	return files, nil
+}
+
+//openFilesystem opens squashfs or ext image r according to its magic
+func openFilesystem(r io.ReaderAt) (fsImage, *Error) {
+	var magic [4]byte
+	if _, err := r.ReadAt(magic[:], 0); err != nil {
+		cerr := ErrNew(err, "could not read magic of file system image")
+		return nil, cerr
+	}
+	if binary.LittleEndian.Uint32(magic[:]) == SQUASHFS_MAGIC {
+		return OpenSquashfs(r)
+	}
+	return OpenExtFs(r)
+}
+
+//ExtractFilesystem extracts squashfs or ext image into dest. If overlay is true, image is treated as overlayfs folder(or the one containing upper folder),
+//whose whiteouts are converted to the ones of OCI layers
+func ExtractFilesystem(file, dest string, overlay bool) *Error {
+	f, oerr := os.Open(file)
+	if oerr != nil {
+		cerr := ErrNew(oerr, fmt.Sprintf("could not open %s", file))
+		return cerr
+	}
+	defer f.Close()
+	img, err := openFilesystem(f)
+	if err != nil {
+		err.AddMsg(fmt.Sprintf("%s is neither squashfs nor ext image", file))
+		return err
+	}
+	x := newFsExtractor()
+	x.overlay = overlay
+	root := "/"
+	if overlay && img.isDir(sifOverlayUpper) {
+		root = sifOverlayUpper
+	}
+	return extractImage(img, x, root, dest)
+}
+
+//parseDeffile returns the sections(without %) of definition file
+func parseDeffile(deffile string) map[string]string {
+	sections := make(map[string]string)
+	section := ""
+	for _, line := range strings.Split(deffile, "\n") {
+		if strings.HasPrefix(line, "%") {
+			fields := strings.Fields(line)
+			section = strings.ToLower(strings.TrimPrefix(fields[0], "%"))
+			continue
+		}
+		if section != "" {
+			sections[section] += line + "\n"
+		}
+	}
+	return sections
+}
+
+//parseLabels parses labels stored in json or in the format of %labels(one 'key value' pair per line)
+func parseLabels(data string, labels map[string]string) {
+	var jlabels map[string]interface{}
+	if err := json.Unmarshal([]byte(data), &jlabels); err == nil {
+		for k, v := range jlabels {
+			labels[k] = fmt.Sprint(v)
+		}
+		return
+	}
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		kv := strings.SplitN(line, " ", 2)
+		value := ""
+		if len(kv) == 2 {
+			value = strings.Trim(strings.TrimSpace(kv[1]), "\"'")
+		}
+		labels[kv[0]] = value
+	}
+}
+
+//envList is the list of environment variables keeping the order they are set
+type envList struct {
+	keys   []string
+	values map[string]string
+}
+
+func newEnvList() *envList {
+	return &envList{values: make(map[string]string)}
+}
+
+func (env *envList) set(key, value string) {
+	if _, ok := env.values[key]; !ok {
+		env.keys = append(env.keys, key)
+	}
+	env.values[key] = value
+}
+
+func (env *envList) get(key string) string {
+	if value, ok := env.values[key]; ok {
+		return value
+	}
+	if key == "PATH" {
+		return DEFAULT_PATH
+	}
+	return ""
+}
+
+func (env *envList) list() []string {
+	var items []string
+	for _, key := range env.keys {
+		items = append(items, fmt.Sprintf("%s=%s", key, env.values[key]))
+	}
+	return items
+}
+
+//expand replaces $VAR and ${VAR} of word with the values of env
+func (env *envList) expand(word string) string {
+	var buf strings.Builder
+	for i := 0; i < len(word); i++ {
+		if word[i] != '$' || i+1 == len(word) {
+			buf.WriteByte(word[i])
+			continue
+		}
+		name := ""
+		if word[i+1] == '{' {
+			end := strings.IndexByte(word[i:], '}')
+			if end < 0 {
+				buf.WriteString(word[i:])
+				break
+			}
+			name = word[i+2 : i+end]
+			//default values like ${VAR:-value} are not supported, the variable is kept as it is
+			i += end
+		} else {
+			j := i + 1
+			for j < len(word) && (word[j] == '_' || word[j] >= 'a' && word[j] <= 'z' || word[j] >= 'A' && word[j] <= 'Z' || word[j] >= '0' && word[j] <= '9') {
+				j++
+			}
+			if j == i+1 {
+				buf.WriteByte('$')
+				continue
+			}
+			name = word[i+1 : j]
+			i = j - 1
+		}
+		buf.WriteString(env.get(name))
+	}
+	return buf.String()
+}
+
+//splitCommands splits line into commands(separated by ;) of shell words, single quoted parts are not expanded while the others are expanded with env
+func (env *envList) splitCommands(line string) [][]string {
+	var commands [][]string
+	var words []string
+	var word strings.Builder
+	inWord := false
+	endWord := func() {
+		if inWord {
+			words = append(words, word.String())
+			word.Reset()
+			inWord = false
+		}
+	}
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '#' && !inWord:
+			i = len(line)
+		case c == ' ' || c == '\t':
+			endWord()
+		case c == ';':
+			endWord()
+			commands = append(commands, words)
+			words = nil
+		case c == '\'' || c == '"':
+			end := strings.IndexByte(line[i+1:], c)
+			if end < 0 {
+				end = len(line) - i - 1
+			}
+			part := line[i+1 : i+1+end]
+			if c == '"' {
+				part = env.expand(part)
+			}
+			word.WriteString(part)
+			inWord = true
+			i += end + 1
+		default:
+			j := i
+			for j < len(line) && !strings.ContainsRune(" \t;'\"", rune(line[j])) {
+				j++
+			}
+			word.WriteString(env.expand(line[i:j]))
+			inWord = true
+			i = j - 1
+		}
+	}
+	endWord()
+	return append(commands, words)
+}
+
+//parseEnvScript evaluates the assignments(optionally exported) of environment script, other commands are skipped
+func (env *envList) parseEnvScript(script string) {
+	scanner := bufio.NewScanner(strings.NewReader(script))
+	scanner.Buffer(make([]byte, 64*1024), sifMetaMaxSize)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		for _, words := range env.splitCommands(line) {
+			if len(words) > 0 && words[0] == "export" {
+				words = words[1:]
+			}
+			for _, word := range words {
+				kv := strings.SplitN(word, "=", 2)
+				if len(kv) != 2 || kv[0] == "" || strings.ContainsAny(kv[0], "$()[]{}") {
+					LOGGER.WithFields(logrus.Fields{
+						"line": line,
+					}).Debug("environment script command is skipped, only assignments are imported")
+					break
+				}
+				env.set(kv[0], kv[1])
+			}
+		}
+	}
+}
+
+//readSquashfsMeta reads the environment, runscript and labels generated by singularity build from primary squashfs partition
+func readSquashfsMeta(fs *Squashfs, env *envList, meta *SifMetadata) {
+	if names, err := fs.ReadDir(SIF_ENV_DIR); err == nil {
+		sort.Strings(names)
+		for _, name := range names {
+			for _, suffix := range sifEnvScripts {
+				if !strings.HasSuffix(name, suffix) {
+					continue
+				}
+				if data, err := fs.ReadFile(filepath.Join(SIF_ENV_DIR, name)); err == nil && len(data) <= sifMetaMaxSize {
+					env.parseEnvScript(string(data))
+				}
+			}
+		}
+	}
+	if data, err := fs.ReadFile(SIF_RUNSCRIPT); err == nil && len(data) <= sifMetaMaxSize {
+		meta.Runscript = string(data)
+	}
+	if data, err := fs.ReadFile(SIF_LABELS); err == nil && len(data) <= sifMetaMaxSize {
+		parseLabels(string(data), meta.Labels)
+	}
+}
+
+//ReadSifMetadata reads the run configuration of sif file. The files generated by singularity build inside primary partition are preferred,
+//the sections of definition file are used if they are missing. Environment and labels data objects are merged at last
+func ReadSifMetadata(file string) (*SifMetadata, *Error) {
+	fimg, err := loadSif(file)
+	if err != nil {
+		return nil, err
+	}
+	defer unloadSif(fimg)
+
+	primary, err := primaryPartition(fimg)
+	if err != nil {
+		return nil, err
+	}
+	meta := &SifMetadata{Labels: make(map[string]string)}
+	if arch, aerr := primary.GetArch(); aerr == nil {
+		meta.Arch = sif.GetGoArch(trimZeroBytes(arch[:]))
+	}
+	env := newEnvList()
+
+	if fstype, _ := primary.GetFsType(); fstype == sif.FsSquash {
+		r, err := descrReader(fimg, primary)
+		if err != nil {
+			return nil, err
+		}
+		fs, err := OpenSquashfs(r)
+		if err != nil {
+			return nil, err
+		}
+		readSquashfsMeta(fs, env, meta)
+	}
+
+	var envs, labels []string
+	for i, v := range fimg.DescrArr {
+		if !v.Used || v.Filelen > sifMetaMaxSize {
+			continue
+		}
+		switch v.Datatype {
+		case sif.DataDeffile:
+			meta.Deffile = string(fimg.DescrArr[i].GetData(fimg))
+		case sif.DataEnvVar:
+			envs = append(envs, string(fimg.DescrArr[i].GetData(fimg)))
+		case sif.DataLabels:
+			labels = append(labels, string(fimg.DescrArr[i].GetData(fimg)))
+		}
+	}
+	if meta.Deffile != "" {
+		sections := parseDeffile(meta.Deffile)
+		if len(env.keys) == 0 {
+			env.parseEnvScript(sections["environment"])
+		}
+		if meta.Runscript == "" && strings.TrimSpace(sections["runscript"]) != "" {
+			meta.Runscript = "#!/bin/sh\n" + sections["runscript"]
+		}
+		if len(meta.Labels) == 0 {
+			parseLabels(sections["labels"], meta.Labels)
+		}
+	}
+	for _, data := range envs {
+		env.parseEnvScript(data)
+	}
+	for _, data := range labels {
+		parseLabels(data, meta.Labels)
+	}
+	meta.Environment = env.list()
+
+	LOGGER.WithFields(logrus.Fields{
+		"file": file,
+		"env":  meta.Environment,
+		"arch": meta.Arch,
+	}).Debug("ReadSifMetadata debug")
+	return meta, nil
+}
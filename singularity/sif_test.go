@@ -0,0 +1,202 @@
+package singularity
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/JasonYangShadow/lpmx/utils"
+	uuid "github.com/satori/go.uuid"
+	"github.com/stretchr/testify/assert"
+	sif "github.com/sylabs/sif/pkg/sif"
+)
+
+const testDeffile = "Bootstrap: docker\nFrom: busybox:latest\n\n%environment\n\texport GREETING=\"hello world\"\n%runscript\n\techo \"Hi\"\n%labels\n\tAuthor lpmx\n"
+
+//writeOverlayFixture decompresses the ext3 overlay partition containing upper/etc/motd, whiteout upper/bin/ls and opaque folder upper/opt
+func writeOverlayFixture(t *testing.T, dir string) string {
+	f, err := os.Open("testdata/overlay.ext3.gz")
+	assert.Nil(t, err)
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	assert.Nil(t, err)
+	file := filepath.Join(dir, "overlay.ext3")
+	to, err := os.Create(file)
+	assert.Nil(t, err)
+	defer to.Close()
+	_, err = io.Copy(to, gz)
+	assert.Nil(t, err)
+	return file
+}
+
+//partitionInput returns the descriptor input of partition file
+func partitionInput(t *testing.T, file string, fs sif.Fstype, part sif.Parttype) sif.DescriptorInput {
+	data, err := ioutil.ReadFile(file)
+	assert.Nil(t, err)
+	input := sif.DescriptorInput{
+		Datatype: sif.DataPartition,
+		Groupid:  sif.DescrDefaultGroup,
+		Link:     sif.DescrUnusedLink,
+		Size:     int64(len(data)),
+		Fname:    file,
+		Data:     data,
+	}
+	assert.Nil(t, input.SetPartExtra(fs, part, sif.HdrArchAMD64))
+	return input
+}
+
+func dataInput(datatype sif.Datatype, name, data string) sif.DescriptorInput {
+	return sif.DescriptorInput{
+		Datatype: datatype,
+		Groupid:  sif.DescrDefaultGroup,
+		Link:     sif.DescrUnusedLink,
+		Size:     int64(len(data)),
+		Fname:    name,
+		Data:     []byte(data),
+	}
+}
+
+//createTestSif builds sif file with an ext3 system partition stored before the primary squashfs partition of testcontainer.sif,
+//an overlay partition and definition, labels and environment data objects
+func createTestSif(t *testing.T, dir string) string {
+	squashfs := filepath.Join(dir, "rootfs.squashfs")
+	assert.Nil(t, ExtractSquashfs("testdata/testcontainer.sif", squashfs))
+	overlay := writeOverlayFixture(t, dir)
+
+	file := filepath.Join(dir, "test.sif")
+	fimg, err := sif.CreateContainer(sif.CreateInfo{
+		Pathname:   file,
+		Launchstr:  sif.HdrLaunch,
+		Sifversion: sif.HdrVersion,
+		ID:         uuid.NewV4(),
+		InputDescr: []sif.DescriptorInput{
+			dataInput(sif.DataDeffile, "Singularity", testDeffile),
+			partitionInput(t, overlay, sif.FsExt3, sif.PartSystem),
+			partitionInput(t, squashfs, sif.FsSquash, sif.PartPrimSys),
+			partitionInput(t, overlay, sif.FsExt3, sif.PartOverlay),
+			dataInput(sif.DataLabels, "labels.json", `{"org.label-schema.schema-version": "1.0"}`),
+			dataInput(sif.DataEnvVar, "env", "export EXTRA=$PATH:/opt/bin\n"),
+		},
+	})
+	assert.Nil(t, err)
+	assert.NotNil(t, fimg)
+	return file
+}
+
+func TestSifPartitions(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "lpmx-sif")
+	defer os.RemoveAll(dir)
+	file := createTestSif(t, dir)
+
+	//primary partition is selected even though it is not the first one
+	fimg, err := loadSif(file)
+	assert.Nil(t, err)
+	primary, err := primaryPartition(fimg)
+	assert.Nil(t, err)
+	fstype, _ := primary.GetFsType()
+	assert.Equal(t, sif.FsSquash, fstype)
+	unloadSif(fimg)
+
+	squashfs := filepath.Join(dir, "primary")
+	assert.Nil(t, ExtractSquashfs(file, squashfs))
+	rootfs := filepath.Join(dir, "rootfs")
+	assert.Nil(t, Unsquashfs(squashfs, rootfs))
+	assert.True(t, FileExist(filepath.Join(rootfs, "bin/busybox")))
+
+	//overlayfs whiteouts become the ones of OCI layers
+	overlays, err := ExtractOverlays(file, dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(overlays))
+	layer := filepath.Join(dir, "overlay")
+	assert.Nil(t, ExtractFilesystem(overlays[0], layer, true))
+	data, rerr := ioutil.ReadFile(filepath.Join(layer, "etc/motd"))
+	assert.Nil(t, rerr)
+	assert.Equal(t, "hello from overlay\n", string(data))
+	assert.True(t, FileExist(filepath.Join(layer, "bin/.wh.ls")))
+	assert.False(t, FileExist(filepath.Join(layer, "bin/ls")))
+	assert.True(t, FileExist(filepath.Join(layer, "opt/.wh..wh..opq")))
+	assert.True(t, FileExist(filepath.Join(layer, "opt/file")))
+	link, lerr := os.Readlink(filepath.Join(layer, "usr/bin/hello"))
+	assert.Nil(t, lerr)
+	assert.Equal(t, "/bin/busybox", link)
+	assert.False(t, FolderExist(filepath.Join(layer, "upper")))
+	assert.False(t, FolderExist(filepath.Join(layer, "work")))
+	assert.False(t, FolderExist(filepath.Join(layer, "lost+found")))
+
+	//without overlay conversion the file system is extracted as it is
+	raw := filepath.Join(dir, "raw")
+	assert.Nil(t, ExtractFilesystem(overlays[0], raw, false))
+	assert.True(t, FolderExist(filepath.Join(raw, "upper/etc")))
+	assert.True(t, FolderExist(filepath.Join(raw, "work")))
+
+	//images without system partition are refused
+	_, err = primaryPartition(&sif.FileImage{})
+	assert.NotNil(t, err)
+}
+
+func TestReadSifMetadata(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "lpmx-sif")
+	defer os.RemoveAll(dir)
+	file := createTestSif(t, dir)
+
+	meta, err := ReadSifMetadata(file)
+	assert.Nil(t, err)
+	assert.Equal(t, "amd64", meta.Arch)
+	assert.Equal(t, testDeffile, meta.Deffile)
+	//environment of docker image comes first, environment data object is merged at last
+	assert.Equal(t, []string{"PATH=" + DEFAULT_PATH, "EXTRA=" + DEFAULT_PATH + ":/opt/bin"}, meta.Environment)
+	//runscript generated by singularity build is preferred over %runscript
+	assert.True(t, strings.HasPrefix(meta.Runscript, "#!/bin/sh\nOCI_ENTRYPOINT=\"\""))
+	cmd := meta.RunCmd()
+	assert.Equal(t, []string{"/bin/sh", "-c"}, cmd[:2])
+	//%labels is used as the image does not carry labels.json, labels data object is merged at last
+	assert.Equal(t, map[string]string{"Author": "lpmx", "org.label-schema.schema-version": "1.0"}, meta.Labels)
+
+	sections := parseDeffile(testDeffile)
+	assert.Equal(t, "\techo \"Hi\"\n", sections["runscript"])
+	assert.Equal(t, "\texport GREETING=\"hello world\"\n", sections["environment"])
+}
+
+func TestRunscript(t *testing.T) {
+	run := func(build *SifBuild, args ...string) string {
+		out, err := exec.Command("/bin/sh", append([]string{"-c", build.runscript(), "runscript"}, args...)...).Output()
+		assert.Nil(t, err)
+		return string(out)
+	}
+	entrypoint := &SifBuild{Entrypoint: []string{"echo", "entrypoint"}}
+	assert.Equal(t, "entrypoint\n", run(entrypoint))
+	assert.Equal(t, "entrypoint arg\n", run(entrypoint, "arg"))
+	cmd := &SifBuild{Cmd: []string{"echo", "cmd"}}
+	assert.Equal(t, "cmd\n", run(cmd))
+	assert.Equal(t, "arg\n", run(cmd, "echo", "arg"))
+	both := &SifBuild{Entrypoint: []string{"echo", "entrypoint"}, Cmd: []string{"cmd"}}
+	assert.Equal(t, "entrypoint cmd\n", run(both))
+	assert.Equal(t, "entrypoint arg\n", run(both, "arg"))
+	assert.Equal(t, "", (&SifBuild{}).runscript())
+}
+
+func TestParseEnvScript(t *testing.T) {
+	env := newEnvList()
+	env.parseEnvScript(`#!/bin/sh
+# comment
+export PATH="/opt/bin:$PATH"
+LANG=C.UTF-8 LC_ALL='$LANG'
+export HOME=/root; export GREETING="hello ${LANG} world" # trailing comment
+if [ -z "$FOO" ]; then
+export EMPTY=
+export PATH
+`)
+	assert.Equal(t, []string{
+		"PATH=/opt/bin:" + DEFAULT_PATH,
+		"LANG=C.UTF-8",
+		"LC_ALL=$LANG",
+		"HOME=/root",
+		"GREETING=hello C.UTF-8 world",
+		"EMPTY=",
+	}, env.list())
+}
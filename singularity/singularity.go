@@ -3,13 +3,11 @@ package singularity
 import (
 	"bytes"
 	"fmt"
-	"io"
 	"os"
 	"path/filepath"
 	"strings"
 
 	. "github.com/JasonYangShadow/lpmx/error"
-	. "github.com/JasonYangShadow/lpmx/paeudo"
 	. "github.com/JasonYangShadow/lpmx/utils"
 	sif "github.com/sylabs/sif/pkg/sif"
 )
@@ -102,11 +100,32 @@ func getDescriptorInfo(fileimage *sif.FileImage) ([]*SingularityObject, *Error)
 	return sigs, nil
 }
 
+//checkFilesystem verifies file is squashfs(compressed by supported algorithms) or ext image
+func checkFilesystem(file string) *Error {
+	f, err := os.Open(file)
+	if err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("could not open %s", file))
+		return cerr
+	}
+	defer f.Close()
+	_, cerr := openFilesystem(f)
+	if cerr != nil {
+		cerr.AddMsg(fmt.Sprintf("%s is not a valid squashfs or ext image", file))
+		return cerr
+	}
+	return nil
+}
+
 func LoadSquashfs(squashfsfile, imagedir string) (map[string]int64, []string, *Error) {
 	if !FileExist(squashfsfile) {
 		cerr := ErrNew(ErrNExist, fmt.Sprintf("could not find file: %s", squashfsfile))
 		return nil, nil, cerr
 	}
+	//make sure the image could be extracted before it is registered
+	err := checkFilesystem(squashfsfile)
+	if err != nil {
+		return nil, nil, err
+	}
 	sha256, err := Sha256file(squashfsfile)
 	if err != nil {
 		return nil, nil, err
@@ -129,47 +148,27 @@ func LoadSquashfs(squashfsfile, imagedir string) (map[string]int64, []string, *E
 	return layer_data, layers, nil
 }
 
+//ExtractSquashfs writes the primary system partition of sif file into filepath
 func ExtractSquashfs(sif, filepath string) *Error {
 	if FileExist(filepath) {
 		return nil
 	}
 
-	to, err := os.Create(filepath)
-	defer to.Close()
-
+	fileimage, err := loadSif(sif)
 	if err != nil {
-		cerr := ErrNew(err, fmt.Sprintf("could not create file: %s", filepath))
-		return cerr
+		return err
 	}
-
-	fileimage, ferr := loadSif(sif)
 	defer unloadSif(fileimage)
-	if ferr != nil {
-		return ferr
-	}
-	sings, serr := getDescriptorInfo(fileimage)
-	if serr != nil {
-		return serr
-	}
-
-	if sings != nil {
-		fileoff := sings[0].Fileoff
-		filelen := sings[0].Filelen
 
-		if _, err := fileimage.Fp.Seek(fileoff, 0); err != nil {
-			cerr := ErrNew(err, fmt.Sprintf("could not set offset of file: %s", filepath))
-			return cerr
-		}
-
-		if _, err := io.CopyN(to, fileimage.Fp, filelen); err != nil {
-			cerr := ErrNew(err, fmt.Sprintf("could not write data to file: %s", filepath))
-			return cerr
-		}
+	primary, err := primaryPartition(fileimage)
+	if err != nil {
+		err.AddMsg(fmt.Sprintf("could not extract system partition of %s", sif))
+		return err
 	}
-
-	return nil
+	return writeDescriptor(fileimage, primary, filepath)
 }
 
+//Unsquashfs extracts squashfs(or ext) partition into destfolder, files used by singularity runtime are removed
 func Unsquashfs(squashfspath, destfolder string) *Error {
 	if !FileExist(squashfspath) {
 		err := ErrNew(ErrNExist, fmt.Sprintf("%s does not exist", squashfspath))
@@ -183,7 +182,7 @@ func Unsquashfs(squashfspath, destfolder string) *Error {
 		}
 	}
 
-	_, err := Command("unsquashfs", "-f", "-d", destfolder, squashfspath)
+	err := ExtractFilesystem(squashfspath, destfolder, false)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,849 @@
+package singularity
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	. "github.com/JasonYangShadow/lpmx/error"
+	. "github.com/JasonYangShadow/lpmx/utils"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	SQUASHFS_MAGIC = 0x73717368
+
+	//size of the uncompressed metadata blocks
+	squashfsMetaSize = 8192
+	//unused table pointers of superblock
+	squashfsInvalidTable = 0xFFFFFFFFFFFFFFFF
+	squashfsNoFragment   = 0xFFFFFFFF
+	squashfsNoXattr      = 0xFFFFFFFF
+	//flags stored inside the sizes of metadata and data blocks
+	squashfsUncompressedMeta  = 1 << 15
+	squashfsUncompressedBlock = 1 << 24
+	//superblock flag telling compressor options follow superblock
+	squashfsCompressorOptions = 0x400
+	//xattr values stored out of line
+	squashfsXattrValueOOL = 0x100
+
+	//inode types, the extended ones carry larger sizes and xattrs
+	squashfsDir      = 1
+	squashfsFile     = 2
+	squashfsSymlink  = 3
+	squashfsBlkdev   = 4
+	squashfsChrdev   = 5
+	squashfsFifo     = 6
+	squashfsSocket   = 7
+	squashfsLDir     = 8
+	squashfsLFile    = 9
+	squashfsLSymlink = 10
+	squashfsLBlkdev  = 11
+	squashfsLChrdev  = 12
+	squashfsLFifo    = 13
+	squashfsLSocket  = 14
+)
+
+var (
+	//prefixes of xattr names, indexed by the type of xattr entries
+	squashfsXattrPrefixes = []string{"user.", "trusted.", "security."}
+)
+
+//squashfsSuper is the superblock of squashfs 4.0, all table positions are relative to the start of image
+type squashfsSuper struct {
+	Magic         uint32
+	Inodes        uint32
+	Mtime         uint32
+	BlockSize     uint32
+	Fragments     uint32
+	Compression   uint16
+	BlockLog      uint16
+	Flags         uint16
+	Ids           uint16
+	Major         uint16
+	Minor         uint16
+	RootInode     uint64
+	BytesUsed     uint64
+	IdTable       uint64
+	XattrTable    uint64
+	InodeTable    uint64
+	DirTable      uint64
+	FragmentTable uint64
+	ExportTable   uint64
+}
+
+type squashfsFragment struct {
+	Start  uint64
+	Size   uint32
+	Unused uint32
+}
+
+type squashfsXattrId struct {
+	Ref   uint64
+	Count uint32
+	Size  uint32
+}
+
+//squashfsInode is the decoded inode, only the fields of its type are set
+type squashfsInode struct {
+	Type   uint16
+	Mode   uint16
+	Uid    uint32
+	Gid    uint32
+	Mtime  uint32
+	Number uint32
+	Nlink  uint32
+	Xattr  uint32
+
+	//directories
+	DirBlock  uint32
+	DirOffset uint16
+	DirSize   uint32
+
+	//regular files
+	StartBlock uint64
+	FileSize   uint64
+	Fragment   uint32
+	FragOffset uint32
+	Blocks     []uint32
+
+	//symlinks
+	Target string
+
+	//block and character devices
+	Rdev uint32
+}
+
+func (inode *squashfsInode) isDir() bool {
+	return inode.Type == squashfsDir || inode.Type == squashfsLDir
+}
+
+//squashfsEntry is one entry of directory listing
+type squashfsEntry struct {
+	Name   string
+	Type   uint16
+	Ref    uint64 //position of inode, block<<16|offset relative to inode table
+	Number uint32
+}
+
+type metaBlock struct {
+	data []byte
+	next int64 //position of the following metadata block
+}
+
+//Squashfs reads squashfs 4.0 images natively, so that unsquashfs is not needed on the host
+type Squashfs struct {
+	r          io.ReaderAt
+	super      squashfsSuper
+	decompress decompressor
+	ids        []uint32
+	fragments  []squashfsFragment
+	xattrIds   []squashfsXattrId
+	xattrTable uint64
+	meta       map[int64]metaBlock
+	fragIdx    uint32
+	fragData   []byte
+}
+
+//OpenSquashfs reads the superblock and lookup tables of squashfs image r
+func OpenSquashfs(r io.ReaderAt) (*Squashfs, *Error) {
+	fs := &Squashfs{r: r, meta: make(map[int64]metaBlock), fragIdx: squashfsNoFragment}
+	if err := fs.init(); err != nil {
+		cerr := ErrNew(err, "could not open squashfs image")
+		return nil, cerr
+	}
+	return fs, nil
+}
+
+//Compression returns the name of compression algorithm used by image
+func (fs *Squashfs) Compression() string {
+	return compressionStr(fs.super.Compression)
+}
+
+func (fs *Squashfs) init() error {
+	s := &fs.super
+	if err := binary.Read(io.NewSectionReader(fs.r, 0, 96), binary.LittleEndian, s); err != nil {
+		return fmt.Errorf("could not read superblock: %s", err.Error())
+	}
+	if s.Magic != SQUASHFS_MAGIC {
+		return fmt.Errorf("bad magic 0x%x, it is not squashfs", s.Magic)
+	}
+	if s.Major != 4 || s.Minor != 0 {
+		return fmt.Errorf("squashfs %d.%d is not supported", s.Major, s.Minor)
+	}
+	if s.BlockLog < 12 || s.BlockLog > 20 || s.BlockSize != 1<<s.BlockLog {
+		return fmt.Errorf("block size %d is invalid", s.BlockSize)
+	}
+
+	var options []byte
+	if s.Flags&squashfsCompressorOptions != 0 {
+		//compressor options are always stored uncompressed
+		var hdr [2]byte
+		if _, err := fs.r.ReadAt(hdr[:], 96); err != nil {
+			return fmt.Errorf("could not read compressor options: %s", err.Error())
+		}
+		if h := binary.LittleEndian.Uint16(hdr[:]); h&squashfsUncompressedMeta != 0 {
+			options = make([]byte, h&^squashfsUncompressedMeta)
+			if _, err := fs.r.ReadAt(options, 98); err != nil {
+				return fmt.Errorf("could not read compressor options: %s", err.Error())
+			}
+		}
+	}
+	decompress, err := newDecompressor(s.Compression, options)
+	if err != nil {
+		return err
+	}
+	fs.decompress = decompress
+
+	data, err := fs.readTable(s.IdTable, int(s.Ids), 4)
+	if err != nil {
+		return fmt.Errorf("could not read id table: %s", err.Error())
+	}
+	fs.ids = make([]uint32, s.Ids)
+	for i := range fs.ids {
+		fs.ids[i] = binary.LittleEndian.Uint32(data[4*i:])
+	}
+
+	if s.Fragments > 0 && s.FragmentTable != squashfsInvalidTable {
+		data, err := fs.readTable(s.FragmentTable, int(s.Fragments), 16)
+		if err != nil {
+			return fmt.Errorf("could not read fragment table: %s", err.Error())
+		}
+		fs.fragments = make([]squashfsFragment, s.Fragments)
+		for i := range fs.fragments {
+			fs.fragments[i].Start = binary.LittleEndian.Uint64(data[16*i:])
+			fs.fragments[i].Size = binary.LittleEndian.Uint32(data[16*i+8:])
+		}
+	}
+
+	if s.XattrTable != squashfsInvalidTable {
+		var hdr [16]byte
+		if _, err := fs.r.ReadAt(hdr[:], int64(s.XattrTable)); err != nil {
+			return fmt.Errorf("could not read xattr table: %s", err.Error())
+		}
+		fs.xattrTable = binary.LittleEndian.Uint64(hdr[:])
+		count := int(binary.LittleEndian.Uint32(hdr[8:]))
+		data, err := fs.readTable(s.XattrTable+16, count, 16)
+		if err != nil {
+			return fmt.Errorf("could not read xattr id table: %s", err.Error())
+		}
+		fs.xattrIds = make([]squashfsXattrId, count)
+		for i := range fs.xattrIds {
+			fs.xattrIds[i].Ref = binary.LittleEndian.Uint64(data[16*i:])
+			fs.xattrIds[i].Count = binary.LittleEndian.Uint32(data[16*i+8:])
+			fs.xattrIds[i].Size = binary.LittleEndian.Uint32(data[16*i+12:])
+		}
+	}
+	return nil
+}
+
+//readMetaBlock reads and decompresses the metadata block at pos, blocks are cached as inodes and directories share them
+func (fs *Squashfs) readMetaBlock(pos int64) (metaBlock, error) {
+	if block, ok := fs.meta[pos]; ok {
+		return block, nil
+	}
+	var hdr [2]byte
+	if _, err := fs.r.ReadAt(hdr[:], pos); err != nil {
+		return metaBlock{}, fmt.Errorf("could not read metadata block at %d: %s", pos, err.Error())
+	}
+	h := binary.LittleEndian.Uint16(hdr[:])
+	size := int(h &^ squashfsUncompressedMeta)
+	if size == 0 || size > squashfsMetaSize {
+		return metaBlock{}, fmt.Errorf("metadata block at %d has invalid size %d", pos, size)
+	}
+	data := make([]byte, size)
+	if _, err := fs.r.ReadAt(data, pos+2); err != nil {
+		return metaBlock{}, fmt.Errorf("could not read metadata block at %d: %s", pos, err.Error())
+	}
+	if h&squashfsUncompressedMeta == 0 {
+		var err error
+		if data, err = fs.decompress(data, squashfsMetaSize); err != nil {
+			return metaBlock{}, fmt.Errorf("could not decompress metadata block at %d: %s", pos, err.Error())
+		}
+	}
+	block := metaBlock{data: data, next: pos + 2 + int64(size)}
+	fs.meta[pos] = block
+	return block, nil
+}
+
+//readTable reads count entries of size bytes stored inside metadata blocks, lookup points to the positions of these blocks
+func (fs *Squashfs) readTable(lookup uint64, count, size int) ([]byte, error) {
+	total := count * size
+	blocks := (total + squashfsMetaSize - 1) / squashfsMetaSize
+	index := make([]byte, 8*blocks)
+	if _, err := fs.r.ReadAt(index, int64(lookup)); err != nil {
+		return nil, err
+	}
+	data := make([]byte, 0, total)
+	for i := 0; i < blocks; i++ {
+		block, err := fs.readMetaBlock(int64(binary.LittleEndian.Uint64(index[8*i:])))
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, block.data...)
+	}
+	if len(data) < total {
+		return nil, fmt.Errorf("table at %d is truncated", lookup)
+	}
+	return data[:total], nil
+}
+
+//metaReader reads the stream of metadata blocks starting from one position
+type metaReader struct {
+	fs   *Squashfs
+	next int64
+	buf  []byte
+}
+
+func (fs *Squashfs) newMetaReader(start uint64, offset uint16) (*metaReader, error) {
+	m := &metaReader{fs: fs, next: int64(start)}
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+	if int(offset) > len(m.buf) {
+		return nil, fmt.Errorf("offset %d is beyond metadata block at %d", offset, start)
+	}
+	m.buf = m.buf[offset:]
+	return m, nil
+}
+
+func (m *metaReader) load() error {
+	block, err := m.fs.readMetaBlock(m.next)
+	if err != nil {
+		return err
+	}
+	m.buf = block.data
+	m.next = block.next
+	return nil
+}
+
+func (m *metaReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		if len(m.buf) == 0 {
+			if err := m.load(); err != nil {
+				return n, err
+			}
+		}
+		c := copy(p[n:], m.buf)
+		m.buf = m.buf[c:]
+		n += c
+	}
+	return n, nil
+}
+
+//readInode decodes the inode at ref(block<<16|offset relative to inode table)
+func (fs *Squashfs) readInode(ref uint64) (*squashfsInode, error) {
+	m, err := fs.newMetaReader(fs.super.InodeTable+ref>>16, uint16(ref&0xffff))
+	if err != nil {
+		return nil, err
+	}
+	le := binary.LittleEndian
+	var hdr struct {
+		Type, Mode, Uid, Gid uint16
+		Mtime, Number        uint32
+	}
+	if err := binary.Read(m, le, &hdr); err != nil {
+		return nil, err
+	}
+	if int(hdr.Uid) >= len(fs.ids) || int(hdr.Gid) >= len(fs.ids) {
+		return nil, fmt.Errorf("inode %d refers to unknown uid/gid", hdr.Number)
+	}
+	inode := &squashfsInode{Type: hdr.Type, Mode: hdr.Mode, Uid: fs.ids[hdr.Uid], Gid: fs.ids[hdr.Gid], Mtime: hdr.Mtime, Number: hdr.Number, Xattr: squashfsNoXattr}
+
+	switch hdr.Type {
+	case squashfsDir:
+		var d struct {
+			StartBlock, Nlink uint32
+			FileSize, Offset  uint16
+			Parent            uint32
+		}
+		err = binary.Read(m, le, &d)
+		inode.Nlink, inode.DirBlock, inode.DirOffset, inode.DirSize = d.Nlink, d.StartBlock, d.Offset, uint32(d.FileSize)
+	case squashfsLDir:
+		var d struct {
+			Nlink, FileSize, StartBlock, Parent uint32
+			Icount, Offset                      uint16
+			Xattr                               uint32
+		}
+		err = binary.Read(m, le, &d)
+		inode.Nlink, inode.DirBlock, inode.DirOffset, inode.DirSize, inode.Xattr = d.Nlink, d.StartBlock, d.Offset, d.FileSize, d.Xattr
+	case squashfsFile:
+		var f struct {
+			StartBlock, Fragment, Offset, FileSize uint32
+		}
+		err = binary.Read(m, le, &f)
+		inode.Nlink, inode.StartBlock, inode.Fragment, inode.FragOffset, inode.FileSize = 1, uint64(f.StartBlock), f.Fragment, f.Offset, uint64(f.FileSize)
+	case squashfsLFile:
+		var f struct {
+			StartBlock, FileSize, Sparse   uint64
+			Nlink, Fragment, Offset, Xattr uint32
+		}
+		err = binary.Read(m, le, &f)
+		inode.Nlink, inode.StartBlock, inode.Fragment, inode.FragOffset, inode.FileSize, inode.Xattr = f.Nlink, f.StartBlock, f.Fragment, f.Offset, f.FileSize, f.Xattr
+	case squashfsSymlink, squashfsLSymlink:
+		var s struct {
+			Nlink, Size uint32
+		}
+		if err = binary.Read(m, le, &s); err != nil {
+			break
+		}
+		if s.Size > 65535 {
+			return nil, fmt.Errorf("symlink inode %d is too long", hdr.Number)
+		}
+		target := make([]byte, s.Size)
+		if _, err = io.ReadFull(m, target); err != nil {
+			break
+		}
+		inode.Nlink, inode.Target = s.Nlink, string(target)
+		if hdr.Type == squashfsLSymlink {
+			err = binary.Read(m, le, &inode.Xattr)
+		}
+	case squashfsBlkdev, squashfsChrdev, squashfsLBlkdev, squashfsLChrdev:
+		var d struct {
+			Nlink, Rdev uint32
+		}
+		if err = binary.Read(m, le, &d); err != nil {
+			break
+		}
+		inode.Nlink, inode.Rdev = d.Nlink, d.Rdev
+		if hdr.Type == squashfsLBlkdev || hdr.Type == squashfsLChrdev {
+			err = binary.Read(m, le, &inode.Xattr)
+		}
+	case squashfsFifo, squashfsSocket, squashfsLFifo, squashfsLSocket:
+		if err = binary.Read(m, le, &inode.Nlink); err != nil {
+			break
+		}
+		if hdr.Type == squashfsLFifo || hdr.Type == squashfsLSocket {
+			err = binary.Read(m, le, &inode.Xattr)
+		}
+	default:
+		return nil, fmt.Errorf("inode %d has unknown type %d", hdr.Number, hdr.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read inode %d: %s", hdr.Number, err.Error())
+	}
+
+	if hdr.Type == squashfsFile || hdr.Type == squashfsLFile {
+		bs := uint64(fs.super.BlockSize)
+		count := inode.FileSize / bs
+		if inode.Fragment == squashfsNoFragment && inode.FileSize%bs != 0 {
+			count++
+		}
+		if count > 1<<28 {
+			return nil, fmt.Errorf("file inode %d is too large", hdr.Number)
+		}
+		inode.Blocks = make([]uint32, count)
+		if err := binary.Read(m, le, inode.Blocks); err != nil {
+			return nil, fmt.Errorf("could not read block list of inode %d: %s", hdr.Number, err.Error())
+		}
+	}
+	return inode, nil
+}
+
+//readDir lists the entries of directory inode
+func (fs *Squashfs) readDir(inode *squashfsInode) ([]squashfsEntry, error) {
+	//the size of listing counts 3 bytes for '.' and '..', which are not stored
+	if inode.DirSize <= 3 {
+		return nil, nil
+	}
+	m, err := fs.newMetaReader(fs.super.DirTable+uint64(inode.DirBlock), inode.DirOffset)
+	if err != nil {
+		return nil, err
+	}
+	le := binary.LittleEndian
+	var entries []squashfsEntry
+	remain := int(inode.DirSize) - 3
+	for remain > 0 {
+		var hdr struct {
+			Count, Start, Number uint32
+		}
+		if err := binary.Read(m, le, &hdr); err != nil {
+			return nil, err
+		}
+		remain -= 12
+		if hdr.Count >= 256 {
+			return nil, fmt.Errorf("directory inode %d has invalid header", inode.Number)
+		}
+		for i := uint32(0); i <= hdr.Count; i++ {
+			var e struct {
+				Offset      uint16
+				InodeOffset int16
+				Type, Size  uint16
+			}
+			if err := binary.Read(m, le, &e); err != nil {
+				return nil, err
+			}
+			name := make([]byte, int(e.Size)+1)
+			if _, err := io.ReadFull(m, name); err != nil {
+				return nil, err
+			}
+			remain -= 8 + len(name)
+			entries = append(entries, squashfsEntry{Name: string(name), Type: e.Type, Ref: uint64(hdr.Start)<<16 | uint64(e.Offset), Number: uint32(int64(hdr.Number) + int64(e.InodeOffset))})
+		}
+	}
+	return entries, nil
+}
+
+//readXattrs returns the xattrs of inode with full names, e.g, user.comment
+func (fs *Squashfs) readXattrs(inode *squashfsInode) (map[string][]byte, error) {
+	if inode.Xattr == squashfsNoXattr {
+		return nil, nil
+	}
+	if int(inode.Xattr) >= len(fs.xattrIds) {
+		return nil, fmt.Errorf("inode %d refers to unknown xattrs", inode.Number)
+	}
+	id := fs.xattrIds[inode.Xattr]
+	m, err := fs.newMetaReader(fs.xattrTable+id.Ref>>16, uint16(id.Ref&0xffff))
+	if err != nil {
+		return nil, err
+	}
+	le := binary.LittleEndian
+	//value reads the size prefixed value of xattr
+	value := func(r io.Reader) ([]byte, error) {
+		var size uint32
+		if err := binary.Read(r, le, &size); err != nil {
+			return nil, err
+		}
+		if size > 65536 {
+			return nil, fmt.Errorf("xattr value of inode %d is too large", inode.Number)
+		}
+		data := make([]byte, size)
+		_, err := io.ReadFull(r, data)
+		return data, err
+	}
+
+	xattrs := make(map[string][]byte)
+	for i := uint32(0); i < id.Count; i++ {
+		var key struct {
+			Type, Size uint16
+		}
+		if err := binary.Read(m, le, &key); err != nil {
+			return nil, err
+		}
+		name := make([]byte, key.Size)
+		if _, err := io.ReadFull(m, name); err != nil {
+			return nil, err
+		}
+		prefix := int(key.Type & 0xff)
+		if prefix >= len(squashfsXattrPrefixes) {
+			return nil, fmt.Errorf("xattr of inode %d has unknown type %d", inode.Number, key.Type)
+		}
+		data, err := value(m)
+		if err != nil {
+			return nil, err
+		}
+		if key.Type&squashfsXattrValueOOL != 0 {
+			if len(data) != 8 {
+				return nil, fmt.Errorf("xattr of inode %d has invalid reference", inode.Number)
+			}
+			ref := le.Uint64(data)
+			vm, err := fs.newMetaReader(fs.xattrTable+ref>>16, uint16(ref&0xffff))
+			if err != nil {
+				return nil, err
+			}
+			if data, err = value(vm); err != nil {
+				return nil, err
+			}
+		}
+		xattrs[squashfsXattrPrefixes[prefix]+string(name)] = data
+	}
+	return xattrs, nil
+}
+
+//readFragment returns the decompressed fragment block idx, the last one is cached as small files share it
+func (fs *Squashfs) readFragment(idx uint32) ([]byte, error) {
+	if idx == fs.fragIdx {
+		return fs.fragData, nil
+	}
+	if int(idx) >= len(fs.fragments) {
+		return nil, fmt.Errorf("fragment %d does not exist", idx)
+	}
+	frag := fs.fragments[idx]
+	size := frag.Size &^ squashfsUncompressedBlock
+	if size > fs.super.BlockSize {
+		return nil, fmt.Errorf("fragment %d has invalid size %d", idx, size)
+	}
+	data := make([]byte, size)
+	if _, err := fs.r.ReadAt(data, int64(frag.Start)); err != nil {
+		return nil, err
+	}
+	if frag.Size&squashfsUncompressedBlock == 0 {
+		var err error
+		if data, err = fs.decompress(data, int(fs.super.BlockSize)); err != nil {
+			return nil, fmt.Errorf("could not decompress fragment %d: %s", idx, err.Error())
+		}
+	}
+	fs.fragIdx, fs.fragData = idx, data
+	return data, nil
+}
+
+//writeFile writes the content of file inode into w
+func (fs *Squashfs) writeFile(w io.Writer, inode *squashfsInode) error {
+	bs := uint64(fs.super.BlockSize)
+	pos := int64(inode.StartBlock)
+	remain := inode.FileSize
+	buf := make([]byte, bs)
+	var zeros []byte
+	for _, block := range inode.Blocks {
+		want := bs
+		if remain < want {
+			want = remain
+		}
+		size := uint64(block &^ squashfsUncompressedBlock)
+		if size > bs {
+			return fmt.Errorf("block of inode %d has invalid size %d", inode.Number, size)
+		}
+		var data []byte
+		if size == 0 {
+			//sparse block
+			if zeros == nil {
+				zeros = make([]byte, bs)
+			}
+			data = zeros
+		} else {
+			data = buf[:size]
+			if _, err := fs.r.ReadAt(data, pos); err != nil {
+				return err
+			}
+			pos += int64(size)
+			if block&squashfsUncompressedBlock == 0 {
+				var err error
+				if data, err = fs.decompress(data, int(bs)); err != nil {
+					return fmt.Errorf("could not decompress block of inode %d: %s", inode.Number, err.Error())
+				}
+			}
+		}
+		if uint64(len(data)) < want {
+			return fmt.Errorf("block of inode %d is truncated", inode.Number)
+		}
+		if _, err := w.Write(data[:want]); err != nil {
+			return err
+		}
+		remain -= want
+	}
+
+	if remain > 0 {
+		if inode.Fragment == squashfsNoFragment {
+			return fmt.Errorf("inode %d is truncated", inode.Number)
+		}
+		data, err := fs.readFragment(inode.Fragment)
+		if err != nil {
+			return err
+		}
+		if uint64(inode.FragOffset)+remain > uint64(len(data)) {
+			return fmt.Errorf("fragment of inode %d is truncated", inode.Number)
+		}
+		if _, err := w.Write(data[inode.FragOffset : uint64(inode.FragOffset)+remain]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//lookup returns the inode of path p inside image, symlinks of the parent folders are followed inside image
+func (fs *Squashfs) lookup(p string) (*squashfsInode, error) {
+	inode, err := fs.readInode(fs.super.RootInode)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(strings.Trim(path.Clean("/"+p), "/"), "/")
+	dirs := []*squashfsInode{inode}
+	for hops, idx := 0, 0; idx < len(parts); idx++ {
+		part := parts[idx]
+		if part == "" || part == "." {
+			continue
+		}
+		if part == ".." {
+			if len(dirs) > 1 {
+				dirs = dirs[:len(dirs)-1]
+			}
+			inode = dirs[len(dirs)-1]
+			continue
+		}
+		if !inode.isDir() {
+			return nil, fmt.Errorf("%s is not a directory", strings.Join(parts[:idx], "/"))
+		}
+		entries, err := fs.readDir(inode)
+		if err != nil {
+			return nil, err
+		}
+		var found *squashfsEntry
+		for i := range entries {
+			if entries[i].Name == part {
+				found = &entries[i]
+				break
+			}
+		}
+		if found == nil {
+			return nil, os.ErrNotExist
+		}
+		if inode, err = fs.readInode(found.Ref); err != nil {
+			return nil, err
+		}
+		//symlinks are resolved except the last one
+		if (inode.Type == squashfsSymlink || inode.Type == squashfsLSymlink) && idx < len(parts)-1 {
+			hops++
+			if hops > 40 {
+				return nil, fmt.Errorf("too many levels of symlinks while resolving %s", p)
+			}
+			link := strings.Split(strings.Trim(inode.Target, "/"), "/")
+			if strings.HasPrefix(inode.Target, "/") {
+				dirs = dirs[:1]
+			}
+			parts = append(link, parts[idx+1:]...)
+			idx = -1
+			inode = dirs[len(dirs)-1]
+			continue
+		}
+		if inode.isDir() {
+			dirs = append(dirs, inode)
+		}
+	}
+	return inode, nil
+}
+
+//ReadFile returns the content of regular file p inside image, the last symlink is followed as well
+func (fs *Squashfs) ReadFile(p string) ([]byte, error) {
+	inode, err := fs.lookup(p)
+	for hops := 0; err == nil && (inode.Type == squashfsSymlink || inode.Type == squashfsLSymlink); hops++ {
+		if hops > 40 {
+			return nil, fmt.Errorf("too many levels of symlinks while resolving %s", p)
+		}
+		target := inode.Target
+		if !strings.HasPrefix(target, "/") {
+			target = path.Join(path.Dir("/"+p), target)
+		}
+		p = target
+		inode, err = fs.lookup(p)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if inode.Type != squashfsFile && inode.Type != squashfsLFile {
+		return nil, fmt.Errorf("%s is not a regular file", p)
+	}
+	var buf bytes.Buffer
+	if err := fs.writeFile(&buf, inode); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+//ReadDir returns the names of entries of directory p inside image
+func (fs *Squashfs) ReadDir(p string) ([]string, error) {
+	inode, err := fs.lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	if !inode.isDir() {
+		return nil, fmt.Errorf("%s is not a directory", p)
+	}
+	entries, err := fs.readDir(inode)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name)
+	}
+	return names, nil
+}
+
+//Extract writes the whole tree of image into dest, existing files are overwritten.
+//Device files and xattrs are skipped if they could not be created, e.g, without root privilege
+func (fs *Squashfs) Extract(dest string) *Error {
+	return extractImage(fs, newFsExtractor(), "/", dest)
+}
+
+func (fs *Squashfs) isDir(p string) bool {
+	inode, err := fs.lookup(p)
+	return err == nil && inode.isDir()
+}
+
+func (fs *Squashfs) extractTree(x *fsExtractor, p, dest string) error {
+	inode, err := fs.lookup(p)
+	if err != nil {
+		return err
+	}
+	if !inode.isDir() {
+		return fmt.Errorf("%s is not a directory", p)
+	}
+	return fs.extractDir(x, inode, dest)
+}
+
+func (fs *Squashfs) attrs(inode *squashfsInode) (fsAttrs, error) {
+	xattrs, err := fs.readXattrs(inode)
+	return fsAttrs{Mode: uint32(inode.Mode & 07777), Uid: inode.Uid, Gid: inode.Gid, Mtime: int64(inode.Mtime), Xattrs: xattrs}, err
+}
+
+func (fs *Squashfs) extractDir(x *fsExtractor, inode *squashfsInode, dir string) error {
+	entries, err := fs.readDir(inode)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := x.name(dir, entry.Name); err != nil {
+			return err
+		}
+		child, err := fs.readInode(entry.Ref)
+		if err != nil {
+			return err
+		}
+		if err := fs.extract(x, child, filepath.Join(dir, entry.Name)); err != nil {
+			return err
+		}
+	}
+	attrs, err := fs.attrs(inode)
+	if err != nil {
+		return err
+	}
+	return x.attrs(dir, false, attrs)
+}
+
+func (fs *Squashfs) extract(x *fsExtractor, inode *squashfsInode, target string) error {
+	perm := uint32(inode.Mode & 07777)
+	var err error
+	switch inode.Type {
+	case squashfsDir, squashfsLDir:
+		if err := x.mkdir(target); err != nil {
+			return err
+		}
+		return fs.extractDir(x, inode, target)
+	case squashfsFile, squashfsLFile:
+		err = x.file(target, uint64(inode.Number), inode.Nlink, inode.FileSize, func(w io.Writer) error {
+			return fs.writeFile(w, inode)
+		})
+	case squashfsSymlink, squashfsLSymlink:
+		err = x.symlink(target, inode.Target)
+	case squashfsBlkdev, squashfsLBlkdev, squashfsChrdev, squashfsLChrdev:
+		kind := uint32(unix.S_IFCHR)
+		if inode.Type == squashfsBlkdev || inode.Type == squashfsLBlkdev {
+			kind = unix.S_IFBLK
+		}
+		//device numbers are stored in the encoding of linux kernel
+		major := (inode.Rdev >> 8) & 0xfff
+		minor := (inode.Rdev & 0xff) | ((inode.Rdev >> 12) & 0xfff00)
+		err = x.node(target, kind, perm, major, minor)
+		if err == nil && !FileExist(target) {
+			return nil
+		}
+	case squashfsFifo, squashfsLFifo:
+		err = x.node(target, unix.S_IFIFO, perm, 0, 0)
+	case squashfsSocket, squashfsLSocket:
+		err = x.node(target, unix.S_IFSOCK, perm, 0, 0)
+	}
+	if err != nil {
+		return err
+	}
+	attrs, err := fs.attrs(inode)
+	if err != nil {
+		return err
+	}
+	return x.attrs(target, inode.Type == squashfsSymlink || inode.Type == squashfsLSymlink, attrs)
+}
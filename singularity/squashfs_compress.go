@@ -0,0 +1,179 @@
+package singularity
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+//compression ids stored inside squashfs superblock
+const (
+	SQUASHFS_GZIP = 1
+	SQUASHFS_LZMA = 2
+	SQUASHFS_LZO  = 3
+	SQUASHFS_XZ   = 4
+	SQUASHFS_LZ4  = 5
+	SQUASHFS_ZSTD = 6
+)
+
+//the only lz4 format written by mksquashfs, blocks are raw lz4 blocks without frame
+const squashfsLz4Legacy = 1
+
+//decompressor decompresses one block of squashfs, the result should not be larger than max bytes
+type decompressor func(src []byte, max int) ([]byte, error)
+
+//zstdDecoder is shared by all squashfs images, DecodeAll is safe for concurrent use
+var zstdDecoder, _ = zstd.NewReader(nil)
+
+func compressionStr(id uint16) string {
+	switch id {
+	case SQUASHFS_GZIP:
+		return "gzip"
+	case SQUASHFS_LZMA:
+		return "lzma"
+	case SQUASHFS_LZO:
+		return "lzo"
+	case SQUASHFS_XZ:
+		return "xz"
+	case SQUASHFS_LZ4:
+		return "lz4"
+	case SQUASHFS_ZSTD:
+		return "zstd"
+	}
+	return fmt.Sprintf("unknown(%d)", id)
+}
+
+//readLimited reads the whole stream r, it fails if the stream is larger than max bytes
+func readLimited(r io.Reader, max int) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, int64(max)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > max {
+		return nil, fmt.Errorf("decompressed block is larger than %d bytes", max)
+	}
+	return data, nil
+}
+
+//newDecompressor returns the decompressor of compression id, options are the compressor options stored after superblock(nil if there are none)
+func newDecompressor(id uint16, options []byte) (decompressor, error) {
+	switch id {
+	case SQUASHFS_GZIP:
+		return func(src []byte, max int) ([]byte, error) {
+			r, err := zlib.NewReader(bytes.NewReader(src))
+			if err != nil {
+				return nil, err
+			}
+			defer r.Close()
+			return readLimited(r, max)
+		}, nil
+	case SQUASHFS_LZMA:
+		return func(src []byte, max int) ([]byte, error) {
+			r, err := lzma.NewReader(bytes.NewReader(src))
+			if err != nil {
+				return nil, err
+			}
+			return readLimited(r, max)
+		}, nil
+	case SQUASHFS_XZ:
+		return func(src []byte, max int) ([]byte, error) {
+			r, err := xz.NewReader(bytes.NewReader(src))
+			if err != nil {
+				return nil, err
+			}
+			return readLimited(r, max)
+		}, nil
+	case SQUASHFS_LZ4:
+		if len(options) >= 4 {
+			if version := binary.LittleEndian.Uint32(options); version != squashfsLz4Legacy {
+				return nil, fmt.Errorf("lz4 format version %d is not supported", version)
+			}
+		}
+		return lz4DecompressBlock, nil
+	case SQUASHFS_ZSTD:
+		return func(src []byte, max int) ([]byte, error) {
+			data, err := zstdDecoder.DecodeAll(src, make([]byte, 0, max))
+			if err != nil {
+				return nil, err
+			}
+			if len(data) > max {
+				return nil, fmt.Errorf("decompressed block is larger than %d bytes", max)
+			}
+			return data, nil
+		}, nil
+	}
+	return nil, fmt.Errorf("%s compression is not supported", compressionStr(id))
+}
+
+//lz4DecompressBlock decodes one raw lz4 block, which is a sequence of literals and matches
+func lz4DecompressBlock(src []byte, max int) ([]byte, error) {
+	dst := make([]byte, 0, max)
+	corrupted := fmt.Errorf("lz4 block is corrupted")
+	//length reads the extra bytes of literal or match length
+	length := func(pos, l int) (int, int, error) {
+		for {
+			if pos >= len(src) {
+				return 0, 0, corrupted
+			}
+			b := src[pos]
+			pos++
+			l += int(b)
+			if b != 255 {
+				return pos, l, nil
+			}
+		}
+	}
+
+	pos := 0
+	for pos < len(src) {
+		token := src[pos]
+		pos++
+		var err error
+		literals := int(token >> 4)
+		if literals == 15 {
+			if pos, literals, err = length(pos, literals); err != nil {
+				return nil, err
+			}
+		}
+		if pos+literals > len(src) || len(dst)+literals > max {
+			return nil, corrupted
+		}
+		dst = append(dst, src[pos:pos+literals]...)
+		pos += literals
+		//the last sequence only has literals
+		if pos == len(src) {
+			break
+		}
+
+		if pos+2 > len(src) {
+			return nil, corrupted
+		}
+		offset := int(binary.LittleEndian.Uint16(src[pos:]))
+		pos += 2
+		if offset == 0 || offset > len(dst) {
+			return nil, corrupted
+		}
+		match := int(token & 0xf)
+		if match == 15 {
+			if pos, match, err = length(pos, match); err != nil {
+				return nil, err
+			}
+		}
+		match += 4
+		if len(dst)+match > max {
+			return nil, corrupted
+		}
+		//matches may overlap with the bytes they produce, so they are copied byte by byte
+		start := len(dst) - offset
+		for i := 0; i < match; i++ {
+			dst = append(dst, dst[start+i])
+		}
+	}
+	return dst, nil
+}
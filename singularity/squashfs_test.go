@@ -0,0 +1,205 @@
+package singularity
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/JasonYangShadow/lpmx/utils"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/ulikunitz/xz"
+)
+
+func TestUnsquashfsNative(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "lpmx-squashfs")
+	defer os.RemoveAll(dir)
+	squashfs := filepath.Join(dir, "file.squashfs")
+	dest := filepath.Join(dir, "rootfs")
+	assert.Nil(t, ExtractSquashfs("testdata/testcontainer.sif", squashfs))
+	assert.Nil(t, checkFilesystem(squashfs))
+	assert.Nil(t, Unsquashfs(squashfs, dest))
+
+	//small files are stored inside fragments
+	data, err := ioutil.ReadFile(filepath.Join(dest, "etc/passwd"))
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(string(data), "root:x:0:0:"))
+
+	//applets of busybox are hardlinks of the same inode
+	busybox, err := os.Stat(filepath.Join(dest, "bin/busybox"))
+	assert.Nil(t, err)
+	ls, err := os.Stat(filepath.Join(dest, "bin/ls"))
+	assert.Nil(t, err)
+	assert.True(t, os.SameFile(busybox, ls))
+	assert.Equal(t, os.FileMode(0755), busybox.Mode().Perm())
+
+	tmp, err := os.Stat(filepath.Join(dest, "tmp"))
+	assert.Nil(t, err)
+	assert.NotZero(t, tmp.Mode()&os.ModeSticky)
+	assert.False(t, FolderExist(filepath.Join(dest, ".singularity.d")))
+
+	//files which are not squashfs are refused
+	assert.NotNil(t, checkFilesystem("testdata/testcontainer.sif"))
+}
+
+func TestLz4DecompressBlock(t *testing.T) {
+	block := []byte{0x44, 'a', 'b', 'c', 'd', 0x04, 0x00, 0x30, 'x', 'y', 'z'}
+	data, err := lz4DecompressBlock(block, 64)
+	assert.Nil(t, err)
+	assert.Equal(t, "abcdabcdabcdxyz", string(data))
+
+	//overlapping match with extended length
+	block = []byte{0x1f, 'a', 0x01, 0x00, 0x01, 0x10, 'b'}
+	data, err = lz4DecompressBlock(block, 64)
+	assert.Nil(t, err)
+	assert.Equal(t, strings.Repeat("a", 21)+"b", string(data))
+
+	_, err = lz4DecompressBlock(block, 10)
+	assert.NotNil(t, err)
+	_, err = lz4DecompressBlock([]byte{0x44, 'a', 'b', 'c', 'd', 0x08, 0x00, 0x30, 'x', 'y', 'z'}, 64)
+	assert.NotNil(t, err)
+}
+
+func TestDecompressors(t *testing.T) {
+	content := bytes.Repeat([]byte("lpmx squashfs "), 100)
+	var gz, x bytes.Buffer
+	zw := zlib.NewWriter(&gz)
+	zw.Write(content)
+	zw.Close()
+	xw, _ := xz.NewWriter(&x)
+	xw.Write(content)
+	xw.Close()
+	enc, _ := zstd.NewWriter(nil)
+	blocks := map[uint16][]byte{
+		SQUASHFS_GZIP: gz.Bytes(),
+		SQUASHFS_XZ:   x.Bytes(),
+		SQUASHFS_ZSTD: enc.EncodeAll(content, nil),
+	}
+	for id, block := range blocks {
+		decompress, err := newDecompressor(id, nil)
+		assert.Nil(t, err)
+		data, err := decompress(block, len(content))
+		assert.Nil(t, err, compressionStr(id))
+		assert.Equal(t, content, data, compressionStr(id))
+		_, err = decompress(block, len(content)-1)
+		assert.NotNil(t, err, compressionStr(id))
+	}
+
+	_, err := newDecompressor(SQUASHFS_LZO, nil)
+	assert.NotNil(t, err)
+}
+
+func TestWriteSquashfs(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "lpmx-squashfs")
+	defer os.RemoveAll(dir)
+
+	//large file with one block of zeros in the middle, which is stored as sparse block
+	large := bytes.Repeat([]byte("lpmx"), 100000)
+	copy(large[1<<squashfsBlockLog:], make([]byte, 1<<squashfsBlockLog))
+	source := filepath.Join(dir, "large")
+	assert.Nil(t, ioutil.WriteFile(source, large, 0644))
+
+	root := NewFsDir(0755)
+	bin := NewFsDir(0755)
+	root.Children["bin"] = bin
+	bin.Children["busybox"] = &FsEntry{Mode: 0755, Data: []byte("busybox"), LinkKey: "busybox", Xattrs: map[string][]byte{"user.comment": []byte("applet"), "system.skipped": []byte("x")}}
+	bin.Children["ls"] = &FsEntry{Mode: 0755, Data: []byte("busybox"), LinkKey: "busybox"}
+	bin.Children["sh"] = &FsEntry{Mode: os.ModeSymlink | 0777, Link: "busybox"}
+	root.Children["large"] = &FsEntry{Mode: 0600, Uid: 1000, Gid: 1000, Mtime: 1234567890, Source: source}
+	root.Children["tmp"] = NewFsDir(0777 | os.ModeSticky)
+	root.Children["fifo"] = &FsEntry{Mode: os.ModeNamedPipe | 0644}
+	//enough entries to span several metadata blocks and directory headers
+	many := NewFsDir(0755)
+	root.Children["many"] = many
+	for i := 0; i < 1000; i++ {
+		many.Children[fmt.Sprintf("file-%04d", i)] = &FsEntry{Mode: 0644, Data: []byte(fmt.Sprintf("%d\n", i))}
+	}
+
+	file := filepath.Join(dir, "image.squashfs")
+	assert.Nil(t, WriteSquashfs(root, file))
+	assert.Nil(t, checkFilesystem(file))
+	fi, err := os.Stat(file)
+	assert.Nil(t, err)
+	assert.Zero(t, fi.Size()%4096)
+
+	f, err := os.Open(file)
+	assert.Nil(t, err)
+	defer f.Close()
+	fs, cerr := OpenSquashfs(f)
+	assert.Nil(t, cerr)
+	assert.Equal(t, "gzip", fs.Compression())
+	names, err := fs.ReadDir("/many")
+	assert.Nil(t, err)
+	assert.Equal(t, 1000, len(names))
+	inode, err := fs.lookup("/bin/ls")
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(2), inode.Nlink)
+	xattrs, err := fs.readXattrs(inode)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]byte{"user.comment": []byte("applet")}, xattrs)
+	inode, err = fs.lookup("/large")
+	assert.Nil(t, err)
+	assert.Equal(t, uint32(0), inode.Blocks[1])
+	assert.Equal(t, uint32(1000), inode.Uid)
+
+	dest := filepath.Join(dir, "rootfs")
+	assert.Nil(t, fs.Extract(dest))
+	data, err := ioutil.ReadFile(filepath.Join(dest, "large"))
+	assert.Nil(t, err)
+	assert.Equal(t, large, data)
+	data, err = ioutil.ReadFile(filepath.Join(dest, "many/file-0999"))
+	assert.Nil(t, err)
+	assert.Equal(t, "999\n", string(data))
+	busybox, err := os.Stat(filepath.Join(dest, "bin/busybox"))
+	assert.Nil(t, err)
+	ls, err := os.Stat(filepath.Join(dest, "bin/ls"))
+	assert.Nil(t, err)
+	assert.True(t, os.SameFile(busybox, ls))
+	link, err := os.Readlink(filepath.Join(dest, "bin/sh"))
+	assert.Nil(t, err)
+	assert.Equal(t, "busybox", link)
+	fi, err = os.Stat(filepath.Join(dest, "tmp"))
+	assert.Nil(t, err)
+	assert.Equal(t, os.ModeDir|os.ModeSticky|0777, fi.Mode())
+	fi, err = os.Lstat(filepath.Join(dest, "large"))
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode())
+	assert.Equal(t, int64(1234567890), fi.ModTime().Unix())
+	fi, err = os.Lstat(filepath.Join(dest, "fifo"))
+	assert.Nil(t, err)
+	assert.NotZero(t, fi.Mode()&os.ModeNamedPipe)
+
+	//the image should be readable by squashfs-tools as well, not only by our reader
+	t.Run("unsquashfs", func(t *testing.T) {
+		if _, err := exec.LookPath("unsquashfs"); err != nil {
+			t.Skip("unsquashfs is not installed")
+		}
+		out, err := exec.Command("unsquashfs", "-lls", file).CombinedOutput()
+		assert.Nil(t, err, string(out))
+		assert.Contains(t, string(out), "squashfs-root/bin/sh -> busybox")
+		assert.Contains(t, string(out), "squashfs-root/many/file-0999")
+		assert.Regexp(t, `(?m)^-rw------- \S+\s+400000 .*squashfs-root/large$`, string(out))
+
+		dest := filepath.Join(dir, "unsquashfs")
+		out, err = exec.Command("unsquashfs", "-no-xattrs", "-d", dest, file).CombinedOutput()
+		assert.Nil(t, err, string(out))
+		data, err := ioutil.ReadFile(filepath.Join(dest, "large"))
+		assert.Nil(t, err)
+		assert.Equal(t, large, data)
+		data, err = ioutil.ReadFile(filepath.Join(dest, "many/file-0999"))
+		assert.Nil(t, err)
+		assert.Equal(t, "999\n", string(data))
+		data, err = ioutil.ReadFile(filepath.Join(dest, "bin/ls"))
+		assert.Nil(t, err)
+		assert.Equal(t, "busybox", string(data))
+	})
+
+	//only directories could be the root of image
+	assert.NotNil(t, WriteSquashfs(&FsEntry{Mode: 0644}, file))
+}
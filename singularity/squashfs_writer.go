@@ -0,0 +1,639 @@
+package singularity
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	. "github.com/JasonYangShadow/lpmx/error"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	//images are written with 128K data blocks, the default of mksquashfs
+	squashfsBlockLog = 17
+	//superblock flags of images written by WriteSquashfs
+	squashfsNoFragments = 0x10
+	squashfsNoXattrs    = 0x200
+	//xattr values larger than this are skipped, they are refused by linux anyway
+	squashfsXattrMaxValue = 65536
+)
+
+//FsEntry is one entry of the file tree written into images.
+//Regular files read their content from host file Source, or from Data if Source is empty
+type FsEntry struct {
+	Mode     os.FileMode //file type and permission bits, including setuid, setgid and sticky bits
+	Uid      uint32
+	Gid      uint32
+	Mtime    int64
+	Source   string
+	Data     []byte
+	Link     string //target of symlinks
+	Rdev     uint64 //device number of block and character devices, see unix.Mkdev
+	Xattrs   map[string][]byte
+	LinkKey  string              //regular files sharing the same non-empty key are written as hardlinks of one inode
+	Children map[string]*FsEntry //entries of directories keyed by name
+}
+
+//NewFsDir returns directory entry with permission perm, owned by root
+func NewFsDir(perm os.FileMode) *FsEntry {
+	return &FsEntry{Mode: os.ModeDir | perm, Mtime: time.Now().Unix(), Children: make(map[string]*FsEntry)}
+}
+
+//unixMode converts os.FileMode to unix permission bits(including setuid, setgid and sticky), it is the reverse of fileMode.
+//Like mksquashfs, the file type is only stored as the type of inode
+func unixMode(mode os.FileMode) uint32 {
+	umode := uint32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		umode |= unix.S_ISUID
+	}
+	if mode&os.ModeSetgid != 0 {
+		umode |= unix.S_ISGID
+	}
+	if mode&os.ModeSticky != 0 {
+		umode |= unix.S_ISVTX
+	}
+	return umode
+}
+
+//basicType returns the basic inode type of entry, which is also the type stored inside directory listings
+func (e *FsEntry) basicType() uint16 {
+	switch {
+	case e.Mode.IsDir():
+		return squashfsDir
+	case e.Mode&os.ModeSymlink != 0:
+		return squashfsSymlink
+	case e.Mode&os.ModeCharDevice != 0:
+		return squashfsChrdev
+	case e.Mode&os.ModeDevice != 0:
+		return squashfsBlkdev
+	case e.Mode&os.ModeNamedPipe != 0:
+		return squashfsFifo
+	case e.Mode&os.ModeSocket != 0:
+		return squashfsSocket
+	}
+	return squashfsFile
+}
+
+//sortedNames returns the names of directory entries in the order required by squashfs
+func (e *FsEntry) sortedNames() []string {
+	names := make([]string, 0, len(e.Children))
+	for name := range e.Children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+//zlibCompress compresses data with zlib, the format of gzip squashfs images
+func zlibCompress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+//metaWriter packs a stream into metadata blocks kept in memory, they are copied into image once all inodes are written
+type metaWriter struct {
+	out    bytes.Buffer
+	buf    []byte
+	blocks []uint64 //positions of blocks inside out, used by lookup tables
+}
+
+//ref returns the position of the next byte written, block<<16|offset relative to the start of table
+func (m *metaWriter) ref() uint64 {
+	return uint64(m.out.Len())<<16 | uint64(len(m.buf))
+}
+
+func (m *metaWriter) Write(p []byte) (int, error) {
+	m.buf = append(m.buf, p...)
+	for len(m.buf) >= squashfsMetaSize {
+		if err := m.block(m.buf[:squashfsMetaSize]); err != nil {
+			return 0, err
+		}
+		m.buf = append([]byte(nil), m.buf[squashfsMetaSize:]...)
+	}
+	return len(p), nil
+}
+
+//flush writes the last partial block
+func (m *metaWriter) flush() error {
+	if len(m.buf) == 0 {
+		return nil
+	}
+	err := m.block(m.buf)
+	m.buf = nil
+	return err
+}
+
+//block writes one metadata block, it is stored uncompressed if compression does not make it smaller
+func (m *metaWriter) block(data []byte) error {
+	m.blocks = append(m.blocks, uint64(m.out.Len()))
+	c, err := zlibCompress(data)
+	if err != nil {
+		return err
+	}
+	hdr := uint16(len(c))
+	if len(c) >= len(data) {
+		c, hdr = data, uint16(len(data))|squashfsUncompressedMeta
+	}
+	binary.Write(&m.out, binary.LittleEndian, hdr)
+	m.out.Write(c)
+	return nil
+}
+
+//squashfsWriter writes squashfs 4.0 images compressed by gzip. Data blocks come right after superblock,
+//tables are appended at last. Fragments are not used, so that files are read without extra blocks
+type squashfsWriter struct {
+	f        *os.File
+	pos      uint64
+	block    []byte
+	inodes   metaWriter
+	dirs     metaWriter
+	ids      []uint32
+	idIdx    map[uint32]uint16
+	xattrs   metaWriter
+	xattrIds []squashfsXattrId
+	xattrIdx map[string]uint32
+	count    uint32
+	numbers  map[*FsEntry]uint32
+	//numbers, link counts and inode refs of hardlinks keyed by LinkKey
+	linkNumbers map[string]uint32
+	nlinks      map[string]uint32
+	links       map[string]uint64
+}
+
+//WriteSquashfs writes the tree of root into squashfs image file, which is overwritten if it exists
+func WriteSquashfs(root *FsEntry, file string) *Error {
+	if root == nil || !root.Mode.IsDir() {
+		cerr := ErrNew(ErrType, "root of squashfs image should be a directory")
+		return cerr
+	}
+	f, err := os.Create(file)
+	if err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("could not create squashfs image %s", file))
+		return cerr
+	}
+	defer f.Close()
+	w := &squashfsWriter{
+		f:           f,
+		block:       make([]byte, 1<<squashfsBlockLog),
+		idIdx:       make(map[uint32]uint16),
+		xattrIdx:    make(map[string]uint32),
+		numbers:     make(map[*FsEntry]uint32),
+		linkNumbers: make(map[string]uint32),
+		nlinks:      make(map[string]uint32),
+		links:       make(map[string]uint64),
+	}
+	if err := w.write(root); err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("could not write squashfs image %s", file))
+		return cerr
+	}
+	if err := f.Close(); err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("could not write squashfs image %s", file))
+		return cerr
+	}
+	return nil
+}
+
+func (w *squashfsWriter) write(root *FsEntry) error {
+	//inode numbers are assigned before writing, directories refer to the numbers of their parents
+	if err := w.number(root); err != nil {
+		return err
+	}
+	if err := w.output(make([]byte, 96)); err != nil {
+		return err
+	}
+	rootRef, err := w.writeDir(root, w.count+1)
+	if err != nil {
+		return err
+	}
+
+	s := squashfsSuper{
+		Magic:         SQUASHFS_MAGIC,
+		Inodes:        w.count,
+		Mtime:         uint32(time.Now().Unix()),
+		BlockSize:     1 << squashfsBlockLog,
+		Compression:   SQUASHFS_GZIP,
+		BlockLog:      squashfsBlockLog,
+		Flags:         squashfsNoFragments,
+		Major:         4,
+		RootInode:     rootRef,
+		XattrTable:    squashfsInvalidTable,
+		FragmentTable: squashfsInvalidTable,
+		ExportTable:   squashfsInvalidTable,
+	}
+	if s.InodeTable, err = w.table(&w.inodes); err != nil {
+		return err
+	}
+	if s.DirTable, err = w.table(&w.dirs); err != nil {
+		return err
+	}
+	//linux expects the lookup table of ids to end at the xattr table, which ends the image
+	var ids metaWriter
+	binary.Write(&ids, binary.LittleEndian, w.ids)
+	if s.IdTable, err = w.lookupTable(&ids); err != nil {
+		return err
+	}
+	if len(w.xattrIds) > 0 {
+		if s.XattrTable, err = w.xattrTable(); err != nil {
+			return err
+		}
+	} else {
+		s.Flags |= squashfsNoXattrs
+	}
+	s.Ids = uint16(len(w.ids))
+	s.BytesUsed = w.pos
+
+	//images are padded to 4K like the ones of mksquashfs, so that they could be used as loop devices
+	if pad := w.pos % 4096; pad != 0 {
+		if err := w.output(make([]byte, 4096-pad)); err != nil {
+			return err
+		}
+	}
+	var super bytes.Buffer
+	binary.Write(&super, binary.LittleEndian, &s)
+	_, err = w.f.WriteAt(super.Bytes(), 0)
+	return err
+}
+
+func (w *squashfsWriter) output(data []byte) error {
+	n, err := w.f.Write(data)
+	w.pos += uint64(n)
+	return err
+}
+
+//number assigns inode numbers in post order, regular files sharing LinkKey share one number
+func (w *squashfsWriter) number(e *FsEntry) error {
+	if e.Mode.IsDir() {
+		for _, name := range e.sortedNames() {
+			if name == "" || name == "." || name == ".." || strings.Contains(name, "/") || len(name) > 256 {
+				return fmt.Errorf("invalid entry name %q", name)
+			}
+			child := e.Children[name]
+			if child == nil {
+				return fmt.Errorf("entry %s is empty", name)
+			}
+			if err := w.number(child); err != nil {
+				return err
+			}
+		}
+	} else if e.LinkKey != "" && e.basicType() == squashfsFile {
+		w.nlinks[e.LinkKey]++
+		if number, ok := w.linkNumbers[e.LinkKey]; ok {
+			w.numbers[e] = number
+			return nil
+		}
+		w.count++
+		w.numbers[e] = w.count
+		w.linkNumbers[e.LinkKey] = w.count
+		return nil
+	}
+	w.count++
+	w.numbers[e] = w.count
+	return nil
+}
+
+//id returns the index of uid or gid inside id table
+func (w *squashfsWriter) id(id uint32) (uint16, error) {
+	if idx, ok := w.idIdx[id]; ok {
+		return idx, nil
+	}
+	if len(w.ids) >= 65536 {
+		return 0, fmt.Errorf("too many uids and gids")
+	}
+	idx := uint16(len(w.ids))
+	w.ids = append(w.ids, id)
+	w.idIdx[id] = idx
+	return idx, nil
+}
+
+//inodeHeader writes the common header of inodes and returns the ref of inode
+func (w *squashfsWriter) inodeHeader(e *FsEntry, typ uint16) (uint64, error) {
+	uid, err := w.id(e.Uid)
+	if err != nil {
+		return 0, err
+	}
+	gid, err := w.id(e.Gid)
+	if err != nil {
+		return 0, err
+	}
+	ref := w.inodes.ref()
+	hdr := struct {
+		Type, Mode, Uid, Gid uint16
+		Mtime, Number        uint32
+	}{typ, uint16(unixMode(e.Mode)), uid, gid, uint32(e.Mtime), w.numbers[e]}
+	return ref, binary.Write(&w.inodes, binary.LittleEndian, &hdr)
+}
+
+//xattrIndex stores the xattrs of entry and returns their index, identical sets are stored once.
+//Only user, trusted and security xattrs are supported by squashfs
+func (w *squashfsWriter) xattrIndex(xattrs map[string][]byte) uint32 {
+	var names []string
+	for name, value := range xattrs {
+		if len(value) > squashfsXattrMaxValue {
+			continue
+		}
+		for _, prefix := range squashfsXattrPrefixes {
+			if strings.HasPrefix(name, prefix) && len(name) > len(prefix) {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	if len(names) == 0 {
+		return squashfsNoXattr
+	}
+	sort.Strings(names)
+	var key bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&key, "%s\x00%d\x00%s", name, len(xattrs[name]), xattrs[name])
+	}
+	if idx, ok := w.xattrIdx[key.String()]; ok {
+		return idx
+	}
+
+	le := binary.LittleEndian
+	id := squashfsXattrId{Ref: w.xattrs.ref(), Count: uint32(len(names))}
+	for _, name := range names {
+		for typ, prefix := range squashfsXattrPrefixes {
+			if strings.HasPrefix(name, prefix) {
+				short := name[len(prefix):]
+				binary.Write(&w.xattrs, le, []uint16{uint16(typ), uint16(len(short))})
+				w.xattrs.Write([]byte(short))
+				break
+			}
+		}
+		value := xattrs[name]
+		binary.Write(&w.xattrs, le, uint32(len(value)))
+		w.xattrs.Write(value)
+		id.Size += uint32(len(name) + 1 + len(value))
+	}
+	idx := uint32(len(w.xattrIds))
+	w.xattrIds = append(w.xattrIds, id)
+	w.xattrIdx[key.String()] = idx
+	return idx
+}
+
+//squashfsDirent is the entry of directory listing being written
+type squashfsDirent struct {
+	name   string
+	ref    uint64
+	number uint32
+	typ    uint16
+}
+
+//writeDir writes the entries of directory e before e itself and returns the ref of its inode
+func (w *squashfsWriter) writeDir(e *FsEntry, parent uint32) (uint64, error) {
+	var ents []squashfsDirent
+	nlink := uint32(2)
+	for _, name := range e.sortedNames() {
+		child := e.Children[name]
+		var ref uint64
+		var err error
+		if child.Mode.IsDir() {
+			ref, err = w.writeDir(child, w.numbers[e])
+			nlink++
+		} else {
+			ref, err = w.writeEntry(child)
+		}
+		if err != nil {
+			return 0, err
+		}
+		ents = append(ents, squashfsDirent{name: name, ref: ref, number: w.numbers[child], typ: child.basicType()})
+	}
+
+	//entries sharing one header should be stored inside the same inode block, with close inode numbers
+	le := binary.LittleEndian
+	start := w.dirs.ref()
+	size := 3
+	for i := 0; i < len(ents); {
+		base := ents[i]
+		j := i + 1
+		for ; j < len(ents) && j-i < 256 && ents[j].ref>>16 == base.ref>>16; j++ {
+			if d := int64(ents[j].number) - int64(base.number); d < -32768 || d > 32767 {
+				break
+			}
+		}
+		binary.Write(&w.dirs, le, []uint32{uint32(j - i - 1), uint32(base.ref >> 16), base.number})
+		size += 12
+		for _, ent := range ents[i:j] {
+			binary.Write(&w.dirs, le, struct {
+				Offset      uint16
+				InodeOffset int16
+				Type, Size  uint16
+			}{uint16(ent.ref & 0xffff), int16(int64(ent.number) - int64(base.number)), ent.typ, uint16(len(ent.name) - 1)})
+			w.dirs.Write([]byte(ent.name))
+			size += 8 + len(ent.name)
+		}
+		i = j
+	}
+
+	xattr := w.xattrIndex(e.Xattrs)
+	if xattr == squashfsNoXattr && size <= 0xffff {
+		ref, err := w.inodeHeader(e, squashfsDir)
+		if err != nil {
+			return 0, err
+		}
+		return ref, binary.Write(&w.inodes, le, struct {
+			StartBlock, Nlink uint32
+			FileSize, Offset  uint16
+			Parent            uint32
+		}{uint32(start >> 16), nlink, uint16(size), uint16(start & 0xffff), parent})
+	}
+	ref, err := w.inodeHeader(e, squashfsLDir)
+	if err != nil {
+		return 0, err
+	}
+	return ref, binary.Write(&w.inodes, le, struct {
+		Nlink, FileSize, StartBlock, Parent uint32
+		Icount, Offset                      uint16
+		Xattr                               uint32
+	}{nlink, uint32(size), uint32(start >> 16), parent, 0, uint16(start & 0xffff), xattr})
+}
+
+//writeEntry writes the inode of entry which is not a directory and returns its ref
+func (w *squashfsWriter) writeEntry(e *FsEntry) (uint64, error) {
+	le := binary.LittleEndian
+	xattr := w.xattrIndex(e.Xattrs)
+	//extended inodes are only used if they are needed
+	typ := e.basicType()
+	if xattr != squashfsNoXattr && typ != squashfsFile {
+		typ += squashfsLDir - squashfsDir
+	}
+
+	switch typ {
+	case squashfsFile:
+		if ref, ok := w.links[e.LinkKey]; ok && e.LinkKey != "" {
+			return ref, nil
+		}
+		start, size, blocks, err := w.writeData(e)
+		if err != nil {
+			return 0, err
+		}
+		nlink := uint32(1)
+		if e.LinkKey != "" {
+			nlink = w.nlinks[e.LinkKey]
+		}
+		var ref uint64
+		if start <= 0xffffffff && size <= 0xffffffff && nlink == 1 && xattr == squashfsNoXattr {
+			if ref, err = w.inodeHeader(e, squashfsFile); err == nil {
+				err = binary.Write(&w.inodes, le, []uint32{uint32(start), squashfsNoFragment, 0, uint32(size)})
+			}
+		} else {
+			if ref, err = w.inodeHeader(e, squashfsLFile); err == nil {
+				err = binary.Write(&w.inodes, le, struct {
+					StartBlock, FileSize, Sparse   uint64
+					Nlink, Fragment, Offset, Xattr uint32
+				}{start, size, 0, nlink, squashfsNoFragment, 0, xattr})
+			}
+		}
+		if err != nil {
+			return 0, err
+		}
+		if e.LinkKey != "" {
+			w.links[e.LinkKey] = ref
+		}
+		return ref, binary.Write(&w.inodes, le, blocks)
+	case squashfsSymlink, squashfsLSymlink:
+		if len(e.Link) == 0 || len(e.Link) > 65535 {
+			return 0, fmt.Errorf("symlink target %q is invalid", e.Link)
+		}
+		ref, err := w.inodeHeader(e, typ)
+		if err != nil {
+			return 0, err
+		}
+		binary.Write(&w.inodes, le, []uint32{1, uint32(len(e.Link))})
+		w.inodes.Write([]byte(e.Link))
+		if typ == squashfsLSymlink {
+			binary.Write(&w.inodes, le, xattr)
+		}
+		return ref, nil
+	case squashfsBlkdev, squashfsChrdev, squashfsLBlkdev, squashfsLChrdev:
+		ref, err := w.inodeHeader(e, typ)
+		if err != nil {
+			return 0, err
+		}
+		//device numbers are stored in the encoding of linux kernel
+		major, minor := unix.Major(e.Rdev), unix.Minor(e.Rdev)
+		rdev := (minor & 0xff) | (major&0xfff)<<8 | (minor&^0xff)<<12
+		binary.Write(&w.inodes, le, []uint32{1, rdev})
+		if typ == squashfsLBlkdev || typ == squashfsLChrdev {
+			binary.Write(&w.inodes, le, xattr)
+		}
+		return ref, nil
+	}
+	ref, err := w.inodeHeader(e, typ)
+	if err != nil {
+		return 0, err
+	}
+	binary.Write(&w.inodes, le, uint32(1))
+	if typ == squashfsLFifo || typ == squashfsLSocket {
+		binary.Write(&w.inodes, le, xattr)
+	}
+	return ref, nil
+}
+
+//writeData writes the content of regular file e as data blocks, blocks full of zeros are stored as sparse blocks
+func (w *squashfsWriter) writeData(e *FsEntry) (start, size uint64, blocks []uint32, err error) {
+	var r io.Reader = bytes.NewReader(e.Data)
+	if e.Source != "" {
+		f, err := os.Open(e.Source)
+		if err != nil {
+			return 0, 0, nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	start = w.pos
+	for {
+		n, rerr := io.ReadFull(r, w.block)
+		if n > 0 {
+			chunk := w.block[:n]
+			size += uint64(n)
+			if bytes.Count(chunk, []byte{0}) == n {
+				blocks = append(blocks, 0)
+			} else {
+				c, err := zlibCompress(chunk)
+				if err != nil {
+					return 0, 0, nil, err
+				}
+				bsize := uint32(len(c))
+				if len(c) >= n {
+					c, bsize = chunk, uint32(n)|squashfsUncompressedBlock
+				}
+				if err := w.output(c); err != nil {
+					return 0, 0, nil, err
+				}
+				blocks = append(blocks, bsize)
+			}
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			return 0, 0, nil, rerr
+		}
+	}
+	return start, size, blocks, nil
+}
+
+//table copies metadata blocks of m into image and returns their position
+func (w *squashfsWriter) table(m *metaWriter) (uint64, error) {
+	if err := m.flush(); err != nil {
+		return 0, err
+	}
+	pos := w.pos
+	return pos, w.output(m.out.Bytes())
+}
+
+//lookupTable copies metadata blocks of m into image followed by the positions of these blocks, it returns the position of the latter
+func (w *squashfsWriter) lookupTable(m *metaWriter) (uint64, error) {
+	start, err := w.table(m)
+	if err != nil {
+		return 0, err
+	}
+	index := make([]uint64, len(m.blocks))
+	for i, block := range m.blocks {
+		index[i] = start + block
+	}
+	pos := w.pos
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, index)
+	return pos, w.output(buf.Bytes())
+}
+
+//xattrTable writes the xattr key/value pairs, id table and its header, it returns the position of header
+func (w *squashfsWriter) xattrTable() (uint64, error) {
+	kv, err := w.table(&w.xattrs)
+	if err != nil {
+		return 0, err
+	}
+	var ids metaWriter
+	binary.Write(&ids, binary.LittleEndian, w.xattrIds)
+	if err := ids.flush(); err != nil {
+		return 0, err
+	}
+	start := w.pos
+	if err := w.output(ids.out.Bytes()); err != nil {
+		return 0, err
+	}
+	pos := w.pos
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, []uint64{kv, uint64(len(w.xattrIds))})
+	for _, block := range ids.blocks {
+		binary.Write(&buf, binary.LittleEndian, start+block)
+	}
+	return pos, w.output(buf.Bytes())
+}
@@ -0,0 +1,459 @@
+package singularity
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/JasonYangShadow/lpmx/error"
+	. "github.com/JasonYangShadow/lpmx/log"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+	pgperrors "github.com/ProtonMail/go-crypto/openpgp/errors"
+	"github.com/sirupsen/logrus"
+	sif "github.com/sylabs/sif/pkg/sif"
+)
+
+const (
+	//VERIFY_AUTO verifies the signatures of SIF if there are, only tampered images are refused
+	VERIFY_AUTO = iota
+	//VERIFY_REQUIRE refuses images whose partitions are not all signed by the keys inside keyring
+	VERIFY_REQUIRE
+	//VERIFY_SKIP loads images without checking signatures
+	VERIFY_SKIP
+
+	//signed message of singularity before 3.6 starts with it and is followed by the hex digest of signed data objects
+	sifHashPrefix = "SIFHASH:"
+	//singularity 3.6+ and apptainer sign json metadata of this version
+	sifMetadataVersion = 1
+)
+
+//sifDigests are the hash functions of digests inside signed metadata, keyed by the names used there
+var sifDigests = map[string]func() hash.Hash{
+	"sha224":     sha256.New224,
+	"sha256":     sha256.New,
+	"sha384":     sha512.New384,
+	"sha512":     sha512.New,
+	"sha512_224": sha512.New512_224,
+	"sha512_256": sha512.New512_256,
+}
+
+//sifMetadata is the document signed by singularity 3.6+ and apptainer, it records the digests of global header,
+//descriptors and data of all objects inside one group. Digests are in the form of "sha256:<hex>"
+type sifMetadata struct {
+	Version int `json:"version"`
+	Header  struct {
+		Digest string `json:"digest"`
+	} `json:"header"`
+	Objects []struct {
+		RelativeID       uint32 `json:"relativeId"` //id of object minus the minimal id of the group
+		DescriptorDigest string `json:"descriptorDigest"`
+		ObjectDigest     string `json:"objectDigest"`
+	} `json:"objects"`
+}
+
+//SifSignature is the result of verifying one signature object of SIF
+type SifSignature struct {
+	ID          uint32   //id of signature object
+	Fingerprint string   //fingerprint of signing key, the one recorded inside signature object is used if the key is unknown
+	Signer      string   //identity of signing key, it is empty if the key is not inside keyring
+	Objects     []uint32 //ids of data objects covered by signature
+	Partitions  []string //covered data objects in the form of "id(fstype parttype)" or "id(datatype)"
+	Err         *Error   //nil means verified, ErrMismatch means the image is tampered, ErrNExist means the key is unknown and nothing is verified,
+	//ErrType means the format of signature is not supported
+}
+
+//DefaultKeyrings returns the public keyrings of apptainer and singularity inside home folder
+func DefaultKeyrings() []string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil
+	}
+	return []string{
+		filepath.Join(home, ".apptainer", "keys", "pgp-public"),
+		filepath.Join(home, ".singularity", "sypgp", "pgp-public"),
+	}
+}
+
+//LoadKeyring reads public keys from files, both binary and armored keyrings are accepted and files not existing are skipped
+func LoadKeyring(files []string) (openpgp.EntityList, *Error) {
+	var keyring openpgp.EntityList
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			cerr := ErrNew(err, fmt.Sprintf("could not read keyring: %s", file))
+			return nil, cerr
+		}
+		if len(bytes.TrimSpace(data)) == 0 {
+			continue
+		}
+		keys, kerr := openpgp.ReadKeyRing(bytes.NewReader(data))
+		if kerr != nil {
+			keys, kerr = openpgp.ReadArmoredKeyRing(bytes.NewReader(data))
+		}
+		if kerr != nil {
+			cerr := ErrNew(kerr, fmt.Sprintf("could not parse keyring: %s", file))
+			return nil, cerr
+		}
+		keyring = append(keyring, keys...)
+	}
+	return keyring, nil
+}
+
+//objectStr describes data object descr in the report of signatures
+func objectStr(descr *sif.Descriptor) string {
+	if descr.Datatype == sif.DataPartition {
+		fstype, _ := descr.GetFsType()
+		ptype, _ := descr.GetPartType()
+		return fmt.Sprintf("%d(%s %s)", descr.ID, fstypeStr(fstype), parttypeStr(ptype))
+	}
+	return fmt.Sprintf("%d(%s)", descr.ID, descr.Datatype.String())
+}
+
+//signedObjects returns the data objects covered by signature descr, it links either one object or a whole group
+func signedObjects(fimg *sif.FileImage, descr *sif.Descriptor) []*sif.Descriptor {
+	var descrs []*sif.Descriptor
+	for i, v := range fimg.DescrArr {
+		if !v.Used || v.Datatype == sif.DataSignature {
+			continue
+		}
+		if (descr.Link&sif.DescrGroupMask != 0 && v.Groupid == descr.Link) || v.ID == descr.Link {
+			descrs = append(descrs, &fimg.DescrArr[i])
+		}
+	}
+	return descrs
+}
+
+//objectsDigest returns the hex digest of the data of descrs concatenated in order
+func objectsDigest(fimg *sif.FileImage, descr *sif.Descriptor, descrs []*sif.Descriptor) (string, *Error) {
+	htype, herr := descr.GetHashType()
+	if herr != nil {
+		cerr := ErrNew(herr, fmt.Sprintf("could not read hash type of signature %d", descr.ID))
+		return "", cerr
+	}
+	var h hash.Hash
+	switch htype {
+	case sif.HashSHA256:
+		h = sha256.New()
+	case sif.HashSHA384:
+		h = sha512.New384()
+	case sif.HashSHA512:
+		h = sha512.New()
+	default:
+		cerr := ErrNew(ErrType, fmt.Sprintf("hash type %d of signature %d is not supported", htype, descr.ID))
+		return "", cerr
+	}
+	for _, v := range descrs {
+		r, err := descrReader(fimg, v)
+		if err != nil {
+			return "", err
+		}
+		if _, cerr := io.Copy(h, r); cerr != nil {
+			err := ErrNew(cerr, fmt.Sprintf("could not read data object %d", v.ID))
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+//digestMatches checks the data of r against digest in the form of "sha256:<hex>"
+func digestMatches(digest string, r io.Reader) (bool, *Error) {
+	kv := strings.SplitN(digest, ":", 2)
+	newHash, ok := sifDigests[kv[0]]
+	if len(kv) != 2 || !ok {
+		cerr := ErrNew(ErrType, fmt.Sprintf("digest %s of signed metadata is not supported", digest))
+		return false, cerr
+	}
+	value, err := hex.DecodeString(kv[1])
+	if err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("digest %s of signed metadata is malformed", digest))
+		return false, cerr
+	}
+	h := newHash()
+	if _, err := io.Copy(h, r); err != nil {
+		cerr := ErrNew(err, "could not read signed data")
+		return false, cerr
+	}
+	return bytes.Equal(h.Sum(nil), value), nil
+}
+
+//headerReader reads the fields of global header covered by signed metadata
+func headerReader(fimg *sif.FileImage) io.Reader {
+	return io.MultiReader(
+		bytes.NewReader(fimg.Header.Launch[:]),
+		bytes.NewReader(fimg.Header.Magic[:]),
+		bytes.NewReader(fimg.Header.Version[:]),
+		bytes.NewReader(fimg.Header.ID[:]),
+	)
+}
+
+//descrIntegrityReader reads the fields of descriptor covered by signed metadata, ids are relative to minId of the group
+func descrIntegrityReader(descr *sif.Descriptor, minId uint32) io.Reader {
+	var buf bytes.Buffer
+	for _, field := range []interface{}{descr.Datatype, descr.Used, descr.ID - minId, descr.Link, descr.Filelen, descr.Ctime, descr.UID, descr.Gid} {
+		binary.Write(&buf, binary.LittleEndian, field)
+	}
+	return io.MultiReader(&buf, bytes.NewReader(descr.Name[:]), bytes.NewReader(descr.Extra[:]))
+}
+
+//verifyMetadata checks descrs of the group signed by descr against the signed metadata
+func verifyMetadata(fimg *sif.FileImage, descr *sif.Descriptor, descrs []*sif.Descriptor, plaintext []byte) *Error {
+	var meta sifMetadata
+	if err := json.Unmarshal(plaintext, &meta); err != nil {
+		cerr := ErrNew(ErrType, fmt.Sprintf("metadata of signature %d is malformed: %s", descr.ID, err.Error()))
+		return cerr
+	}
+	if meta.Version != sifMetadataVersion {
+		cerr := ErrNew(ErrType, fmt.Sprintf("metadata version %d of signature %d is not supported", meta.Version, descr.ID))
+		return cerr
+	}
+
+	ok, err := digestMatches(meta.Header.Digest, headerReader(fimg))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		cerr := ErrNew(ErrMismatch, fmt.Sprintf("global header is modified after signed by signature %d", descr.ID))
+		return cerr
+	}
+
+	minId := descrs[0].ID
+	for _, v := range descrs {
+		if v.ID < minId {
+			minId = v.ID
+		}
+	}
+	//objects of the group should be exactly the signed ones
+	if len(meta.Objects) != len(descrs) {
+		cerr := ErrNew(ErrMismatch, fmt.Sprintf("data objects are added to or removed from the group after signed by signature %d", descr.ID))
+		return cerr
+	}
+	for _, v := range descrs {
+		found := false
+		for _, obj := range meta.Objects {
+			if obj.RelativeID != v.ID-minId {
+				continue
+			}
+			found = true
+			dok, err := digestMatches(obj.DescriptorDigest, descrIntegrityReader(v, minId))
+			if err != nil {
+				return err
+			}
+			r, err := descrReader(fimg, v)
+			if err != nil {
+				return err
+			}
+			ook, err := digestMatches(obj.ObjectDigest, r)
+			if err != nil {
+				return err
+			}
+			if !dok || !ook {
+				cerr := ErrNew(ErrMismatch, fmt.Sprintf("data object %s is modified after signed by signature %d", objectStr(v), descr.ID))
+				return cerr
+			}
+		}
+		if !found {
+			cerr := ErrNew(ErrMismatch, fmt.Sprintf("data object %s is not signed by signature %d", objectStr(v), descr.ID))
+			return cerr
+		}
+	}
+	return nil
+}
+
+//verifySignature checks signature descr against keyring, both the digest format of singularity before 3.6 and
+//the json metadata of singularity 3.6+ and apptainer are understood
+func verifySignature(fimg *sif.FileImage, descr *sif.Descriptor, keyring openpgp.EntityList) *SifSignature {
+	sig := &SifSignature{ID: descr.ID}
+	if entity, eerr := descr.GetEntityString(); eerr == nil {
+		sig.Fingerprint = entity
+	}
+	descrs := signedObjects(fimg, descr)
+	for _, v := range descrs {
+		sig.Objects = append(sig.Objects, v.ID)
+		sig.Partitions = append(sig.Partitions, objectStr(v))
+	}
+	if len(descrs) == 0 {
+		sig.Err = ErrNew(ErrNExist, fmt.Sprintf("signature %d does not link any data object", descr.ID))
+		return sig
+	}
+
+	r, err := descrReader(fimg, descr)
+	if err != nil {
+		sig.Err = err
+		return sig
+	}
+	data, rerr := ioutil.ReadAll(r)
+	if rerr != nil {
+		sig.Err = ErrNew(rerr, fmt.Sprintf("could not read signature %d", descr.ID))
+		return sig
+	}
+	//DSSE envelopes signed with sigstore keys are not clear signed messages
+	block, _ := clearsign.Decode(data)
+	if block == nil {
+		sig.Err = ErrNew(ErrType, fmt.Sprintf("signature %d is not a clear signed message, its format is not supported", descr.ID))
+		return sig
+	}
+	legacy := bytes.HasPrefix(bytes.TrimSpace(block.Plaintext), []byte(sifHashPrefix))
+	if !legacy && !bytes.HasPrefix(bytes.TrimSpace(block.Plaintext), []byte("{")) {
+		sig.Err = ErrNew(ErrType, fmt.Sprintf("format of signature %d is not supported", descr.ID))
+		return sig
+	}
+
+	//the digests inside message of unknown keys could be forged together with data, so they are not checked at all
+	signer, verr := openpgp.CheckDetachedSignature(keyring, bytes.NewReader(block.Bytes), block.ArmoredSignature.Body, nil)
+	if verr == pgperrors.ErrUnknownIssuer {
+		sig.Err = ErrNew(ErrNExist, fmt.Sprintf("key %s of signature %d is not inside keyring, signed data objects are not verified", sig.Fingerprint, descr.ID))
+		return sig
+	}
+	if verr != nil {
+		sig.Err = ErrNew(ErrMismatch, fmt.Sprintf("signature %d is invalid: %s", descr.ID, verr.Error()))
+		return sig
+	}
+	fingerprint := fmt.Sprintf("%X", signer.PrimaryKey.Fingerprint)
+	if sig.Fingerprint != "" && !strings.EqualFold(sig.Fingerprint, fingerprint) {
+		sig.Err = ErrNew(ErrMismatch, fmt.Sprintf("signature %d is made by %s rather than %s recorded inside descriptor", descr.ID, fingerprint, sig.Fingerprint))
+		return sig
+	}
+
+	if legacy {
+		digest, err := objectsDigest(fimg, descr, descrs)
+		if err != nil {
+			sig.Err = err
+			return sig
+		}
+		plaintext := strings.TrimSpace(string(block.Plaintext))
+		if !strings.EqualFold(strings.TrimSpace(strings.TrimPrefix(plaintext, sifHashPrefix)), digest) {
+			sig.Err = ErrNew(ErrMismatch, fmt.Sprintf("data objects %s are modified after signed by signature %d", strings.Join(sig.Partitions, ", "), descr.ID))
+			return sig
+		}
+	} else if err := verifyMetadata(fimg, descr, descrs, block.Plaintext); err != nil {
+		sig.Err = err
+		return sig
+	}
+	sig.Fingerprint = fingerprint
+	for name := range signer.Identities {
+		sig.Signer = name
+		break
+	}
+	return sig
+}
+
+//VerifySif verifies the signatures of sif file against keyring, nil is returned for unsigned images.
+//Failures of each signature are recorded in SifSignature.Err
+func VerifySif(file string, keyring openpgp.EntityList) ([]*SifSignature, *Error) {
+	fimg, err := loadSif(file)
+	if err != nil {
+		return nil, err
+	}
+	defer unloadSif(fimg)
+
+	var sigs []*SifSignature
+	for i, v := range fimg.DescrArr {
+		if v.Used && v.Datatype == sif.DataSignature {
+			sigs = append(sigs, verifySignature(fimg, &fimg.DescrArr[i], keyring))
+		}
+	}
+	return sigs, nil
+}
+
+//unsignedPartitions returns the partitions of sif file not covered by verified signatures
+func unsignedPartitions(file string, sigs []*SifSignature) ([]string, *Error) {
+	fimg, err := loadSif(file)
+	if err != nil {
+		return nil, err
+	}
+	defer unloadSif(fimg)
+
+	signed := make(map[uint32]bool)
+	for _, sig := range sigs {
+		for _, id := range sig.Objects {
+			if sig.Err == nil {
+				signed[id] = true
+			}
+		}
+	}
+	var parts []string
+	for i, v := range fimg.DescrArr {
+		if v.Used && v.Datatype == sif.DataPartition && !signed[v.ID] {
+			parts = append(parts, objectStr(&fimg.DescrArr[i]))
+		}
+	}
+	return parts, nil
+}
+
+//CheckSifSignatures verifies sif file according to mode(VERIFY_AUTO, VERIFY_REQUIRE or VERIFY_SKIP) and reports the signers.
+//keyrings are the files of public keys, DefaultKeyrings are used if it is empty
+func CheckSifSignatures(file string, mode int, keyrings []string) *Error {
+	if mode == VERIFY_SKIP {
+		LOGGER.WithFields(logrus.Fields{
+			"file": file,
+		}).Warn("signatures of sif are not verified")
+		return nil
+	}
+	if len(keyrings) == 0 {
+		keyrings = DefaultKeyrings()
+	}
+	keyring, err := LoadKeyring(keyrings)
+	if err != nil {
+		return err
+	}
+	sigs, err := VerifySif(file, keyring)
+	if err != nil {
+		return err
+	}
+
+	var unverified []string
+	for _, sig := range sigs {
+		fields := logrus.Fields{
+			"signature":   sig.ID,
+			"fingerprint": sig.Fingerprint,
+			"partitions":  strings.Join(sig.Partitions, ", "),
+		}
+		if sig.Err == nil {
+			fields["signer"] = sig.Signer
+			LOGGER.WithFields(fields).Info("signature of sif is verified")
+			continue
+		}
+		switch sig.Err.Err {
+		case ErrMismatch:
+			sig.Err.AddMsg(fmt.Sprintf("%s is tampered, use --no-verify to load it anyway", file))
+			return sig.Err
+		case ErrNExist:
+			LOGGER.WithFields(fields).Warn(sig.Err.Error())
+			unverified = append(unverified, fmt.Sprintf("signature %d", sig.ID))
+		default:
+			//signatures which could not be checked might hide tampered images
+			sig.Err.AddMsg(fmt.Sprintf("signature %d of %s could not be checked, use --no-verify to load it anyway", sig.ID, file))
+			return sig.Err
+		}
+	}
+
+	unsigned, err := unsignedPartitions(file, sigs)
+	if err != nil {
+		return err
+	}
+	if len(unsigned) > 0 {
+		LOGGER.WithFields(logrus.Fields{
+			"file":       file,
+			"partitions": strings.Join(unsigned, ", "),
+		}).Warn("partitions of sif are not covered by verified signatures")
+	}
+	if mode == VERIFY_REQUIRE && (len(sigs) == 0 || len(unverified) > 0 || len(unsigned) > 0) {
+		cerr := ErrNew(ErrStatus, fmt.Sprintf("%s is not fully signed by the keys inside %s", file, strings.Join(keyrings, ", ")))
+		return cerr
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package singularity
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/JasonYangShadow/lpmx/error"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+	"github.com/stretchr/testify/assert"
+	sif "github.com/sylabs/sif/pkg/sif"
+)
+
+//signSif adds the signature of data objects linked by link to sif file in the way singularity before 3.6 does
+func signSif(t *testing.T, file string, entity *openpgp.Entity, link uint32) {
+	fimg, err := sif.LoadContainer(file, false)
+	assert.Nil(t, err)
+	defer fimg.UnloadContainer()
+
+	data, err := ioutil.ReadFile(file)
+	assert.Nil(t, err)
+	h := sha512.New384()
+	for _, v := range fimg.DescrArr {
+		if v.Used && v.Datatype != sif.DataSignature && (v.ID == link || v.Groupid == link) {
+			h.Write(data[v.Fileoff : v.Fileoff+v.Filelen])
+		}
+	}
+	var msg bytes.Buffer
+	w, err := clearsign.Encode(&msg, entity.PrivateKey, nil)
+	assert.Nil(t, err)
+	fmt.Fprintf(w, "%s\n%x", sifHashPrefix, h.Sum(nil))
+	assert.Nil(t, w.Close())
+
+	input := sif.DescriptorInput{
+		Datatype: sif.DataSignature,
+		Groupid:  sif.DescrUnusedGroup,
+		Link:     link,
+		Size:     int64(msg.Len()),
+		Data:     msg.Bytes(),
+	}
+	assert.Nil(t, input.SetSignExtra(sif.HashSHA384, fmt.Sprintf("%X", entity.PrimaryKey.Fingerprint)))
+	assert.Nil(t, fimg.AddObject(input))
+}
+
+func TestVerifySif(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "lpmx-verify")
+	defer os.RemoveAll(dir)
+	entity, err := openpgp.NewEntity("lpmx test", "", "test@lpmx", &packet.Config{RSABits: 1024})
+	assert.Nil(t, err)
+	fingerprint := fmt.Sprintf("%X", entity.PrimaryKey.Fingerprint)
+	keyring := filepath.Join(dir, "pgp-public")
+	f, _ := os.Create(keyring)
+	assert.Nil(t, entity.Serialize(f))
+	f.Close()
+	//armored keys exported by gpg are accepted as well
+	armored := filepath.Join(dir, "key.asc")
+	f, _ = os.Create(armored)
+	aw, _ := armor.Encode(f, openpgp.PublicKeyType, nil)
+	assert.Nil(t, entity.Serialize(aw))
+	aw.Close()
+	f.Close()
+	missing := []string{filepath.Join(dir, "missing")}
+
+	//unsigned images are loaded unless signatures are required
+	file := createTestSif(t, dir)
+	keys, kerr := LoadKeyring([]string{keyring})
+	assert.Nil(t, kerr)
+	sigs, kerr := VerifySif(file, keys)
+	assert.Nil(t, kerr)
+	assert.Empty(t, sigs)
+	assert.Nil(t, CheckSifSignatures(file, VERIFY_AUTO, []string{keyring}))
+	assert.NotNil(t, CheckSifSignatures(file, VERIFY_REQUIRE, []string{keyring}))
+
+	//signature of primary partition only leaves the other partitions unsigned
+	fimg, _ := loadSif(file)
+	primary, _ := primaryPartition(fimg)
+	primaryId := primary.ID
+	unloadSif(fimg)
+	signSif(t, file, entity, primaryId)
+	sigs, kerr = VerifySif(file, keys)
+	assert.Nil(t, kerr)
+	assert.Equal(t, 1, len(sigs))
+	assert.Nil(t, sigs[0].Err)
+	assert.Equal(t, fingerprint, sigs[0].Fingerprint)
+	assert.Equal(t, "lpmx test <test@lpmx>", sigs[0].Signer)
+	assert.Equal(t, []uint32{primaryId}, sigs[0].Objects)
+	assert.Equal(t, []string{fmt.Sprintf("%d(Squashfs *System)", primaryId)}, sigs[0].Partitions)
+	assert.Nil(t, CheckSifSignatures(file, VERIFY_AUTO, []string{keyring}))
+	assert.NotNil(t, CheckSifSignatures(file, VERIFY_REQUIRE, []string{keyring}))
+
+	//group signature covers all partitions and data objects
+	signSif(t, file, entity, sif.DescrDefaultGroup)
+	keys, kerr = LoadKeyring([]string{armored})
+	assert.Nil(t, kerr)
+	sigs, kerr = VerifySif(file, keys)
+	assert.Nil(t, kerr)
+	assert.Equal(t, 2, len(sigs))
+	assert.Nil(t, sigs[1].Err)
+	assert.Equal(t, 6, len(sigs[1].Objects))
+	assert.Nil(t, CheckSifSignatures(file, VERIFY_REQUIRE, []string{armored}))
+
+	//signers not inside keyring are reported but nothing is verified
+	keys, kerr = LoadKeyring(missing)
+	assert.Nil(t, kerr)
+	sigs, kerr = VerifySif(file, keys)
+	assert.Nil(t, kerr)
+	assert.Equal(t, ErrNExist, sigs[0].Err.Err)
+	assert.Equal(t, fingerprint, sigs[0].Fingerprint)
+	assert.Nil(t, CheckSifSignatures(file, VERIFY_AUTO, missing))
+	assert.NotNil(t, CheckSifSignatures(file, VERIFY_REQUIRE, missing))
+
+	//modifying signed partition is detected by trusted signatures
+	data, _ := ioutil.ReadFile(file)
+	fimg, _ = loadSif(file)
+	primary, _ = primaryPartition(fimg)
+	data[primary.Fileoff+primary.Filelen-1] ^= 0xff
+	unloadSif(fimg)
+	assert.Nil(t, ioutil.WriteFile(file, data, 0644))
+	keys, _ = LoadKeyring([]string{keyring})
+	sigs, kerr = VerifySif(file, keys)
+	assert.Nil(t, kerr)
+	assert.Equal(t, ErrMismatch, sigs[0].Err.Err)
+	cerr := CheckSifSignatures(file, VERIFY_AUTO, []string{keyring})
+	assert.NotNil(t, cerr)
+	assert.Equal(t, ErrMismatch, cerr.Err)
+	assert.Nil(t, CheckSifSignatures(file, VERIFY_SKIP, []string{keyring}))
+	//while signatures of unknown keys could be forged together with the data, so they only stay unverified
+	sigs, kerr = VerifySif(file, nil)
+	assert.Nil(t, kerr)
+	assert.Equal(t, ErrNExist, sigs[0].Err.Err)
+}
+
+//copyFixture copies the file inside testdata into dir
+func copyFixture(t *testing.T, dir, name string) string {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	assert.Nil(t, err)
+	file := filepath.Join(dir, name)
+	assert.Nil(t, ioutil.WriteFile(file, data, 0644))
+	return file
+}
+
+func TestVerifySifMetadata(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "lpmx-verify")
+	defer os.RemoveAll(dir)
+	//images and the key are the test data of github.com/sylabs/sif, signed the way singularity 3.6+ and apptainer do
+	keyring := []string{"testdata/sylabs-sif-test.asc"}
+	keys, kerr := LoadKeyring(keyring)
+	assert.Nil(t, kerr)
+
+	file := copyFixture(t, dir, "one-group-signed-pgp.sif")
+	sigs, kerr := VerifySif(file, keys)
+	assert.Nil(t, kerr)
+	assert.Equal(t, 1, len(sigs))
+	assert.Nil(t, sigs[0].Err)
+	assert.Equal(t, []uint32{1, 2}, sigs[0].Objects)
+	assert.NotEmpty(t, sigs[0].Signer)
+	assert.Nil(t, CheckSifSignatures(file, VERIFY_REQUIRE, keyring))
+
+	fimg, err := loadSif(file)
+	assert.Nil(t, err)
+	descr := fimg.DescrArr[0]
+	//name of the first descriptor follows its fixed size fields
+	name := fimg.Header.Descroff + 73
+	unloadSif(fimg)
+	data, _ := ioutil.ReadFile(file)
+	modify := func(off int64) {
+		tampered := append([]byte{}, data...)
+		tampered[off] ^= 0xff
+		assert.Nil(t, ioutil.WriteFile(file, tampered, 0644))
+	}
+	//data, descriptors and global header are all covered
+	for _, off := range []int64{descr.Fileoff, descr.Fileoff + descr.Filelen - 1, name, 0} {
+		modify(off)
+		sigs, kerr = VerifySif(file, keys)
+		assert.Nil(t, kerr)
+		assert.Equal(t, ErrMismatch, sigs[0].Err.Err)
+		err := CheckSifSignatures(file, VERIFY_AUTO, keyring)
+		assert.NotNil(t, err)
+		assert.Equal(t, ErrMismatch, err.Err)
+	}
+
+	//unsupported formats are refused unless verification is skipped
+	file = copyFixture(t, dir, "one-group-signed-dsse.sif")
+	sigs, kerr = VerifySif(file, keys)
+	assert.Nil(t, kerr)
+	assert.Equal(t, ErrType, sigs[0].Err.Err)
+	err = CheckSifSignatures(file, VERIFY_AUTO, keyring)
+	assert.NotNil(t, err)
+	assert.Equal(t, ErrType, err.Err)
+	assert.Nil(t, CheckSifSignatures(file, VERIFY_SKIP, keyring))
+}
@@ -0,0 +1,150 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+
+	. "github.com/JasonYangShadow/lpmx/error"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	COMPRESSION_NONE = "none" //plain tar
+	COMPRESSION_GZIP = "gzip"
+	COMPRESSION_ZSTD = "zstd"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+//DetectCompression tells the compression of stream by its leading bytes, anything unknown is treated as plain tar
+func DetectCompression(magic []byte) string {
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return COMPRESSION_GZIP
+	case bytes.HasPrefix(magic, zstdMagic):
+		return COMPRESSION_ZSTD
+	default:
+		return COMPRESSION_NONE
+	}
+}
+
+//CompressionExtension returns the file extension of tarball compressed with compression
+func CompressionExtension(compression string) string {
+	switch compression {
+	case COMPRESSION_ZSTD:
+		return ".tar.zst"
+	case COMPRESSION_NONE:
+		return ".tar"
+	default:
+		return ".tar.gz"
+	}
+}
+
+//FileCompression detects the compression of file by its leading bytes
+func FileCompression(file string) (string, *Error) {
+	f, err := os.Open(file)
+	if err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("could not open %s", file))
+		return "", cerr
+	}
+	defer f.Close()
+	magic := make([]byte, len(zstdMagic))
+	n, _ := io.ReadFull(f, magic)
+	return DetectCompression(magic[:n]), nil
+}
+
+//readCloser closes the decompressor and then the underlying file
+type readCloser struct {
+	io.Reader
+	closers []func() error
+}
+
+func (r *readCloser) Close() error {
+	var err error
+	for _, close := range r.closers {
+		if cerr := close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+//Decompress detects the compression of r and returns the decompressed stream together with the detected compression
+func Decompress(r io.Reader) (io.ReadCloser, string, *Error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(len(zstdMagic))
+	compression := DetectCompression(magic)
+	switch compression {
+	case COMPRESSION_GZIP:
+		gzr, err := gzip.NewReader(br)
+		if err != nil {
+			cerr := ErrNew(err, "could not read gzip stream")
+			return nil, compression, cerr
+		}
+		return gzr, compression, nil
+	case COMPRESSION_ZSTD:
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			cerr := ErrNew(err, "could not read zstd stream")
+			return nil, compression, cerr
+		}
+		return &readCloser{Reader: zr, closers: []func() error{func() error { zr.Close(); return nil }}}, compression, nil
+	default:
+		return io.NopCloser(br), compression, nil
+	}
+}
+
+//OpenTar opens tarball file(plain, gzip or zstd compressed) and returns the uncompressed tar stream
+func OpenTar(file string) (io.ReadCloser, string, *Error) {
+	if !FileExist(file) {
+		cerr := ErrNew(ErrNExist, fmt.Sprintf("file %s does not exist", file))
+		return nil, "", cerr
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		cerr := ErrNew(ErrFileIO, fmt.Sprintf("open file %s failure", file))
+		return nil, "", cerr
+	}
+	r, compression, cerr := Decompress(f)
+	if cerr != nil {
+		f.Close()
+		cerr.AddMsg(fmt.Sprintf("could not open tarball %s", file))
+		return nil, compression, cerr
+	}
+	return &readCloser{Reader: r, closers: []func() error{r.Close, f.Close}}, compression, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+//Compress wraps w with the compressor of compression, the returned writer should be closed to flush the stream, w is not closed
+func Compress(w io.Writer, compression string) (io.WriteCloser, *Error) {
+	switch compression {
+	case COMPRESSION_GZIP, "":
+		return gzip.NewWriter(w), nil
+	case COMPRESSION_ZSTD:
+		zw, err := zstd.NewWriter(w)
+		if err != nil {
+			cerr := ErrNew(err, "could not create zstd writer")
+			return nil, cerr
+		}
+		return zw, nil
+	case COMPRESSION_NONE:
+		return nopWriteCloser{w}, nil
+	default:
+		cerr := ErrNew(ErrType, fmt.Sprintf("compression %s is not supported, should be one of %s, %s and %s", compression, COMPRESSION_GZIP, COMPRESSION_ZSTD, COMPRESSION_NONE))
+		return nil, cerr
+	}
+}
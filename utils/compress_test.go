@@ -0,0 +1,51 @@
+package utils
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompressionExtension(t *testing.T) {
+	assert.Equal(t, ".tar.gz", CompressionExtension(COMPRESSION_GZIP))
+	assert.Equal(t, ".tar.zst", CompressionExtension(COMPRESSION_ZSTD))
+	assert.Equal(t, ".tar", CompressionExtension(COMPRESSION_NONE))
+}
+
+func TestCompressRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+	root := newLayerRoot(t)
+	layer := buildLayer(t, dir("etc"), file("etc/hostname", "lpmx")).Bytes()
+
+	for _, compression := range []string{COMPRESSION_NONE, COMPRESSION_GZIP, COMPRESSION_ZSTD} {
+		var buf bytes.Buffer
+		w, err := Compress(&buf, compression)
+		assert.Nil(err)
+		w.Write(layer)
+		w.Close()
+		assert.Equal(compression, DetectCompression(buf.Bytes()))
+
+		//blobs are named by digest, compression is detected from the content
+		tarball := filepath.Join(root, "blob-"+compression)
+		ioutil.WriteFile(tarball, buf.Bytes(), 0644)
+		detected, err := FileCompression(tarball)
+		assert.Nil(err)
+		assert.Equal(compression, detected)
+
+		folder := filepath.Join(root, compression)
+		assert.Nil(UntarLayer(tarball, folder), compression)
+		data, _ := ioutil.ReadFile(filepath.Join(folder, "etc/hostname"))
+		assert.Equal("lpmx", string(data), compression)
+
+		folder = filepath.Join(root, "untar-"+compression)
+		assert.Nil(Untar(tarball, folder), compression)
+		data, _ = ioutil.ReadFile(filepath.Join(folder, "etc/hostname"))
+		assert.Equal("lpmx", string(data), compression)
+	}
+
+	_, err := Compress(&bytes.Buffer{}, "xz")
+	assert.NotNil(err)
+}
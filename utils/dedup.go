@@ -0,0 +1,168 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	. "github.com/JasonYangShadow/lpmx/error"
+)
+
+//DedupStats summarises the work done on a folder by DedupFolder
+type DedupStats struct {
+	Files  int   //regular files inspected
+	Linked int   //files replaced with hardlinks of existing objects
+	Saved  int64 //bytes no longer stored twice
+}
+
+//DiskUsage is the usage of a folder, apparent size counts hardlinks every time while actual size counts each inode once
+type DiskUsage struct {
+	Files    int
+	Apparent int64
+	Actual   int64
+}
+
+//ObjectPath returns where the content with hash and permission perm is kept inside store.
+//Hardlinks share the mode, so files with identical content but different permissions are different objects
+func ObjectPath(store, hash string, perm os.FileMode) string {
+	return filepath.Join(store, hash[:2], fmt.Sprintf("%s-%04o", hash, perm))
+}
+
+func hashFile(file string) (string, *Error) {
+	f, err := os.Open(file)
+	if err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("could not open %s", file))
+		return "", cerr
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("could not read %s", file))
+		return "", cerr
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func linkCount(fi os.FileInfo) uint64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Nlink)
+	}
+	return 1
+}
+
+//DedupFolder keys the contents of regular files inside folder by hash inside store and replaces duplicates with hardlinks of the stored objects.
+//Files already having several links are skipped, as they are either deduplicated before or hardlinks of the layer itself.
+//Files which could not be hardlinked, e.g, store locates on another file system, are kept as they are
+func DedupFolder(folder, store string) (*DedupStats, *Error) {
+	stats := new(DedupStats)
+	err := filepath.Walk(folder, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() || fi.Size() == 0 || linkCount(fi) > 1 {
+			return nil
+		}
+		stats.Files++
+
+		hash, cerr := hashFile(file)
+		if cerr != nil {
+			return cerr
+		}
+		object := ObjectPath(store, hash, fi.Mode().Perm())
+		if !FileExist(object) {
+			if err := os.MkdirAll(filepath.Dir(object), 0755); err != nil {
+				return err
+			}
+			//the first file becomes the object itself
+			os.Link(file, object)
+			return nil
+		}
+
+		temp := file + ".lpmx-dedup"
+		if err := os.Link(object, temp); err != nil {
+			return nil
+		}
+		if err := os.Rename(temp, file); err != nil {
+			os.Remove(temp)
+			return err
+		}
+		stats.Linked++
+		stats.Saved += fi.Size()
+		return nil
+	})
+	if err != nil {
+		if cerr, ok := err.(*Error); ok {
+			return stats, cerr
+		}
+		cerr := ErrNew(err, fmt.Sprintf("could not deduplicate %s", folder))
+		return stats, cerr
+	}
+	return stats, nil
+}
+
+//GCObjects removes the objects of store which are not linked by any layer any longer, it returns the number of removed objects and freed bytes
+func GCObjects(store string) (int, int64, *Error) {
+	if !FolderExist(store) {
+		return 0, 0, nil
+	}
+	removed := 0
+	var freed int64
+	err := filepath.Walk(store, func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !fi.Mode().IsRegular() || linkCount(fi) > 1 {
+			return nil
+		}
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+		removed++
+		freed += fi.Size()
+		return nil
+	})
+	if err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("could not collect garbage of %s", store))
+		return removed, freed, cerr
+	}
+	return removed, freed, nil
+}
+
+//GetDiskUsage calculates usage of folders together, inodes shared among them are counted once by actual size
+func GetDiskUsage(folders ...string) (*DiskUsage, *Error) {
+	usage := new(DiskUsage)
+	seen := make(map[[2]uint64]bool)
+	for _, folder := range folders {
+		if !FolderExist(folder) {
+			continue
+		}
+		err := filepath.Walk(folder, func(file string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !fi.Mode().IsRegular() {
+				return nil
+			}
+			usage.Files++
+			usage.Apparent += fi.Size()
+			if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+				key := [2]uint64{uint64(st.Dev), uint64(st.Ino)}
+				if seen[key] {
+					return nil
+				}
+				seen[key] = true
+			}
+			usage.Actual += fi.Size()
+			return nil
+		})
+		if err != nil {
+			cerr := ErrNew(err, fmt.Sprintf("could not calculate disk usage of %s", folder))
+			return nil, cerr
+		}
+	}
+	return usage, nil
+}
@@ -0,0 +1,59 @@
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDedupFolder(t *testing.T) {
+	assert := assert.New(t)
+	root := newLayerRoot(t)
+	store := filepath.Join(root, "objects")
+	layer1 := filepath.Join(root, "layer1")
+	layer2 := filepath.Join(root, "layer2")
+	for _, layer := range []string{layer1, layer2} {
+		os.MkdirAll(filepath.Join(layer, "lib"), 0755)
+		ioutil.WriteFile(filepath.Join(layer, "lib/libc.so"), []byte("libc"), 0755)
+		ioutil.WriteFile(filepath.Join(layer, "lib/empty"), nil, 0644)
+	}
+	//same content but different permission should not be shared
+	ioutil.WriteFile(filepath.Join(layer2, "libc.copy"), []byte("libc"), 0644)
+
+	stats, err := DedupFolder(layer1, store)
+	assert.Nil(err)
+	assert.Equal(1, stats.Files)
+	assert.Equal(0, stats.Linked)
+
+	stats, err = DedupFolder(layer2, store)
+	assert.Nil(err)
+	assert.Equal(2, stats.Files)
+	assert.Equal(1, stats.Linked)
+	assert.Equal(int64(4), stats.Saved)
+
+	fi1, _ := os.Stat(filepath.Join(layer1, "lib/libc.so"))
+	fi2, _ := os.Stat(filepath.Join(layer2, "lib/libc.so"))
+	fi3, _ := os.Stat(filepath.Join(layer2, "libc.copy"))
+	assert.True(os.SameFile(fi1, fi2))
+	assert.False(os.SameFile(fi1, fi3))
+	assert.Equal(os.FileMode(0755), fi2.Mode().Perm())
+
+	usage, err := GetDiskUsage(layer1, layer2, store)
+	assert.Nil(err)
+	assert.Equal(int64(4*5), usage.Apparent)
+	assert.Equal(int64(4*2), usage.Actual)
+
+	//objects are released once no layer links them
+	os.RemoveAll(layer2)
+	removed, freed, err := GCObjects(store)
+	assert.Nil(err)
+	assert.Equal(1, removed)
+	assert.Equal(int64(4), freed)
+	os.RemoveAll(layer1)
+	removed, _, err = GCObjects(store)
+	assert.Nil(err)
+	assert.Equal(1, removed)
+}
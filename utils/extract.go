@@ -0,0 +1,138 @@
+package utils
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/JasonYangShadow/lpmx/error"
+)
+
+var (
+	//SAFE_EXTRACT makes Untar and UntarLayer reject entries escaping the destination folder and enforce the limits below
+	SAFE_EXTRACT = true
+	//EXTRACT_MAX_ENTRIES is the maximum number of entries of a single archive
+	EXTRACT_MAX_ENTRIES = 1 << 20
+	//EXTRACT_MAX_SIZE is the maximum total size of the files inside a single archive
+	EXTRACT_MAX_SIZE int64 = 64 << 30
+	//extractMaxSymlinks limits the symlinks followed while resolving a single path
+	extractMaxSymlinks = 40
+)
+
+//extractGuard validates the entries of an archive before they are extracted into dest
+type extractGuard struct {
+	dest     string
+	entries  int
+	size     int64
+	symlinks map[string]bool //symlinks created by the archive itself
+}
+
+func newExtractGuard(dest string) *extractGuard {
+	guard := new(extractGuard)
+	guard.dest = filepath.Clean(dest)
+	guard.symlinks = make(map[string]bool)
+	return guard
+}
+
+//target checks header against the limits and returns the path it should be extracted to
+func (g *extractGuard) target(header *tar.Header) (string, *Error) {
+	if !SAFE_EXTRACT {
+		return filepath.Join(g.dest, header.Name), nil
+	}
+
+	g.entries++
+	if g.entries > EXTRACT_MAX_ENTRIES {
+		cerr := ErrNew(ErrFull, fmt.Sprintf("archive contains more than %d entries, stopped at %s", EXTRACT_MAX_ENTRIES, header.Name))
+		return "", cerr
+	}
+	if header.Size < 0 {
+		cerr := ErrNew(ErrUnsafe, fmt.Sprintf("entry %s has negative size", header.Name))
+		return "", cerr
+	}
+	g.size += header.Size
+	if g.size > EXTRACT_MAX_SIZE {
+		cerr := ErrNew(ErrFull, fmt.Sprintf("archive is larger than %d bytes, stopped at %s", EXTRACT_MAX_SIZE, header.Name))
+		return "", cerr
+	}
+
+	target, cerr := g.path(header.Name)
+	if cerr != nil {
+		return "", cerr
+	}
+	if header.Typeflag == tar.TypeSymlink {
+		g.symlinks[target] = true
+	}
+	return target, nil
+}
+
+//link returns the path of hardlink target name, which is relative to the root of archive
+func (g *extractGuard) link(name string) (string, *Error) {
+	if !SAFE_EXTRACT {
+		return filepath.Join(g.dest, name), nil
+	}
+	return g.path(name)
+}
+
+//path rejects absolute paths and paths containing '..' escaping dest, its parent folders are resolved without following the symlinks created by the archive
+func (g *extractGuard) path(name string) (string, *Error) {
+	if strings.HasPrefix(name, "/") || filepath.IsAbs(name) {
+		cerr := ErrNew(ErrUnsafe, fmt.Sprintf("entry %s has absolute path", name))
+		return "", cerr
+	}
+	clean := filepath.Clean(name)
+	if clean == ".." || strings.HasPrefix(clean, "../") {
+		cerr := ErrNew(ErrUnsafe, fmt.Sprintf("entry %s escapes destination folder", name))
+		return "", cerr
+	}
+	if clean == "." {
+		return g.dest, nil
+	}
+
+	dir, cerr := g.resolve(filepath.Dir(clean), 0)
+	if cerr != nil {
+		cerr.AddMsg(fmt.Sprintf("refused to extract entry %s", name))
+		return "", cerr
+	}
+	return filepath.Join(dir, filepath.Base(clean)), nil
+}
+
+//resolve returns the real path of rel(relative to dest). Symlinks existing before extraction, e.g, the ones of lower layers,
+//are resolved as if dest was the root folder, so they never lead outside of it. Symlinks created by the archive are never followed
+func (g *extractGuard) resolve(rel string, hops int) (string, *Error) {
+	current := g.dest
+	parts := strings.Split(rel, string(os.PathSeparator))
+	for idx, part := range parts {
+		if part == "" || part == "." {
+			continue
+		}
+		next := filepath.Join(current, part)
+		fi, err := os.Lstat(next)
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			current = next
+			continue
+		}
+		if g.symlinks[next] {
+			cerr := ErrNew(ErrUnsafe, fmt.Sprintf("%s is a symlink created by the archive", strings.TrimPrefix(next, g.dest)))
+			return "", cerr
+		}
+		if hops >= extractMaxSymlinks {
+			cerr := ErrNew(ErrUnsafe, fmt.Sprintf("too many levels of symlinks while resolving %s", rel))
+			return "", cerr
+		}
+
+		link, err := os.Readlink(next)
+		if err != nil {
+			cerr := ErrNew(err, fmt.Sprintf("could not read symlink %s", next))
+			return "", cerr
+		}
+		if !filepath.IsAbs(link) {
+			link = filepath.Join(strings.TrimPrefix(current, g.dest), link)
+		}
+		//cleaning an absolute path drops the '..' beyond root, just like chroot does
+		remain := filepath.Clean("/" + filepath.Join(append([]string{link}, parts[idx+1:]...)...))
+		return g.resolve(strings.TrimPrefix(remain, "/"), hops+1)
+	}
+	return current, nil
+}
@@ -0,0 +1,130 @@
+package utils
+
+import (
+	"archive/tar"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/JasonYangShadow/lpmx/error"
+	"github.com/stretchr/testify/assert"
+)
+
+func symlink(name, linkname string) testEntry {
+	return testEntry{name: name, typeflag: tar.TypeSymlink, linkname: linkname}
+}
+
+func TestApplyLayerRejectsTraversal(t *testing.T) {
+	assert := assert.New(t)
+	parent := newLayerRoot(t)
+	root := filepath.Join(parent, "root")
+	os.Mkdir(root, 0755)
+
+	cases := map[string]*testEntry{
+		"absolute": &testEntry{name: filepath.Join(parent, "abs"), typeflag: tar.TypeReg, content: "x"},
+		"dotdot":   &testEntry{name: "a/../../escaped", typeflag: tar.TypeReg, content: "x"},
+		"hardlink": &testEntry{name: "link", typeflag: tar.TypeLink, linkname: "../outside"},
+	}
+	for name, entry := range cases {
+		_, err := ApplyLayer(buildLayer(t, *entry), root)
+		if assert.NotNil(err, name) {
+			assert.Equal(ErrUnsafe, err.Err, name)
+			assert.Contains(err.Error(), entry.name, "offending entry should be reported")
+		}
+	}
+	assert.False(FileExist(filepath.Join(parent, "abs")))
+	assert.False(FileExist(filepath.Join(parent, "escaped")))
+}
+
+func TestApplyLayerSymlinkEscape(t *testing.T) {
+	assert := assert.New(t)
+	parent := newLayerRoot(t)
+	root := filepath.Join(parent, "root")
+	os.Mkdir(root, 0755)
+
+	//symlink created by the archive is never followed
+	_, err := ApplyLayer(buildLayer(t, symlink("evil", ".."), file("evil/escaped", "x")), root)
+	if assert.NotNil(err) {
+		assert.Equal(ErrUnsafe, err.Err)
+		assert.Contains(err.Error(), "evil/escaped")
+	}
+	assert.False(FileExist(filepath.Join(parent, "escaped")))
+
+	//symlinks of lower layers are resolved inside root
+	os.Remove(filepath.Join(root, "evil"))
+	os.MkdirAll(filepath.Join(root, "usr/lib"), 0755)
+	os.Symlink("/usr/lib", filepath.Join(root, "lib"))
+	os.Symlink("../../../..", filepath.Join(root, "up"))
+	applyLayers(t, root, buildLayer(t, file("lib/libc.so", "libc"), file("up/escaped", "x")))
+	data, _ := ioutil.ReadFile(filepath.Join(root, "usr/lib/libc.so"))
+	assert.Equal("libc", string(data))
+	assert.True(FileExist(filepath.Join(root, "escaped")))
+	assert.False(FileExist(filepath.Join(parent, "escaped")))
+}
+
+func TestExtractLimits(t *testing.T) {
+	assert := assert.New(t)
+	root := newLayerRoot(t)
+
+	max_entries, max_size := EXTRACT_MAX_ENTRIES, EXTRACT_MAX_SIZE
+	defer func() {
+		EXTRACT_MAX_ENTRIES, EXTRACT_MAX_SIZE = max_entries, max_size
+	}()
+
+	EXTRACT_MAX_ENTRIES = 2
+	_, err := ApplyLayer(buildLayer(t, file("a", "a"), file("b", "b"), file("c", "c")), root)
+	if assert.NotNil(err) {
+		assert.Equal(ErrFull, err.Err)
+		assert.Contains(err.Error(), "c")
+	}
+
+	EXTRACT_MAX_ENTRIES = max_entries
+	EXTRACT_MAX_SIZE = 4
+	_, err = ApplyLayer(buildLayer(t, file("small", "abc"), file("large", "abcdef")), root)
+	if assert.NotNil(err) {
+		assert.Equal(ErrFull, err.Err)
+		assert.Contains(err.Error(), "large")
+	}
+}
+
+func TestUntarUnsafe(t *testing.T) {
+	assert := assert.New(t)
+	parent := newLayerRoot(t)
+	root := filepath.Join(parent, "root")
+	os.Mkdir(root, 0755)
+
+	tarball := filepath.Join(parent, "layer.tar")
+	layer := buildLayer(t, file("ok", "ok"), symlink("evil", ".."), file("evil/escaped", "x"))
+	ioutil.WriteFile(tarball, layer.Bytes(), 0644)
+
+	err := Untar(tarball, root)
+	if assert.NotNil(err) {
+		assert.Equal(ErrUnsafe, err.Err)
+		assert.Contains(err.Error(), "evil/escaped")
+	}
+	assert.True(FileExist(filepath.Join(root, "ok")))
+	assert.False(FileExist(filepath.Join(parent, "escaped")))
+
+	//hardlinks to bin/arch are copied, which must not read the host file behind a symlink of the archive
+	secret := filepath.Join(parent, "secret")
+	ioutil.WriteFile(secret, []byte("secret"), 0600)
+	layer = buildLayer(t, testEntry{name: "bin", typeflag: tar.TypeDir, mode: 0755}, symlink("bin/arch", secret), testEntry{name: "bin/ls", typeflag: tar.TypeLink, linkname: "bin/arch"})
+	ioutil.WriteFile(tarball, layer.Bytes(), 0644)
+	err = Untar(tarball, root)
+	if assert.NotNil(err) {
+		assert.Equal(ErrUnsafe, err.Err)
+		assert.Contains(err.Error(), "bin/ls")
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(root, "bin/ls"))
+	assert.NotEqual("secret", string(data))
+
+	//unsafe mode keeps the legacy behaviour
+	SAFE_EXTRACT = false
+	defer func() {
+		SAFE_EXTRACT = true
+	}()
+	ioutil.WriteFile(tarball, buildLayer(t, file("a/../b", "b")).Bytes(), 0644)
+	assert.Nil(Untar(tarball, root))
+	assert.True(FileExist(filepath.Join(root, "b")))
+}
@@ -0,0 +1,333 @@
+package utils
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/JasonYangShadow/lpmx/error"
+	. "github.com/JasonYangShadow/lpmx/log"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	WHITEOUT_PREFIX = ".wh."         //file .wh.name deletes name of lower layers
+	WHITEOUT_OPAQUE = ".wh..wh..opq" //directory containing it hides all contents of lower layers
+	LAYER_META      = ".meta"        //suffix of the file recording the attributes which could not be reproduced during extraction
+)
+
+//LayerEntryMeta records the attributes of a layer entry that unprivileged extraction could not reproduce,
+//e.g, owner, special mode bits, device nodes and xattrs(including capabilities), so that fakeroot could emulate them
+type LayerEntryMeta struct {
+	Path     string            `json:"path"` //path relative to the layer root, starting with /
+	Mode     int64             `json:"mode"` //mode recorded inside the layer
+	Uid      int               `json:"uid"`
+	Gid      int               `json:"gid"`
+	Device   string            `json:"device,omitempty"` //char, block or fifo, a placeholder regular file is created instead
+	Devmajor int64             `json:"devmajor,omitempty"`
+	Devminor int64             `json:"devminor,omitempty"`
+	Xattrs   map[string]string `json:"xattrs,omitempty"`
+}
+
+//layerApplier applies a single layer(OCI changeset) on top of the content of folder
+type layerApplier struct {
+	folder    string
+	guard     *extractGuard
+	written   map[string]bool //entries created by the current layer
+	ancestors map[string]bool //parent folders of entries created by the current layer
+	metas     []LayerEntryMeta
+}
+
+//ApplyLayer extracts the uncompressed layer tar stream on top of folder following OCI layer changeset semantics:
+//whiteouts delete files of lower layers, opaque whiteouts hide the contents of lower directories, hardlinks are resolved inside the layer
+//and device nodes are replaced with placeholders. Attributes that could not be reproduced are returned.
+//Entries escaping folder are rejected if SAFE_EXTRACT is enabled
+func ApplyLayer(r io.Reader, folder string) ([]LayerEntryMeta, *Error) {
+	applier := &layerApplier{
+		folder:    filepath.Clean(folder),
+		guard:     newExtractGuard(folder),
+		written:   make(map[string]bool),
+		ancestors: make(map[string]bool),
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return applier.metas, nil
+		}
+		if err != nil {
+			cerr := ErrNew(err, "reading tar header errors")
+			return nil, cerr
+		}
+		if cerr := applier.apply(header, tr); cerr != nil {
+			cerr.AddMsg(fmt.Sprintf("layer entry: %s", header.Name))
+			return nil, cerr
+		}
+	}
+}
+
+func (la *layerApplier) apply(header *tar.Header, tr *tar.Reader) *Error {
+	target, cerr := la.guard.target(header)
+	if cerr != nil {
+		return cerr
+	}
+	if target == la.folder {
+		return nil
+	}
+	dir, base := filepath.Split(target)
+	dir = filepath.Clean(dir)
+
+	//whiteouts are never extracted, they only remove contents of lower layers
+	if base == WHITEOUT_OPAQUE {
+		return la.clearOpaque(dir)
+	}
+	if strings.HasPrefix(base, WHITEOUT_PREFIX) {
+		name := strings.TrimPrefix(base, WHITEOUT_PREFIX)
+		if name == "" || name == "." || name == ".." {
+			cerr := ErrNew(ErrUnsafe, fmt.Sprintf("invalid whiteout %s", header.Name))
+			return cerr
+		}
+		deleted := filepath.Join(dir, name)
+		LOGGER.WithFields(logrus.Fields{
+			"file_to_delete":    deleted,
+			"wh_file_to_delete": target,
+		}).Debug("ApplyLayer whiteout deletion")
+		if err := os.RemoveAll(deleted); err != nil {
+			cerr := ErrNew(err, fmt.Sprintf("could not delete %s", deleted))
+			return cerr
+		}
+		return nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("untar making dir %s error", dir))
+		return cerr
+	}
+	//entries of upper layers replace the lower ones, except directories which are merged
+	if fi, err := os.Lstat(target); err == nil && !(fi.IsDir() && header.Typeflag == tar.TypeDir) {
+		if err := os.RemoveAll(target); err != nil {
+			cerr := ErrNew(err, fmt.Sprintf("could not replace %s", target))
+			return cerr
+		}
+	}
+
+	mode := header.FileInfo().Mode()
+	meta := LayerEntryMeta{
+		Path: "/" + strings.TrimPrefix(filepath.ToSlash(strings.TrimPrefix(target, la.folder)), "/"),
+		Mode: header.Mode,
+		Uid:  header.Uid,
+		Gid:  header.Gid,
+	}
+	record := header.Uid != 0 || header.Gid != 0 || mode&(os.ModeSetuid|os.ModeSetgid|os.ModeSticky) != 0
+	for key, value := range header.PAXRecords {
+		if strings.HasPrefix(key, "SCHILY.xattr.") {
+			if meta.Xattrs == nil {
+				meta.Xattrs = make(map[string]string)
+			}
+			meta.Xattrs[strings.TrimPrefix(key, "SCHILY.xattr.")] = value
+			record = true
+		}
+	}
+
+	switch header.Typeflag {
+	case tar.TypeDir:
+		if err := os.MkdirAll(target, 0755); err != nil {
+			cerr := ErrNew(err, "untar making dir error")
+			return cerr
+		}
+		//directories should always be accessible by the owner, otherwise extraction of their contents fails
+		if err := os.Chmod(target, mode.Perm()|0700); err != nil {
+			cerr := ErrNew(err, fmt.Sprintf("could not change mode of %s", target))
+			return cerr
+		}
+		record = record || mode.Perm()&0700 != 0700
+
+	case tar.TypeReg, tar.TypeRegA:
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+		if err != nil {
+			cerr := ErrNew(err, fmt.Sprintf("untar create file %s error", target))
+			return cerr
+		}
+		_, err = io.Copy(f, tr)
+		f.Close()
+		if err != nil {
+			cerr := ErrNew(err, "untar copying file content error")
+			return cerr
+		}
+		//the owner keeps read and write permission so that lpmx could clean it up, the original mode is recorded
+		if err := os.Chmod(target, mode.Perm()|0600); err != nil {
+			cerr := ErrNew(err, fmt.Sprintf("could not change mode of %s", target))
+			return cerr
+		}
+		os.Chtimes(target, header.ModTime, header.ModTime)
+		record = record || mode.Perm()&0600 != 0600
+
+	case tar.TypeSymlink:
+		if err := os.Symlink(header.Linkname, target); err != nil {
+			cerr := ErrNew(err, fmt.Sprintf("could not create symlink %s -> %s", target, header.Linkname))
+			return cerr
+		}
+
+	case tar.TypeLink:
+		//linkname of hardlink is the path of another entry inside the same layer
+		source, cerr := la.guard.link(header.Linkname)
+		if cerr != nil {
+			return cerr
+		}
+		if source != la.folder && !strings.HasPrefix(source, la.folder+string(os.PathSeparator)) {
+			cerr := ErrNew(ErrMismatch, fmt.Sprintf("hardlink %s points outside of the layer: %s", header.Name, header.Linkname))
+			return cerr
+		}
+		fi, err := os.Lstat(source)
+		if err != nil || !fi.Mode().IsRegular() {
+			cerr := ErrNew(ErrNExist, fmt.Sprintf("hardlink target %s is not a regular file of the layer", header.Linkname))
+			return cerr
+		}
+		if err := os.Link(source, target); err != nil {
+			//e.g, file systems not supporting hardlinks
+			if _, cerr := CopyFile(source, target); cerr != nil {
+				return cerr
+			}
+		}
+		//hardlinks share the attributes of their targets
+		record = false
+
+	case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+		//device nodes could not be created without privileges, an empty placeholder is created and the device is recorded
+		f, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+		if err != nil {
+			cerr := ErrNew(err, fmt.Sprintf("could not create placeholder %s", target))
+			return cerr
+		}
+		f.Close()
+		switch header.Typeflag {
+		case tar.TypeChar:
+			meta.Device = "char"
+		case tar.TypeBlock:
+			meta.Device = "block"
+		default:
+			meta.Device = "fifo"
+		}
+		meta.Devmajor = header.Devmajor
+		meta.Devminor = header.Devminor
+		record = true
+
+	default:
+		LOGGER.WithFields(logrus.Fields{
+			"name": header.Name,
+			"type": header.Typeflag,
+		}).Debug("ApplyLayer skips unsupported entry")
+		return nil
+	}
+
+	la.written[target] = true
+	for p := filepath.Dir(target); p != la.folder && strings.HasPrefix(p, la.folder); p = filepath.Dir(p) {
+		la.ancestors[p] = true
+	}
+	if record {
+		la.metas = append(la.metas, meta)
+	}
+	return nil
+}
+
+//clearOpaque removes the contents of dir coming from lower layers, entries created by the current layer are kept
+func (la *layerApplier) clearOpaque(dir string) *Error {
+	children, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		cerr := ErrNew(err, fmt.Sprintf("could not read dir %s", dir))
+		return cerr
+	}
+	for _, child := range children {
+		p := filepath.Join(dir, child.Name())
+		if la.written[p] || la.ancestors[p] {
+			if child.IsDir() {
+				if cerr := la.clearOpaque(p); cerr != nil {
+					return cerr
+				}
+			}
+			continue
+		}
+		if err := os.RemoveAll(p); err != nil {
+			cerr := ErrNew(err, fmt.Sprintf("could not delete %s", p))
+			return cerr
+		}
+	}
+	return nil
+}
+
+//UntarLayer applies layer tarball(plain, gzip or zstd compressed) on top of folder, see ApplyLayer.
+//Attributes which could not be reproduced are recorded inside folder.meta as json
+func UntarLayer(file string, folder string) *Error {
+	reader, _, cerr := OpenTar(file)
+	if cerr != nil {
+		return cerr
+	}
+	defer reader.Close()
+
+	metas, cerr := ApplyLayer(reader, folder)
+	if cerr != nil {
+		return cerr
+	}
+	return appendLayerMeta(fmt.Sprintf("%s%s", filepath.Clean(folder), LAYER_META), metas)
+}
+
+//appendLayerMeta merges metas into the meta file, entries of later layers override the earlier ones
+func appendLayerMeta(file string, metas []LayerEntryMeta) *Error {
+	if len(metas) == 0 {
+		return nil
+	}
+	existing, cerr := ReadLayerMeta(file)
+	if cerr != nil && cerr.Err != ErrNExist {
+		return cerr
+	}
+	index := make(map[string]int)
+	for i, meta := range existing {
+		index[meta.Path] = i
+	}
+	for _, meta := range metas {
+		if i, ok := index[meta.Path]; ok {
+			existing[i] = meta
+		} else {
+			index[meta.Path] = len(existing)
+			existing = append(existing, meta)
+		}
+	}
+	data, err := json.MarshalIndent(existing, "", "  ")
+	if err != nil {
+		cerr := ErrNew(err, "could not encode layer meta")
+		return cerr
+	}
+	if err := ioutil.WriteFile(file, data, 0644); err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("could not write %s", file))
+		return cerr
+	}
+	return nil
+}
+
+//ReadLayerMeta reads the attributes recorded by UntarLayer
+func ReadLayerMeta(file string) ([]LayerEntryMeta, *Error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			cerr := ErrNew(ErrNExist, fmt.Sprintf("%s does not exist", file))
+			return nil, cerr
+		}
+		cerr := ErrNew(err, fmt.Sprintf("could not read %s", file))
+		return nil, cerr
+	}
+	var metas []LayerEntryMeta
+	if err := json.Unmarshal(data, &metas); err != nil {
+		cerr := ErrNew(err, fmt.Sprintf("could not decode %s", file))
+		return nil, cerr
+	}
+	return metas, nil
+}
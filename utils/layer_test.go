@@ -0,0 +1,184 @@
+package utils
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+//testEntry describes an entry of synthetic layer tarball
+type testEntry struct {
+	name     string
+	typeflag byte
+	content  string
+	linkname string
+	mode     int64
+	uid      int
+	pax      map[string]string
+}
+
+func buildLayer(t *testing.T, entries ...testEntry) *bytes.Buffer {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		mode := e.mode
+		if mode == 0 {
+			mode = 0644
+			if e.typeflag == tar.TypeDir {
+				mode = 0755
+			}
+		}
+		header := &tar.Header{Name: e.name, Typeflag: e.typeflag, Linkname: e.linkname, Mode: mode, Uid: e.uid, Size: int64(len(e.content)), PAXRecords: e.pax}
+		if e.pax != nil {
+			header.Format = tar.FormatPAX
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(e.content))
+	}
+	tw.Close()
+	return &buf
+}
+
+func file(name, content string) testEntry {
+	return testEntry{name: name, typeflag: tar.TypeReg, content: content}
+}
+
+func dir(name string) testEntry {
+	return testEntry{name: name, typeflag: tar.TypeDir}
+}
+
+func newLayerRoot(t *testing.T) string {
+	root, err := ioutil.TempDir("", "lpmx-layer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		os.RemoveAll(root)
+	})
+	return root
+}
+
+func applyLayers(t *testing.T, root string, layers ...*bytes.Buffer) []LayerEntryMeta {
+	var metas []LayerEntryMeta
+	for _, layer := range layers {
+		m, err := ApplyLayer(layer, root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		metas = append(metas, m...)
+	}
+	return metas
+}
+
+func TestApplyLayerWhiteout(t *testing.T) {
+	root := newLayerRoot(t)
+	applyLayers(t, root,
+		buildLayer(t, dir("etc/"), file("etc/a", "a"), file("etc/b", "b"), dir("opt/"), dir("opt/tool/"), file("opt/tool/bin", "bin")),
+		buildLayer(t, file("etc/.wh.a", ""), file("opt/.wh.tool", "")),
+	)
+
+	assert.False(t, FileExist(filepath.Join(root, "etc/a")), "whiteout should delete lower file")
+	assert.True(t, FileExist(filepath.Join(root, "etc/b")))
+	assert.False(t, FolderExist(filepath.Join(root, "opt/tool")), "whiteout should delete lower directory")
+	assert.False(t, FileExist(filepath.Join(root, "etc/.wh.a")), "whiteout should not be extracted")
+}
+
+func TestApplyLayerOpaque(t *testing.T) {
+	root := newLayerRoot(t)
+	applyLayers(t, root,
+		buildLayer(t, dir("data/"), file("data/old", "old"), dir("data/sub/"), file("data/sub/old", "old")),
+		buildLayer(t, dir("data/"), file("data/new", "new"), dir("data/sub/"), file("data/sub/new", "new"), file("data/.wh..wh..opq", ""), file("data/after", "after")),
+	)
+
+	assert.False(t, FileExist(filepath.Join(root, "data/old")), "opaque directory should hide lower contents")
+	assert.False(t, FileExist(filepath.Join(root, "data/sub/old")), "opaque directory should hide lower contents recursively")
+	assert.True(t, FileExist(filepath.Join(root, "data/new")), "contents of the same layer should be kept")
+	assert.True(t, FileExist(filepath.Join(root, "data/sub/new")))
+	assert.True(t, FileExist(filepath.Join(root, "data/after")))
+	assert.False(t, FileExist(filepath.Join(root, "data/.wh..wh..opq")))
+}
+
+func TestApplyLayerHardlink(t *testing.T) {
+	root := newLayerRoot(t)
+	applyLayers(t, root, buildLayer(t, dir("bin/"), file("bin/busybox", "bb"), testEntry{name: "bin/sh", typeflag: tar.TypeLink, linkname: "bin/busybox"}))
+
+	data, _ := ioutil.ReadFile(filepath.Join(root, "bin/sh"))
+	assert.Equal(t, "bb", string(data))
+	fi1, _ := os.Stat(filepath.Join(root, "bin/busybox"))
+	fi2, _ := os.Stat(filepath.Join(root, "bin/sh"))
+	assert.True(t, os.SameFile(fi1, fi2), "hardlink should share the same inode")
+
+	_, err := ApplyLayer(buildLayer(t, testEntry{name: "escape", typeflag: tar.TypeLink, linkname: "../../etc/passwd"}), root)
+	assert.NotNil(t, err, "hardlink outside of layer should be rejected")
+	_, err = ApplyLayer(buildLayer(t, testEntry{name: "dangling", typeflag: tar.TypeLink, linkname: "missing"}), root)
+	assert.NotNil(t, err)
+}
+
+func TestApplyLayerReplace(t *testing.T) {
+	root := newLayerRoot(t)
+	outside := filepath.Join(newLayerRoot(t), "outside")
+	ioutil.WriteFile(outside, []byte("outside"), 0644)
+
+	applyLayers(t, root,
+		buildLayer(t, testEntry{name: "link", typeflag: tar.TypeSymlink, linkname: outside}, dir("path/"), file("path/f", "f")),
+		buildLayer(t, file("link", "upper"), file("path", "now a file")),
+	)
+	data, _ := ioutil.ReadFile(outside)
+	assert.Equal(t, "outside", string(data), "upper file should replace symlink rather than write through it")
+	data, _ = ioutil.ReadFile(filepath.Join(root, "link"))
+	assert.Equal(t, "upper", string(data))
+	data, _ = ioutil.ReadFile(filepath.Join(root, "path"))
+	assert.Equal(t, "now a file", string(data))
+}
+
+func TestApplyLayerMeta(t *testing.T) {
+	root := newLayerRoot(t)
+	metas := applyLayers(t, root, buildLayer(t,
+		dir("usr/"),
+		testEntry{name: "usr/exe", typeflag: tar.TypeReg, content: "x", mode: 0755},
+		testEntry{name: "usr/readonly", typeflag: tar.TypeReg, content: "r", mode: 0444},
+		testEntry{name: "usr/su", typeflag: tar.TypeReg, content: "s", mode: 04755},
+		testEntry{name: "usr/ping", typeflag: tar.TypeReg, content: "p", mode: 0755, pax: map[string]string{"SCHILY.xattr.security.capability": "cap"}},
+		testEntry{name: "usr/owned", typeflag: tar.TypeReg, content: "o", uid: 1000},
+		testEntry{name: "dev/null", typeflag: tar.TypeChar, mode: 0666},
+	))
+
+	fi, _ := os.Stat(filepath.Join(root, "usr/exe"))
+	assert.Equal(t, os.FileMode(0755), fi.Mode().Perm(), "mode should be kept")
+	fi, _ = os.Stat(filepath.Join(root, "usr/readonly"))
+	assert.Equal(t, os.FileMode(0644), fi.Mode().Perm(), "owner could always read and write")
+	fi, _ = os.Stat(filepath.Join(root, "dev/null"))
+	assert.True(t, fi.Mode().IsRegular(), "device should be replaced with placeholder")
+
+	recorded := make(map[string]LayerEntryMeta)
+	for _, meta := range metas {
+		recorded[meta.Path] = meta
+	}
+	assert.NotContains(t, recorded, "/usr/exe")
+	assert.Equal(t, int64(0444), recorded["/usr/readonly"].Mode)
+	assert.Equal(t, int64(04755), recorded["/usr/su"].Mode)
+	assert.Equal(t, "cap", recorded["/usr/ping"].Xattrs["security.capability"])
+	assert.Equal(t, 1000, recorded["/usr/owned"].Uid)
+	assert.Equal(t, "char", recorded["/dev/null"].Device)
+}
+
+func TestUntarLayerMetaFile(t *testing.T) {
+	root := newLayerRoot(t)
+	layer := filepath.Join(root, "layer.tar")
+	ioutil.WriteFile(layer, buildLayer(t, testEntry{name: "dev/zero", typeflag: tar.TypeChar, mode: 0666}).Bytes(), 0644)
+
+	folder := filepath.Join(root, "rootfs")
+	os.MkdirAll(folder, 0755)
+	assert.Nil(t, UntarLayer(layer, folder))
+	metas, err := ReadLayerMeta(folder + LAYER_META)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(metas))
+	assert.Equal(t, "/dev/zero", metas[0].Path)
+}
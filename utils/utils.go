@@ -41,6 +41,11 @@ const (
 	TYPE_OTHER
 )
 
+const (
+	//ENV_LPMX_HOME overrides the folder holding .lpmxsys/.lpmxdata, so that one lpmx binary could serve several data roots
+	ENV_LPMX_HOME = "LPMX_HOME"
+)
+
 var (
 	time_sleep    = 2
 	gdrive_prefix = "https://drive.google.com/file/d/"
@@ -436,6 +441,11 @@ func CopyFile(src string, dst string) (bool, *Error) {
 	return true, nil
 }
 
+//ShellQuote quotes s with single quotes, so that it is passed to sh -c as one word without expansion
+func ShellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'"'"'`, -1) + "'"
+}
+
 func RandomString(n int) string {
 	rand.Seed(time.Now().UnixNano())
 	var letter = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
@@ -644,12 +654,22 @@ func ConvertTar2Gzip(src_file, target_file string) *Error {
 
 //this tar function eliminate symlink
 func TarLayer(src_folder string, target_folder string, target_name string, layers []string) *Error {
+	return TarLayerExclude(src_folder, fmt.Sprintf("%s/%s%s", target_folder, target_name, CompressionExtension(COMPRESSION_GZIP)), nil)
+}
+
+//TarLayerExclude packs src_folder into gzip compressed tarball target_path, entry names are relative to src_folder.
+//excludes are paths relative to src_folder, e.g, /tmp, which are skipped together with their contents
+func TarLayerExclude(src_folder string, target_path string, excludes []string) *Error {
+	return TarLayerCompress(src_folder, target_path, excludes, COMPRESSION_GZIP)
+}
+
+//TarLayerCompress is the same as TarLayerExclude, but the tarball is compressed with compression(gzip, zstd or none)
+func TarLayerCompress(src_folder string, target_path string, excludes []string, compression string) *Error {
 	if !FolderExist(src_folder) {
 		cerr := ErrNew(ErrNExist, fmt.Sprintf("%s folder not exist", src_folder))
 		return cerr
 	}
 
-	target_path := fmt.Sprintf("%s/%s.tar.gz", target_folder, target_name)
 	file, ferr := os.Create(target_path)
 	if ferr != nil {
 		cerr := ErrNew(ferr, fmt.Sprintf("%s creating error", target_path))
@@ -658,12 +678,20 @@ func TarLayer(src_folder string, target_folder string, target_name string, layer
 	defer file.Close()
 
 	mw := io.Writer(file)
-	gzw := gzip.NewWriter(mw)
-	defer gzw.Close()
+	cw, cerr := Compress(mw, compression)
+	if cerr != nil {
+		return cerr
+	}
+	defer cw.Close()
 
-	tw := tar.NewWriter(gzw)
+	tw := tar.NewWriter(cw)
 	defer tw.Close()
 
+	skip := make(map[string]bool)
+	for _, exclude := range excludes {
+		skip["/"+strings.Trim(exclude, "/")] = true
+	}
+
 	err := filepath.Walk(src_folder, func(file string, fi os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -672,10 +700,18 @@ func TarLayer(src_folder string, target_folder string, target_name string, layer
 			return nil
 		}
 
+		name := strings.TrimPrefix(file, src_folder)
+		if skip[name] {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
 		//process symlink seperately
-		mode := fi.Mode()
-		if mode&os.ModeSymlink != 0 {
-			link, err := os.Readlink(file)
+		link := ""
+		if fi.Mode()&os.ModeSymlink != 0 {
+			link, err = os.Readlink(file)
 			if err != nil {
 				return err
 			}
@@ -684,23 +720,17 @@ func TarLayer(src_folder string, target_folder string, target_name string, layer
 				"link": link,
 				"file": file,
 			}).Debug("TarLayer symlink process")
-
-			header, err := tar.FileInfoHeader(fi, link)
-			if err != nil {
-				return err
-			}
-			header.Name = strings.TrimPrefix(file, src_folder)
-			if err := tw.WriteHeader(header); err != nil {
-				return err
-			}
 		}
 
-		header, err := tar.FileInfoHeader(fi, fi.Name())
+		header, err := tar.FileInfoHeader(fi, link)
 		if err != nil {
 			return err
 		}
 		//modify header's name
-		header.Name = strings.TrimPrefix(file, src_folder)
+		header.Name = strings.TrimPrefix(name, "/")
+		if fi.IsDir() {
+			header.Name += "/"
+		}
 		if err := tw.WriteHeader(header); err != nil {
 			return err
 		}
@@ -714,10 +744,10 @@ func TarLayer(src_folder string, target_folder string, target_name string, layer
 		if err != nil {
 			return err
 		}
+		defer f.Close()
 		if _, err := io.Copy(tw, f); err != nil {
 			return err
 		}
-		f.Close()
 		return nil
 	})
 	if err != nil {
@@ -728,38 +758,17 @@ func TarLayer(src_folder string, target_folder string, target_name string, layer
 
 }
 
-func UntarLayer(file string, folder string) *Error {
-	if !FileExist(file) {
-		cerr := ErrNew(ErrNExist, fmt.Sprintf("file %s does not exist", file))
-		return cerr
-	}
-
-	r, err := os.Open(file)
-	if err != nil {
-		cerr := ErrNew(ErrFileIO, fmt.Sprintf("open file %s failure", file))
+//Untar extracts tarball file into folder, compression(gzip, zstd or none) is detected by the content rather than the file extension
+func Untar(file string, folder string) *Error {
+	r, _, cerr := OpenTar(file)
+	if cerr != nil {
 		return cerr
 	}
 	defer r.Close()
+	tr := tar.NewReader(r)
 
-	var tr *tar.Reader
-	ext := filepath.Ext(file)
-	if strings.ToLower(ext) == ".tar" {
-		tr = tar.NewReader(r)
-	} else if strings.ToLower(ext) == ".gz" && filepath.Ext(strings.TrimSuffix(strings.ToLower(file), ".gz")) == ".tar" {
-		gzr, err := gzip.NewReader(r)
-		if err != nil {
-			cerr := ErrNew(err, fmt.Sprintf("gzip open file %s failure", file))
-			return cerr
-		}
-		defer gzr.Close()
-
-		tr = tar.NewReader(gzr)
-
-	} else {
-		cerr := ErrNew(ErrMismatch, fmt.Sprintf("%s file is neither tar.gz file nor tar file", file))
-		return cerr
-	}
-
+	//entries escaping folder are rejected if SAFE_EXTRACT is enabled
+	guard := newExtractGuard(folder)
 	for {
 		header, err := tr.Next()
 
@@ -778,166 +787,15 @@ func UntarLayer(file string, folder string) *Error {
 		if !strings.HasSuffix(folder, "/") {
 			folder = folder + "/"
 		}
-		target := filepath.Join(folder, header.Name)
-
-		switch header.Typeflag {
-
-		// if it's a dir and it doesn't exist create it
-		case tar.TypeDir:
-			if _, err := os.Stat(target); err != nil {
-				if err := os.MkdirAll(target, 0755); err != nil {
-					cerr := ErrNew(err, "untar making dir error")
-					return cerr
-				}
-			}
-
-		case tar.TypeReg:
-			t_file_mode := os.FileMode(header.Mode)
-			//here we check file mode, if file does not have at least rw mode, we change it
-			//fixing "permission denied" error on cluster
-			permission := permbits.FileMode(t_file_mode)
-			if !(permission.UserRead() && permission.UserWrite()) {
-				permission.SetUserRead(true)
-				permission.SetUserWrite(true)
-				permbits.UpdateFileMode(&t_file_mode, permission)
-			}
-
-			//check if the file is white-out file
-			if strings.HasPrefix(filepath.Base(target), ".wh") {
-				file_name := strings.TrimPrefix(filepath.Base(target), ".wh.")
-				file_to_delete := fmt.Sprintf("%s/%s", filepath.Dir(target), file_name)
-				LOGGER.WithFields(logrus.Fields{
-					"file_to_delete":    file_to_delete,
-					"wh_file_to_delete": target,
-				}).Debug("UntarLayer regular file deletion")
-				os.RemoveAll(file_to_delete)
-				//remove .wh file
-				os.RemoveAll(target)
-			} else {
-				//20200204 adds trucate option
-				f, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR|os.O_TRUNC, t_file_mode)
-				if err != nil {
-					cerr := ErrNew(err, fmt.Sprintf("untar create file %s error", target))
-					return cerr
-				}
-
-				// copy over contents
-				if _, err := io.Copy(f, tr); err != nil {
-					cerr := ErrNew(err, "untar copying file content error")
-					return cerr
-				}
-
-				f.Close()
-			}
-
-		case tar.TypeSymlink:
-			//if linkname is absolute path should be linked to the same layer
-			//target here is symlink, header.Linkname points the target to be linked.
-			//target -> header.Linkname
-
-			//os.Symlink(oldname <- to be linked, newname <- link)
-			//fmt.Printf("-----symlink---- %s, %s, %s\n", header.Linkname, folder, target)
-			if strings.HasPrefix(filepath.Base(target), ".wh") {
-				//remove Linkname
-				link_path := filepath.Join(folder, header.Linkname)
-				if strings.HasPrefix(filepath.Base(link_path), ".wh") {
-					file_name := strings.TrimPrefix(filepath.Base(link_path), ".wh.")
-					file_to_delete := fmt.Sprintf("%s/%s", filepath.Dir(link_path), file_name)
-					LOGGER.WithFields(logrus.Fields{
-						"file":         file_to_delete,
-						"wh_file":      link_path,
-						"orig_wh_file": target,
-					}).Debug("UntarLayer symlink file deletion")
-					//remove linked file
-					os.RemoveAll(file_to_delete)
-					//remove link itself
-					os.RemoveAll(link_path)
-				}
-				//remove link
-				os.RemoveAll(target)
-			} else {
-				os.Symlink(header.Linkname, target)
-			}
-
-			//we should avoid of creating hard link
-		case tar.TypeLink:
-			//fmt.Printf("-----hardlink---- %s, %s, %s\n", header.Linkname, folder, target)
-			//only works on linking to the file inside the same folder
-			if strings.HasPrefix(filepath.Base(target), ".wh") {
-				//remove Linkname
-				link_path := filepath.Join(folder, header.Linkname)
-				if strings.HasPrefix(filepath.Base(link_path), ".wh") {
-					file_name := strings.TrimPrefix(filepath.Base(link_path), ".wh.")
-					file_to_delete := fmt.Sprintf("%s/%s", filepath.Dir(link_path), file_name)
-					LOGGER.WithFields(logrus.Fields{
-						"file":         file_to_delete,
-						"wh_file":      link_path,
-						"orig_wh_file": target,
-					}).Debug("UntarLayer link file deletion")
-					//remove linked file
-					os.RemoveAll(file_to_delete)
-					//remove link itself
-					os.RemoveAll(link_path)
-				}
-				//remove link
-				os.RemoveAll(target)
-			} else {
-				os.Symlink(header.Linkname, target)
-			}
-		}
-	}
-}
-
-func Untar(file string, folder string) *Error {
-	if !FileExist(file) {
-		cerr := ErrNew(ErrNExist, fmt.Sprintf("file %s does not exist", file))
-		return cerr
-	}
-	r, err := os.Open(file)
-	if err != nil {
-		cerr := ErrNew(ErrFileIO, fmt.Sprintf("open file %s failure", file))
-		return cerr
-	}
-	defer r.Close()
-
-	var tr *tar.Reader
-	ext := filepath.Ext(file)
-	if strings.ToLower(ext) == ".tar" {
-		tr = tar.NewReader(r)
-	} else if strings.ToLower(ext) == ".gz" && filepath.Ext(strings.TrimSuffix(strings.ToLower(file), ".gz")) == ".tar" {
-		gzr, err := gzip.NewReader(r)
-		if err != nil {
-			cerr := ErrNew(err, fmt.Sprintf("gzip open file %s failure", file))
-			return cerr
-		}
-		defer gzr.Close()
-
-		tr = tar.NewReader(gzr)
-
-	} else {
-		cerr := ErrNew(ErrMismatch, fmt.Sprintf("%s file is neither tar.gz file nor tar file", file))
-		return cerr
-	}
-
-	for {
-		header, err := tr.Next()
-
-		switch {
-		case err == io.EOF:
-			return nil
-
-		case err != nil:
-			cerr := ErrNew(err, "reading tar header errors")
+		target, cerr := guard.target(header)
+		if cerr != nil {
+			cerr.AddMsg(fmt.Sprintf("untar %s stops at entry: %s", file, header.Name))
 			return cerr
-
-		case header == nil:
-			continue
 		}
-
-		if !strings.HasSuffix(folder, "/") {
-			folder = folder + "/"
+		//never write through the symlink existing at target
+		if fi, err := os.Lstat(target); err == nil && fi.Mode()&os.ModeSymlink != 0 && header.Typeflag != tar.TypeSymlink {
+			os.Remove(target)
 		}
-		target := filepath.Join(folder, header.Name)
 
 		switch header.Typeflag {
 
@@ -987,6 +845,11 @@ func Untar(file string, folder string) *Error {
 		case tar.TypeLink:
 			//fmt.Printf("-----hardlink---- %s, %s, %s\n", header.Linkname, folder, target)
 			//only works on linking to the file inside the same folder
+			source_file, cerr := guard.link(header.Linkname)
+			if cerr != nil {
+				cerr.AddMsg(fmt.Sprintf("untar %s stops at entry: %s", file, header.Name))
+				return cerr
+			}
 
 			//here we need to add a patch for specific bin/arch, for debian 10, all binaries are hardlinked to bin/arch
 			if strings.Compare(header.Linkname, "bin/arch") == 0 {
@@ -1001,6 +864,14 @@ func Untar(file string, folder string) *Error {
 					permbits.UpdateFileMode(&t_file_mode, permission)
 				}
 
+				//bin/arch could be a symlink created by the archive itself, copying it would leak the host file it points to
+				if SAFE_EXTRACT {
+					if fi, err := os.Lstat(source_file); err != nil || !fi.Mode().IsRegular() {
+						cerr := ErrNew(ErrUnsafe, fmt.Sprintf("hardlink target %s of entry %s is not a regular file", header.Linkname, header.Name))
+						return cerr
+					}
+				}
+
 				//write target
 				f, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR, t_file_mode)
 				if err != nil {
@@ -1009,7 +880,6 @@ func Untar(file string, folder string) *Error {
 				}
 
 				// copy over contents
-				source_file := fmt.Sprintf("%s%s", folder, header.Linkname)
 				sf, err := os.Open(source_file)
 				if err != nil {
 					cerr := ErrNew(err, fmt.Sprintf("untar read source file %s error", source_file))
@@ -1024,6 +894,7 @@ func Untar(file string, folder string) *Error {
 				sf.Close()
 			} else {
 				os.Symlink(header.Linkname, target)
+				guard.symlinks[target] = true
 			}
 		}
 	}
@@ -1063,6 +934,14 @@ func GetCurrDir() (string, *Error) {
 }
 
 func GetConfigDir() (string, *Error) {
+	if home := os.Getenv(ENV_LPMX_HOME); home != "" {
+		abs, err := filepath.Abs(home)
+		if err != nil {
+			cerr := ErrNew(err, fmt.Sprintf("could not resolve %s: %s", ENV_LPMX_HOME, home))
+			return "", cerr
+		}
+		return abs, nil
+	}
 	curr, cerr := GetCurrDir()
 	if cerr != nil {
 		return "", cerr
@@ -2,7 +2,12 @@ package utils
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestGdrive(t *testing.T) {
@@ -26,6 +31,40 @@ func TestTar(t *testing.T) {
 	}
 }
 
+func TestTarLayerExclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lpmx-tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "rw")
+	os.MkdirAll(filepath.Join(src, "etc"), 0755)
+	os.MkdirAll(filepath.Join(src, "tmp", "cache"), 0755)
+	ioutil.WriteFile(filepath.Join(src, "etc", "hosts"), []byte("127.0.0.1 localhost"), 0644)
+	ioutil.WriteFile(filepath.Join(src, "etc", "passwd"), []byte("root:x:0:0"), 0644)
+	ioutil.WriteFile(filepath.Join(src, "tmp", "cache", "file"), []byte("tmp"), 0644)
+	ioutil.WriteFile(filepath.Join(src, ".wh.deleted"), nil, 0644)
+	os.Symlink("/etc/hosts", filepath.Join(src, "hosts"))
+
+	target := filepath.Join(dir, "layer.tar.gz")
+	cerr := TarLayerExclude(src, target, []string{"/tmp", "/etc/passwd"})
+	assert.Nil(t, cerr)
+
+	out := filepath.Join(dir, "out")
+	os.MkdirAll(out, 0755)
+	cerr = Untar(target, out)
+	assert.Nil(t, cerr)
+
+	data, _ := ioutil.ReadFile(filepath.Join(out, "etc", "hosts"))
+	assert.Equal(t, "127.0.0.1 localhost", string(data))
+	assert.True(t, FileExist(filepath.Join(out, ".wh.deleted")), "whiteout should be kept")
+	link, _ := os.Readlink(filepath.Join(out, "hosts"))
+	assert.Equal(t, "/etc/hosts", link)
+	assert.False(t, FileExist(filepath.Join(out, "etc", "passwd")))
+	assert.False(t, FolderExist(filepath.Join(out, "tmp")))
+}
+
 func TestGetPid(t *testing.T) {
 	t.Skip("skip test")
 	b, err := CheckProcessByPid("30742")
@@ -62,3 +101,20 @@ func TestUtils2(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestGetConfigDirHome(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "lpmx-home")
+	defer os.RemoveAll(dir)
+	os.Setenv(ENV_LPMX_HOME, dir)
+	defer os.Unsetenv(ENV_LPMX_HOME)
+	home, err := GetConfigDir()
+	assert.Nil(t, err)
+	assert.Equal(t, dir, home)
+
+	//relative homes are resolved against the working directory
+	cwd, _ := os.Getwd()
+	os.Setenv(ENV_LPMX_HOME, "data")
+	home, err = GetConfigDir()
+	assert.Nil(t, err)
+	assert.Equal(t, filepath.Join(cwd, "data"), home)
+}